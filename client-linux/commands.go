@@ -0,0 +1,910 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/glassrye/soltar"
+	"github.com/glassrye/soltar/qrcode"
+)
+
+// StatusOutput is what `status` reports
+type StatusOutput struct {
+	Profile      string             `json:"profile,omitempty"`
+	Server       string             `json:"server"`
+	ClientID     string             `json:"client_id"`
+	TokenExpires *time.Time         `json:"token_expires,omitempty"`
+	Status       string             `json:"status"`
+	Environment  soltar.Environment `json:"environment"`
+}
+
+// ProfileOutput is one entry of `profiles list`
+type ProfileOutput struct {
+	Name     string     `json:"name"`
+	Server   string     `json:"server"`
+	Email    string     `json:"email,omitempty"`
+	ClientID string     `json:"client_id,omitempty"`
+	LoggedIn bool       `json:"logged_in"`
+	Current  bool       `json:"current"`
+	Expires  *time.Time `json:"token_expires,omitempty"`
+}
+
+// parseArgs parses the flags of a command wherever they appear in args and
+// returns the positional arguments
+func parseArgs(flags *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := flags.Parse(args); err != nil {
+			if err == flag.ErrHelp {
+				return nil, err
+			}
+			return nil, &cliError{exitUsage, err}
+		}
+		if err := checkOutput(); err != nil {
+			return nil, err
+		}
+		args = flags.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+// parseNoArgs parses the flags of a command that takes no positional
+// arguments
+func parseNoArgs(flags *flag.FlagSet, args []string) error {
+	positional, err := parseArgs(flags, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) > 0 {
+		return usageErrorf("unexpected argument %q", positional[0])
+	}
+	return nil
+}
+
+// runLogin sends a one-time password to the profile's email. In a terminal
+// it then asks for the code; scripts finish with `verify --otp`.
+func runLogin(args []string) error {
+	flags := newFlagSet("login")
+	email := flags.String("email", "", "email address (default: the profile's last one)")
+	otp := flags.String("otp", "", "one-time password; skips sending a new one")
+	device := flags.String("device", "", "name of this device in the session list (default: hostname)")
+	if err := parseNoArgs(flags, args); err != nil {
+		return err
+	}
+
+	if *otp != "" {
+		return verify(*email, *otp, *device)
+	}
+
+	var name string
+	err := withCredentials(func(store *CredentialStore) error {
+		name = store.profileName()
+		profile, err := store.ensureProfile(name)
+		if err != nil {
+			return err
+		}
+
+		if *email == "" {
+			*email = profile.Email
+		}
+		if *email == "" {
+			if *email, err = prompt("Enter your email: ", "email"); err != nil {
+				return err
+			}
+		}
+		if *email == "" {
+			return usageErrorf("an email address is required")
+		}
+
+		progress("📧 Sending one-time password to %s...", *email)
+		if err := apiClient(profile).Register(context.Background(), *email); err != nil {
+			return fmt.Errorf("registration failed: %w", err)
+		}
+		profile.Email = *email
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if !isTerminal(os.Stdin) || options.json() {
+		return emit(map[string]string{"profile": name, "email": *email, "status": "otp_sent"}, func() {
+			fmt.Printf("✅ One-time password sent to %s\n", *email)
+			fmt.Println("Run: soltar-client verify --otp CODE")
+		})
+	}
+
+	code, err := prompt("Enter the one-time password: ", "otp")
+	if err != nil {
+		return err
+	}
+	return verify(*email, code, *device)
+}
+
+func runVerify(args []string) error {
+	flags := newFlagSet("verify")
+	email := flags.String("email", "", "email address (default: the profile's last one)")
+	otp := flags.String("otp", "", "one-time password")
+	device := flags.String("device", "", "name of this device in the session list (default: hostname)")
+	positional, err := parseArgs(flags, args)
+	if err != nil {
+		return err
+	}
+	if *otp == "" && len(positional) == 1 {
+		*otp = positional[0]
+	} else if len(positional) > 0 {
+		return usageErrorf("unexpected argument %q", positional[0])
+	}
+	if *otp == "" {
+		return usageErrorf("--otp is required")
+	}
+	return verify(*email, *otp, *device)
+}
+
+// verify trades a one-time password for a session and stores it in the
+// active profile
+func verify(email, otp, device string) error {
+	if device == "" {
+		device, _ = os.Hostname()
+	}
+
+	var name string
+	var auth *soltar.AuthResponse
+	err := withCredentials(func(store *CredentialStore) error {
+		name = store.profileName()
+		profile, err := store.ensureProfile(name)
+		if err != nil {
+			return err
+		}
+
+		if email == "" {
+			email = profile.Email
+		}
+		if email == "" {
+			return usageErrorf("--email is required")
+		}
+
+		progress("🔐 Verifying one-time password...")
+		auth, err = apiClient(profile).Verify(context.Background(), soltar.OTPVerify{Email: email, OTP: otp, Device: device})
+		if err != nil {
+			return fmt.Errorf("verification failed: %w", err)
+		}
+		profile.Email = email
+		profile.ClientID = auth.ClientID
+		profile.RefreshToken = ""
+		profile.setTokens(auth.Token, auth.RefreshToken, auth.ExpiresIn)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return emit(map[string]interface{}{
+		"profile":     name,
+		"client_id":   auth.ClientID,
+		"environment": auth.Environment,
+	}, func() {
+		fmt.Println("✅ Logged in")
+		fmt.Printf("🆔 Client ID: %s\n", auth.ClientID)
+		fmt.Printf("🌐 VPN Server: %s\n", auth.Environment.VPNServer)
+	})
+}
+
+func runStatus(args []string) error {
+	flags := newFlagSet("status")
+	if err := parseNoArgs(flags, args); err != nil {
+		return err
+	}
+
+	profile, err := authenticate()
+	if err != nil {
+		return err
+	}
+
+	progress("🔗 Testing connection to %s...", profile.Server)
+	result, err := apiClient(profile).Connect(context.Background())
+	if err != nil {
+		return fmt.Errorf("connection failed: %w", err)
+	}
+
+	status := StatusOutput{
+		Profile:     profile.Name,
+		Server:      profile.Server,
+		ClientID:    profile.ClientID,
+		Status:      result.Status,
+		Environment: result.Environment,
+	}
+	if !profile.Expires.IsZero() {
+		status.TokenExpires = &profile.Expires
+	}
+	return emit(status, func() {
+		if status.Profile != "" {
+			fmt.Printf("👤 Profile: %s\n", status.Profile)
+		}
+		fmt.Printf("🌐 Server: %s\n", status.Server)
+		fmt.Printf("🆔 Client ID: %s\n", status.ClientID)
+		if status.TokenExpires != nil {
+			fmt.Printf("🔑 Token valid until %s\n", status.TokenExpires.Local().Format(time.Kitchen))
+		}
+		fmt.Printf("📊 Status: %s\n", status.Status)
+		fmt.Printf("🏠 Environment: %s (%s, %s)\n", status.Environment.ID, status.Environment.Region, status.Environment.Status)
+	})
+}
+
+// runConfig prints the JSON config (summarised in text mode), a config file
+// in one of the server's formats, or a QR code for the WireGuard app
+func runConfig(args []string) error {
+	flags := newFlagSet("config")
+	peer := flags.String("peer", "", "device to show the config of (default: the server's default)")
+	format := flags.String("format", "", "print a config file: wg-quick, networkmanager, networkd-netdev, networkd-network or openvpn")
+	qr := flags.Bool("qr", false, "print the wg-quick config as a QR code for the WireGuard app")
+	if err := parseNoArgs(flags, args); err != nil {
+		return err
+	}
+	if *qr && (*format != "" || options.json()) {
+		return usageErrorf("--qr cannot be combined with --format or --output json")
+	}
+
+	profile, err := authenticate()
+	if err != nil {
+		return err
+	}
+
+	if *qr {
+		*format = "wg-quick"
+	}
+	client := apiClient(profile)
+	if *format != "" {
+		body, err := client.ConfigFile(context.Background(), *peer, *format)
+		if err != nil {
+			return fmt.Errorf("config failed: %w", err)
+		}
+		if !*qr {
+			_, err = os.Stdout.Write(body)
+			return err
+		}
+		code, err := qrcode.Encode(body, qrcode.Medium)
+		if err != nil {
+			return fmt.Errorf("failed to encode QR code: %v", err)
+		}
+		progress("📱 Scan this code with the WireGuard app:")
+		fmt.Print(code.ANSI())
+		return nil
+	}
+
+	config, err := client.Config(context.Background(), *peer)
+	if err != nil {
+		return fmt.Errorf("config failed: %w", err)
+	}
+	return emit(config, func() {
+		printConfig(config)
+	})
+}
+
+func printConfig(config *soltar.VPNConfig) {
+	fmt.Printf("🌐 Server: %s\n", config.Server)
+	fmt.Printf("🔌 Port: %d\n", config.Port)
+	fmt.Printf("🆔 Environment ID: %s\n", config.EnvironmentID)
+	if config.WireGuard != nil {
+		fmt.Printf("📱 Device: %s\n", config.Peer)
+		fmt.Printf("📍 Addresses: %s\n", strings.Join(config.WireGuard.Interface.Address, ", "))
+		fmt.Printf("🧭 DNS: %s\n", strings.Join(config.WireGuard.Interface.DNS, ", "))
+		fmt.Printf("🔗 Endpoint: %s\n", config.WireGuard.Peer.Endpoint)
+		fmt.Printf("🛣️  Allowed IPs: %s\n", strings.Join(config.WireGuard.Peer.AllowedIPs, ", "))
+	}
+}
+
+// runUp handles `up [--config FILE] [--interface NAME] [--peer NAME]`. Without
+// --config the device config is fetched from the server.
+func runUp(args []string) error {
+	flags := newFlagSet("up")
+	configFile := flags.String("config", "", "wg-quick config to use instead of fetching one")
+	iface := flags.String("interface", defaultInterface, "name of the TUN interface")
+	peer := flags.String("peer", "", "device to fetch the config of (default: the server's default)")
+	if err := parseNoArgs(flags, args); err != nil {
+		return err
+	}
+
+	if *configFile == "" {
+		profile, err := authenticate()
+		if err != nil {
+			return err
+		}
+		config, err := fetchTunnelConfig(context.Background(), profile, *peer)
+		if err != nil {
+			return err
+		}
+		return runTunnel(*iface, config)
+	}
+
+	data, err := os.ReadFile(*configFile)
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+	config, err := parseWgQuickConfig(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("invalid config: %v", err)
+	}
+	return runTunnel(*iface, config)
+}
+
+// fetchTunnelConfig downloads and parses the wg-quick config of peer
+func fetchTunnelConfig(ctx context.Context, profile *Profile, peer string) (*TunnelConfig, error) {
+	progress("⚙️  Fetching tunnel config...")
+	data, err := apiClient(profile).ConfigFile(ctx, peer, "wg-quick")
+	if err != nil {
+		return nil, fmt.Errorf("failed to load config: %w", err)
+	}
+	config, err := parseWgQuickConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("invalid config: %v", err)
+	}
+	return config, nil
+}
+
+func runDown(args []string) error {
+	flags := newFlagSet("down")
+	iface := flags.String("interface", defaultInterface, "name of the TUN interface")
+	if err := parseNoArgs(flags, args); err != nil {
+		return err
+	}
+
+	if err := stopTunnel(*iface); err != nil {
+		return err
+	}
+	return emit(map[string]string{"interface": *iface, "status": "down"}, func() {
+		fmt.Printf("✅ Tunnel %s is down\n", *iface)
+	})
+}
+
+// runLogout ends the session on the server and forgets its tokens. The
+// tokens are forgotten even when the server cannot be reached.
+func runLogout(args []string) error {
+	flags := newFlagSet("logout")
+	if err := parseNoArgs(flags, args); err != nil {
+		return err
+	}
+
+	var serverErr error
+	if profile, err := authenticate(); err == nil {
+		serverErr = apiClient(profile).Logout(context.Background())
+	} else if exitCode(err) != exitAuth {
+		serverErr = err
+	}
+
+	var name string
+	err := withCredentials(func(store *CredentialStore) error {
+		name = store.profileName()
+		profile, err := store.profile(name)
+		if err != nil {
+			return err
+		}
+		if profile != nil {
+			profile.clearTokens()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if serverErr != nil {
+		progress("⚠️  The server did not end the session: %v", serverErr)
+	}
+	return emit(map[string]string{"profile": name, "status": "logged_out"}, func() {
+		fmt.Printf("✅ Logged out of profile %s\n", name)
+	})
+}
+
+func runProfiles(args []string) error {
+	flags := newFlagSet("profiles")
+	positional, err := parseArgs(flags, args)
+	if err != nil {
+		return err
+	}
+	action := "list"
+	if len(positional) > 0 {
+		action = positional[0]
+		positional = positional[1:]
+	}
+
+	if action == "list" {
+		if len(positional) > 0 {
+			return usageErrorf("unexpected argument %q", positional[0])
+		}
+		return listProfiles()
+	}
+	if action != "use" && action != "add" && action != "remove" {
+		return usageErrorf("unknown profiles command %q, use list, use, add or remove", action)
+	}
+	if len(positional) != 1 {
+		return usageErrorf("profiles %s takes one profile name", action)
+	}
+	name := positional[0]
+
+	err = withCredentials(func(store *CredentialStore) error {
+		_, exists := store.Profiles[name]
+		switch action {
+		case "use":
+			if !exists {
+				return usageErrorf("no profile named %s", name)
+			}
+			store.Current = name
+		case "add":
+			if exists {
+				return usageErrorf("profile %s already exists", name)
+			}
+			options.profile = name
+			if _, err := store.ensureProfile(name); err != nil {
+				return err
+			}
+		case "remove":
+			if !exists {
+				return usageErrorf("no profile named %s", name)
+			}
+			delete(store.Profiles, name)
+			if store.Current == name {
+				store.Current = ""
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return emit(map[string]string{"profile": name, "action": action}, func() {
+		switch action {
+		case "use":
+			fmt.Printf("✅ Now using profile %s\n", name)
+		case "add":
+			fmt.Printf("✅ Added profile %s\n", name)
+		case "remove":
+			fmt.Printf("✅ Removed profile %s\n", name)
+		}
+	})
+}
+
+func listProfiles() error {
+	var profiles []ProfileOutput
+	err := withCredentials(func(store *CredentialStore) error {
+		current := store.profileName()
+		for _, name := range store.names() {
+			profile := store.Profiles[name]
+			entry := ProfileOutput{
+				Name:     name,
+				Server:   profile.Server,
+				Email:    profile.Email,
+				ClientID: profile.ClientID,
+				LoggedIn: profile.loggedIn(),
+				Current:  name == current,
+			}
+			if !profile.Expires.IsZero() {
+				expires := profile.Expires
+				entry.Expires = &expires
+			}
+			profiles = append(profiles, entry)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if profiles == nil {
+		profiles = []ProfileOutput{}
+	}
+	return emit(profiles, func() {
+		if len(profiles) == 0 {
+			fmt.Println("No profiles yet. Run: soltar-client login")
+			return
+		}
+		for _, p := range profiles {
+			marker := " "
+			if p.Current {
+				marker = "*"
+			}
+			state := "logged out"
+			if p.LoggedIn {
+				state = "logged in as " + p.Email
+			}
+			fmt.Printf("%s %-12s %-32s %s\n", marker, p.Name, p.Server, state)
+		}
+	})
+}
+
+// listFlag is a comma-separated flag that remembers whether it was given
+type listFlag struct {
+	set    bool
+	values []string
+}
+
+func (f *listFlag) String() string { return strings.Join(f.values, ",") }
+
+func (f *listFlag) Set(value string) error {
+	f.set = true
+	f.values = []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			f.values = append(f.values, item)
+		}
+	}
+	return nil
+}
+
+func runInfra(args []string) error {
+	flags := newFlagSet("infra")
+	file := flags.String("file", "", "set: JSON file with the infrastructure; patch: JSON file with the patch; - for stdin")
+	var vpnInstances, loadBalancers, databases, storage listFlag
+	flags.Var(&vpnInstances, "vpn-instances", "set: comma-separated VPN instance IDs")
+	flags.Var(&loadBalancers, "load-balancers", "set: comma-separated load balancer IDs")
+	flags.Var(&databases, "databases", "set: comma-separated database IDs")
+	flags.Var(&storage, "storage", "set: comma-separated storage volume IDs")
+	positional, err := parseArgs(flags, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) == 0 {
+		return usageErrorf("use infra get, set, patch, history or rollback REVISION")
+	}
+	switch action := positional[0]; {
+	case action == "get" || action == "set" || action == "patch" || action == "history":
+		if len(positional) != 1 {
+			return usageErrorf("infra %s takes no arguments", action)
+		}
+	case action == "rollback":
+		if len(positional) != 2 {
+			return usageErrorf("use infra rollback REVISION")
+		}
+	default:
+		return usageErrorf("use infra get, set, patch, history or rollback REVISION")
+	}
+	if positional[0] == "patch" && (*file == "" || vpnInstances.set || loadBalancers.set || databases.set || storage.set) {
+		return usageErrorf("infra patch takes --file and no resource flags")
+	}
+	if positional[0] != "set" && positional[0] != "patch" && (*file != "" || vpnInstances.set || loadBalancers.set || databases.set || storage.set) {
+		return usageErrorf("infra %s takes no --file or resource flags", positional[0])
+	}
+
+	profile, err := authenticate()
+	if err != nil {
+		return err
+	}
+
+	client := apiClient(profile)
+	switch positional[0] {
+	case "history":
+		return runInfraHistory(client)
+	case "patch":
+		return runInfraPatch(client, *file)
+	case "rollback":
+		revision, err := strconv.ParseInt(positional[1], 10, 64)
+		if err != nil || revision < 1 {
+			return usageErrorf("invalid revision %q", positional[1])
+		}
+		result, err := client.RollbackInfrastructure(context.Background(), revision)
+		if err != nil {
+			return fmt.Errorf("failed to roll back infrastructure: %w", err)
+		}
+		return emit(result, func() {
+			fmt.Printf("✅ %s (now revision %d)\n", result.Message, result.Revision)
+		})
+	}
+
+	current, err := client.GetInfrastructure(context.Background())
+	if err != nil {
+		return fmt.Errorf("failed to get infrastructure: %w", err)
+	}
+
+	if positional[0] == "get" {
+		return emit(current, func() {
+			printResources("🛡️  VPN instances", current.Infrastructure.VPNInstances)
+			printResources("⚖️  Load balancers", current.Infrastructure.LoadBalancers)
+			printResources("🗄️  Databases", current.Infrastructure.Databases)
+			printResources("📦 Storage", current.Infrastructure.Storage)
+			if !current.Infrastructure.LastUpdated.IsZero() {
+				fmt.Printf("🕒 Last updated: %s (revision %d)\n", current.Infrastructure.LastUpdated.Local().Format(time.RFC1123), current.Infrastructure.Generation)
+			}
+			printInfrastructureStatus(current.Status)
+		})
+	}
+
+	infra := current.Infrastructure
+	if *file != "" {
+		data, err := readInput(*file)
+		if err != nil {
+			return err
+		}
+		if infra, err = decodeInfrastructure(data); err != nil {
+			return usageErrorf("invalid infrastructure in %s: %v", *file, err)
+		}
+	} else if !vpnInstances.set && !loadBalancers.set && !databases.set && !storage.set {
+		return usageErrorf("infra set needs --file or at least one resource flag")
+	}
+	if vpnInstances.set {
+		infra.VPNInstances = resourcesFromIDs(vpnInstances.values, soltar.ResourceVPNInstance, infra.VPNInstances)
+	}
+	if loadBalancers.set {
+		infra.LoadBalancers = resourcesFromIDs(loadBalancers.values, soltar.ResourceLoadBalancer, infra.LoadBalancers)
+	}
+	if databases.set {
+		infra.Databases = resourcesFromIDs(databases.values, soltar.ResourceDatabase, infra.Databases)
+	}
+	if storage.set {
+		infra.Storage = resourcesFromIDs(storage.values, soltar.ResourceStorage, infra.Storage)
+	}
+
+	// Resource flags edit what was just read, so they must not overwrite a
+	// change made in between; --file replaces the whole document anyway
+	var result *soltar.MessageResponse
+	if *file == "" {
+		result, err = client.UpdateInfrastructureAt(context.Background(), infra, current.Infrastructure.Generation)
+	} else {
+		result, err = client.UpdateInfrastructure(context.Background(), infra)
+	}
+	var apiErr *soltar.APIError
+	if errors.As(err, &apiErr) && apiErr.Code == soltar.ErrCodeRevisionMismatch {
+		return fmt.Errorf("infrastructure changed while it was being edited (%s), run infra set again", apiErr.Message)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update infrastructure: %w", err)
+	}
+	return emit(result, func() {
+		fmt.Printf("✅ Infrastructure updated (revision %d)\n", result.Revision)
+	})
+}
+
+// runInfraPatch sends a JSON Patch if the file holds an array of operations
+// and a merge patch if it holds an object
+func runInfraPatch(client *soltar.Client, file string) error {
+	data, err := readInput(file)
+	if err != nil {
+		return err
+	}
+
+	var result *soltar.MessageResponse
+	switch trimmed := bytes.TrimSpace(data); {
+	case bytes.HasPrefix(trimmed, []byte("[")):
+		var ops []soltar.PatchOperation
+		if err := json.Unmarshal(trimmed, &ops); err != nil {
+			return usageErrorf("invalid JSON Patch in %s: %v", file, err)
+		}
+		result, err = client.JSONPatchInfrastructure(context.Background(), ops)
+	case bytes.HasPrefix(trimmed, []byte("{")):
+		result, err = client.MergePatchInfrastructure(context.Background(), json.RawMessage(trimmed))
+	default:
+		return usageErrorf("%s must hold a JSON Patch array or a merge patch object", file)
+	}
+	var apiErr *soltar.APIError
+	if errors.As(err, &apiErr) && apiErr.Code == soltar.ErrCodePatchConflict {
+		return fmt.Errorf("patch does not apply to the current infrastructure: %s", apiErr.Message)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to patch infrastructure: %w", err)
+	}
+	return emit(result, func() {
+		fmt.Printf("✅ Infrastructure patched (revision %d)\n", result.Revision)
+	})
+}
+
+func runInfraHistory(client *soltar.Client) error {
+	history, err := client.InfrastructureHistory(context.Background())
+	if err != nil {
+		return fmt.Errorf("failed to get infrastructure history: %w", err)
+	}
+	return emit(history, func() {
+		if len(history.Revisions) == 0 {
+			fmt.Println("No infrastructure changes yet")
+			return
+		}
+		for _, rev := range history.Revisions {
+			line := fmt.Sprintf("#%d  %s  by %s", rev.Revision, rev.Time.Local().Format(time.RFC3339), rev.Author)
+			if rev.RollbackOf != 0 {
+				line += fmt.Sprintf("  (rollback to #%d)", rev.RollbackOf)
+			}
+			fmt.Println(line)
+			for _, c := range rev.Diff {
+				fmt.Printf("   %-7s %s %s\n", c.Op, c.Kind, c.ID)
+			}
+		}
+	})
+}
+
+// runEnvironment handles `environment [get | suspend | resume | delete]`
+func runEnvironment(args []string) error {
+	flags := newFlagSet("environment")
+	reason := flags.String("reason", "", "suspend, delete: why, recorded on the environment")
+	yes := flags.Bool("yes", false, "delete: confirm; deleting cannot be undone")
+	positional, err := parseArgs(flags, args)
+	if err != nil {
+		return err
+	}
+	action := "get"
+	if len(positional) == 1 {
+		action = positional[0]
+	}
+	if len(positional) > 1 || (action != "get" && action != "suspend" && action != "resume" && action != "delete") {
+		return usageErrorf("use environment get, suspend, resume or delete")
+	}
+	if action == "delete" && !*yes {
+		return usageErrorf("environment delete releases the environment for good; pass --yes")
+	}
+
+	profile, err := authenticate()
+	if err != nil {
+		return err
+	}
+
+	client := apiClient(profile)
+	ctx := context.Background()
+	var result *soltar.EnvironmentResponse
+	switch action {
+	case "get":
+		result, err = client.Environment(ctx)
+	case "suspend":
+		result, err = client.SuspendEnvironment(ctx, *reason)
+	case "resume":
+		result, err = client.ResumeEnvironment(ctx)
+	case "delete":
+		result, err = client.DeleteEnvironment(ctx, *reason)
+	}
+	if err != nil {
+		return fmt.Errorf("environment %s failed: %w", action, err)
+	}
+
+	env := result.Environment
+	return emit(result, func() {
+		fmt.Printf("🏠 Environment: %s (%s)\n", env.ID, env.Region)
+		state := env.Status
+		if env.StatusReason != "" {
+			state += " (" + env.StatusReason + ")"
+		}
+		if env.StatusChanged != nil {
+			state += " since " + env.StatusChanged.Local().Format(time.RFC1123)
+		}
+		fmt.Printf("📊 Status: %s\n", state)
+		for _, t := range env.Transitions {
+			fmt.Printf("   %s  %s → %s by %s", t.Time.Local().Format(time.RFC3339), t.From, t.To, t.Actor)
+			if t.Reason != "" {
+				fmt.Printf(": %s", t.Reason)
+			}
+			fmt.Println()
+		}
+	})
+}
+
+// resourcesFromIDs builds the resources of kind named by a resource flag.
+// Resources that already exist keep their spec and region; new ones get the
+// server's defaults.
+func resourcesFromIDs(ids []string, kind string, existing []soltar.Resource) []soltar.Resource {
+	byID := make(map[string]soltar.Resource, len(existing))
+	for _, r := range existing {
+		byID[r.ID] = r
+	}
+
+	resources := make([]soltar.Resource, 0, len(ids))
+	for _, id := range ids {
+		r, ok := byID[id]
+		if !ok {
+			r = soltar.Resource{ID: id, Kind: kind}
+		}
+		resources = append(resources, r)
+	}
+	return resources
+}
+
+func printResources(label string, resources []soltar.Resource) {
+	if len(resources) == 0 {
+		fmt.Printf("%s: none\n", label)
+		return
+	}
+	fmt.Printf("%s:\n", label)
+	for _, r := range resources {
+		line := "   " + r.ID
+		if len(r.Spec) > 0 {
+			line += " " + string(r.Spec)
+		}
+		if r.Region != "" {
+			line += " in " + r.Region
+		}
+		if r.Status != "" {
+			line += " (" + r.Status + ")"
+		}
+		fmt.Println(line)
+	}
+}
+
+// printInfrastructureStatus shows how far the provisioned resources have
+// caught up with the desired infrastructure
+func printInfrastructureStatus(status soltar.InfrastructureStatus) {
+	if status.Synced {
+		fmt.Println("🔄 Status: in sync")
+	} else {
+		fmt.Println("🔄 Status: reconciling")
+	}
+	for _, r := range status.Resources {
+		if r.State == soltar.ResourceReady {
+			continue
+		}
+		line := fmt.Sprintf("   %s %s: %s", r.Kind, r.ID, r.State)
+		if r.LastError != "" {
+			line += fmt.Sprintf(" (%s, attempt %d)", r.LastError, r.Attempts)
+		}
+		fmt.Println(line)
+	}
+}
+
+func readInput(path string) ([]byte, error) {
+	if path == "-" {
+		return io.ReadAll(os.Stdin)
+	}
+	return os.ReadFile(path)
+}
+
+// decodeInfrastructure accepts the body of POST /infrastructure, the output
+// of `infra get --output json`, or a bare infrastructure object
+func decodeInfrastructure(data []byte) (soltar.Infrastructure, error) {
+	var wrapped struct {
+		Infrastructure *soltar.Infrastructure `json:"infrastructure"`
+	}
+	if err := json.Unmarshal(data, &wrapped); err != nil {
+		return soltar.Infrastructure{}, err
+	}
+	if wrapped.Infrastructure != nil {
+		return *wrapped.Infrastructure, nil
+	}
+	var infra soltar.Infrastructure
+	err := json.Unmarshal(data, &infra)
+	return infra, err
+}
+
+func runGenkey(args []string) error {
+	if err := parseNoArgs(newFlagSet("genkey"), args); err != nil {
+		return err
+	}
+	return runKeyCommand("genkey")
+}
+
+func runPubkey(args []string) error {
+	if err := parseNoArgs(newFlagSet("pubkey"), args); err != nil {
+		return err
+	}
+	return runKeyCommand("pubkey")
+}
+
+// runKeyCommand implements `genkey` (private key on stdout) and `pubkey`
+// (private key on stdin, public key on stdout), like wg(8)
+func runKeyCommand(command string) error {
+	if command == "genkey" {
+		private, _, err := generateKeyPair()
+		if err != nil {
+			return err
+		}
+		fmt.Println(private)
+		return nil
+	}
+
+	input, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		return err
+	}
+	public, err := publicKeyOf(string(input))
+	if err != nil {
+		return usageErrorf("%v", err)
+	}
+	fmt.Println(public)
+	return nil
+}
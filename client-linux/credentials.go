@@ -0,0 +1,526 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/sys/unix"
+
+	"github.com/glassrye/soltar"
+)
+
+const (
+	defaultProfile  = "default"
+	credentialsFile = "credentials.json"
+	// renewBefore is how long before expiry an access token is renewed
+	renewBefore = 2 * time.Minute
+
+	encryptionNone       = "none"
+	encryptionPassphrase = "passphrase"
+	encryptionKeyring    = "keyring"
+
+	// keyringKeyDescription names the data key in the kernel keyring
+	keyringKeyDescription = "soltar:credentials"
+)
+
+// Profile is a login to one server
+type Profile struct {
+	Name         string    `json:"-"`
+	Server       string    `json:"server"`
+	Email        string    `json:"email,omitempty"`
+	ClientID     string    `json:"client_id,omitempty"`
+	Token        string    `json:"token,omitempty"`
+	RefreshToken string    `json:"refresh_token,omitempty"`
+	Expires      time.Time `json:"expires,omitempty"`
+}
+
+// loggedIn reports whether the profile holds a session
+func (p *Profile) loggedIn() bool {
+	return p.Token != "" || p.RefreshToken != ""
+}
+
+// CredentialStore is the content of $XDG_CONFIG_HOME/soltar/credentials.json
+type CredentialStore struct {
+	Current  string              `json:"current"`
+	Profiles map[string]*Profile `json:"profiles"`
+
+	// encryption is kept from the file unless SOLTAR_ENCRYPTION changes it
+	encryption string
+	passphrase []byte
+}
+
+// KDFParams are the argon2id parameters a passphrase key was derived with
+type KDFParams struct {
+	Name    string `json:"name"`
+	Time    uint32 `json:"time"`
+	Memory  uint32 `json:"memory"`
+	Threads uint8  `json:"threads"`
+}
+
+// credentialFile is the on-disk envelope. Store is set when the file is not
+// encrypted, Ciphertext (AES-256-GCM of the store) otherwise.
+type credentialFile struct {
+	Version    int              `json:"version"`
+	Encryption string           `json:"encryption"`
+	KDF        *KDFParams       `json:"kdf,omitempty"`
+	Salt       []byte           `json:"salt,omitempty"`
+	Nonce      []byte           `json:"nonce,omitempty"`
+	Ciphertext []byte           `json:"ciphertext,omitempty"`
+	Store      *CredentialStore `json:"store,omitempty"`
+}
+
+var errRefreshRejected = errors.New("refresh token was rejected")
+
+// configDir is $XDG_CONFIG_HOME/soltar, or ~/.config/soltar
+func configDir() (string, error) {
+	if dir := os.Getenv("XDG_CONFIG_HOME"); dir != "" {
+		return filepath.Join(dir, "soltar"), nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".config", "soltar"), nil
+}
+
+// withCredentials runs fn on the credential store and saves it afterwards if
+// fn changed it. The store is locked for the duration so two clients
+// renewing at once do not both spend the same refresh token.
+func withCredentials(fn func(store *CredentialStore) error) error {
+	dir, err := configDir()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	lock, err := os.OpenFile(filepath.Join(dir, credentialsFile+".lock"), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	if err := unix.Flock(int(lock.Fd()), unix.LOCK_EX); err != nil {
+		return fmt.Errorf("failed to lock credentials: %v", err)
+	}
+	defer unix.Flock(int(lock.Fd()), unix.LOCK_UN)
+
+	path := filepath.Join(dir, credentialsFile)
+	store, err := loadCredentials(path)
+	if err != nil {
+		return err
+	}
+	before, err := json.Marshal(store)
+	if err != nil {
+		return err
+	}
+	save := func() error {
+		// Rewriting an unchanged store would re-encrypt it, which costs a key
+		// derivation and possibly a passphrase prompt
+		after, err := json.Marshal(store)
+		if err == nil && bytes.Equal(before, after) && !store.reencrypt() {
+			return nil
+		}
+		return saveCredentials(path, store)
+	}
+
+	if err := fn(store); err != nil {
+		// Keep whatever fn managed to change, e.g. a rotated refresh token
+		if saveErr := save(); saveErr != nil {
+			return fmt.Errorf("%v (and failed to save credentials: %v)", err, saveErr)
+		}
+		return err
+	}
+	return save()
+}
+
+// reencrypt reports whether SOLTAR_ENCRYPTION asks for another encryption
+// than the store has
+func (s *CredentialStore) reencrypt() bool {
+	mode := os.Getenv("SOLTAR_ENCRYPTION")
+	return mode != "" && mode != s.encryption
+}
+
+func loadCredentials(path string) (*CredentialStore, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &CredentialStore{Profiles: map[string]*Profile{}, encryption: encryptionNone}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var file credentialFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", path, err)
+	}
+
+	store := file.Store
+	switch file.Encryption {
+	case "", encryptionNone:
+		if store == nil {
+			store = &CredentialStore{}
+		}
+	case encryptionPassphrase, encryptionKeyring:
+		var key, passphrase []byte
+		if file.Encryption == encryptionPassphrase {
+			if file.KDF == nil || file.KDF.Name != "argon2id" {
+				return nil, fmt.Errorf("failed to read %s: unsupported key derivation", path)
+			}
+			if passphrase, err = readPassphrase("🔒 Passphrase for stored credentials: "); err != nil {
+				return nil, err
+			}
+			key = argon2.IDKey(passphrase, file.Salt, file.KDF.Time, file.KDF.Memory, file.KDF.Threads, 32)
+		} else {
+			if key, err = keyringKey(false); err != nil {
+				return nil, fmt.Errorf("%v; remove %s and log in again", err, path)
+			}
+		}
+		plaintext, err := decrypt(key, file.Nonce, file.Ciphertext)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt %s: wrong passphrase or key", path)
+		}
+		store = &CredentialStore{}
+		if err := json.Unmarshal(plaintext, store); err != nil {
+			return nil, fmt.Errorf("failed to read %s: %v", path, err)
+		}
+		store.passphrase = passphrase
+	default:
+		return nil, fmt.Errorf("failed to read %s: unknown encryption %q", path, file.Encryption)
+	}
+
+	if store.Profiles == nil {
+		store.Profiles = map[string]*Profile{}
+	}
+	store.encryption = file.Encryption
+	if store.encryption == "" {
+		store.encryption = encryptionNone
+	}
+	return store, nil
+}
+
+// saveCredentials writes the store atomically with mode 0600, encrypted as
+// SOLTAR_ENCRYPTION asks or, when unset, as it was before
+func saveCredentials(path string, store *CredentialStore) error {
+	encryption := store.encryption
+	if mode := os.Getenv("SOLTAR_ENCRYPTION"); mode != "" {
+		encryption = mode
+	}
+
+	file := credentialFile{Version: 1, Encryption: encryption}
+	switch encryption {
+	case encryptionNone:
+		file.Store = store
+	case encryptionPassphrase, encryptionKeyring:
+		plaintext, err := json.Marshal(store)
+		if err != nil {
+			return err
+		}
+		var key []byte
+		if encryption == encryptionPassphrase {
+			if store.passphrase == nil {
+				if store.passphrase, err = newPassphrase(); err != nil {
+					return err
+				}
+			}
+			file.KDF = &KDFParams{Name: "argon2id", Time: 1, Memory: 64 * 1024, Threads: 4}
+			file.Salt = make([]byte, 16)
+			if _, err := rand.Read(file.Salt); err != nil {
+				return err
+			}
+			key = argon2.IDKey(store.passphrase, file.Salt, file.KDF.Time, file.KDF.Memory, file.KDF.Threads, 32)
+		} else {
+			if key, err = keyringKey(true); err != nil {
+				return err
+			}
+		}
+		if file.Nonce, file.Ciphertext, err = encrypt(key, plaintext); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown SOLTAR_ENCRYPTION %q, use none, passphrase or keyring", encryption)
+	}
+	store.encryption = encryption
+
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), credentialsFile+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	// CreateTemp already uses 0600; be explicit since the file holds secrets
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func encrypt(key, plaintext []byte) (nonce, ciphertext []byte, err error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, err
+	}
+	nonce = make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, nil, err
+	}
+	return nonce, gcm.Seal(nil, nonce, plaintext, nil), nil
+}
+
+func decrypt(key, nonce, ciphertext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != gcm.NonceSize() {
+		return nil, fmt.Errorf("invalid nonce")
+	}
+	return gcm.Open(nil, nonce, ciphertext, nil)
+}
+
+// keyringKey returns the data key kept in the kernel keyring, creating it if
+// create is set. The persistent keyring outlives login sessions; kernels
+// without it fall back to the user keyring, which lasts until reboot.
+func keyringKey(create bool) ([]byte, error) {
+	ring, err := unix.KeyctlInt(unix.KEYCTL_GET_PERSISTENT, -1, unix.KEY_SPEC_PROCESS_KEYRING, 0, 0)
+	if err != nil {
+		ring = unix.KEY_SPEC_USER_KEYRING
+	}
+
+	id, err := unix.KeyctlSearch(ring, "user", keyringKeyDescription, 0)
+	if err == nil {
+		key := make([]byte, 32)
+		n, err := unix.KeyctlBuffer(unix.KEYCTL_READ, id, key, 0)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the credential key from the kernel keyring: %v", err)
+		}
+		if n != len(key) {
+			return nil, fmt.Errorf("the credential key in the kernel keyring is malformed")
+		}
+		return key, nil
+	}
+	if !create {
+		return nil, fmt.Errorf("the credential key is not in the kernel keyring")
+	}
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if _, err := unix.AddKey("user", keyringKeyDescription, key, ring); err != nil {
+		return nil, fmt.Errorf("failed to add the credential key to the kernel keyring: %v", err)
+	}
+	return key, nil
+}
+
+// readPassphrase takes the passphrase from SOLTAR_PASSPHRASE or, without
+// echo, from the terminal
+func readPassphrase(prompt string) ([]byte, error) {
+	if passphrase := os.Getenv("SOLTAR_PASSPHRASE"); passphrase != "" {
+		return []byte(passphrase), nil
+	}
+
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return nil, fmt.Errorf("a passphrase is needed: set SOLTAR_PASSPHRASE or run in a terminal")
+	}
+	defer tty.Close()
+
+	fd := int(tty.Fd())
+	termios, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err != nil {
+		return nil, err
+	}
+	noEcho := *termios
+	noEcho.Lflag &^= unix.ECHO
+	noEcho.Lflag |= unix.ICANON | unix.ECHONL
+	if err := unix.IoctlSetTermios(fd, unix.TCSETS, &noEcho); err != nil {
+		return nil, err
+	}
+	defer unix.IoctlSetTermios(fd, unix.TCSETS, termios)
+
+	fmt.Fprint(tty, prompt)
+	var line []byte
+	buf := make([]byte, 1)
+	for {
+		n, err := tty.Read(buf)
+		if err != nil || n == 0 || buf[0] == '\n' {
+			break
+		}
+		line = append(line, buf[0])
+	}
+	line = bytes.TrimRight(line, "\r")
+	if len(line) == 0 {
+		return nil, fmt.Errorf("empty passphrase")
+	}
+	return line, nil
+}
+
+func newPassphrase() ([]byte, error) {
+	if passphrase := os.Getenv("SOLTAR_PASSPHRASE"); passphrase != "" {
+		return []byte(passphrase), nil
+	}
+	passphrase, err := readPassphrase("🔒 New passphrase for stored credentials: ")
+	if err != nil {
+		return nil, err
+	}
+	confirm, err := readPassphrase("🔒 Repeat passphrase: ")
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(passphrase, confirm) {
+		return nil, fmt.Errorf("passphrases do not match")
+	}
+	return passphrase, nil
+}
+
+// profileName is --profile (or SOLTAR_PROFILE), else the store's current
+// profile
+func (s *CredentialStore) profileName() string {
+	if options.profile != "" {
+		return options.profile
+	}
+	if s.Current != "" {
+		return s.Current
+	}
+	return defaultProfile
+}
+
+// profile returns the named profile, or nil if it does not exist. A --server
+// that differs from the profile's is an error; tokens of one server are no
+// use on another.
+func (s *CredentialStore) profile(name string) (*Profile, error) {
+	profile, ok := s.Profiles[name]
+	if !ok {
+		return nil, nil
+	}
+	if server := options.serverURL(); server != "" && server != profile.Server {
+		return nil, usageErrorf("profile %s is for %s; use --profile to pick another one for %s", name, profile.Server, server)
+	}
+	return profile, nil
+}
+
+// ensureProfile returns the named profile, creating it for --server (or the
+// default server) when it does not exist
+func (s *CredentialStore) ensureProfile(name string) (*Profile, error) {
+	profile, err := s.profile(name)
+	if err != nil || profile != nil {
+		return profile, err
+	}
+	server := options.serverURL()
+	if server == "" {
+		server = defaultServer
+	}
+	profile = &Profile{Server: server}
+	s.Profiles[name] = profile
+	if s.Current == "" {
+		s.Current = name
+	}
+	return profile, nil
+}
+
+// clearTokens forgets the session of a profile, keeping its server and email
+func (p *Profile) clearTokens() {
+	p.ClientID = ""
+	p.Token = ""
+	p.RefreshToken = ""
+	p.Expires = time.Time{}
+}
+
+// names returns the profile names in order
+func (s *CredentialStore) names() []string {
+	names := make([]string, 0, len(s.Profiles))
+	for name := range s.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// setTokens records a fresh access token and, when the server rotated it,
+// the new refresh token
+func (p *Profile) setTokens(token, refreshToken string, expiresIn int) {
+	p.Token = token
+	if refreshToken != "" {
+		p.RefreshToken = refreshToken
+	}
+	if expiresIn > 0 {
+		p.Expires = time.Now().Add(time.Duration(expiresIn) * time.Second)
+	} else {
+		p.Expires = tokenExpiry(token)
+	}
+}
+
+// needsRenewal reports whether the access token is missing or expires within
+// renewBefore
+func (p *Profile) needsRenewal() bool {
+	return p.Token == "" || time.Until(p.Expires) < renewBefore
+}
+
+// renew trades the refresh token for a new access token
+func (p *Profile) renew() error {
+	tokens, err := soltar.NewClient(p.Server).Refresh(context.Background(), p.RefreshToken)
+	var apiErr *soltar.APIError
+	if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusUnauthorized {
+		return errRefreshRejected
+	}
+	if err != nil {
+		return err
+	}
+	p.setTokens(tokens.Token, tokens.RefreshToken, tokens.ExpiresIn)
+	return nil
+}
+
+// tokenExpiry reads the exp claim of a JWT without verifying it, for
+// servers that do not send expires_in
+func tokenExpiry(token string) time.Time {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return time.Time{}
+	}
+	// exp may carry a fraction of a second
+	var claims struct {
+		Exp float64 `json:"exp"`
+	}
+	if json.Unmarshal(payload, &claims) != nil || claims.Exp == 0 {
+		return time.Time{}
+	}
+	return time.UnixMilli(int64(claims.Exp * 1000))
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/glassrye/soltar"
+)
+
+// useTestConfigDir points the credential store at a temporary directory and
+// restores the global options afterwards
+func useTestConfigDir(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", dir)
+	t.Setenv("SOLTAR_ENCRYPTION", "")
+	t.Setenv("SOLTAR_PASSPHRASE", "")
+	saved := options
+	options = Options{output: "json"}
+	t.Cleanup(func() { options = saved })
+	return filepath.Join(dir, "soltar", credentialsFile)
+}
+
+// storeTestProfile logs a profile in with the given tokens
+func storeTestProfile(t *testing.T, name string, profile Profile) {
+	t.Helper()
+	err := withCredentials(func(store *CredentialStore) error {
+		store.Profiles[name] = &profile
+		if store.Current == "" {
+			store.Current = name
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Expected to store profile %s, got %v", name, err)
+	}
+}
+
+// readCredentialFile returns the on-disk envelope at path
+func readCredentialFile(t *testing.T, path string) (credentialFile, string) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Expected credentials at %s, got %v", path, err)
+	}
+	var file credentialFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		t.Fatalf("Expected a JSON credential file, got %v", err)
+	}
+	return file, string(data)
+}
+
+// testJWT returns an unsigned token with the given exp claim
+func testJWT(exp time.Time) string {
+	payload, _ := json.Marshal(map[string]int64{"exp": exp.Unix()})
+	return "e30." + base64.RawURLEncoding.EncodeToString(payload) + ".sig"
+}
+
+func TestCredentialsArePrivate(t *testing.T) {
+	path := useTestConfigDir(t)
+
+	// A file left readable by others is replaced, not rewritten in place
+	os.MkdirAll(filepath.Dir(path), 0700)
+	os.WriteFile(path, []byte(`{"version":1,"encryption":"none"}`), 0644)
+
+	storeTestProfile(t, "default", Profile{Server: "https://vpn.example", RefreshToken: "refresh-1"})
+
+	for _, name := range []string{path, path + ".lock"} {
+		info, err := os.Stat(name)
+		if err != nil {
+			t.Fatalf("Expected %s to exist, got %v", name, err)
+		}
+		if mode := info.Mode().Perm(); mode != 0600 {
+			t.Errorf("Expected %s to have mode 0600, got %o", filepath.Base(name), mode)
+		}
+	}
+	if info, _ := os.Stat(filepath.Dir(path)); info.Mode().Perm() != 0700 {
+		t.Errorf("Expected the config directory to have mode 0700, got %o", info.Mode().Perm())
+	}
+
+	file, _ := readCredentialFile(t, path)
+	if file.Encryption != encryptionNone || file.Store == nil || file.Store.Profiles["default"].RefreshToken != "refresh-1" {
+		t.Errorf("Expected an unencrypted store, got %+v", file)
+	}
+}
+
+func TestCredentialsPassphrase(t *testing.T) {
+	path := useTestConfigDir(t)
+	t.Setenv("SOLTAR_ENCRYPTION", encryptionPassphrase)
+	t.Setenv("SOLTAR_PASSPHRASE", "correct horse")
+
+	storeTestProfile(t, "default", Profile{Server: "https://vpn.example", RefreshToken: "refresh-secret"})
+
+	file, raw := readCredentialFile(t, path)
+	if file.Encryption != encryptionPassphrase || file.KDF == nil || file.KDF.Name != "argon2id" || len(file.Salt) != 16 {
+		t.Fatalf("Expected an argon2id passphrase envelope, got %+v", file)
+	}
+	if file.Store != nil || strings.Contains(raw, "refresh-secret") {
+		t.Fatal("Expected the refresh token to be encrypted")
+	}
+
+	// The store stays encrypted once SOLTAR_ENCRYPTION is no longer set
+	t.Setenv("SOLTAR_ENCRYPTION", "")
+	store, err := loadCredentials(path)
+	if err != nil {
+		t.Fatalf("Expected to decrypt with the passphrase, got %v", err)
+	}
+	if store.Profiles["default"].RefreshToken != "refresh-secret" {
+		t.Errorf("Expected the stored profile back, got %+v", store.Profiles["default"])
+	}
+	if err := saveCredentials(path, store); err != nil {
+		t.Fatalf("Expected to save again, got %v", err)
+	}
+	if file, _ := readCredentialFile(t, path); file.Encryption != encryptionPassphrase {
+		t.Errorf("Expected the store to stay encrypted, got %s", file.Encryption)
+	}
+
+	t.Setenv("SOLTAR_PASSPHRASE", "wrong")
+	if _, err := loadCredentials(path); err == nil || !strings.Contains(err.Error(), "wrong passphrase") {
+		t.Errorf("Expected a wrong passphrase to be refused, got %v", err)
+	}
+}
+
+func TestCredentialsKeyring(t *testing.T) {
+	path := useTestConfigDir(t)
+	t.Setenv("SOLTAR_ENCRYPTION", encryptionKeyring)
+
+	// A key that was already there belongs to the user; only remove ours
+	_, missing := keyringKey(false)
+	if _, err := keyringKey(true); err != nil {
+		t.Skipf("kernel keyring not available: %v", err)
+	}
+	if missing != nil {
+		t.Cleanup(func() {
+			ring, err := unix.KeyctlInt(unix.KEYCTL_GET_PERSISTENT, -1, unix.KEY_SPEC_PROCESS_KEYRING, 0, 0)
+			if err != nil {
+				ring = unix.KEY_SPEC_USER_KEYRING
+			}
+			if id, err := unix.KeyctlSearch(ring, "user", keyringKeyDescription, 0); err == nil {
+				unix.KeyctlInt(unix.KEYCTL_INVALIDATE, id, 0, 0, 0)
+			}
+		})
+	}
+
+	storeTestProfile(t, "default", Profile{Server: "https://vpn.example", RefreshToken: "refresh-secret"})
+
+	file, raw := readCredentialFile(t, path)
+	if file.Encryption != encryptionKeyring || file.KDF != nil || strings.Contains(raw, "refresh-secret") {
+		t.Fatalf("Expected a keyring envelope without the token in clear, got %s", raw)
+	}
+	store, err := loadCredentials(path)
+	if err != nil || store.Profiles["default"].RefreshToken != "refresh-secret" {
+		t.Errorf("Expected to decrypt with the keyring key, got %v", err)
+	}
+}
+
+func TestCredentialsUnchangedAreNotRewritten(t *testing.T) {
+	path := useTestConfigDir(t)
+	t.Setenv("SOLTAR_ENCRYPTION", encryptionPassphrase)
+	t.Setenv("SOLTAR_PASSPHRASE", "correct horse")
+	storeTestProfile(t, "default", Profile{Server: "https://vpn.example", RefreshToken: "refresh-1"})
+	_, saved := readCredentialFile(t, path)
+
+	if err := withCredentials(func(store *CredentialStore) error { return nil }); err != nil {
+		t.Fatalf("Expected to read the store, got %v", err)
+	}
+	if _, raw := readCredentialFile(t, path); raw != saved {
+		t.Error("Expected an unchanged store to keep its file, salt and nonce")
+	}
+
+	// Asking for another encryption is a change even if the profiles are not
+	t.Setenv("SOLTAR_ENCRYPTION", encryptionNone)
+	if err := withCredentials(func(store *CredentialStore) error { return nil }); err != nil {
+		t.Fatalf("Expected to read the store, got %v", err)
+	}
+	if file, _ := readCredentialFile(t, path); file.Encryption != encryptionNone {
+		t.Errorf("Expected the store to be decrypted, got %s", file.Encryption)
+	}
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	key := make([]byte, 32)
+	nonce, ciphertext, err := encrypt(key, []byte("tokens"))
+	if err != nil {
+		t.Fatalf("Expected to encrypt, got %v", err)
+	}
+	if plaintext, err := decrypt(key, nonce, ciphertext); err != nil || string(plaintext) != "tokens" {
+		t.Errorf("Expected the plaintext back, got %q, %v", plaintext, err)
+	}
+
+	ciphertext[0] ^= 1
+	if _, err := decrypt(key, nonce, ciphertext); err == nil {
+		t.Error("Expected tampered ciphertext to be refused")
+	}
+	if _, err := decrypt(key, nonce[:4], ciphertext); err == nil {
+		t.Error("Expected a short nonce to be refused")
+	}
+}
+
+func TestProfileSwitching(t *testing.T) {
+	path := useTestConfigDir(t)
+	storeTestProfile(t, "default", Profile{Server: "https://home.example", Token: "home-token"})
+
+	options.server = "https://work.example"
+	if err := runProfiles([]string{"add", "work"}); err != nil {
+		t.Fatalf("Expected to add a profile, got %v", err)
+	}
+	if err := runProfiles([]string{"add", "work"}); exitCode(err) != exitUsage {
+		t.Errorf("Expected adding it twice to be a usage error, got %v", err)
+	}
+	options = Options{output: "json"}
+
+	store, _ := loadCredentials(path)
+	if store.Current != "default" || store.Profiles["work"] == nil || store.Profiles["work"].Server != "https://work.example" {
+		t.Fatalf("Expected work added for its server and default still current, got %+v", store)
+	}
+
+	if err := runProfiles([]string{"use", "work"}); err != nil {
+		t.Fatalf("Expected to switch profiles, got %v", err)
+	}
+	store, _ = loadCredentials(path)
+	if name := store.profileName(); name != "work" {
+		t.Errorf("Expected work to be current, got %s", name)
+	}
+
+	// --profile wins over the current profile, and --server must match it
+	options.profile = "default"
+	if name := store.profileName(); name != "default" {
+		t.Errorf("Expected --profile to pick default, got %s", name)
+	}
+	options.server = "https://work.example/"
+	if _, err := store.profile("default"); exitCode(err) != exitUsage {
+		t.Errorf("Expected another server to be refused, got %v", err)
+	}
+	if profile, err := store.profile("work"); err != nil || profile == nil {
+		t.Errorf("Expected a trailing slash to match the work server, got %v", err)
+	}
+	options = Options{output: "json"}
+
+	if err := runProfiles([]string{"remove", "work"}); err != nil {
+		t.Fatalf("Expected to remove the profile, got %v", err)
+	}
+	store, _ = loadCredentials(path)
+	if store.Profiles["work"] != nil || store.profileName() != defaultProfile {
+		t.Errorf("Expected work gone and default current again, got %+v", store)
+	}
+	if err := runProfiles([]string{"use", "work"}); exitCode(err) != exitUsage {
+		t.Errorf("Expected switching to a missing profile to be a usage error, got %v", err)
+	}
+}
+
+func TestNeedsRenewal(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name    string
+		profile Profile
+		want    bool
+	}{
+		{"no token", Profile{RefreshToken: "refresh"}, true},
+		{"expired", Profile{Token: "t", Expires: now.Add(-time.Minute)}, true},
+		{"expires soon", Profile{Token: "t", Expires: now.Add(renewBefore - time.Second)}, true},
+		{"fresh", Profile{Token: "t", Expires: now.Add(renewBefore + time.Minute)}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.profile.needsRenewal(); got != tt.want {
+			t.Errorf("%s: expected needsRenewal %v, got %v", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestSetTokens(t *testing.T) {
+	profile := Profile{RefreshToken: "refresh-1"}
+
+	profile.setTokens("token-1", "", 900)
+	if profile.RefreshToken != "refresh-1" || time.Until(profile.Expires) < 14*time.Minute {
+		t.Errorf("Expected the refresh token kept and expiry from expires_in, got %+v", profile)
+	}
+
+	// Without expires_in the exp claim of the token is used
+	exp := time.Now().Add(time.Hour).Truncate(time.Second)
+	profile.setTokens(testJWT(exp), "refresh-2", 0)
+	if profile.RefreshToken != "refresh-2" || !profile.Expires.Equal(exp) {
+		t.Errorf("Expected the rotated refresh token and the exp claim, got %+v", profile)
+	}
+
+	// The worker writes times with milliseconds
+	fractional := "e30." + base64.RawURLEncoding.EncodeToString([]byte(`{"exp":1700000000.25}`)) + ".sig"
+	if expiry := tokenExpiry(fractional); !expiry.Equal(time.UnixMilli(1700000000250)) {
+		t.Errorf("Expected a fractional exp to be read, got %v", expiry)
+	}
+
+	for _, token := range []string{"", "opaque", "a.!!!.c", "e30.e30.sig"} {
+		if expiry := tokenExpiry(token); !expiry.IsZero() {
+			t.Errorf("Expected no expiry for %q, got %v", token, expiry)
+		}
+	}
+}
+
+func TestAuthenticateRenewsToken(t *testing.T) {
+	useTestConfigDir(t)
+
+	var refreshes int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req soltar.RefreshRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		if r.URL.Path != "/token/refresh" || req.RefreshToken != "refresh-1" {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(soltar.ErrorResponse{Error: "invalid_token"})
+			return
+		}
+		refreshes++
+		json.NewEncoder(w).Encode(soltar.TokenResponse{Token: "token-2", RefreshToken: "refresh-2", ExpiresIn: 900})
+	}))
+	defer server.Close()
+
+	// A token that is still good is used as it is
+	storeTestProfile(t, "default", Profile{Server: server.URL, Token: "token-1", RefreshToken: "refresh-1", Expires: time.Now().Add(time.Hour)})
+	if profile, err := authenticate(); err != nil || profile.Token != "token-1" || refreshes != 0 {
+		t.Fatalf("Expected the stored token without a refresh, got %+v, %v", profile, err)
+	}
+
+	// One about to expire is renewed and the rotated refresh token kept
+	storeTestProfile(t, "default", Profile{Server: server.URL, Token: "token-1", RefreshToken: "refresh-1", Expires: time.Now().Add(time.Minute)})
+	profile, err := authenticate()
+	if err != nil || profile.Token != "token-2" || refreshes != 1 {
+		t.Fatalf("Expected a renewed token, got %+v, %v", profile, err)
+	}
+	profile, err = authenticate()
+	if err != nil || profile.RefreshToken != "refresh-2" || refreshes != 1 {
+		t.Errorf("Expected the renewed token to be saved, got %+v, %v", profile, err)
+	}
+
+	// A rejected refresh token ends the session
+	storeTestProfile(t, "default", Profile{Server: server.URL, RefreshToken: "revoked"})
+	if _, err := authenticate(); exitCode(err) != exitAuth {
+		t.Errorf("Expected a rejected refresh to be an auth error, got %v", err)
+	}
+	if _, err := authenticate(); exitCode(err) != exitAuth || !strings.Contains(err.Error(), "not logged in") {
+		t.Errorf("Expected the tokens to be forgotten, got %v", err)
+	}
+}
@@ -0,0 +1,653 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/glassrye/soltar"
+)
+
+// Daemon states reported on the status socket
+const (
+	daemonStarting     = "starting"
+	daemonOnline       = "online"
+	daemonReconnecting = "reconnecting"
+	daemonLoggedOut    = "logged_out"
+	daemonStopped      = "stopped"
+)
+
+const (
+	// defaultHeartbeatInterval is used until the server names its own
+	defaultHeartbeatInterval = 30 * time.Second
+	minBackoff               = time.Second
+	maxBackoff               = time.Minute
+)
+
+// networkSettle is how long the network must be quiet after a change before
+// the daemon reconnects; a variable so tests can shorten it
+var networkSettle = 2 * time.Second
+
+// DaemonStatus is served as JSON by GET /status on the daemon socket
+type DaemonStatus struct {
+	State         string        `json:"state"`
+	Profile       string        `json:"profile,omitempty"`
+	Server        string        `json:"server,omitempty"`
+	ClientID      string        `json:"client_id,omitempty"`
+	Device        string        `json:"device"`
+	PID           int           `json:"pid"`
+	Started       time.Time     `json:"started"`
+	Since         time.Time     `json:"since"`
+	LastHeartbeat *time.Time    `json:"last_heartbeat,omitempty"`
+	LastError     string        `json:"last_error,omitempty"`
+	Failures      int           `json:"failures"`
+	NextAttempt   *time.Time    `json:"next_attempt,omitempty"`
+	Interval      int           `json:"interval"`
+	Tunnel        *TunnelStatus `json:"tunnel,omitempty"`
+}
+
+// TunnelStatus is the state of the tunnel a daemon started with --tunnel
+type TunnelStatus struct {
+	Interface     string     `json:"interface"`
+	Up            bool       `json:"up"`
+	Endpoint      string     `json:"endpoint,omitempty"`
+	RxBytes       uint64     `json:"rx_bytes"`
+	TxBytes       uint64     `json:"tx_bytes"`
+	LastHandshake *time.Time `json:"last_handshake,omitempty"`
+}
+
+// Daemon keeps a device's presence alive on the server: it sends heartbeats,
+// reconnects with backoff after failures and network changes, and
+// optionally owns the tunnel
+type Daemon struct {
+	device     string
+	iface      string
+	withTunnel bool
+	changes    chan struct{}
+
+	mu       sync.Mutex
+	status   DaemonStatus
+	profile  *Profile
+	tunnel   *Tunnel
+	interval time.Duration
+}
+
+func defaultSocket() string {
+	return filepath.Join(runtimeDir(), "daemon.sock")
+}
+
+// runDaemon handles `daemon [--tunnel] [--peer NAME] [--socket PATH]` and
+// `daemon status`
+func runDaemon(args []string) error {
+	flags := newFlagSet("daemon")
+	peer := flags.String("peer", "", "device to report as and fetch the tunnel config of (default: the server's default)")
+	withTunnel := flags.Bool("tunnel", false, "also bring the WireGuard tunnel up (needs root)")
+	iface := flags.String("interface", defaultInterface, "name of the TUN interface with --tunnel")
+	socket := flags.String("socket", defaultSocket(), "path of the status socket")
+	rest, err := parseArgs(flags, args)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case len(rest) == 1 && rest[0] == "status":
+		return daemonStatus(*socket)
+	case len(rest) != 0:
+		return usageErrorf("unknown daemon command %q", strings.Join(rest, " "))
+	}
+
+	device := *peer
+	if device == "" {
+		device = "default"
+	}
+	now := time.Now()
+	d := &Daemon{
+		device:     device,
+		iface:      *iface,
+		withTunnel: *withTunnel,
+		changes:    make(chan struct{}, 1),
+		interval:   defaultHeartbeatInterval,
+		status: DaemonStatus{
+			State:    daemonStarting,
+			Device:   device,
+			PID:      os.Getpid(),
+			Started:  now,
+			Since:    now,
+			Interval: int(defaultHeartbeatInterval / time.Second),
+		},
+	}
+
+	listener, err := listenStatus(*socket)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(*socket)
+	server := &http.Server{Handler: d.statusHandler()}
+	go server.Serve(listener)
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(signals)
+	go func() {
+		select {
+		case sig := <-signals:
+			progress("🔌 Received %s, shutting down...", sig)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	go func() {
+		if err := watchNetwork(ctx, d.changes, d.tunnelIndex); err != nil {
+			progress("⚠️  Not watching for network changes: %v", err)
+		}
+	}()
+
+	progress("🛰️  Daemon started for device %s; status on %s", device, *socket)
+	d.run(ctx)
+	d.shutdown()
+	return nil
+}
+
+// run sends heartbeats until ctx is cancelled
+func (d *Daemon) run(ctx context.Context) {
+	failures := 0
+	for {
+		wait := d.currentInterval()
+		if err := d.beat(ctx); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			failures++
+			wait = backoff(failures)
+			var api *soltar.APIError
+			if errors.As(err, &api) && time.Duration(api.RetryAfter)*time.Second > wait {
+				wait = time.Duration(api.RetryAfter) * time.Second
+			}
+			d.failed(err, failures, wait)
+		} else {
+			failures = 0
+		}
+
+		next := time.Now().Add(wait)
+		d.update(func(s *DaemonStatus) { s.NextAttempt = &next })
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		case <-d.changes:
+			timer.Stop()
+			if !settle(ctx, d.changes) {
+				return
+			}
+			progress("🔄 Network changed, reconnecting...")
+			failures = 0
+			d.reresolve()
+		}
+	}
+}
+
+// beat renews the session if needed, brings the tunnel up when asked to and
+// sends one heartbeat. The profile is kept between beats; the credential
+// store, which may need a passphrase, is only read again to renew the token.
+func (d *Daemon) beat(ctx context.Context) error {
+	profile, err := d.currentProfile()
+	if err != nil {
+		return err
+	}
+
+	if d.withTunnel && d.currentTunnel() == nil {
+		if err := d.startTunnel(ctx, profile); err != nil {
+			return err
+		}
+	}
+
+	req := soltar.HeartbeatRequest{Device: d.device}
+	if t := d.currentTunnel(); t != nil {
+		stats := t.stats()
+		req.TunnelUp = true
+		req.RxBytes, req.TxBytes, req.LastHandshake = stats.RxBytes, stats.TxBytes, stats.LastHandshake
+		d.update(func(s *DaemonStatus) { s.Tunnel = stats })
+	}
+
+	resp, err := apiClient(profile).Heartbeat(ctx, req)
+	if err != nil {
+		// A rejected token may have been revoked; read the store again
+		if exitCode(err) == exitAuth {
+			d.mu.Lock()
+			d.profile = nil
+			d.mu.Unlock()
+		}
+		return err
+	}
+
+	interval := time.Duration(resp.Interval) * time.Second
+	if interval <= 0 {
+		interval = defaultHeartbeatInterval
+	}
+	now := time.Now()
+	d.mu.Lock()
+	d.interval = interval
+	d.mu.Unlock()
+	d.update(func(s *DaemonStatus) {
+		if s.State != daemonOnline {
+			progress("✅ Online as %s (heartbeat every %s)", d.device, interval)
+			s.State = daemonOnline
+			s.Since = now
+		}
+		s.LastHeartbeat = &now
+		s.LastError = ""
+		s.Failures = 0
+		s.Interval = int(interval / time.Second)
+	})
+	return nil
+}
+
+func (d *Daemon) failed(err error, failures int, wait time.Duration) {
+	state := daemonReconnecting
+	if exitCode(err) == exitAuth {
+		state = daemonLoggedOut
+	}
+	d.update(func(s *DaemonStatus) {
+		if s.State != state {
+			s.State = state
+			s.Since = time.Now()
+		}
+		s.LastError = err.Error()
+		s.Failures = failures
+	})
+	progress("⚠️  Heartbeat failed (%s, retrying in %s): %v", state, wait.Round(time.Second), err)
+}
+
+func (d *Daemon) startTunnel(ctx context.Context, profile *Profile) error {
+	config, err := fetchTunnelConfig(ctx, profile, d.device)
+	if err != nil {
+		return err
+	}
+	t, err := startTunnel(d.iface, config)
+	if err != nil {
+		return err
+	}
+
+	// `down` stops the daemon like it stops `up`
+	pid := pidFile(t.Name)
+	if err := os.MkdirAll(filepath.Dir(pid), 0700); err == nil {
+		os.WriteFile(pid, []byte(strconv.Itoa(os.Getpid())), 0600)
+	}
+	progress("✅ Tunnel %s is up (%s)", t.Name, joinPrefixes(config.Addresses))
+
+	d.mu.Lock()
+	d.tunnel = t
+	d.mu.Unlock()
+	return nil
+}
+
+// reresolve points the tunnel's peers at the current addresses of their
+// endpoints, which may have changed with the network
+func (d *Daemon) reresolve() {
+	t := d.currentTunnel()
+	if t == nil {
+		return
+	}
+	if err := t.reresolveEndpoints(); err != nil {
+		progress("⚠️  %v", err)
+	}
+}
+
+// shutdown tells the server the device is going away and tears the tunnel down
+func (d *Daemon) shutdown() {
+	d.mu.Lock()
+	profile, t := d.profile, d.tunnel
+	d.tunnel = nil
+	d.mu.Unlock()
+
+	if profile != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		_, err := apiClient(profile).Heartbeat(ctx, soltar.HeartbeatRequest{Device: d.device, Disconnect: true})
+		cancel()
+		if err != nil {
+			progress("⚠️  Failed to report the disconnect: %v", err)
+		}
+	}
+	if t != nil {
+		t.Close()
+		os.Remove(pidFile(t.Name))
+	}
+	d.update(func(s *DaemonStatus) {
+		s.State = daemonStopped
+		s.Since = time.Now()
+		s.NextAttempt = nil
+	})
+}
+
+func (d *Daemon) update(fn func(s *DaemonStatus)) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	fn(&d.status)
+}
+
+// currentProfile returns the profile of the last beat, authenticating again
+// when there is none yet or its token is due for renewal
+func (d *Daemon) currentProfile() (*Profile, error) {
+	d.mu.Lock()
+	profile := d.profile
+	d.mu.Unlock()
+	if profile != nil && !profile.needsRenewal() {
+		return profile, nil
+	}
+
+	profile, err := authenticate()
+	if err != nil {
+		return nil, err
+	}
+	d.mu.Lock()
+	d.profile = profile
+	d.status.Profile = profile.Name
+	d.status.Server = profile.Server
+	d.status.ClientID = profile.ClientID
+	d.mu.Unlock()
+	return profile, nil
+}
+
+func (d *Daemon) currentTunnel() *Tunnel {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.tunnel
+}
+
+func (d *Daemon) currentInterval() time.Duration {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.interval
+}
+
+// tunnelIndex is the interface index of the tunnel, whose own link events
+// are not network changes
+func (d *Daemon) tunnelIndex() int {
+	t := d.currentTunnel()
+	if t == nil {
+		return 0
+	}
+	iface, err := net.InterfaceByName(t.Name)
+	if err != nil {
+		return 0
+	}
+	return iface.Index
+}
+
+func (d *Daemon) statusHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		d.mu.Lock()
+		status := d.status
+		d.mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status)
+	})
+	return mux
+}
+
+// backoff is the wait after the given number of consecutive failures:
+// exponential from minBackoff up to maxBackoff, with up to 20% jitter so
+// clients that lost the same network do not return in lockstep
+func backoff(failures int) time.Duration {
+	wait := maxBackoff
+	if failures < 8 {
+		wait = minBackoff << (failures - 1)
+		if wait > maxBackoff {
+			wait = maxBackoff
+		}
+	}
+	return wait + time.Duration(rand.Int63n(int64(wait)/5+1))
+}
+
+// settle waits until no change arrived for networkSettle. It returns false
+// if ctx was cancelled meanwhile.
+func settle(ctx context.Context, changes <-chan struct{}) bool {
+	timer := time.NewTimer(networkSettle)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-changes:
+			if !timer.Stop() {
+				<-timer.C
+			}
+			timer.Reset(networkSettle)
+		case <-timer.C:
+			return true
+		}
+	}
+}
+
+// listenStatus opens the status socket, replacing a stale one. Only the
+// daemon's user may connect.
+func listenStatus(path string) (net.Listener, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return nil, fmt.Errorf("a daemon is already running on %s", path)
+	}
+	os.Remove(path)
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %v", path, err)
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// daemonStatus handles `daemon status` by querying the socket
+func daemonStatus(socket string) error {
+	client := &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", socket)
+			},
+		},
+	}
+	resp, err := client.Get("http://daemon/status")
+	if err != nil {
+		return fmt.Errorf("daemon is not running (no answer on %s)", socket)
+	}
+	defer resp.Body.Close()
+
+	var status DaemonStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return fmt.Errorf("invalid status from daemon: %v", err)
+	}
+	return emit(status, func() {
+		fmt.Printf("🛰️  State: %s since %s\n", status.State, status.Since.Format(time.RFC3339))
+		fmt.Printf("👤 Profile: %s (%s)\n", status.Profile, status.Server)
+		fmt.Printf("📱 Device: %s (pid %d)\n", status.Device, status.PID)
+		if status.LastHeartbeat != nil {
+			fmt.Printf("💓 Last heartbeat: %s (every %ds)\n", status.LastHeartbeat.Format(time.RFC3339), status.Interval)
+		}
+		if status.LastError != "" {
+			fmt.Printf("⚠️  Last error: %s (%d failures)\n", status.LastError, status.Failures)
+		}
+		if status.NextAttempt != nil && status.State != daemonOnline {
+			fmt.Printf("⏳ Next attempt: %s\n", status.NextAttempt.Format(time.RFC3339))
+		}
+		if t := status.Tunnel; t != nil {
+			fmt.Printf("🔗 Tunnel %s: endpoint %s, rx %d B, tx %d B\n", t.Interface, t.Endpoint, t.RxBytes, t.TxBytes)
+			if t.LastHandshake != nil {
+				fmt.Printf("🤝 Last handshake: %s\n", t.LastHandshake.Format(time.RFC3339))
+			}
+		}
+	})
+}
+
+// stats reads the transfer counters and latest handshake of the tunnel's
+// peers from the UAPI
+func (t *Tunnel) stats() *TunnelStatus {
+	status := &TunnelStatus{Interface: t.Name, Up: true}
+	uapi, err := t.device.IpcGet()
+	if err != nil {
+		return status
+	}
+
+	var handshake int64
+	scanner := bufio.NewScanner(strings.NewReader(uapi))
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), "=")
+		if !ok {
+			continue
+		}
+		n, _ := strconv.ParseUint(value, 10, 64)
+		switch key {
+		case "endpoint":
+			status.Endpoint = value
+		case "rx_bytes":
+			status.RxBytes += n
+		case "tx_bytes":
+			status.TxBytes += n
+		case "last_handshake_time_sec":
+			if int64(n) > handshake {
+				handshake = int64(n)
+			}
+		}
+	}
+	if handshake > 0 {
+		last := time.Unix(handshake, 0)
+		status.LastHandshake = &last
+	}
+	return status
+}
+
+// reresolveEndpoints looks the peers' endpoints up again and updates the
+// ones that moved
+func (t *Tunnel) reresolveEndpoints() error {
+	var b strings.Builder
+	for _, p := range t.config.Peers {
+		if p.Endpoint == "" {
+			continue
+		}
+		publicKey, err := keyToHex(p.PublicKey)
+		if err != nil {
+			return err
+		}
+		endpoint, err := resolveEndpoint(p.Endpoint)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&b, "public_key=%s\nupdate_only=true\nendpoint=%s\n", publicKey, endpoint)
+	}
+	if b.Len() == 0 {
+		return nil
+	}
+	if err := t.device.IpcSet(b.String()); err != nil {
+		return fmt.Errorf("failed to update endpoints: %v", err)
+	}
+	return nil
+}
+
+// watchNetwork sends on changes whenever a link or address of an
+// interface other than the tunnel changes. It returns when ctx is cancelled.
+func watchNetwork(ctx context.Context, changes chan<- struct{}, tunnelIndex func() int) error {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_ROUTE)
+	if err != nil {
+		return fmt.Errorf("netlink socket: %v", err)
+	}
+	defer unix.Close(fd)
+
+	// Routes are left out: the tunnel installs its own
+	groups := uint32(unix.RTMGRP_LINK | unix.RTMGRP_IPV4_IFADDR | unix.RTMGRP_IPV6_IFADDR)
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK, Groups: groups}); err != nil {
+		return fmt.Errorf("netlink bind: %v", err)
+	}
+	// Wake up every second to notice cancellation
+	timeout := unix.Timeval{Sec: 1}
+	if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &timeout); err != nil {
+		return fmt.Errorf("netlink timeout: %v", err)
+	}
+
+	buf := make([]byte, 1<<16)
+	for ctx.Err() == nil {
+		n, _, err := unix.Recvfrom(fd, buf, 0)
+		if err == unix.EAGAIN || err == unix.EINTR {
+			continue
+		}
+		if err == unix.ENOBUFS {
+			// Events were dropped; something changed
+			notify(changes)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("netlink receive: %v", err)
+		}
+
+		messages, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			continue
+		}
+		ignore := tunnelIndex()
+		for _, m := range messages {
+			if index, ok := netlinkIndex(m); ok && (ignore == 0 || index != ignore) {
+				notify(changes)
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// netlinkIndex returns the interface a link or address message is about
+func netlinkIndex(m syscall.NetlinkMessage) (int, bool) {
+	switch m.Header.Type {
+	case unix.RTM_NEWLINK, unix.RTM_DELLINK:
+		// struct ifinfomsg: family, pad, type, index
+		if len(m.Data) >= unix.SizeofIfInfomsg {
+			return int(int32(binary.NativeEndian.Uint32(m.Data[4:8]))), true
+		}
+	case unix.RTM_NEWADDR, unix.RTM_DELADDR:
+		// struct ifaddrmsg: family, prefixlen, flags, scope, index
+		if len(m.Data) >= unix.SizeofIfAddrmsg {
+			return int(binary.NativeEndian.Uint32(m.Data[4:8])), true
+		}
+	}
+	return 0, false
+}
+
+func notify(changes chan<- struct{}) {
+	select {
+	case changes <- struct{}{}:
+	default:
+	}
+}
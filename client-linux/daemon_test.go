@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/glassrye/soltar"
+)
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		failures int
+		base     time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{4, 8 * time.Second},
+		{6, 32 * time.Second},
+		{7, time.Minute},
+		{8, time.Minute},
+		{1000, time.Minute},
+	}
+	for _, tt := range tests {
+		for i := 0; i < 20; i++ {
+			if wait := backoff(tt.failures); wait < tt.base || wait > tt.base+tt.base/5 {
+				t.Errorf("Expected backoff(%d) within 20%% above %v, got %v", tt.failures, tt.base, wait)
+				break
+			}
+		}
+	}
+}
+
+func TestSettle(t *testing.T) {
+	defer func(d time.Duration) { networkSettle = d }(networkSettle)
+	networkSettle = 50 * time.Millisecond
+
+	// Every change restarts the wait
+	changes := make(chan struct{}, 1)
+	go func() {
+		for i := 0; i < 4; i++ {
+			time.Sleep(networkSettle / 2)
+			notify(changes)
+		}
+	}()
+	start := time.Now()
+	if !settle(context.Background(), changes) {
+		t.Fatal("Expected the network to settle")
+	}
+	if elapsed := time.Since(start); elapsed < 2*networkSettle+networkSettle/2 {
+		t.Errorf("Expected changes to extend the wait, settled after %v", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if settle(ctx, changes) {
+		t.Error("Expected a cancelled context to stop the wait")
+	}
+}
+
+func TestNotifyDoesNotBlock(t *testing.T) {
+	changes := make(chan struct{}, 1)
+	notify(changes)
+	notify(changes)
+	if len(changes) != 1 {
+		t.Errorf("Expected one pending change, got %d", len(changes))
+	}
+}
+
+func TestNetlinkIndex(t *testing.T) {
+	message := func(typ uint16, size int, index uint32) syscall.NetlinkMessage {
+		data := make([]byte, size)
+		if size >= 8 {
+			binary.NativeEndian.PutUint32(data[4:8], index)
+		}
+		return syscall.NetlinkMessage{Header: syscall.NlMsghdr{Type: typ}, Data: data}
+	}
+
+	tests := []struct {
+		name    string
+		message syscall.NetlinkMessage
+		index   int
+		ok      bool
+	}{
+		{"new link", message(unix.RTM_NEWLINK, unix.SizeofIfInfomsg, 7), 7, true},
+		{"deleted link", message(unix.RTM_DELLINK, unix.SizeofIfInfomsg, 3), 3, true},
+		{"new address", message(unix.RTM_NEWADDR, unix.SizeofIfAddrmsg, 12), 12, true},
+		{"deleted address", message(unix.RTM_DELADDR, unix.SizeofIfAddrmsg, 2), 2, true},
+		{"short link", message(unix.RTM_NEWLINK, unix.SizeofIfInfomsg-1, 7), 0, false},
+		{"short address", message(unix.RTM_NEWADDR, 4, 0), 0, false},
+		{"route", message(unix.RTM_NEWROUTE, 64, 7), 0, false},
+	}
+	for _, tt := range tests {
+		if index, ok := netlinkIndex(tt.message); index != tt.index || ok != tt.ok {
+			t.Errorf("%s: expected %d, %v, got %d, %v", tt.name, tt.index, tt.ok, index, ok)
+		}
+	}
+}
+
+func TestBeatKeepsProfile(t *testing.T) {
+	useTestConfigDir(t)
+	t.Setenv("SOLTAR_ENCRYPTION", encryptionPassphrase)
+	t.Setenv("SOLTAR_PASSPHRASE", "correct horse")
+
+	var heartbeats, refreshes int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/heartbeat":
+			if r.Header.Get("Authorization") == "Bearer revoked" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			heartbeats++
+			json.NewEncoder(w).Encode(soltar.HeartbeatResponse{Interval: 30})
+		case "/token/refresh":
+			refreshes++
+			json.NewEncoder(w).Encode(soltar.TokenResponse{Token: "token-2", ExpiresIn: 900})
+		}
+	}))
+	defer server.Close()
+	storeTestProfile(t, "default", Profile{Server: server.URL, Token: "token-1", RefreshToken: "refresh-1", Expires: time.Now().Add(time.Hour)})
+
+	d := &Daemon{device: "laptop", changes: make(chan struct{}, 1)}
+	if err := d.beat(context.Background()); err != nil {
+		t.Fatalf("Expected the first beat to succeed, got %v", err)
+	}
+
+	// Later beats do not need the passphrase again
+	t.Setenv("SOLTAR_PASSPHRASE", "wrong")
+	for i := 0; i < 3; i++ {
+		if err := d.beat(context.Background()); err != nil {
+			t.Fatalf("Expected beat %d to use the kept profile, got %v", i+2, err)
+		}
+	}
+	if heartbeats != 4 || refreshes != 0 || d.status.Profile != "default" {
+		t.Errorf("Expected 4 heartbeats without a refresh, got %d and %d", heartbeats, refreshes)
+	}
+
+	// A token due for renewal goes back through the store
+	t.Setenv("SOLTAR_PASSPHRASE", "correct horse")
+	storeTestProfile(t, "default", Profile{Server: server.URL, Token: "token-1", RefreshToken: "refresh-1", Expires: time.Now().Add(time.Minute)})
+	d.profile.Expires = time.Now().Add(time.Minute)
+	if err := d.beat(context.Background()); err != nil || refreshes != 1 || d.profile.Token != "token-2" {
+		t.Errorf("Expected the token to be renewed, got %v after %d refreshes", err, refreshes)
+	}
+
+	// So does one the server rejects
+	d.profile.Token = "revoked"
+	if err := d.beat(context.Background()); exitCode(err) != exitAuth || d.profile != nil {
+		t.Errorf("Expected a rejected token to drop the kept profile, got %v", err)
+	}
+}
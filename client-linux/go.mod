@@ -1,3 +1,17 @@
 module soltar-client-linux
 
-go 1.21 
\ No newline at end of file
+go 1.21
+
+require (
+	golang.org/x/crypto v0.13.0
+	golang.org/x/sys v0.12.0
+	golang.zx2c4.com/wireguard v0.0.0-20231211153847-12269c276173
+	github.com/glassrye/soltar v0.0.0
+)
+
+require (
+	golang.org/x/net v0.15.0 // indirect
+	golang.zx2c4.com/wintun v0.0.0-20230126152724-0fa3db229ce2 // indirect
+)
+
+replace github.com/glassrye/soltar => ../
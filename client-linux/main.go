@@ -1,183 +1,303 @@
 package main
 
 import (
-	"bytes"
+	"bufio"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
-	"io"
 	"net/http"
 	"os"
+	"strings"
 	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/glassrye/soltar"
 )
 
+// defaultServer is used by new profiles when neither --server nor
+// SOLTAR_SERVER is given
+const defaultServer = "http://localhost:8080"
+
+// Exit codes
 const (
-	API_BASE = "http://localhost:8080"
+	exitOK    = 0
+	exitError = 1 // network, local or unexpected errors
+	exitUsage = 2 // bad flags or arguments, or input needed but not interactive
+	exitAuth  = 3 // not logged in, or the server rejected the credentials
+	exitAPI   = 4 // the server refused the request
 )
 
-type OTPRequest struct {
-	Email string `json:"email"`
+// Options are the flags every command accepts
+type Options struct {
+	server  string
+	profile string
+	output  string
 }
 
-type OTPVerify struct {
-	Email string `json:"email"`
-	OTP   string `json:"otp"`
-}
+var (
+	options = Options{
+		server:  os.Getenv("SOLTAR_SERVER"),
+		profile: os.Getenv("SOLTAR_PROFILE"),
+		output:  os.Getenv("SOLTAR_OUTPUT"),
+	}
+)
 
-type AuthResponse struct {
-	ClientID    string      `json:"client_id"`
-	Token       string      `json:"token"`
-	Environment Environment `json:"environment"`
+func (o *Options) serverURL() string {
+	return strings.TrimRight(o.server, "/")
 }
 
-type Environment struct {
-	ID        string `json:"id"`
-	ClientID  string `json:"client_id"`
-	VPNServer string `json:"vpn_server"`
-	VPNPort   int    `json:"vpn_port"`
-	Status    string `json:"status"`
-	Region    string `json:"region"`
+func (o *Options) json() bool {
+	return o.output == "json"
 }
 
-func main() {
-	fmt.Println("🔒 Soltar VPN Client (Linux)")
-	fmt.Println("=============================")
-
-	// Check if we have stored credentials
-	clientID := os.Getenv("SOLTAR_CLIENT_ID")
-	token := os.Getenv("SOLTAR_TOKEN")
+// Command is one subcommand of soltar-client
+type Command struct {
+	Name    string
+	Usage   string
+	Summary string
+	Run     func(args []string) error
+}
 
-	if clientID == "" || token == "" {
-		fmt.Println("No stored credentials found. Starting registration process...")
-		clientID, token = registerAndVerify()
+var commands []Command
+
+func init() {
+	commands = []Command{
+		{"login", "login [--email EMAIL] [--otp CODE]", "Request a one-time password and log in", runLogin},
+		{"verify", "verify [--email EMAIL] --otp CODE", "Finish a login with the one-time password", runVerify},
+		{"status", "status", "Show the profile and test the connection to the server", runStatus},
+		{"config", "config [--peer NAME] [--format FORMAT] [--qr]", "Show or download a device config", runConfig},
+		{"up", "up [--config FILE] [--interface NAME] [--peer NAME]", "Bring the WireGuard tunnel up (needs root)", runUp},
+		{"down", "down [--interface NAME]", "Bring the WireGuard tunnel down", runDown},
+		{"daemon", "daemon [--tunnel] [--peer NAME] [--socket PATH] | daemon status", "Keep the device online with heartbeats; status queries a running daemon", runDaemon},
+		{"logout", "logout", "End the session and forget its tokens", runLogout},
+		{"profiles", "profiles [list | use NAME | add NAME | remove NAME]", "Manage credential profiles", runProfiles},
+		{"infra", "infra get | set [--file FILE] [--vpn-instances LIST] ... | patch --file FILE | history | rollback REVISION", "Show, change, patch or roll back the infrastructure", runInfra},
+		{"environment", "environment [get | suspend | resume | delete --yes] [--reason TEXT]", "Show, suspend, resume or delete the environment", runEnvironment},
+		{"genkey", "genkey", "Print a new WireGuard private key", runGenkey},
+		{"pubkey", "pubkey", "Print the public key of the private key on stdin", runPubkey},
+		{"help", "help", "Show this help", runHelp},
 	}
+}
 
-	if clientID == "" || token == "" {
-		fmt.Println("❌ Failed to get credentials")
-		return
-	}
+// cliError carries the exit code of an error
+type cliError struct {
+	code int
+	err  error
+}
 
-	fmt.Printf("✅ Authenticated as client: %s\n", clientID)
-	fmt.Printf("🔑 Token: %s...\n", token[:20])
+func (e *cliError) Error() string { return e.err.Error() }
+func (e *cliError) Unwrap() error { return e.err }
 
-	// Test connection
-	testConnection(clientID, token)
+func usageErrorf(format string, args ...interface{}) error {
+	return &cliError{exitUsage, fmt.Errorf(format, args...)}
 }
 
-func registerAndVerify() (string, string) {
-	var email string
-	fmt.Print("Enter your email: ")
-	fmt.Scanln(&email)
+func authErrorf(format string, args ...interface{}) error {
+	return &cliError{exitAuth, fmt.Errorf(format, args...)}
+}
 
-	// Step 1: Register
-	fmt.Println("\n📧 Sending registration request...")
-	resp, err := http.Post(API_BASE+"/register", "application/json",
-		bytes.NewBufferString(fmt.Sprintf(`{"email":"%s"}`, email)))
-	if err != nil {
-		fmt.Printf("❌ Registration failed: %v\n", err)
-		return "", ""
+func exitCode(err error) int {
+	var cli *cliError
+	if errors.As(err, &cli) {
+		return cli.code
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		fmt.Printf("❌ Registration failed: %s\n", string(body))
-		return "", ""
+	var api *soltar.APIError
+	if errors.As(err, &api) {
+		if api.StatusCode == http.StatusUnauthorized {
+			return exitAuth
+		}
+		return exitAPI
 	}
+	return exitError
+}
 
-	fmt.Println("✅ Registration successful! Check server logs for OTP.")
+func main() {
+	global := flag.NewFlagSet("soltar-client", flag.ContinueOnError)
+	global.Usage = printUsage
+	addGlobalFlags(global)
+	if err := global.Parse(os.Args[1:]); err != nil {
+		if err == flag.ErrHelp {
+			os.Exit(exitOK)
+		}
+		os.Exit(exitUsage)
+	}
 
-	// Step 2: Get OTP from user
-	var otp string
-	fmt.Print("Enter the OTP from server logs: ")
-	fmt.Scanln(&otp)
+	args := global.Args()
+	if len(args) == 0 {
+		printUsage()
+		os.Exit(exitUsage)
+	}
 
-	// Step 3: Verify OTP
-	fmt.Println("\n🔐 Verifying OTP...")
-	verifyData := OTPVerify{
-		Email: email,
-		OTP:   otp,
+	var command *Command
+	for i := range commands {
+		if commands[i].Name == args[0] {
+			command = &commands[i]
+		}
+	}
+	if command == nil {
+		fmt.Fprintf(os.Stderr, "❌ unknown command %q\n\n", args[0])
+		printUsage()
+		os.Exit(exitUsage)
 	}
-	verifyJSON, _ := json.Marshal(verifyData)
 
-	resp, err = http.Post(API_BASE+"/verify", "application/json", bytes.NewBuffer(verifyJSON))
+	err := checkOutput()
+	if err == nil {
+		err = command.Run(args[1:])
+	}
+	if err == flag.ErrHelp {
+		os.Exit(exitOK)
+	}
 	if err != nil {
-		fmt.Printf("❌ Verification failed: %v\n", err)
-		return "", ""
+		fmt.Fprintf(os.Stderr, "❌ %v\n", err)
+		os.Exit(exitCode(err))
 	}
-	defer resp.Body.Close()
+}
 
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		fmt.Printf("❌ Verification failed: %s\n", string(body))
-		return "", ""
+func checkOutput() error {
+	if options.output != "" && options.output != "text" && options.output != "json" {
+		return usageErrorf("unknown --output %q, use json or text", options.output)
 	}
+	return nil
+}
 
-	var authResp AuthResponse
-	json.NewDecoder(resp.Body).Decode(&authResp)
-
-	fmt.Printf("✅ Verification successful!\n")
-	fmt.Printf("🆔 Client ID: %s\n", authResp.ClientID)
-	fmt.Printf("🌐 VPN Server: %s\n", authResp.Environment.VPNServer)
+func printUsage() {
+	w := os.Stderr
+	fmt.Fprintln(w, "🔒 Soltar VPN Client (Linux)")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Usage: soltar-client [--server URL] [--profile NAME] [--output json|text] COMMAND [ARGS]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Commands:")
+	for _, command := range commands {
+		fmt.Fprintf(w, "  %-10s %s\n", command.Name, command.Summary)
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Run soltar-client COMMAND --help for the flags of a command.")
+}
 
-	return authResp.ClientID, authResp.Token
+func runHelp(args []string) error {
+	printUsage()
+	return nil
 }
 
-func testConnection(clientID, token string) {
-	fmt.Println("\n🔗 Testing connection...")
+func addGlobalFlags(flags *flag.FlagSet) {
+	flags.StringVar(&options.server, "server", options.server, "server URL (default: the profile's, or SOLTAR_SERVER)")
+	flags.StringVar(&options.profile, "profile", options.profile, "credential profile (default: the current one, or SOLTAR_PROFILE)")
+	flags.StringVar(&options.output, "output", options.output, "output format: text or json (or SOLTAR_OUTPUT)")
+}
 
-	req, _ := http.NewRequest("POST", API_BASE+"/connect", nil)
-	req.Header.Set("Authorization", "Bearer "+token)
+// newFlagSet returns the flags of a command, including the global ones so
+// they may also follow the command name
+func newFlagSet(command string) *flag.FlagSet {
+	flags := flag.NewFlagSet(command, flag.ContinueOnError)
+	flags.Usage = func() {
+		for _, c := range commands {
+			if c.Name == command {
+				fmt.Fprintf(os.Stderr, "Usage: soltar-client %s\n\n%s\n\n", c.Usage, c.Summary)
+			}
+		}
+		flags.PrintDefaults()
+	}
+	addGlobalFlags(flags)
+	return flags
+}
 
-	client := &http.Client{Timeout: 10 * time.Second}
-	resp, err := client.Do(req)
-	if err != nil {
-		fmt.Printf("❌ Connection failed: %v\n", err)
-		return
+// progress prints a status line to stderr in text mode; stdout is reserved
+// for results so they can be piped
+func progress(format string, args ...interface{}) {
+	if !options.json() {
+		fmt.Fprintf(os.Stderr, format+"\n", args...)
 	}
-	defer resp.Body.Close()
+}
 
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		fmt.Printf("❌ Connection failed: %s\n", string(body))
-		return
+// emit prints v as JSON with --output json, or runs text otherwise
+func emit(v interface{}, text func()) error {
+	if options.json() {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
 	}
+	text()
+	return nil
+}
 
-	var result map[string]interface{}
-	json.NewDecoder(resp.Body).Decode(&result)
+func isTerminal(f *os.File) bool {
+	_, err := unix.IoctlGetTermios(int(f.Fd()), unix.TCGETS)
+	return err == nil
+}
 
-	fmt.Println("✅ Connection successful!")
-	fmt.Printf("📊 Status: %v\n", result["status"])
-	fmt.Printf("🆔 Client ID: %v\n", result["client_id"])
+var stdin = bufio.NewReader(os.Stdin)
 
-	// Test config endpoint
-	testConfig(token)
+// prompt asks for a value on the terminal. Without one it fails with a usage
+// error naming the flag to pass instead, so scripts never hang.
+func prompt(label, flagName string) (string, error) {
+	if !isTerminal(os.Stdin) {
+		return "", usageErrorf("--%s is required when not running in a terminal", flagName)
+	}
+	fmt.Fprint(os.Stderr, label)
+	line, err := stdin.ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+	return strings.TrimSpace(line), nil
 }
 
-func testConfig(token string) {
-	fmt.Println("\n⚙️  Testing config endpoint...")
-
-	req, _ := http.NewRequest("GET", API_BASE+"/config", nil)
-	req.Header.Set("Authorization", "Bearer "+token)
+// apiClient returns an SDK client for the server and token of profile
+func apiClient(profile *Profile) *soltar.Client {
+	client := soltar.NewClient(profile.Server)
+	client.Token = profile.Token
+	return client
+}
 
-	client := &http.Client{Timeout: 10 * time.Second}
-	resp, err := client.Do(req)
-	if err != nil {
-		fmt.Printf("❌ Config failed: %v\n", err)
-		return
+// authenticate returns the active profile with a usable access token,
+// renewing it if needed. It never prompts; without a session it fails with
+// exitAuth. SOLTAR_CLIENT_ID and SOLTAR_TOKEN bypass the credential store;
+// such tokens are never renewed.
+func authenticate() (*Profile, error) {
+	if clientID, token := os.Getenv("SOLTAR_CLIENT_ID"), os.Getenv("SOLTAR_TOKEN"); clientID != "" && token != "" {
+		server := options.serverURL()
+		if server == "" {
+			server = defaultServer
+		}
+		return &Profile{Server: server, ClientID: clientID, Token: token, Expires: tokenExpiry(token)}, nil
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		fmt.Printf("❌ Config failed: %s\n", string(body))
-		return
+	var profile *Profile
+	err := withCredentials(func(store *CredentialStore) error {
+		name := store.profileName()
+		var err error
+		if profile, err = store.profile(name); err != nil {
+			return err
+		}
+		if profile == nil || !profile.loggedIn() {
+			return authErrorf("not logged in to profile %s; run soltar-client login", name)
+		}
+		profile.Name = name
+
+		if !profile.needsRenewal() {
+			return nil
+		}
+		if profile.RefreshToken == "" {
+			return authErrorf("the session of profile %s has expired; run soltar-client login", name)
+		}
+		err = profile.renew()
+		if err == errRefreshRejected {
+			profile.clearTokens()
+			return authErrorf("the session of profile %s has ended; run soltar-client login", name)
+		}
+		if err != nil {
+			// A token that has not expired yet is still worth trying
+			if profile.Token != "" && time.Now().Before(profile.Expires) {
+				progress("⚠️  Token renewal failed: %v", err)
+				return nil
+			}
+			return fmt.Errorf("token renewal failed: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
-
-	var config map[string]interface{}
-	json.NewDecoder(resp.Body).Decode(&config)
-
-	fmt.Println("✅ Config retrieved successfully!")
-	fmt.Printf("🌐 Server: %v\n", config["server"])
-	fmt.Printf("🔌 Port: %v\n", config["port"])
-	fmt.Printf("🆔 Environment ID: %v\n", config["environment_id"])
+	return profile, nil
 }
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/glassrye/soltar"
+)
+
+func TestParseArgs(t *testing.T) {
+	defer func(saved Options) { options = saved }(options)
+
+	tests := []struct {
+		name       string
+		args       []string
+		positional []string
+		peer       string
+		profile    string
+		code       int
+	}{
+		{"flags first", []string{"--peer", "phone", "use", "work"}, []string{"use", "work"}, "phone", "", exitOK},
+		{"flags between arguments", []string{"use", "--profile", "dev", "work", "--peer=tablet"}, []string{"use", "work"}, "tablet", "dev", exitOK},
+		{"no arguments", nil, nil, "", "", exitOK},
+		{"after --", []string{"get", "--", "--peer"}, []string{"get", "--peer"}, "", "", exitOK},
+		{"unknown flag", []string{"get", "--frobnicate"}, nil, "", "", exitUsage},
+		{"missing value", []string{"--peer"}, nil, "", "", exitUsage},
+		{"bad output", []string{"--output", "yaml"}, nil, "", "", exitUsage},
+	}
+	for _, tt := range tests {
+		options = Options{}
+		flags := newFlagSet("test")
+		flags.SetOutput(io.Discard)
+		peer := flags.String("peer", "", "peer name")
+
+		positional, err := parseArgs(flags, tt.args)
+		if tt.code != exitOK {
+			if exitCode(err) != tt.code {
+				t.Errorf("%s: expected exit code %d, got %v", tt.name, tt.code, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(positional, tt.positional) || *peer != tt.peer || options.profile != tt.profile {
+			t.Errorf("%s: expected %q, peer %q, profile %q, got %q, %q, %q", tt.name, tt.positional, tt.peer, tt.profile, positional, *peer, options.profile)
+		}
+	}
+
+	options = Options{}
+	flags := newFlagSet("test")
+	flags.SetOutput(io.Discard)
+	if _, err := parseArgs(flags, []string{"--help"}); err != flag.ErrHelp {
+		t.Errorf("Expected --help to be passed through, got %v", err)
+	}
+	if err := parseNoArgs(newFlagSet("test"), []string{"extra"}); exitCode(err) != exitUsage {
+		t.Errorf("Expected an unexpected argument to be a usage error, got %v", err)
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"usage", usageErrorf("unexpected argument %q", "x"), exitUsage},
+		{"auth", authErrorf("not logged in"), exitAuth},
+		{"wrapped usage", fmt.Errorf("login: %w", usageErrorf("--email is required")), exitUsage},
+		{"unauthorized", &soltar.APIError{StatusCode: http.StatusUnauthorized}, exitAuth},
+		{"refused", &soltar.APIError{StatusCode: http.StatusConflict}, exitAPI},
+		{"wrapped refused", fmt.Errorf("update: %w", &soltar.APIError{StatusCode: http.StatusUnprocessableEntity}), exitAPI},
+		{"network", errors.New("connection refused"), exitError},
+	}
+	for _, tt := range tests {
+		if got := exitCode(tt.err); got != tt.want {
+			t.Errorf("%s: expected exit code %d, got %d", tt.name, tt.want, got)
+		}
+	}
+
+	if err := usageErrorf("bad %s", "flag"); err.Error() != "bad flag" || errors.Unwrap(err) == nil {
+		t.Errorf("Expected the usage error to read and unwrap as its cause, got %v", err)
+	}
+}
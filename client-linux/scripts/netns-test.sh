@@ -0,0 +1,103 @@
+#!/bin/bash
+#
+# Runs the userspace WireGuard data plane between two network namespaces on
+# this host: two soltar-client processes peer over a veth pair, one tunnel
+# address pings the other, then both are torn down. Needs root.
+
+set -euo pipefail
+
+CLIENT="${CLIENT:-$(pwd)/soltar-client}"
+WORK="$(mktemp -d)"
+NS_A=soltar-test-a
+NS_B=soltar-test-b
+
+cleanup() {
+    ip netns exec "$NS_A" "$CLIENT" down --interface wga >/dev/null 2>&1 || true
+    ip netns exec "$NS_B" "$CLIENT" down --interface wgb >/dev/null 2>&1 || true
+    ip netns del "$NS_A" 2>/dev/null || true
+    ip netns del "$NS_B" 2>/dev/null || true
+    rm -rf "$WORK"
+}
+trap cleanup EXIT
+
+if [ "$(id -u)" -ne 0 ]; then
+    echo "❌ Must run as root" >&2
+    exit 1
+fi
+if [ ! -x "$CLIENT" ]; then
+    echo "❌ Build the client first: go build -o soltar-client ." >&2
+    exit 1
+fi
+
+echo "🔧 Creating namespaces..."
+ip netns add "$NS_A"
+ip netns add "$NS_B"
+ip link add veth-a netns "$NS_A" type veth peer name veth-b netns "$NS_B"
+ip -n "$NS_A" address add 192.0.2.1/24 dev veth-a
+ip -n "$NS_B" address add 192.0.2.2/24 dev veth-b
+for ns in "$NS_A" "$NS_B"; do
+    ip -n "$ns" link set lo up
+done
+ip -n "$NS_A" link set veth-a up
+ip -n "$NS_B" link set veth-b up
+
+KEY_A="$("$CLIENT" genkey)"
+KEY_B="$("$CLIENT" genkey)"
+PSK="$("$CLIENT" genkey)"
+
+cat > "$WORK/a.conf" <<CONF
+[Interface]
+PrivateKey = $KEY_A
+Address = 10.99.0.1/24
+ListenPort = 51820
+
+[Peer]
+PublicKey = $(echo "$KEY_B" | "$CLIENT" pubkey)
+PresharedKey = $PSK
+Endpoint = 192.0.2.2:51820
+AllowedIPs = 10.99.0.2/32
+CONF
+
+cat > "$WORK/b.conf" <<CONF
+[Interface]
+PrivateKey = $KEY_B
+Address = 10.99.0.2/24
+ListenPort = 51820
+
+[Peer]
+PublicKey = $(echo "$KEY_A" | "$CLIENT" pubkey)
+PresharedKey = $PSK
+Endpoint = 192.0.2.1:51820
+AllowedIPs = 10.99.0.1/32
+PersistentKeepalive = 5
+CONF
+
+echo "🚀 Bringing up tunnels..."
+ip netns exec "$NS_A" "$CLIENT" up --config "$WORK/a.conf" --interface wga >"$WORK/a.log" 2>&1 &
+ip netns exec "$NS_B" "$CLIENT" up --config "$WORK/b.conf" --interface wgb >"$WORK/b.log" 2>&1 &
+
+for _ in $(seq 50); do
+    if ip -n "$NS_A" link show wga >/dev/null 2>&1 && ip -n "$NS_B" link show wgb >/dev/null 2>&1; then
+        break
+    fi
+    sleep 0.1
+done
+
+echo "📡 Pinging through the tunnel..."
+if ! ip netns exec "$NS_A" ping -c 3 -W 2 10.99.0.2; then
+    echo "❌ No traffic through the tunnel" >&2
+    cat "$WORK/a.log" "$WORK/b.log" >&2
+    exit 1
+fi
+
+echo "🔌 Tearing down..."
+ip netns exec "$NS_A" "$CLIENT" down --interface wga
+ip netns exec "$NS_B" "$CLIENT" down --interface wgb
+wait
+
+if ip -n "$NS_A" link show wga >/dev/null 2>&1 || ip -n "$NS_B" link show wgb >/dev/null 2>&1; then
+    echo "❌ Interfaces left behind after down" >&2
+    exit 1
+fi
+
+echo "✅ Data plane works between namespaces"
@@ -0,0 +1,507 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/tun"
+)
+
+const (
+	defaultInterface = "soltar0"
+	defaultMTU       = 1420
+	// Full tunnels route through their own table, and the tunnel's own
+	// packets carry this mark so they skip it, as wg-quick does
+	tunnelTable  = 51820
+	tunnelFwMark = 51820
+)
+
+// TunnelConfig is a parsed wg-quick config
+type TunnelConfig struct {
+	PrivateKey string
+	Addresses  []netip.Prefix
+	DNS        []netip.Addr
+	ListenPort int
+	MTU        int
+	Peers      []TunnelPeer
+}
+
+type TunnelPeer struct {
+	PublicKey           string
+	PresharedKey        string
+	Endpoint            string
+	AllowedIPs          []netip.Prefix
+	PersistentKeepalive int
+}
+
+// parseWgQuickConfig reads the wg-quick format served by GET /config?format=wg-quick
+func parseWgQuickConfig(r io.Reader) (*TunnelConfig, error) {
+	config := &TunnelConfig{MTU: defaultMTU}
+	var peer *TunnelPeer
+	section := ""
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if i := strings.Index(text, "#"); i >= 0 {
+			text = strings.TrimSpace(text[:i])
+		}
+		if text == "" {
+			continue
+		}
+
+		if strings.HasPrefix(text, "[") && strings.HasSuffix(text, "]") {
+			section = strings.ToLower(text[1 : len(text)-1])
+			if section == "peer" {
+				config.Peers = append(config.Peers, TunnelPeer{})
+				peer = &config.Peers[len(config.Peers)-1]
+			}
+			continue
+		}
+
+		key, value, ok := strings.Cut(text, "=")
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected key = value", line)
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+
+		var err error
+		switch {
+		case section == "interface" && key == "privatekey":
+			config.PrivateKey = value
+		case section == "interface" && key == "address":
+			config.Addresses, err = parsePrefixes(value)
+		case section == "interface" && key == "dns":
+			for _, s := range splitComma(value) {
+				addr, perr := netip.ParseAddr(s)
+				if perr != nil {
+					err = perr
+					break
+				}
+				config.DNS = append(config.DNS, addr)
+			}
+		case section == "interface" && key == "listenport":
+			config.ListenPort, err = strconv.Atoi(value)
+		case section == "interface" && key == "mtu":
+			config.MTU, err = strconv.Atoi(value)
+		case section == "peer" && key == "publickey":
+			peer.PublicKey = value
+		case section == "peer" && key == "presharedkey":
+			peer.PresharedKey = value
+		case section == "peer" && key == "endpoint":
+			peer.Endpoint = value
+		case section == "peer" && key == "allowedips":
+			peer.AllowedIPs, err = parsePrefixes(value)
+		case section == "peer" && key == "persistentkeepalive":
+			peer.PersistentKeepalive, err = strconv.Atoi(value)
+		default:
+			return nil, fmt.Errorf("line %d: unsupported key %q in [%s]", line, key, section)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if config.PrivateKey == "" {
+		return nil, fmt.Errorf("config has no PrivateKey; the key of this device is kept elsewhere")
+	}
+	if len(config.Addresses) == 0 || len(config.Peers) == 0 {
+		return nil, fmt.Errorf("config needs an Address and at least one [Peer]")
+	}
+	return config, nil
+}
+
+func splitComma(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func parsePrefixes(value string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, s := range splitComma(value) {
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, p)
+	}
+	return prefixes, nil
+}
+
+// keyToHex converts a base64 WireGuard key to the hex form of the UAPI
+func keyToHex(key string) (string, error) {
+	raw, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || len(raw) != 32 {
+		return "", fmt.Errorf("invalid key %q", key)
+	}
+	return hex.EncodeToString(raw), nil
+}
+
+// isFullTunnel reports whether the config routes a default route through
+// the tunnel, which needs policy routing to keep the endpoint reachable
+func (c *TunnelConfig) isFullTunnel() bool {
+	for _, p := range c.Peers {
+		for _, ip := range p.AllowedIPs {
+			if ip.Bits() == 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// uapiConfig renders the config for device.IpcSet
+func (c *TunnelConfig) uapiConfig() (string, error) {
+	var b strings.Builder
+
+	privateKey, err := keyToHex(c.PrivateKey)
+	if err != nil {
+		return "", err
+	}
+	fmt.Fprintf(&b, "private_key=%s\n", privateKey)
+	if c.ListenPort > 0 {
+		fmt.Fprintf(&b, "listen_port=%d\n", c.ListenPort)
+	}
+	if c.isFullTunnel() {
+		fmt.Fprintf(&b, "fwmark=%d\n", tunnelFwMark)
+	}
+	b.WriteString("replace_peers=true\n")
+
+	for _, p := range c.Peers {
+		publicKey, err := keyToHex(p.PublicKey)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&b, "public_key=%s\n", publicKey)
+		if p.PresharedKey != "" {
+			psk, err := keyToHex(p.PresharedKey)
+			if err != nil {
+				return "", err
+			}
+			fmt.Fprintf(&b, "preshared_key=%s\n", psk)
+		}
+		if p.Endpoint != "" {
+			endpoint, err := resolveEndpoint(p.Endpoint)
+			if err != nil {
+				return "", err
+			}
+			fmt.Fprintf(&b, "endpoint=%s\n", endpoint)
+		}
+		if p.PersistentKeepalive > 0 {
+			fmt.Fprintf(&b, "persistent_keepalive_interval=%d\n", p.PersistentKeepalive)
+		}
+		b.WriteString("replace_allowed_ips=true\n")
+		for _, ip := range p.AllowedIPs {
+			fmt.Fprintf(&b, "allowed_ip=%s\n", ip)
+		}
+	}
+	return b.String(), nil
+}
+
+// resolveEndpoint looks up a host:port endpoint; the UAPI only takes literal
+// addresses
+func resolveEndpoint(endpoint string) (netip.AddrPort, error) {
+	addr, err := net.ResolveUDPAddr("udp", endpoint)
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("failed to resolve endpoint %s: %v", endpoint, err)
+	}
+	resolved := addr.AddrPort()
+	return netip.AddrPortFrom(resolved.Addr().Unmap(), resolved.Port()), nil
+}
+
+// Tunnel is a running userspace WireGuard interface and the host state
+// installed for it. Every change to the host is recorded as an undo step so
+// teardown can reverse exactly what was done, even after a partial setup.
+type Tunnel struct {
+	Name   string
+	config *TunnelConfig
+	device *device.Device
+	undo   [][]string
+}
+
+// ip runs an iproute2 command, remembering how to reverse it
+func (t *Tunnel) ip(undo []string, args ...string) error {
+	out, err := exec.Command("ip", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("ip %s: %v: %s", strings.Join(args, " "), err, bytes.TrimSpace(out))
+	}
+	if undo != nil {
+		t.undo = append(t.undo, append([]string{"ip"}, undo...))
+	}
+	return nil
+}
+
+// startTunnel creates the TUN interface, starts the WireGuard data plane
+// and installs addresses, routes and DNS
+func startTunnel(name string, config *TunnelConfig) (*Tunnel, error) {
+	uapi, err := config.uapiConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	tdev, err := tun.CreateTUN(name, config.MTU)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create TUN device %s: %v", name, err)
+	}
+	if realName, err := tdev.Name(); err == nil {
+		name = realName
+	}
+
+	logger := device.NewLogger(device.LogLevelError, fmt.Sprintf("(%s) ", name))
+	t := &Tunnel{
+		Name:   name,
+		config: config,
+		device: device.NewDevice(tdev, conn.NewDefaultBind(), logger),
+	}
+
+	if err := t.device.IpcSet(uapi); err != nil {
+		t.Close()
+		return nil, fmt.Errorf("failed to configure WireGuard: %v", err)
+	}
+	if err := t.device.Up(); err != nil {
+		t.Close()
+		return nil, fmt.Errorf("failed to start WireGuard: %v", err)
+	}
+
+	if err := t.configureHost(); err != nil {
+		t.Close()
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *Tunnel) configureHost() error {
+	for _, addr := range t.config.Addresses {
+		if err := t.ip(nil, "address", "add", addr.String(), "dev", t.Name); err != nil {
+			return err
+		}
+	}
+	if err := t.ip(nil, "link", "set", "mtu", strconv.Itoa(t.config.MTU), "up", "dev", t.Name); err != nil {
+		return err
+	}
+
+	// Routes through the interface vanish with it; only policy rules need undoing
+	table := strconv.Itoa(tunnelTable)
+	mark := strconv.Itoa(tunnelFwMark)
+	full := map[string]bool{}
+	for _, p := range t.config.Peers {
+		for _, ip := range p.AllowedIPs {
+			family := "-4"
+			if ip.Addr().Is6() {
+				family = "-6"
+			}
+
+			if ip.Bits() != 0 {
+				if err := t.ip(nil, family, "route", "add", ip.String(), "dev", t.Name); err != nil {
+					return err
+				}
+				continue
+			}
+
+			if err := t.ip(nil, family, "route", "add", ip.String(), "dev", t.Name, "table", table); err != nil {
+				return err
+			}
+			if full[family] {
+				continue
+			}
+			full[family] = true
+			if err := t.ip([]string{family, "rule", "del", "not", "fwmark", mark, "table", table},
+				family, "rule", "add", "not", "fwmark", mark, "table", table); err != nil {
+				return err
+			}
+			if err := t.ip([]string{family, "rule", "del", "table", "main", "suppress_prefixlength", "0"},
+				family, "rule", "add", "table", "main", "suppress_prefixlength", "0"); err != nil {
+				return err
+			}
+		}
+	}
+
+	return t.configureDNS()
+}
+
+// configureDNS points the resolver at the tunnel's DNS servers through
+// systemd-resolved, or resolvconf where resolved is not running
+func (t *Tunnel) configureDNS() error {
+	if len(t.config.DNS) == 0 {
+		return nil
+	}
+
+	var servers []string
+	for _, d := range t.config.DNS {
+		servers = append(servers, d.String())
+	}
+
+	if _, err := exec.LookPath("resolvectl"); err == nil {
+		args := append([]string{"dns", t.Name}, servers...)
+		if out, err := exec.Command("resolvectl", args...).CombinedOutput(); err != nil {
+			return fmt.Errorf("resolvectl dns: %v: %s", err, bytes.TrimSpace(out))
+		}
+		t.undo = append(t.undo, []string{"resolvectl", "revert", t.Name})
+		if out, err := exec.Command("resolvectl", "domain", t.Name, "~.").CombinedOutput(); err != nil {
+			return fmt.Errorf("resolvectl domain: %v: %s", err, bytes.TrimSpace(out))
+		}
+		return nil
+	}
+
+	if _, err := exec.LookPath("resolvconf"); err == nil {
+		var conf strings.Builder
+		for _, s := range servers {
+			fmt.Fprintf(&conf, "nameserver %s\n", s)
+		}
+		cmd := exec.Command("resolvconf", "-a", "tun."+t.Name, "-m", "0", "-x")
+		cmd.Stdin = strings.NewReader(conf.String())
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("resolvconf: %v: %s", err, bytes.TrimSpace(out))
+		}
+		t.undo = append(t.undo, []string{"resolvconf", "-d", "tun." + t.Name, "-f"})
+		return nil
+	}
+
+	progress("⚠️  Neither resolvectl nor resolvconf found, leaving DNS unchanged")
+	return nil
+}
+
+// Close reverts host changes in reverse order and stops the data plane,
+// which removes the TUN interface
+func (t *Tunnel) Close() {
+	for i := len(t.undo) - 1; i >= 0; i-- {
+		step := t.undo[i]
+		if out, err := exec.Command(step[0], step[1:]...).CombinedOutput(); err != nil {
+			progress("⚠️  Cleanup step %s failed: %v: %s", strings.Join(step, " "), err, bytes.TrimSpace(out))
+		}
+	}
+	t.undo = nil
+	t.device.Close()
+}
+
+// runtimeDir holds pid files and the daemon socket: /run/soltar for root,
+// $XDG_RUNTIME_DIR/soltar otherwise
+func runtimeDir() string {
+	dir := os.Getenv("XDG_RUNTIME_DIR")
+	if dir == "" || os.Geteuid() == 0 {
+		dir = "/run"
+	}
+	return filepath.Join(dir, "soltar")
+}
+
+// pidFile is where a running `up` records itself so `down` can find it
+func pidFile(name string) string {
+	return filepath.Join(runtimeDir(), name+".pid")
+}
+
+// runTunnel brings the tunnel up and blocks until a signal or `down` stops it
+func runTunnel(name string, config *TunnelConfig) error {
+	t, err := startTunnel(name, config)
+	if err != nil {
+		return err
+	}
+	defer t.Close()
+
+	pid := pidFile(t.Name)
+	if err := os.MkdirAll(filepath.Dir(pid), 0700); err == nil {
+		os.WriteFile(pid, []byte(strconv.Itoa(os.Getpid())), 0600)
+		defer os.Remove(pid)
+	}
+
+	progress("✅ Tunnel %s is up (%s)", t.Name, joinPrefixes(config.Addresses))
+	progress("Press Ctrl+C or run `soltar-client down` to disconnect")
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(signals)
+
+	select {
+	case sig := <-signals:
+		progress("\n🔌 Received %s, tearing down %s...", sig, t.Name)
+	case <-t.device.Wait():
+		progress("🔌 WireGuard device %s stopped", t.Name)
+	}
+	return nil
+}
+
+// stopTunnel signals the `up` process owning the interface and waits for it
+// to finish its teardown
+func stopTunnel(name string) error {
+	data, err := os.ReadFile(pidFile(name))
+	if err != nil {
+		return fmt.Errorf("tunnel %s is not running", name)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return fmt.Errorf("corrupt pid file %s", pidFile(name))
+	}
+
+	process, err := os.FindProcess(pid)
+	if err == nil {
+		err = process.Signal(syscall.SIGTERM)
+	}
+	if err != nil {
+		os.Remove(pidFile(name))
+		return fmt.Errorf("tunnel %s is not running (stale pid %d)", name, pid)
+	}
+
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(100 * time.Millisecond) {
+		if _, err := os.Stat(pidFile(name)); os.IsNotExist(err) {
+			return nil
+		}
+	}
+	return fmt.Errorf("tunnel %s did not stop within 10s", name)
+}
+
+func joinPrefixes(prefixes []netip.Prefix) string {
+	var s []string
+	for _, p := range prefixes {
+		s = append(s, p.String())
+	}
+	return strings.Join(s, ", ")
+}
+
+// generateKeyPair returns a base64 private and public key, for `genkey`
+func generateKeyPair() (string, string, error) {
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	return base64.StdEncoding.EncodeToString(priv.Bytes()),
+		base64.StdEncoding.EncodeToString(priv.PublicKey().Bytes()), nil
+}
+
+// publicKeyOf derives the public key of a base64 private key, for `pubkey`
+func publicKeyOf(privateKey string) (string, error) {
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(privateKey))
+	if err != nil {
+		return "", fmt.Errorf("invalid private key")
+	}
+	priv, err := ecdh.X25519().NewPrivateKey(raw)
+	if err != nil {
+		return "", fmt.Errorf("invalid private key: %v", err)
+	}
+	return base64.StdEncoding.EncodeToString(priv.PublicKey().Bytes()), nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+// testKey returns a base64 key of 32 copies of b
+func testKey(b byte) string {
+	return base64.StdEncoding.EncodeToString([]byte(strings.Repeat(string(b), 32)))
+}
+
+func TestParseWgQuickConfig(t *testing.T) {
+	config, err := parseWgQuickConfig(strings.NewReader(`
+# Soltar VPN - laptop
+[Interface]
+PrivateKey = ` + testKey('a') + `
+Address = 10.8.0.2/32, fd00:8::2/128
+DNS = 10.8.0.1,fd00:8::1
+ListenPort = 51821
+
+[Peer]
+PublicKey = ` + testKey('b') + `
+PresharedKey = ` + testKey('c') + `
+Endpoint = 198.51.100.7:51820 # the worker
+AllowedIPs = 0.0.0.0/0, ::/0
+PersistentKeepalive = 25
+`))
+	if err != nil {
+		t.Fatalf("Expected the config to parse, got %v", err)
+	}
+
+	if config.PrivateKey != testKey('a') || config.ListenPort != 51821 || config.MTU != defaultMTU {
+		t.Errorf("Unexpected interface: %+v", config)
+	}
+	if len(config.Addresses) != 2 || config.Addresses[1] != netip.MustParsePrefix("fd00:8::2/128") {
+		t.Errorf("Expected both addresses, got %v", config.Addresses)
+	}
+	if len(config.DNS) != 2 || config.DNS[0] != netip.MustParseAddr("10.8.0.1") {
+		t.Errorf("Expected both DNS servers, got %v", config.DNS)
+	}
+	if len(config.Peers) != 1 {
+		t.Fatalf("Expected one peer, got %d", len(config.Peers))
+	}
+	peer := config.Peers[0]
+	if peer.Endpoint != "198.51.100.7:51820" || peer.PersistentKeepalive != 25 || len(peer.AllowedIPs) != 2 {
+		t.Errorf("Unexpected peer: %+v", peer)
+	}
+	if !config.isFullTunnel() {
+		t.Error("Expected a default route to make a full tunnel")
+	}
+}
+
+func TestParseWgQuickConfigErrors(t *testing.T) {
+	const peer = "\n[Peer]\nPublicKey = key\nAllowedIPs = 10.8.0.0/24\n"
+	tests := []struct {
+		name   string
+		config string
+		want   string
+	}{
+		{"no private key", "[Interface]\nAddress = 10.8.0.2/32" + peer, "no PrivateKey"},
+		{"no peer", "[Interface]\nPrivateKey = key\nAddress = 10.8.0.2/32\n", "at least one [Peer]"},
+		{"no address", "[Interface]\nPrivateKey = key" + peer, "needs an Address"},
+		{"not key value", "[Interface]\nPrivateKey\n", "line 2: expected key = value"},
+		{"unknown key", "[Interface]\nPostUp = iptables -A FORWARD\n", `line 2: unsupported key "postup" in [interface]`},
+		{"key outside its section", "[Peer]\nMTU = 1280\n", `unsupported key "mtu" in [peer]`},
+		{"bad address", "[Interface]\nAddress = 10.8.0.2\n", "line 2:"},
+		{"bad port", "[Interface]\nListenPort = many\n", "line 2:"},
+		{"bad dns", "[Interface]\nDNS = resolver.example\n", "line 2:"},
+	}
+	for _, tt := range tests {
+		_, err := parseWgQuickConfig(strings.NewReader(tt.config))
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: expected an error containing %q, got %v", tt.name, tt.want, err)
+		}
+	}
+}
+
+func TestUAPIConfig(t *testing.T) {
+	config := &TunnelConfig{
+		PrivateKey: testKey('a'),
+		ListenPort: 51821,
+		Peers: []TunnelPeer{{
+			PublicKey:           testKey('b'),
+			PresharedKey:        testKey('c'),
+			Endpoint:            "[2001:db8::7]:51820",
+			AllowedIPs:          []netip.Prefix{netip.MustParsePrefix("10.8.0.0/24")},
+			PersistentKeepalive: 25,
+		}, {
+			PublicKey:  testKey('d'),
+			AllowedIPs: []netip.Prefix{netip.MustParsePrefix("10.9.0.0/24"), netip.MustParsePrefix("fd00:9::/64")},
+		}},
+	}
+
+	got, err := config.uapiConfig()
+	if err != nil {
+		t.Fatalf("Expected the config to render, got %v", err)
+	}
+	want := "private_key=" + strings.Repeat("61", 32) + "\n" +
+		"listen_port=51821\n" +
+		"replace_peers=true\n" +
+		"public_key=" + strings.Repeat("62", 32) + "\n" +
+		"preshared_key=" + strings.Repeat("63", 32) + "\n" +
+		"endpoint=[2001:db8::7]:51820\n" +
+		"persistent_keepalive_interval=25\n" +
+		"replace_allowed_ips=true\n" +
+		"allowed_ip=10.8.0.0/24\n" +
+		"public_key=" + strings.Repeat("64", 32) + "\n" +
+		"replace_allowed_ips=true\n" +
+		"allowed_ip=10.9.0.0/24\n" +
+		"allowed_ip=fd00:9::/64\n"
+	if got != want {
+		t.Errorf("Unexpected UAPI config:\n%s\nwant:\n%s", got, want)
+	}
+
+	// A full tunnel marks its own packets so they skip the tunnel's table
+	config.Peers[1].AllowedIPs = append(config.Peers[1].AllowedIPs, netip.MustParsePrefix("0.0.0.0/0"))
+	if got, _ := config.uapiConfig(); !strings.Contains(got, "fwmark=51820\nreplace_peers=true\n") {
+		t.Errorf("Expected a full tunnel to set the fwmark, got:\n%s", got)
+	}
+
+	config.Peers[1].PublicKey = "short"
+	if _, err := config.uapiConfig(); err == nil || !strings.Contains(err.Error(), "invalid key") {
+		t.Errorf("Expected an invalid peer key to be refused, got %v", err)
+	}
+}
+
+func TestKeyPair(t *testing.T) {
+	privateKey, publicKey, err := generateKeyPair()
+	if err != nil {
+		t.Fatalf("Expected a key pair, got %v", err)
+	}
+	if derived, err := publicKeyOf(privateKey + "\n"); err != nil || derived != publicKey {
+		t.Errorf("Expected pubkey to derive %s, got %s, %v", publicKey, derived, err)
+	}
+	if _, err := keyToHex(publicKey); err != nil {
+		t.Errorf("Expected the public key to convert for the UAPI, got %v", err)
+	}
+	if _, err := publicKeyOf("not base64!"); err == nil {
+		t.Error("Expected an invalid private key to be refused")
+	}
+}
@@ -0,0 +1,331 @@
+package soltar
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Client calls the Soltar API. Methods other than Register, Verify and
+// Refresh need Token; Verify and Refresh set it.
+//
+//	c := soltar.NewClient("https://vpn.example.com")
+//	if err := c.Register(ctx, email); err != nil { ... }
+//	auth, err := c.Verify(ctx, soltar.OTPVerify{Email: email, OTP: otp})
+//	config, err := c.Config(ctx, "")
+type Client struct {
+	BaseURL    string
+	Token      string
+	HTTPClient *http.Client
+}
+
+// NewClient returns a client for the server at baseURL
+func NewClient(baseURL string) *Client {
+	return &Client{
+		BaseURL:    strings.TrimRight(baseURL, "/"),
+		HTTPClient: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// APIError is a non-2xx response. Code, RetryAfter, AttemptsRemaining and
+// Fields are set by endpoints that answer with an ErrorResponse.
+type APIError struct {
+	StatusCode        int
+	Code              string
+	Message           string
+	RetryAfter        int
+	AttemptsRemaining *int
+	Fields            []ValidationError
+}
+
+func (e *APIError) Error() string {
+	message := e.Message
+	if message == "" {
+		message = http.StatusText(e.StatusCode)
+	}
+	text := fmt.Sprintf("%s (HTTP %d)", message, e.StatusCode)
+	for _, f := range e.Fields {
+		text += fmt.Sprintf("\n  %s: %s", f.Field, f.Message)
+	}
+	return text
+}
+
+// Register asks the server to send a one-time password to email
+func (c *Client) Register(ctx context.Context, email string) error {
+	return c.do(ctx, "POST", "/register", false, OTPRequest{Email: email}, nil)
+}
+
+// Verify trades a one-time password for a session and keeps its access
+// token in c.Token
+func (c *Client) Verify(ctx context.Context, req OTPVerify) (*AuthResponse, error) {
+	var resp AuthResponse
+	if err := c.do(ctx, "POST", "/verify", false, req, &resp); err != nil {
+		return nil, err
+	}
+	c.Token = resp.Token
+	return &resp, nil
+}
+
+// Refresh trades a refresh token for a new access token, kept in c.Token,
+// and its rotated refresh token
+func (c *Client) Refresh(ctx context.Context, refreshToken string) (*TokenResponse, error) {
+	var resp TokenResponse
+	if err := c.do(ctx, "POST", "/token/refresh", false, RefreshRequest{RefreshToken: refreshToken}, &resp); err != nil {
+		return nil, err
+	}
+	c.Token = resp.Token
+	return &resp, nil
+}
+
+// Logout revokes c.Token and ends its session
+func (c *Client) Logout(ctx context.Context) error {
+	return c.do(ctx, "POST", "/logout", true, nil, nil)
+}
+
+// Connect checks in with the server
+func (c *Client) Connect(ctx context.Context) (*ConnectResponse, error) {
+	var resp ConnectResponse
+	if err := c.do(ctx, "POST", "/connect", true, nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Config returns the config of a peer (device); "" is the default peer
+func (c *Client) Config(ctx context.Context, peer string) (*VPNConfig, error) {
+	var config VPNConfig
+	if err := c.do(ctx, "GET", configPath(peer, ""), true, nil, &config); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// ConfigFile returns the config of a peer rendered by the server in format:
+// wg-quick, networkmanager, networkd-netdev, networkd-network, openvpn or json
+func (c *Client) ConfigFile(ctx context.Context, peer, format string) ([]byte, error) {
+	var body []byte
+	if err := c.do(ctx, "GET", configPath(peer, format), true, nil, &body); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+func configPath(peer, format string) string {
+	query := url.Values{}
+	if peer != "" {
+		query.Set("peer", peer)
+	}
+	if format != "" {
+		query.Set("format", format)
+	}
+	if len(query) == 0 {
+		return "/config"
+	}
+	return "/config?" + query.Encode()
+}
+
+// Environment returns the client's environment and its lifecycle state
+func (c *Client) Environment(ctx context.Context) (*EnvironmentResponse, error) {
+	return c.environment(ctx, "GET", "/environment", nil)
+}
+
+// SuspendEnvironment stops the environment from handing out configs until
+// ResumeEnvironment
+func (c *Client) SuspendEnvironment(ctx context.Context, reason string) (*EnvironmentResponse, error) {
+	return c.environment(ctx, "POST", "/environment/suspend", EnvironmentAction{Reason: reason})
+}
+
+// ResumeEnvironment reactivates an environment the client suspended
+func (c *Client) ResumeEnvironment(ctx context.Context) (*EnvironmentResponse, error) {
+	return c.environment(ctx, "POST", "/environment/resume", EnvironmentAction{})
+}
+
+// DeleteEnvironment deprovisions the environment for good
+func (c *Client) DeleteEnvironment(ctx context.Context, reason string) (*EnvironmentResponse, error) {
+	return c.environment(ctx, "DELETE", "/environment", EnvironmentAction{Reason: reason})
+}
+
+func (c *Client) environment(ctx context.Context, method, path string, body interface{}) (*EnvironmentResponse, error) {
+	var resp EnvironmentResponse
+	if err := c.do(ctx, method, path, true, body, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Heartbeat reports that the device is alive
+func (c *Client) Heartbeat(ctx context.Context, req HeartbeatRequest) (*HeartbeatResponse, error) {
+	var resp HeartbeatResponse
+	if err := c.do(ctx, "POST", "/heartbeat", true, req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Presence returns the online state of the client and its devices
+func (c *Client) Presence(ctx context.Context) (*ClientPresence, error) {
+	var resp ClientPresence
+	if err := c.do(ctx, "GET", "/presence", true, nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (c *Client) GetInfrastructure(ctx context.Context) (*InfrastructureResponse, error) {
+	var resp InfrastructureResponse
+	if err := c.do(ctx, "GET", "/infrastructure", true, nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// UpdateInfrastructure replaces the client's desired infrastructure; its
+// provisioning progress shows in GetInfrastructure's Status
+func (c *Client) UpdateInfrastructure(ctx context.Context, infrastructure Infrastructure) (*MessageResponse, error) {
+	return c.writeInfrastructure(ctx, "POST", "/infrastructure", nil, InfrastructureUpdate{Infrastructure: infrastructure})
+}
+
+// UpdateInfrastructureAt is UpdateInfrastructure for a change made against
+// revision, usually the Generation read by GetInfrastructure. It fails with
+// an APIError coded ErrCodeRevisionMismatch if another write came first.
+func (c *Client) UpdateInfrastructureAt(ctx context.Context, infrastructure Infrastructure, revision int64) (*MessageResponse, error) {
+	return c.writeInfrastructure(ctx, "POST", "/infrastructure", ifMatch(revision), InfrastructureUpdate{Infrastructure: infrastructure})
+}
+
+// InfrastructureHistory lists the revisions of the client's infrastructure,
+// newest first
+func (c *Client) InfrastructureHistory(ctx context.Context) (*InfrastructureHistoryResponse, error) {
+	var resp InfrastructureHistoryResponse
+	if err := c.do(ctx, "GET", "/infrastructure/history", true, nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// InfrastructureRevision returns one revision with its full document
+func (c *Client) InfrastructureRevision(ctx context.Context, revision int64) (*InfrastructureRevision, error) {
+	var resp InfrastructureRevision
+	if err := c.do(ctx, "GET", fmt.Sprintf("/infrastructure/revisions/%d", revision), true, nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// RollbackInfrastructure makes the infrastructure of an earlier revision the
+// desired state again, recorded as a new revision
+func (c *Client) RollbackInfrastructure(ctx context.Context, revision int64) (*MessageResponse, error) {
+	return c.writeInfrastructure(ctx, "POST", fmt.Sprintf("/infrastructure/rollback/%d", revision), nil, nil)
+}
+
+// MergePatchInfrastructure applies a JSON Merge Patch (RFC 7396) to the
+// stored infrastructure. Lists in patch replace the stored ones whole; null
+// removes one.
+func (c *Client) MergePatchInfrastructure(ctx context.Context, patch interface{}) (*MessageResponse, error) {
+	return c.writeInfrastructure(ctx, "PATCH", "/infrastructure", http.Header{"Content-Type": {MergePatchContentType}}, patch)
+}
+
+// JSONPatchInfrastructure applies a JSON Patch (RFC 6902) to the stored
+// infrastructure. All operations apply or none do; a failed "test" is an
+// APIError with ErrCodePatchConflict.
+func (c *Client) JSONPatchInfrastructure(ctx context.Context, ops []PatchOperation) (*MessageResponse, error) {
+	return c.writeInfrastructure(ctx, "PATCH", "/infrastructure", http.Header{"Content-Type": {JSONPatchContentType}}, ops)
+}
+
+func (c *Client) writeInfrastructure(ctx context.Context, method, path string, header http.Header, body interface{}) (*MessageResponse, error) {
+	var resp MessageResponse
+	if err := c.send(ctx, method, path, true, header, body, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// ifMatch makes a write conditional on the infrastructure being at revision
+func ifMatch(revision int64) http.Header {
+	return http.Header{"If-Match": {fmt.Sprintf(`"%d"`, revision)}}
+}
+
+// do sends body as JSON and decodes the response into out, which may be a
+// *[]byte for the raw body
+func (c *Client) do(ctx context.Context, method, path string, auth bool, body, out interface{}) error {
+	return c.send(ctx, method, path, auth, nil, body, out)
+}
+
+// send is do with extra request headers
+func (c *Client) send(ctx context.Context, method, path string, auth bool, header http.Header, body, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+path, reader)
+	if err != nil {
+		return err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if body != nil && req.Header.Get("Content-Type") == "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if auth {
+		if c.Token == "" {
+			return fmt.Errorf("soltar: %s %s needs a token", method, path)
+		}
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return parseError(resp.StatusCode, data)
+	}
+
+	switch out := out.(type) {
+	case nil:
+		return nil
+	case *[]byte:
+		*out = data
+		return nil
+	default:
+		if err := json.Unmarshal(data, out); err != nil {
+			return fmt.Errorf("soltar: invalid response from %s %s: %v", method, path, err)
+		}
+		return nil
+	}
+}
+
+// parseError reads an ErrorResponse, or the plain text of http.Error
+func parseError(status int, data []byte) *APIError {
+	apiErr := &APIError{StatusCode: status, Message: strings.TrimSpace(string(data))}
+	var resp ErrorResponse
+	if json.Unmarshal(data, &resp) == nil && resp.Error != "" {
+		apiErr.Code = resp.Error
+		apiErr.Message = resp.Message
+		apiErr.RetryAfter = resp.RetryAfter
+		apiErr.AttemptsRemaining = resp.AttemptsRemaining
+		apiErr.Fields = resp.Fields
+	}
+	return apiErr
+}
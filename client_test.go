@@ -0,0 +1,167 @@
+package soltar
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestClientSendsTokenAndQuery(t *testing.T) {
+	var gotAuth, gotQuery string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotAuth = r.Header.Get("Authorization")
+		gotQuery = r.URL.RawQuery
+		w.Write([]byte("[Interface]\n"))
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL + "/")
+	client.Token = "abc"
+	body, err := client.ConfigFile(context.Background(), "phone", "wg-quick")
+	if err != nil {
+		t.Fatalf("ConfigFile failed: %v", err)
+	}
+	if string(body) != "[Interface]\n" {
+		t.Errorf("Expected the raw body, got %q", body)
+	}
+	if gotAuth != "Bearer abc" {
+		t.Errorf("Expected bearer token, got %q", gotAuth)
+	}
+	if gotQuery != "format=wg-quick&peer=phone" {
+		t.Errorf("Unexpected query %q", gotQuery)
+	}
+}
+
+func TestClientSendsIfMatch(t *testing.T) {
+	var gotIfMatch, gotPath string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotIfMatch = r.Header.Get("If-Match")
+		gotPath = r.URL.Path
+		w.WriteHeader(http.StatusPreconditionFailed)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: ErrCodeRevisionMismatch, Message: "Infrastructure is at revision 4"})
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL)
+	client.Token = "abc"
+	_, err := client.UpdateInfrastructureAt(context.Background(), Infrastructure{}, 3)
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.Code != ErrCodeRevisionMismatch {
+		t.Fatalf("Expected a revision mismatch, got %v", err)
+	}
+	if gotIfMatch != `"3"` || gotPath != "/infrastructure" {
+		t.Errorf("Expected If-Match \"3\" on /infrastructure, got %q on %s", gotIfMatch, gotPath)
+	}
+
+	client.RollbackInfrastructure(context.Background(), 2)
+	if gotIfMatch != "" || gotPath != "/infrastructure/rollback/2" {
+		t.Errorf("Expected an unconditional rollback of 2, got %q on %s", gotIfMatch, gotPath)
+	}
+}
+
+func TestClientSendsPatches(t *testing.T) {
+	var gotMethod, gotType, gotBody string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		gotMethod, gotType, gotBody = r.Method, r.Header.Get("Content-Type"), string(body)
+		json.NewEncoder(w).Encode(MessageResponse{Message: "Infrastructure patched", Revision: 5})
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL)
+	client.Token = "abc"
+	resp, err := client.JSONPatchInfrastructure(context.Background(), []PatchOperation{
+		{Op: "add", Path: "/vpn_instances/-", Value: json.RawMessage(`{"id":"vpn-2"}`)},
+	})
+	if err != nil || resp.Revision != 5 {
+		t.Fatalf("Expected revision 5, got %+v, %v", resp, err)
+	}
+	if gotMethod != "PATCH" || gotType != JSONPatchContentType || gotBody != `[{"op":"add","path":"/vpn_instances/-","value":{"id":"vpn-2"}}]` {
+		t.Errorf("Expected a JSON Patch, got %s %s %s", gotMethod, gotType, gotBody)
+	}
+
+	client.MergePatchInfrastructure(context.Background(), map[string]interface{}{"databases": nil})
+	if gotType != MergePatchContentType || gotBody != `{"databases":null}` {
+		t.Errorf("Expected a merge patch, got %s %s", gotType, gotBody)
+	}
+}
+
+func TestClientNeedsToken(t *testing.T) {
+	client := NewClient("http://127.0.0.1:1")
+	if _, err := client.Connect(context.Background()); err == nil {
+		t.Error("Expected an error without a token")
+	}
+}
+
+func TestClientErrors(t *testing.T) {
+	remaining := 2
+	tests := []struct {
+		name     string
+		status   int
+		body     string
+		wantCode string
+		wantMsg  string
+	}{
+		{
+			name:    "plain text",
+			status:  http.StatusUnauthorized,
+			body:    "Invalid token\n",
+			wantMsg: "Invalid token",
+		},
+		{
+			name:     "error response",
+			status:   http.StatusBadRequest,
+			body:     mustJSON(ErrorResponse{Error: ErrCodeOTPMismatch, Message: "Invalid OTP", AttemptsRemaining: &remaining}),
+			wantCode: ErrCodeOTPMismatch,
+			wantMsg:  "Invalid OTP",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+			}))
+			defer server.Close()
+
+			_, err := NewClient(server.URL).Verify(context.Background(), OTPVerify{Email: "a@example.com", OTP: "1"})
+			var apiErr *APIError
+			if !errors.As(err, &apiErr) {
+				t.Fatalf("Expected *APIError, got %v", err)
+			}
+			if apiErr.StatusCode != tt.status || apiErr.Code != tt.wantCode || apiErr.Message != tt.wantMsg {
+				t.Errorf("Unexpected error %+v", apiErr)
+			}
+			if tt.wantCode != "" && (apiErr.AttemptsRemaining == nil || *apiErr.AttemptsRemaining != remaining) {
+				t.Error("Expected attempts remaining to be decoded")
+			}
+		})
+	}
+}
+
+func TestClientHonoursContext(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := NewClient(server.URL).Register(ctx, "a@example.com")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected deadline exceeded, got %v", err)
+	}
+}
+
+func mustJSON(v interface{}) string {
+	data, _ := json.Marshal(v)
+	return string(data)
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Operator roles, from least to most privileged. Each role can do everything
+// the roles before it can.
+const (
+	RoleViewer   = "viewer"
+	RoleOperator = "operator"
+)
+
+var roleRank = map[string]int{
+	RoleViewer:   1,
+	RoleOperator: 2,
+}
+
+// adminAudience marks admin-scoped JWTs so they are never mistaken for
+// client tokens, and vice versa
+const adminAudience = "soltar-admin"
+
+// AdminIdentity is the authenticated operator behind an admin request
+type AdminIdentity struct {
+	Name string `json:"name"`
+	Role string `json:"role"`
+}
+
+func (a AdminIdentity) has(role string) bool {
+	return roleRank[a.Role] >= roleRank[role]
+}
+
+// AdminClaims are the claims of an admin-scoped JWT
+type AdminClaims struct {
+	Role string `json:"role"`
+	jwt.RegisteredClaims
+}
+
+type adminKey struct {
+	identity AdminIdentity
+	key      []byte
+}
+
+var (
+	// adminEndpointsEnabled controls whether /debug and /admin are routed at all
+	adminEndpointsEnabled = getEnv("ENABLE_ADMIN_ENDPOINTS", "true") == "true"
+	adminKeys             []adminKey
+)
+
+// parseAdminKeys reads ADMIN_API_KEYS, a comma-separated list of
+// name:role:key entries
+func parseAdminKeys(value string) ([]adminKey, error) {
+	var keys []adminKey
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		fields := strings.SplitN(entry, ":", 3)
+		if len(fields) != 3 || fields[0] == "" || fields[2] == "" {
+			return nil, fmt.Errorf("invalid admin key entry %q, expected name:role:key", entry)
+		}
+		if _, ok := roleRank[fields[1]]; !ok {
+			return nil, fmt.Errorf("unknown role %q for admin %s", fields[1], fields[0])
+		}
+
+		keys = append(keys, adminKey{
+			identity: AdminIdentity{Name: fields[0], Role: fields[1]},
+			key:      []byte(fields[2]),
+		})
+	}
+	return keys, nil
+}
+
+// authenticateAdmin accepts either an admin API key or an admin-scoped JWT as
+// the bearer credential
+func authenticateAdmin(r *http.Request) (AdminIdentity, error) {
+	authHeader := r.Header.Get("Authorization")
+	if authHeader == "" {
+		return AdminIdentity{}, fmt.Errorf("missing credentials")
+	}
+	credential := strings.TrimPrefix(authHeader, "Bearer ")
+
+	for _, k := range adminKeys {
+		if subtle.ConstantTimeCompare(k.key, []byte(credential)) == 1 {
+			return k.identity, nil
+		}
+	}
+
+	return validateAdminToken(credential)
+}
+
+func generateAdminToken(name, role string, ttl time.Duration) (string, error) {
+	if _, ok := roleRank[role]; !ok {
+		return "", fmt.Errorf("unknown role %q", role)
+	}
+
+	claims := AdminClaims{
+		Role: role,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   name,
+			Audience:  jwt.ClaimStrings{adminAudience},
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(ttl)),
+		},
+	}
+
+	return keyring.Sign(claims)
+}
+
+func validateAdminToken(tokenString string) (AdminIdentity, error) {
+	token, err := jwt.ParseWithClaims(tokenString, &AdminClaims{}, keyring.Keyfunc, jwt.WithAudience(adminAudience))
+
+	if err != nil || !token.Valid {
+		return AdminIdentity{}, fmt.Errorf("invalid admin token")
+	}
+
+	claims, ok := token.Claims.(*AdminClaims)
+	if !ok || claims.Subject == "" {
+		return AdminIdentity{}, fmt.Errorf("invalid admin claims")
+	}
+	if _, ok := roleRank[claims.Role]; !ok {
+		return AdminIdentity{}, fmt.Errorf("unknown role %q", claims.Role)
+	}
+
+	return AdminIdentity{Name: claims.Subject, Role: claims.Role}, nil
+}
+
+// handleAdminRequest routes /debug and /admin. Both sit behind operator
+// authentication and disappear entirely when ENABLE_ADMIN_ENDPOINTS=false.
+func handleAdminRequest(w http.ResponseWriter, r *http.Request, parts []string) {
+	if !adminEndpointsEnabled {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	identity, err := authenticateAdmin(r)
+	if err != nil {
+		log.Printf("Admin authentication failed for %s %s from %s: %v", r.Method, r.URL.Path, clientIP(r), err)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// requireRole reports whether identity may continue, answering 403 if not
+	requireRole := func(role string) bool {
+		if !identity.has(role) {
+			log.Printf("Admin %s (%s) denied %s %s: requires %s", identity.Name, identity.Role, r.Method, r.URL.Path, role)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return false
+		}
+		log.Printf("Admin %s (%s): %s %s", identity.Name, identity.Role, r.Method, r.URL.Path)
+		return true
+	}
+
+	switch {
+	case r.Method == "GET" && parts[0] == "debug" && len(parts) > 1:
+		// Raw values include live OTPs and full client records
+		if requireRole(RoleOperator) {
+			handleDebug(w, r, parts[1])
+		}
+	case r.Method == "GET" && parts[0] == "debug" && len(parts) == 1:
+		if requireRole(RoleViewer) {
+			handleDebugList(w, r)
+		}
+	case r.Method == "GET" && parts[0] == "admin" && len(parts) == 2 && parts[1] == "whoami":
+		if requireRole(RoleViewer) {
+			w.WriteHeader(http.StatusOK)
+			json.NewEncoder(w).Encode(identity)
+		}
+	case r.Method == "POST" && parts[0] == "admin" && len(parts) == 4 && parts[1] == "clients" && parts[3] == "revoke":
+		if requireRole(RoleOperator) {
+			handleAdminRevokeClient(w, r, parts[2])
+		}
+	case r.Method == "POST" && parts[0] == "admin" && len(parts) == 4 && parts[1] == "environments" && (parts[3] == "suspend" || parts[3] == "resume"):
+		if requireRole(RoleOperator) {
+			handleAdminEnvironmentAction(w, r, identity, parts[2], parts[3])
+		}
+	case r.Method == "DELETE" && parts[0] == "admin" && len(parts) == 3 && parts[1] == "environments":
+		if requireRole(RoleOperator) {
+			handleAdminEnvironmentAction(w, r, identity, parts[2], "delete")
+		}
+	case r.Method == "GET" && parts[0] == "admin" && len(parts) == 4 && parts[1] == "environments" && parts[3] == "resources":
+		if requireRole(RoleViewer) {
+			handleAdminEnvironmentResources(w, r, parts[2])
+		}
+	case r.Method == "GET" && parts[0] == "admin" && len(parts) == 2 && parts[1] == "presence":
+		if requireRole(RoleViewer) {
+			handleAdminPresence(w, r)
+		}
+	case r.Method == "GET" && parts[0] == "admin" && len(parts) == 4 && parts[1] == "clients" && parts[3] == "presence":
+		if requireRole(RoleViewer) {
+			handleAdminClientPresence(w, r, parts[2])
+		}
+	case r.Method == "GET" && parts[0] == "admin" && len(parts) == 2 && parts[1] == "ipam":
+		if requireRole(RoleViewer) {
+			handleAdminIPAM(w, r)
+		}
+	case r.Method == "GET" && parts[0] == "admin" && len(parts) == 3 && parts[1] == "ipam":
+		if requireRole(RoleViewer) {
+			handleAdminIPAMEnvironment(w, r, parts[2])
+		}
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func useTestAdminKeys(t *testing.T) {
+	keys, err := parseAdminKeys("alice:operator:operator-key, bob:viewer:viewer-key")
+	if err != nil {
+		t.Fatalf("Failed to parse admin keys: %v", err)
+	}
+	adminKeys = keys
+	t.Cleanup(func() { adminKeys = nil })
+}
+
+func TestParseAdminKeys(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    int
+		wantErr bool
+	}{
+		{value: "", want: 0},
+		{value: "alice:operator:k1,bob:viewer:k2", want: 2},
+		{value: "alice:operator:key:with:colons", want: 1},
+		{value: "alice:root:k1", wantErr: true},
+		{value: "alice:viewer", wantErr: true},
+		{value: "alice:viewer:", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		keys, err := parseAdminKeys(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseAdminKeys(%q): expected error %v, got %v", tt.value, tt.wantErr, err)
+			continue
+		}
+		if len(keys) != tt.want {
+			t.Errorf("parseAdminKeys(%q): expected %d keys, got %d", tt.value, tt.want, len(keys))
+		}
+	}
+}
+
+// Test that debug and admin routes require an operator identity with the right role
+func TestAdminEndpointAuthorization(t *testing.T) {
+	storage = NewMockStorage()
+	useTestAdminKeys(t)
+	storage.Put("otp:test@example.com", []byte(`{"otp":"123456"}`))
+	storage.Put("wg:server:env-1", []byte(`{"private_key":"secret"}`))
+
+	clientToken := generateToken("client-123", "")
+	viewerToken, _ := generateAdminToken("carol", RoleViewer, time.Hour)
+	operatorToken, _ := generateAdminToken("dave", RoleOperator, time.Hour)
+
+	tests := []struct {
+		name       string
+		path       string
+		credential string
+		wantStatus int
+	}{
+		{"unauthenticated list", "/debug", "", http.StatusUnauthorized},
+		{"unauthenticated key", "/debug/otp:test@example.com", "", http.StatusUnauthorized},
+		{"wrong key", "/debug", "not-a-key", http.StatusUnauthorized},
+		{"client token", "/debug", clientToken, http.StatusUnauthorized},
+		{"viewer key lists keys", "/debug", "viewer-key", http.StatusOK},
+		{"viewer key cannot read values", "/debug/otp:test@example.com", "viewer-key", http.StatusForbidden},
+		{"operator key reads values", "/debug/otp:test@example.com", "operator-key", http.StatusOK},
+		{"viewer token lists keys", "/debug", viewerToken, http.StatusOK},
+		{"viewer token cannot read values", "/debug/otp:test@example.com", viewerToken, http.StatusForbidden},
+		{"operator token reads values", "/debug/otp:test@example.com", operatorToken, http.StatusOK},
+		{"signing keys are never shown", "/debug/jwt:keyring", "operator-key", http.StatusForbidden},
+		{"server keys are never shown", "/debug/wg:server:env-1", "operator-key", http.StatusForbidden},
+		{"peer keys are never shown", "/debug/wg:peers:client-123", operatorToken, http.StatusForbidden},
+		{"database passwords are never shown", "/debug/db:password:env-123:pg-main", operatorToken, http.StatusForbidden},
+		{"whoami", "/admin/whoami", "viewer-key", http.StatusOK},
+		{"unknown admin route", "/admin/nope", "operator-key", http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := requestForTest("GET", tt.path, tt.credential, nil)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("Expected status %d, got %d", tt.wantStatus, w.Code)
+			}
+			if w.Header().Get("Access-Control-Allow-Origin") != "" {
+				t.Error("Expected no CORS headers on admin endpoints")
+			}
+		})
+	}
+}
+
+func TestAdminWhoami(t *testing.T) {
+	useTestAdminKeys(t)
+
+	w := requestForTest("GET", "/admin/whoami", "operator-key", nil)
+
+	var identity AdminIdentity
+	json.Unmarshal(w.Body.Bytes(), &identity)
+	if identity.Name != "alice" || identity.Role != RoleOperator {
+		t.Errorf("Expected alice/operator, got %+v", identity)
+	}
+}
+
+// Test that disabling admin endpoints removes them entirely
+func TestAdminEndpointsDisabled(t *testing.T) {
+	useTestAdminKeys(t)
+	adminEndpointsEnabled = false
+	defer func() { adminEndpointsEnabled = true }()
+
+	w := requestForTest("GET", "/debug", "operator-key", nil)
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 with admin endpoints disabled, got %d", w.Code)
+	}
+}
+
+// Test that admin tokens cannot be used as client tokens
+func TestAdminTokenRejectedAsClientToken(t *testing.T) {
+	token, err := generateAdminToken("alice", RoleOperator, time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to generate admin token: %v", err)
+	}
+
+	if _, err := validateToken(token); err == nil {
+		t.Error("Expected admin token to be rejected by validateToken")
+	}
+}
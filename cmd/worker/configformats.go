@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// tunnelInterfaceName is the interface name used by exported configs that
+// have to name one (NetworkManager, systemd-networkd)
+const tunnelInterfaceName = "soltar0"
+
+// Policy routing used by the systemd-networkd export for full tunnels, the
+// same table and mark wg-quick picks
+const (
+	tunnelRouteTable = 51820
+	tunnelFwMark     = 0xca6c
+)
+
+// ConfigFormat renders a VPNConfig for one kind of VPN tooling
+type ConfigFormat struct {
+	Name        string
+	ContentType string
+	Filename    string
+	Render      func(config *VPNConfig) ([]byte, error)
+}
+
+var configFormats = map[string]ConfigFormat{
+	"json":             {"json", "application/json", "soltar.json", renderJSONConfig},
+	"wg-quick":         {"wg-quick", "text/plain; charset=utf-8", "soltar.conf", renderWgQuickConfig},
+	"networkmanager":   {"networkmanager", "text/plain; charset=utf-8", "soltar.nmconnection", renderNetworkManagerConfig},
+	"networkd-netdev":  {"networkd-netdev", "text/plain; charset=utf-8", "soltar.netdev", renderNetworkdNetdev},
+	"networkd-network": {"networkd-network", "text/plain; charset=utf-8", "soltar.network", renderNetworkdNetwork},
+	"openvpn":          {"openvpn", "application/x-openvpn-profile", "soltar.ovpn", renderOpenVPNConfig},
+}
+
+func configFormatNames() []string {
+	names := make([]string, 0, len(configFormats))
+	for name := range configFormats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// writeConfig answers GET /config in the format picked by ?format=. Without
+// one the JSON document is returned inline as before; any explicit format is
+// sent as a download.
+func writeConfig(w http.ResponseWriter, r *http.Request, config *VPNConfig) {
+	name := r.URL.Query().Get("format")
+	if name == "" {
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(config)
+		return
+	}
+
+	format, ok := configFormats[name]
+	if !ok {
+		http.Error(w, fmt.Sprintf("Unknown format %q, supported: %s", name, strings.Join(configFormatNames(), ", ")), http.StatusBadRequest)
+		return
+	}
+
+	body, err := format.Render(config)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+		return
+	}
+
+	w.Header().Set("Content-Type", format.ContentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, format.Filename))
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
+
+// splitByFamily separates IPv4 from IPv6 entries of an address or DNS list
+func splitByFamily(values []string) (v4, v6 []string) {
+	for _, v := range values {
+		addr, err := netip.ParseAddr(v)
+		if err != nil {
+			prefix, perr := netip.ParsePrefix(v)
+			if perr != nil {
+				continue
+			}
+			addr = prefix.Addr()
+		}
+		if addr.Is4() {
+			v4 = append(v4, v)
+		} else {
+			v6 = append(v6, v)
+		}
+	}
+	return v4, v6
+}
+
+func wireGuardSection(config *VPNConfig) (*WireGuardConfig, error) {
+	if config.WireGuard == nil {
+		return nil, fmt.Errorf("config has no WireGuard tunnel")
+	}
+	return config.WireGuard, nil
+}
+
+func renderJSONConfig(config *VPNConfig) ([]byte, error) {
+	return json.MarshalIndent(config, "", "  ")
+}
+
+func renderWgQuickConfig(config *VPNConfig) ([]byte, error) {
+	wg, err := wireGuardSection(config)
+	if err != nil {
+		return nil, err
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "# Soltar environment %s, peer %s\n", config.EnvironmentID, config.Peer)
+	b.WriteString("[Interface]\n")
+	if wg.Interface.PrivateKey != "" {
+		fmt.Fprintf(&b, "PrivateKey = %s\n", wg.Interface.PrivateKey)
+	} else {
+		b.WriteString("# PrivateKey = <the key generated on the device that registered this peer>\n")
+	}
+	fmt.Fprintf(&b, "Address = %s\n", strings.Join(wg.Interface.Address, ", "))
+	if len(wg.Interface.DNS) > 0 {
+		fmt.Fprintf(&b, "DNS = %s\n", strings.Join(wg.Interface.DNS, ", "))
+	}
+
+	b.WriteString("\n[Peer]\n")
+	fmt.Fprintf(&b, "PublicKey = %s\n", wg.Peer.PublicKey)
+	fmt.Fprintf(&b, "PresharedKey = %s\n", wg.Peer.PresharedKey)
+	fmt.Fprintf(&b, "Endpoint = %s\n", wg.Peer.Endpoint)
+	fmt.Fprintf(&b, "AllowedIPs = %s\n", strings.Join(wg.Peer.AllowedIPs, ", "))
+	if wg.Peer.PersistentKeepalive > 0 {
+		fmt.Fprintf(&b, "PersistentKeepalive = %d\n", wg.Peer.PersistentKeepalive)
+	}
+	return b.Bytes(), nil
+}
+
+// renderServerWgQuickConfig produces the wg-quick file of an environment's
+// VPN server, one [Peer] per device
+func renderServerWgQuickConfig(wg *ServerWireGuard) string {
+	var b strings.Builder
+	b.WriteString("[Interface]\n")
+	fmt.Fprintf(&b, "PrivateKey = %s\n", wg.PrivateKey)
+	if len(wg.Addresses) > 0 {
+		fmt.Fprintf(&b, "Address = %s\n", strings.Join(wg.Addresses, ", "))
+	}
+	fmt.Fprintf(&b, "ListenPort = %d\n", wg.ListenPort)
+
+	for _, peer := range wg.Peers {
+		fmt.Fprintf(&b, "\n# %s\n[Peer]\n", peer.Name)
+		fmt.Fprintf(&b, "PublicKey = %s\n", peer.PublicKey)
+		fmt.Fprintf(&b, "PresharedKey = %s\n", peer.PresharedKey)
+		fmt.Fprintf(&b, "AllowedIPs = %s\n", strings.Join(peer.AllowedIPs, ", "))
+	}
+	return b.String()
+}
+
+// renderNetworkManagerConfig produces a keyfile for
+// /etc/NetworkManager/system-connections
+func renderNetworkManagerConfig(config *VPNConfig) ([]byte, error) {
+	wg, err := wireGuardSection(config)
+	if err != nil {
+		return nil, err
+	}
+
+	// A stable UUID lets re-imports replace the connection instead of adding one
+	id := uuid.NewSHA1(uuid.NameSpaceURL, []byte("soltar:"+config.EnvironmentID+":"+config.Peer))
+
+	var b bytes.Buffer
+	b.WriteString("[connection]\n")
+	fmt.Fprintf(&b, "id=soltar-%s\n", config.Peer)
+	fmt.Fprintf(&b, "uuid=%s\n", id)
+	b.WriteString("type=wireguard\n")
+	fmt.Fprintf(&b, "interface-name=%s\n", tunnelInterfaceName)
+	b.WriteString("autoconnect=false\n")
+
+	b.WriteString("\n[wireguard]\n")
+	if wg.Interface.PrivateKey != "" {
+		fmt.Fprintf(&b, "private-key=%s\n", wg.Interface.PrivateKey)
+	} else {
+		// Let a secret agent supply the key that never left the device
+		b.WriteString("private-key-flags=1\n")
+	}
+
+	fmt.Fprintf(&b, "\n[wireguard-peer.%s]\n", wg.Peer.PublicKey)
+	fmt.Fprintf(&b, "endpoint=%s\n", wg.Peer.Endpoint)
+	fmt.Fprintf(&b, "preshared-key=%s\n", wg.Peer.PresharedKey)
+	b.WriteString("preshared-key-flags=0\n")
+	if wg.Peer.PersistentKeepalive > 0 {
+		fmt.Fprintf(&b, "persistent-keepalive=%d\n", wg.Peer.PersistentKeepalive)
+	}
+	fmt.Fprintf(&b, "allowed-ips=%s;\n", strings.Join(wg.Peer.AllowedIPs, ";"))
+
+	addr4, addr6 := splitByFamily(wg.Interface.Address)
+	dns4, dns6 := splitByFamily(wg.Interface.DNS)
+	for _, family := range []struct {
+		section   string
+		addresses []string
+		dns       []string
+	}{{"ipv4", addr4, dns4}, {"ipv6", addr6, dns6}} {
+		fmt.Fprintf(&b, "\n[%s]\n", family.section)
+		if len(family.addresses) == 0 {
+			b.WriteString("method=disabled\n")
+			continue
+		}
+		for i, a := range family.addresses {
+			fmt.Fprintf(&b, "address%d=%s\n", i+1, a)
+		}
+		if len(family.dns) > 0 {
+			fmt.Fprintf(&b, "dns=%s;\n", strings.Join(family.dns, ";"))
+			// Route all lookups through the tunnel's resolvers
+			b.WriteString("dns-search=~.;\n")
+		}
+		b.WriteString("method=manual\n")
+	}
+
+	return b.Bytes(), nil
+}
+
+// renderNetworkdNetdev produces the .netdev half of a systemd-networkd
+// tunnel. Routes for AllowedIPs go to their own table so that a full tunnel
+// does not swallow the traffic to the endpoint itself.
+func renderNetworkdNetdev(config *VPNConfig) ([]byte, error) {
+	wg, err := wireGuardSection(config)
+	if err != nil {
+		return nil, err
+	}
+
+	var b bytes.Buffer
+	b.WriteString("[NetDev]\n")
+	fmt.Fprintf(&b, "Name=%s\n", tunnelInterfaceName)
+	b.WriteString("Kind=wireguard\n")
+	fmt.Fprintf(&b, "Description=Soltar environment %s, peer %s\n", config.EnvironmentID, config.Peer)
+
+	b.WriteString("\n[WireGuard]\n")
+	if wg.Interface.PrivateKey != "" {
+		fmt.Fprintf(&b, "PrivateKey=%s\n", wg.Interface.PrivateKey)
+	} else {
+		fmt.Fprintf(&b, "PrivateKeyFile=/etc/systemd/network/%s.key\n", tunnelInterfaceName)
+	}
+	fmt.Fprintf(&b, "FirewallMark=0x%x\n", tunnelFwMark)
+	fmt.Fprintf(&b, "RouteTable=%d\n", tunnelRouteTable)
+
+	b.WriteString("\n[WireGuardPeer]\n")
+	fmt.Fprintf(&b, "PublicKey=%s\n", wg.Peer.PublicKey)
+	fmt.Fprintf(&b, "PresharedKey=%s\n", wg.Peer.PresharedKey)
+	fmt.Fprintf(&b, "Endpoint=%s\n", wg.Peer.Endpoint)
+	fmt.Fprintf(&b, "AllowedIPs=%s\n", strings.Join(wg.Peer.AllowedIPs, ","))
+	if wg.Peer.PersistentKeepalive > 0 {
+		fmt.Fprintf(&b, "PersistentKeepalive=%d\n", wg.Peer.PersistentKeepalive)
+	}
+	return b.Bytes(), nil
+}
+
+// renderNetworkdNetwork produces the .network half matching
+// renderNetworkdNetdev
+func renderNetworkdNetwork(config *VPNConfig) ([]byte, error) {
+	wg, err := wireGuardSection(config)
+	if err != nil {
+		return nil, err
+	}
+
+	var b bytes.Buffer
+	b.WriteString("[Match]\n")
+	fmt.Fprintf(&b, "Name=%s\n", tunnelInterfaceName)
+
+	b.WriteString("\n[Network]\n")
+	for _, a := range wg.Interface.Address {
+		fmt.Fprintf(&b, "Address=%s\n", a)
+	}
+	for _, d := range wg.Interface.DNS {
+		fmt.Fprintf(&b, "DNS=%s\n", d)
+	}
+	if len(wg.Interface.DNS) > 0 {
+		b.WriteString("Domains=~.\n")
+	}
+
+	// Everything not marked by the tunnel itself uses the tunnel table,
+	// unless the main table has a more specific route
+	b.WriteString("\n[RoutingPolicyRule]\n")
+	fmt.Fprintf(&b, "FirewallMark=0x%x\n", tunnelFwMark)
+	b.WriteString("InvertRule=true\n")
+	fmt.Fprintf(&b, "Table=%d\n", tunnelRouteTable)
+	b.WriteString("Priority=10\n")
+	b.WriteString("Family=both\n")
+
+	b.WriteString("\n[RoutingPolicyRule]\n")
+	b.WriteString("Table=main\n")
+	b.WriteString("SuppressPrefixLength=0\n")
+	b.WriteString("Priority=9\n")
+	b.WriteString("Family=both\n")
+	return b.Bytes(), nil
+}
+
+// renderOpenVPNConfig produces a client profile for servers that also run
+// OpenVPN. It needs the server CA from OPENVPN_CA_FILE. The worker does not
+// check OpenVPN credentials, so the profile asks for none; how clients are
+// authenticated is up to the OpenVPN server.
+func renderOpenVPNConfig(config *VPNConfig) ([]byte, error) {
+	caFile := getEnv("OPENVPN_CA_FILE", "")
+	if caFile == "" {
+		return nil, fmt.Errorf("OpenVPN is not enabled on this server")
+	}
+	ca, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read OpenVPN CA: %v", err)
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "# Soltar environment %s, peer %s\n", config.EnvironmentID, config.Peer)
+	b.WriteString("client\n")
+	b.WriteString("dev tun\n")
+	fmt.Fprintf(&b, "proto %s\n", getEnv("OPENVPN_PROTO", "udp"))
+	fmt.Fprintf(&b, "remote %s %s\n", config.Server, getEnv("OPENVPN_PORT", "1194"))
+	b.WriteString("resolv-retry infinite\n")
+	b.WriteString("nobind\n")
+	b.WriteString("persist-key\n")
+	b.WriteString("persist-tun\n")
+	b.WriteString("remote-cert-tls server\n")
+	if config.WireGuard != nil {
+		for _, d := range config.WireGuard.Interface.DNS {
+			fmt.Fprintf(&b, "dhcp-option DNS %s\n", d)
+		}
+	}
+	b.WriteString("verb 3\n")
+	b.WriteString("<ca>\n")
+	b.Write(bytes.TrimSpace(ca))
+	b.WriteString("\n</ca>\n")
+	return b.Bytes(), nil
+}
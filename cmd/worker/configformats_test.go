@@ -0,0 +1,130 @@
+package main
+
+import (
+	"flag"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite golden files in testdata")
+
+// goldenConfigs are fixed inputs for the renderers: one peer with a
+// server-generated key pair and one that brought its own public key
+func goldenConfigs() map[string]*VPNConfig {
+	wg := func(privateKey string) *WireGuardConfig {
+		return &WireGuardConfig{
+			Interface: WireGuardInterface{
+				PrivateKey: privateKey,
+				Address:    []string{"10.13.0.2/32", "fd13:5017::2/128"},
+				DNS:        []string{"1.1.1.1", "2606:4700:4700::1111"},
+			},
+			Peer: WireGuardPeer{
+				PublicKey:           "hSDwCYkwp1R0i33ctD73Wg2/Og0mOBr066SpjqqbTmo=",
+				PresharedKey:        "FpCyhws9cxwWoV4xELtfJvjJN+zQVRPISllRWgeopVE=",
+				Endpoint:            "vpn.soltar.com:51820",
+				AllowedIPs:          []string{"0.0.0.0/0", "::/0"},
+				PersistentKeepalive: 25,
+			},
+		}
+	}
+
+	base := VPNConfig{
+		Server:        "vpn.soltar.com",
+		Port:          51820,
+		Token:         "token",
+		EnvironmentID: "6f1c2a4e-9b7d-4c1e-8a53-0d2f7e9b1c44",
+	}
+
+	generated, supplied := base, base
+	generated.Peer = "default"
+	generated.WireGuard = wg("yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=")
+	supplied.Peer = "phone"
+	supplied.WireGuard = wg("")
+
+	return map[string]*VPNConfig{"generated": &generated, "supplied": &supplied}
+}
+
+func TestConfigFormatsGolden(t *testing.T) {
+	t.Setenv("OPENVPN_CA_FILE", filepath.Join("testdata", "config", "ca.pem"))
+
+	for fixture, config := range goldenConfigs() {
+		for name, format := range configFormats {
+			t.Run(fixture+"/"+name, func(t *testing.T) {
+				got, err := format.Render(config)
+				if err != nil {
+					t.Fatalf("Render failed: %v", err)
+				}
+
+				path := filepath.Join("testdata", "config", fixture+"."+name+".golden")
+				if *updateGolden {
+					if err := os.WriteFile(path, got, 0644); err != nil {
+						t.Fatalf("Failed to update golden file: %v", err)
+					}
+				}
+
+				want, err := os.ReadFile(path)
+				if err != nil {
+					t.Fatalf("Missing golden file (run go test -update): %v", err)
+				}
+				if string(got) != string(want) {
+					t.Errorf("%s differs from golden file:\n--- got\n%s\n--- want\n%s", name, got, want)
+				}
+			})
+		}
+	}
+}
+
+func TestOpenVPNRequiresCA(t *testing.T) {
+	t.Setenv("OPENVPN_CA_FILE", "")
+	if _, err := renderOpenVPNConfig(goldenConfigs()["generated"]); err == nil {
+		t.Error("Expected OpenVPN export to fail without a CA")
+	}
+}
+
+func TestHandleConfigFormats(t *testing.T) {
+	storage = NewMockStorage()
+	auth := loginForTest(t, "test@example.com", "")
+
+	tests := []struct {
+		format      string
+		status      int
+		contentType string
+		filename    string
+	}{
+		{"wg-quick", http.StatusOK, "text/plain; charset=utf-8", "soltar.conf"},
+		{"networkmanager", http.StatusOK, "text/plain; charset=utf-8", "soltar.nmconnection"},
+		{"networkd-netdev", http.StatusOK, "text/plain; charset=utf-8", "soltar.netdev"},
+		{"networkd-network", http.StatusOK, "text/plain; charset=utf-8", "soltar.network"},
+		{"json", http.StatusOK, "application/json", "soltar.json"},
+		{"openvpn", http.StatusNotImplemented, "", ""},
+		{"pptp", http.StatusBadRequest, "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			w := requestForTest("GET", "/config?format="+tt.format, auth.Token, nil)
+
+			if w.Code != tt.status {
+				t.Fatalf("Expected %d, got %d: %s", tt.status, w.Code, w.Body.String())
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			if got := w.Header().Get("Content-Type"); got != tt.contentType {
+				t.Errorf("Expected Content-Type %q, got %q", tt.contentType, got)
+			}
+			if got := w.Header().Get("Content-Disposition"); !strings.Contains(got, `filename="`+tt.filename+`"`) {
+				t.Errorf("Expected attachment %s, got %q", tt.filename, got)
+			}
+		})
+	}
+
+	// Without ?format= the JSON document is served inline as before
+	w := requestForTest("GET", "/config", auth.Token, nil)
+	if w.Header().Get("Content-Disposition") != "" || w.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("Expected inline JSON, got headers %v", w.Header())
+	}
+}
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// DockerProvisioner runs each environment on the local Docker daemon through
+// the docker CLI: a network per environment holding a WireGuard container and
+// a Redis container, plus one container (or, for storage, a volume) per
+// requested infrastructure resource. Everything it creates is labelled with
+// the environment ID and the resource's spec, so Status and Destroy work from
+// what Docker reports and a changed spec recreates the container. The VPN
+// container gets the server's wg-quick file in SOLTAR_WG_CONFIG and is
+// labelled with its hash, so changed peers recreate it on the same port.
+type DockerProvisioner struct {
+	Binary string
+	// Host is the address clients reach published container ports on
+	Host          string
+	VPNImage      string
+	RedisImage    string
+	PostgresImage string
+	LBImage       string
+
+	// run executes the docker CLI and returns its stdout; nil uses Binary
+	run func(ctx context.Context, args ...string) (string, error)
+}
+
+// Roles of the containers and volumes of an environment. The infrastructure
+// roles are the resource kinds.
+const (
+	dockerRoleVPN          = "vpn"
+	dockerRoleRedis        = "redis"
+	dockerRoleVPNInstance  = ResourceVPNInstance
+	dockerRoleLoadBalancer = ResourceLoadBalancer
+	dockerRoleDatabase     = ResourceDatabase
+	dockerRoleStorage      = ResourceStorage
+)
+
+// wireGuardContainerPort is the port the VPN image listens on
+const wireGuardContainerPort = "51820/udp"
+
+// dockerNamePattern limits resource IDs to what Docker accepts in names
+var dockerNamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]{0,62}$`)
+
+// dockerResource is a container or volume labelled with an environment
+type dockerResource struct {
+	name   string
+	role   string
+	id     string
+	spec   string
+	volume bool
+	// config is the hash of the VPN container's WireGuard config
+	config string
+}
+
+// dockerListFormat prints the name and labels of a container or volume; the
+// name field differs between the two
+const dockerListFormat = "\t{{.Label \"soltar.role\"}}\t{{.Label \"soltar.resource\"}}\t{{.Label \"soltar.spec\"}}\t{{.Label \"soltar.config\"}}"
+
+func (d *DockerProvisioner) docker(ctx context.Context, args ...string) (string, error) {
+	if d.run != nil {
+		return d.run(ctx, args...)
+	}
+
+	cmd := exec.CommandContext(ctx, d.Binary, args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("docker %s: %v: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return string(out), nil
+}
+
+func dockerNetworkName(environmentID string) string {
+	return "soltar-" + shortID(environmentID)
+}
+
+func environmentLabel(environmentID string) string {
+	return "soltar.environment=" + environmentID
+}
+
+// observe lists the network, containers and volumes of an environment
+func (d *DockerProvisioner) observe(ctx context.Context, environmentID string) (bool, []dockerResource, error) {
+	filter := "label=" + environmentLabel(environmentID)
+
+	networks, err := d.docker(ctx, "network", "ls", "--filter", filter, "--format", "{{.Name}}")
+	if err != nil {
+		return false, nil, err
+	}
+	containers, err := d.docker(ctx, "ps", "-a", "--filter", filter, "--format", "{{.Names}}"+dockerListFormat)
+	if err != nil {
+		return false, nil, err
+	}
+	volumes, err := d.docker(ctx, "volume", "ls", "--filter", filter, "--format", "{{.Name}}"+dockerListFormat)
+	if err != nil {
+		return false, nil, err
+	}
+
+	resources := append(parseDockerResources(containers, false), parseDockerResources(volumes, true)...)
+	return strings.TrimSpace(networks) != "", resources, nil
+}
+
+func parseDockerResources(out string, volume bool) []dockerResource {
+	var resources []dockerResource
+	// An empty spec label leaves a trailing tab, so only newlines are trimmed
+	for _, line := range strings.Split(strings.Trim(out, "\r\n"), "\n") {
+		fields := strings.Split(strings.TrimRight(line, "\r"), "\t")
+		if len(fields) != 5 {
+			continue
+		}
+		resources = append(resources, dockerResource{name: fields[0], role: fields[1], id: fields[2], spec: fields[3], config: fields[4], volume: volume})
+	}
+	return resources
+}
+
+func (d *DockerProvisioner) Create(ctx context.Context, spec ProvisionSpec) (*Provisioned, error) {
+	return d.converge(ctx, spec, false)
+}
+
+func (d *DockerProvisioner) Update(ctx context.Context, spec ProvisionSpec) (*Provisioned, error) {
+	return d.converge(ctx, spec, true)
+}
+
+// converge creates whatever of the environment and its requested
+// infrastructure is missing, recreates containers whose spec changed and
+// removes resources no longer requested
+func (d *DockerProvisioner) converge(ctx context.Context, spec ProvisionSpec, mustExist bool) (*Provisioned, error) {
+	desired, err := desiredDockerResources(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	hasNetwork, observed, err := d.observe(ctx, spec.EnvironmentID)
+	if err != nil {
+		return nil, err
+	}
+	if mustExist && !hasNetwork {
+		return nil, ErrNotProvisioned
+	}
+
+	network := dockerNetworkName(spec.EnvironmentID)
+	if !hasNetwork {
+		if _, err := d.docker(ctx, "network", "create", "--label", environmentLabel(spec.EnvironmentID), network); err != nil {
+			return nil, err
+		}
+	}
+
+	existing := make(map[string]dockerResource, len(observed))
+	for _, r := range observed {
+		existing[r.role+"/"+r.id] = r
+	}
+	wanted := make(map[string]bool, len(desired))
+	for _, r := range desired {
+		wanted[r.role+"/"+r.id] = true
+		hostPort := ""
+		if current, ok := existing[r.role+"/"+r.id]; ok {
+			// Volumes keep their data; only containers are replaced
+			if (current.spec == r.spec && current.config == r.config) || r.volume {
+				continue
+			}
+			// A replaced VPN server keeps its port, so clients' endpoints
+			// stay valid
+			if r.role == dockerRoleVPN {
+				if port, err := d.publishedPort(ctx, current.name); err == nil {
+					hostPort = strconv.Itoa(port)
+				}
+			}
+			if err := d.removeResource(ctx, current); err != nil {
+				return nil, err
+			}
+		}
+		if err := d.createResource(ctx, spec, network, r, hostPort); err != nil {
+			return nil, err
+		}
+	}
+	for _, r := range observed {
+		if wanted[r.role+"/"+r.id] {
+			continue
+		}
+		if err := d.removeResource(ctx, r); err != nil {
+			return nil, err
+		}
+	}
+
+	return d.Status(ctx, spec.EnvironmentID)
+}
+
+// desiredDockerResources lists the environment's own containers followed by
+// one resource per requested infrastructure resource
+func desiredDockerResources(spec ProvisionSpec) ([]dockerResource, error) {
+	short := shortID(spec.EnvironmentID)
+	resources := []dockerResource{
+		{name: fmt.Sprintf("soltar-%s-vpn", short), role: dockerRoleVPN, id: "vpn-" + short, config: wireGuardConfigHash(spec.WireGuard)},
+		{name: fmt.Sprintf("soltar-%s-redis", short), role: dockerRoleRedis, id: "redis-" + short},
+	}
+
+	for _, role := range resourceKinds {
+		for _, r := range *resourceList(&spec.Infrastructure, role) {
+			if !dockerNamePattern.MatchString(r.ID) {
+				return nil, fmt.Errorf("invalid %s ID %q: use letters, digits, '.', '-' or '_'", role, r.ID)
+			}
+			var compact bytes.Buffer
+			if len(r.Spec) > 0 {
+				if err := json.Compact(&compact, r.Spec); err != nil {
+					return nil, fmt.Errorf("invalid spec of %s %s: %v", role, r.ID, err)
+				}
+			}
+			resources = append(resources, dockerResource{
+				name:   fmt.Sprintf("soltar-%s-%s-%s", short, strings.ReplaceAll(role, "_", "-"), r.ID),
+				role:   role,
+				id:     r.ID,
+				spec:   compact.String(),
+				volume: role == dockerRoleStorage,
+			})
+		}
+	}
+	return resources, nil
+}
+
+// wireGuardConfigHash identifies a VPN server's WireGuard config without
+// revealing its keys in a label
+func wireGuardConfigHash(wg *ServerWireGuard) string {
+	if wg == nil {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(renderServerWgQuickConfig(wg)))
+	return hex.EncodeToString(sum[:8])
+}
+
+// createResource creates r; a VPN container is published on hostPort if
+// given, or on a port Docker picks
+func (d *DockerProvisioner) createResource(ctx context.Context, spec ProvisionSpec, network string, r dockerResource, hostPort string) error {
+	labels := []string{
+		"--label", environmentLabel(spec.EnvironmentID),
+		"--label", "soltar.role=" + r.role,
+		"--label", "soltar.resource=" + r.id,
+		"--label", "soltar.spec=" + r.spec,
+	}
+	if r.config != "" {
+		labels = append(labels, "--label", "soltar.config="+r.config)
+	}
+
+	if r.volume {
+		_, err := d.docker(ctx, append(append([]string{"volume", "create"}, labels...), r.name)...)
+		return err
+	}
+
+	args := append([]string{"run", "-d", "--name", r.name, "--network", network, "--restart", "unless-stopped"}, labels...)
+	switch r.role {
+	case dockerRoleVPN:
+		if spec.WireGuard == nil {
+			return fmt.Errorf("no WireGuard config for the VPN server of %s", spec.EnvironmentID)
+		}
+		publish := wireGuardContainerPort
+		if hostPort != "" {
+			publish = hostPort + ":" + wireGuardContainerPort
+		}
+		args = append(args, "--cap-add", "NET_ADMIN", "-p", publish,
+			"-e", "SOLTAR_ENVIRONMENT_ID="+spec.EnvironmentID,
+			"-e", "SOLTAR_WG_CONFIG="+renderServerWgQuickConfig(spec.WireGuard),
+			d.VPNImage)
+	case dockerRoleVPNInstance:
+		args = append(args, "--cap-add", "NET_ADMIN", "-p", wireGuardContainerPort, "-e", "SOLTAR_ENVIRONMENT_ID="+spec.EnvironmentID, d.VPNImage)
+	case dockerRoleLoadBalancer:
+		args = append(args, "-p", "80/tcp", d.LBImage)
+	case dockerRoleDatabase:
+		var db DatabaseSpec
+		if r.spec != "" {
+			if err := json.Unmarshal([]byte(r.spec), &db); err != nil {
+				return fmt.Errorf("invalid spec of database %s: %v", r.id, err)
+			}
+		}
+		if db.Engine == "postgres" {
+			password := spec.DatabasePasswords[r.id]
+			if password == "" {
+				return fmt.Errorf("no password for database %s", r.id)
+			}
+			args = append(args, "-e", "POSTGRES_PASSWORD="+password, withImageTag(d.PostgresImage, db.Version))
+		} else {
+			args = append(args, withImageTag(d.RedisImage, db.Version))
+		}
+	default:
+		args = append(args, d.RedisImage)
+	}
+	_, err := d.docker(ctx, args...)
+	return err
+}
+
+// withImageTag replaces the tag of image with version, if one is given
+func withImageTag(image, version string) string {
+	if version == "" {
+		return image
+	}
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		image = image[:i]
+	}
+	return image + ":" + version
+}
+
+func (d *DockerProvisioner) removeResource(ctx context.Context, r dockerResource) error {
+	if r.volume {
+		_, err := d.docker(ctx, "volume", "rm", r.name)
+		return err
+	}
+	_, err := d.docker(ctx, "rm", "-f", r.name)
+	return err
+}
+
+func (d *DockerProvisioner) Destroy(ctx context.Context, environmentID string) error {
+	hasNetwork, observed, err := d.observe(ctx, environmentID)
+	if err != nil {
+		return err
+	}
+
+	// Containers go first; their volumes and network stay busy until then
+	for _, volumes := range []bool{false, true} {
+		for _, r := range observed {
+			if r.volume != volumes {
+				continue
+			}
+			if err := d.removeResource(ctx, r); err != nil {
+				return err
+			}
+		}
+	}
+	if hasNetwork {
+		if _, err := d.docker(ctx, "network", "rm", dockerNetworkName(environmentID)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *DockerProvisioner) Status(ctx context.Context, environmentID string) (*Provisioned, error) {
+	hasNetwork, observed, err := d.observe(ctx, environmentID)
+	if err != nil {
+		return nil, err
+	}
+	if !hasNetwork && len(observed) == 0 {
+		return nil, ErrNotProvisioned
+	}
+
+	p := &Provisioned{
+		VPNServer: d.Host,
+		Instances: []Resource{},
+		Databases: []Resource{},
+		Storage:   []Resource{},
+		Infrastructure: Infrastructure{
+			VPNInstances:  []Resource{},
+			LoadBalancers: []Resource{},
+			Databases:     []Resource{},
+			Storage:       []Resource{},
+		},
+	}
+	for _, r := range observed {
+		resource := Resource{ID: r.id, Kind: r.role}
+		if r.spec != "" {
+			resource.Spec = json.RawMessage(r.spec)
+		}
+		switch r.role {
+		case dockerRoleVPN:
+			resource.Kind = ResourceInstance
+			p.Instances = append(p.Instances, resource)
+			port, err := d.publishedPort(ctx, r.name)
+			if err != nil {
+				return nil, err
+			}
+			p.VPNPort = port
+		case dockerRoleRedis:
+			resource.Kind = ResourceDatabase
+			p.Databases = append(p.Databases, resource)
+		case dockerRoleVPNInstance, dockerRoleLoadBalancer, dockerRoleDatabase, dockerRoleStorage:
+			list := resourceList(&p.Infrastructure, r.role)
+			*list = append(*list, resource)
+		}
+	}
+	return p, nil
+}
+
+// publishedPort is the host port Docker mapped the WireGuard port to
+func (d *DockerProvisioner) publishedPort(ctx context.Context, container string) (int, error) {
+	out, err := d.docker(ctx, "port", container, wireGuardContainerPort)
+	if err != nil {
+		return 0, err
+	}
+
+	// One line per host address, e.g. "0.0.0.0:49153" and "[::]:49153"
+	line := strings.TrimSpace(strings.SplitN(strings.TrimSpace(out), "\n", 2)[0])
+	_, port, err := net.SplitHostPort(line)
+	if err != nil {
+		return 0, fmt.Errorf("unexpected docker port output %q", out)
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil {
+		return 0, fmt.Errorf("unexpected docker port output %q", out)
+	}
+	return n, nil
+}
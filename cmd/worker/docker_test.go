@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// fakeDocker emulates the handful of docker CLI commands the provisioner uses
+type fakeDocker struct {
+	networks   map[string]string // name → environment label
+	containers map[string][5]string
+	volumes    map[string][5]string
+	commands   []string
+	last       []string // the last docker run
+}
+
+func newFakeDocker() *fakeDocker {
+	return &fakeDocker{
+		networks:   map[string]string{},
+		containers: map[string][5]string{},
+		volumes:    map[string][5]string{},
+	}
+}
+
+// labels extracts the environment, role, resource, spec and config labels
+// from args
+func (f *fakeDocker) labels(args []string) [5]string {
+	var l [5]string
+	for i, arg := range args {
+		if arg != "--label" || i+1 == len(args) {
+			continue
+		}
+		key, value, _ := strings.Cut(args[i+1], "=")
+		switch key {
+		case "soltar.environment":
+			l[0] = value
+		case "soltar.role":
+			l[1] = value
+		case "soltar.resource":
+			l[2] = value
+		case "soltar.spec":
+			l[3] = value
+		case "soltar.config":
+			l[4] = value
+		}
+	}
+	return l
+}
+
+func (f *fakeDocker) run(ctx context.Context, args ...string) (string, error) {
+	f.commands = append(f.commands, strings.Join(args[:2], " "))
+	last := args[len(args)-1]
+
+	list := func(items map[string][5]string, environment string) string {
+		var lines []string
+		for name, l := range items {
+			if l[0] == environment {
+				lines = append(lines, fmt.Sprintf("%s\t%s\t%s\t%s\t%s", name, l[1], l[2], l[3], l[4]))
+			}
+		}
+		sort.Strings(lines)
+		return strings.Join(lines, "\n")
+	}
+	environmentFilter := func() string {
+		for i, arg := range args {
+			if arg == "--filter" {
+				return strings.TrimPrefix(args[i+1], "label=soltar.environment=")
+			}
+		}
+		return ""
+	}
+
+	switch strings.Join(args[:2], " ") {
+	case "network ls":
+		for name, env := range f.networks {
+			if env == environmentFilter() {
+				return name + "\n", nil
+			}
+		}
+		return "", nil
+	case "network create":
+		f.networks[last] = f.labels(args)[0]
+	case "network rm":
+		delete(f.networks, last)
+	case "ps -a":
+		return list(f.containers, environmentFilter()), nil
+	case "volume ls":
+		return list(f.volumes, environmentFilter()), nil
+	case "volume create":
+		f.volumes[last] = f.labels(args)
+	case "volume rm":
+		delete(f.volumes, last)
+	case "rm -f":
+		delete(f.containers, last)
+	case "port " + args[1]:
+		return "0.0.0.0:49153\n[::]:49153\n", nil
+	default:
+		if args[0] != "run" {
+			return "", fmt.Errorf("unexpected docker %s", strings.Join(args, " "))
+		}
+		f.last = args
+		for i, arg := range args {
+			if arg == "--name" {
+				f.containers[args[i+1]] = f.labels(args)
+			}
+		}
+	}
+	return "", nil
+}
+
+func TestDockerProvisionerLifecycle(t *testing.T) {
+	fake := newFakeDocker()
+	d := &DockerProvisioner{Host: "vpn.example.net", VPNImage: "wg", RedisImage: "redis:7-alpine", PostgresImage: "postgres:16-alpine", LBImage: "nginx", run: fake.run}
+	ctx := context.Background()
+	spec := ProvisionSpec{
+		EnvironmentID:     "0123456789abcdef",
+		ClientID:          "client",
+		Infrastructure:    Infrastructure{Databases: []Resource{{ID: "pg-main"}}, Storage: []Resource{{ID: "backups"}}},
+		WireGuard:         &ServerWireGuard{PrivateKey: "server-private", ListenPort: wireGuardListenPort},
+		DatabasePasswords: map[string]string{"pg-main": "s3cret"},
+	}
+
+	if _, err := d.Update(ctx, spec); err != ErrNotProvisioned {
+		t.Fatalf("Expected updating an unknown environment to fail with ErrNotProvisioned, got %v", err)
+	}
+
+	p, err := d.Create(ctx, spec)
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if p.VPNServer != "vpn.example.net" || p.VPNPort != 49153 {
+		t.Errorf("Expected the published WireGuard port, got %s:%d", p.VPNServer, p.VPNPort)
+	}
+	if len(p.Instances) != 1 || len(p.Databases) != 1 {
+		t.Errorf("Expected the environment's VPN and Redis containers, got %+v", p)
+	}
+	if len(p.Infrastructure.Databases) != 1 || len(p.Infrastructure.Storage) != 1 {
+		t.Errorf("Expected the requested database and volume, got %+v", p.Infrastructure)
+	}
+	if _, ok := fake.volumes["soltar-01234567-storage-backups"]; !ok {
+		t.Errorf("Expected storage to be a volume, got %v", fake.volumes)
+	}
+
+	// Creating again only fills in what is missing
+	fake.commands = nil
+	if _, err := d.Create(ctx, spec); err != nil {
+		t.Fatalf("Repeated Create failed: %v", err)
+	}
+	for _, cmd := range fake.commands {
+		if strings.HasPrefix(cmd, "run ") || strings.HasSuffix(cmd, " create") {
+			t.Errorf("Expected no new resources on a repeated Create, got %s", cmd)
+		}
+	}
+
+	// A changed spec replaces the container
+	spec.Infrastructure.Databases[0].Spec = json.RawMessage(`{"engine":"postgres","version":"15"}`)
+	fake.commands = nil
+	p, err = d.Update(ctx, spec)
+	if err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+	if got := strings.Join(fake.commands, ","); !strings.Contains(got, "rm -f,run -d") {
+		t.Errorf("Expected the database to be recreated, got %s", got)
+	}
+	if image := fake.last[len(fake.last)-1]; image != "postgres:15" {
+		t.Errorf("Expected the postgres image at version 15, got %s", image)
+	}
+	if args := strings.Join(fake.last, " "); !strings.Contains(args, "-e POSTGRES_PASSWORD=s3cret") || strings.Contains(args, "trust") {
+		t.Errorf("Expected the database's password, got %s", args)
+	}
+	if db := p.Infrastructure.Databases; len(db) != 1 || !specEqual(db[0].Spec, spec.Infrastructure.Databases[0].Spec) {
+		t.Errorf("Expected the new spec to be reported, got %+v", db)
+	}
+
+	spec.Infrastructure = Infrastructure{LoadBalancers: []Resource{{ID: "edge"}}}
+	p, err = d.Update(ctx, spec)
+	if err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+	if len(p.Infrastructure.LoadBalancers) != 1 || len(p.Infrastructure.Databases) != 0 || len(p.Infrastructure.Storage) != 0 {
+		t.Errorf("Expected only the load balancer to remain requested, got %+v", p.Infrastructure)
+	}
+	if len(p.Instances) != 1 {
+		t.Error("Expected Update to keep the environment's own containers")
+	}
+
+	if err := d.Destroy(ctx, spec.EnvironmentID); err != nil {
+		t.Fatalf("Destroy failed: %v", err)
+	}
+	if len(fake.containers) != 0 || len(fake.volumes) != 0 || len(fake.networks) != 0 {
+		t.Errorf("Expected everything to be removed, got %+v", fake)
+	}
+	if _, err := d.Status(ctx, spec.EnvironmentID); err != ErrNotProvisioned {
+		t.Errorf("Expected ErrNotProvisioned after Destroy, got %v", err)
+	}
+}
+
+func TestDockerProvisionerWireGuard(t *testing.T) {
+	fake := newFakeDocker()
+	var runs [][]string
+	run := func(ctx context.Context, args ...string) (string, error) {
+		if args[0] == "run" {
+			runs = append(runs, args)
+		}
+		return fake.run(ctx, args...)
+	}
+	d := &DockerProvisioner{Host: "vpn.example.net", VPNImage: "wg", RedisImage: "redis", run: run}
+	ctx := context.Background()
+	spec := ProvisionSpec{
+		EnvironmentID: "0123456789abcdef",
+		WireGuard: &ServerWireGuard{
+			PrivateKey: "server-private",
+			Addresses:  []string{"10.13.0.1/24"},
+			ListenPort: wireGuardListenPort,
+			Peers:      []ServerPeer{{Name: "laptop", PublicKey: "laptop-public", PresharedKey: "laptop-psk", AllowedIPs: []string{"10.13.0.2/32"}}},
+		},
+	}
+	vpnRun := func() string {
+		for i := len(runs) - 1; i >= 0; i-- {
+			if args := strings.Join(runs[i], " "); strings.Contains(args, "soltar.role=vpn ") {
+				return args
+			}
+		}
+		return ""
+	}
+
+	if _, err := d.Create(ctx, spec); err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	args := vpnRun()
+	for _, want := range []string{"-e SOLTAR_WG_CONFIG=[Interface]\nPrivateKey = server-private\n", "Address = 10.13.0.1/24", "ListenPort = 51820", "PublicKey = laptop-public", "PresharedKey = laptop-psk", "AllowedIPs = 10.13.0.2/32"} {
+		if !strings.Contains(args, want) {
+			t.Errorf("Expected %q in the VPN container's run, got %s", want, args)
+		}
+	}
+	if strings.Contains(args, "soltar.config=server-private") {
+		t.Error("Expected the label to hold a hash, not the config")
+	}
+
+	// The same peers leave the container alone
+	runs = nil
+	if _, err := d.Update(ctx, spec); err != nil || len(runs) != 0 {
+		t.Errorf("Expected no container to be recreated, got %v, %v", runs, err)
+	}
+
+	// Changed peers recreate it on the port it had
+	spec.WireGuard.Peers = append(spec.WireGuard.Peers, ServerPeer{Name: "phone", PublicKey: "phone-public", PresharedKey: "phone-psk", AllowedIPs: []string{"10.13.0.3/32"}})
+	if _, err := d.Update(ctx, spec); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+	args = vpnRun()
+	if !strings.Contains(args, "PublicKey = phone-public") || !strings.Contains(args, "-p 49153:51820/udp") {
+		t.Errorf("Expected the new peer on the same port, got %s", args)
+	}
+
+	spec.WireGuard.Peers = spec.WireGuard.Peers[1:]
+	if _, err := d.Update(ctx, spec); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+	if args := vpnRun(); strings.Contains(args, "laptop-public") {
+		t.Errorf("Expected the removed peer to be gone, got %s", args)
+	}
+}
+
+func TestDockerProvisionerRejectsUnsafeIDs(t *testing.T) {
+	d := &DockerProvisioner{run: newFakeDocker().run}
+	spec := ProvisionSpec{EnvironmentID: "env", Infrastructure: Infrastructure{VPNInstances: []Resource{{ID: "--privileged"}}}}
+	if _, err := d.Create(context.Background(), spec); err == nil {
+		t.Error("Expected an ID that is not a valid Docker name to be refused")
+	}
+}
+
+func TestDockerProvisionerFromEnv(t *testing.T) {
+	t.Setenv("PROVISIONER", "docker")
+
+	p, err := newProvisionerFromEnv()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if d := p.(*DockerProvisioner); d.PostgresImage != "postgres:16-alpine" || d.RedisImage != "redis:7-alpine" {
+		t.Errorf("Expected the default database images, got %q and %q", d.PostgresImage, d.RedisImage)
+	}
+
+	t.Setenv("PROVISIONER_POSTGRES_IMAGE", "registry.example.com/postgres:15")
+	p, _ = newProvisionerFromEnv()
+	if d := p.(*DockerProvisioner); d.PostgresImage != "registry.example.com/postgres:15" {
+		t.Errorf("Expected PROVISIONER_POSTGRES_IMAGE to be used, got %q", d.PostgresImage)
+	}
+}
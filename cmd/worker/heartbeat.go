@@ -0,0 +1,296 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/glassrye/soltar"
+)
+
+type (
+	HeartbeatRequest  = soltar.HeartbeatRequest
+	HeartbeatResponse = soltar.HeartbeatResponse
+	DevicePresence    = soltar.DevicePresence
+	ClientPresence    = soltar.ClientPresence
+)
+
+const (
+	PresenceOnline  = soltar.PresenceOnline
+	PresenceOffline = soltar.PresenceOffline
+)
+
+var (
+	// heartbeatInterval is how often client daemons are asked to report
+	heartbeatInterval = 30 * time.Second
+	// heartbeatTimeout is how long a device stays online after its last
+	// heartbeat
+	heartbeatTimeout = 90 * time.Second
+)
+
+// heartbeatRetention is how long the last heartbeat of a silent device is kept
+const heartbeatRetention = 30 * 24 * time.Hour
+
+// Heartbeat is the last report of one device of a client
+type Heartbeat struct {
+	Device        string     `json:"device"`
+	Time          time.Time  `json:"time"`
+	IP            string     `json:"ip"`
+	TunnelUp      bool       `json:"tunnel_up"`
+	RxBytes       uint64     `json:"rx_bytes,omitempty"`
+	TxBytes       uint64     `json:"tx_bytes,omitempty"`
+	LastHandshake *time.Time `json:"last_handshake,omitempty"`
+	// Disconnected is set by the daemon's last heartbeat on a clean shutdown
+	Disconnected bool `json:"disconnected,omitempty"`
+}
+
+func heartbeatKey(clientID, device string) string {
+	return fmt.Sprintf("heartbeat:%s:%s", clientID, device)
+}
+
+// setupHeartbeat reads HEARTBEAT_INTERVAL and HEARTBEAT_TIMEOUT; the timeout
+// defaults to three missed heartbeats
+func setupHeartbeat() error {
+	interval, err := parseDurationEnv("HEARTBEAT_INTERVAL", heartbeatInterval)
+	if err != nil {
+		return err
+	}
+	timeout, err := parseDurationEnv("HEARTBEAT_TIMEOUT", 3*interval)
+	if err != nil {
+		return err
+	}
+	if interval < time.Second || timeout <= interval {
+		return fmt.Errorf("HEARTBEAT_TIMEOUT (%s) must exceed HEARTBEAT_INTERVAL (%s), which must be at least 1s", timeout, interval)
+	}
+	heartbeatInterval, heartbeatTimeout = interval, timeout
+	return nil
+}
+
+// online reports whether the device is online at now
+func (h Heartbeat) online(now time.Time) bool {
+	return !h.Disconnected && now.Sub(h.Time) < heartbeatTimeout
+}
+
+func (h Heartbeat) presence(now time.Time) DevicePresence {
+	state := PresenceOffline
+	if h.online(now) {
+		state = PresenceOnline
+	}
+	return DevicePresence{
+		Device:        h.Device,
+		State:         state,
+		LastHeartbeat: h.Time,
+		IP:            h.IP,
+		TunnelUp:      h.TunnelUp,
+		RxBytes:       h.RxBytes,
+		TxBytes:       h.TxBytes,
+		LastHandshake: h.LastHandshake,
+	}
+}
+
+func handleHeartbeat(w http.ResponseWriter, r *http.Request) {
+	claims, ok := authenticateClient(w, r)
+	if !ok {
+		return
+	}
+
+	var req HeartbeatRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if req.Device == "" {
+		req.Device = defaultPeerName
+	}
+	if !peerNamePattern.MatchString(req.Device) {
+		http.Error(w, "Device names are 1-32 letters, digits, '-' or '_'", http.StatusBadRequest)
+		return
+	}
+	// Only the client's own devices are tracked, so heartbeats cannot fill
+	// storage with made-up names
+	if req.Device != defaultPeerName {
+		peers, err := loadPeers(claims.Subject)
+		if err != nil {
+			log.Printf("Failed to load peers of %s: %v", claims.Subject, err)
+			http.Error(w, "Failed to record heartbeat", http.StatusInternalServerError)
+			return
+		}
+		if _, ok := peers[req.Device]; !ok {
+			http.Error(w, "Device is not a registered peer", http.StatusNotFound)
+			return
+		}
+	}
+
+	now := time.Now()
+	heartbeat := Heartbeat{
+		Device:        req.Device,
+		Time:          now,
+		IP:            clientIP(r),
+		TunnelUp:      req.TunnelUp,
+		RxBytes:       req.RxBytes,
+		TxBytes:       req.TxBytes,
+		LastHandshake: req.LastHandshake,
+		Disconnected:  req.Disconnect,
+	}
+
+	key := heartbeatKey(claims.Subject, req.Device)
+	var previous *Heartbeat
+	if data, err := storage.Get(key); err == nil {
+		var h Heartbeat
+		if json.Unmarshal(data, &h) == nil {
+			previous = &h
+		}
+	}
+
+	data, err := json.Marshal(heartbeat)
+	if err != nil {
+		http.Error(w, "Failed to record heartbeat", http.StatusInternalServerError)
+		return
+	}
+	if err := storage.PutWithTTL(key, data, heartbeatRetention); err != nil {
+		log.Printf("Failed to record heartbeat of %s/%s: %v", claims.Subject, req.Device, err)
+		http.Error(w, "Failed to record heartbeat", http.StatusInternalServerError)
+		return
+	}
+
+	wasOnline := previous != nil && previous.online(now)
+	switch {
+	case req.Disconnect && wasOnline:
+		log.Printf("Client %s device %s went offline (disconnected)", claims.Subject, req.Device)
+	case !req.Disconnect && !wasOnline:
+		log.Printf("Client %s device %s came online from %s", claims.Subject, req.Device, heartbeat.IP)
+	}
+
+	if !req.Disconnect {
+		if err := updateClientLastSeen(claims.Subject); err != nil {
+			log.Printf("Failed to update last seen for %s: %v", claims.Subject, err)
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(HeartbeatResponse{
+		State:    heartbeat.presence(now).State,
+		Interval: int(heartbeatInterval / time.Second),
+		Timeout:  int(heartbeatTimeout / time.Second),
+	})
+}
+
+// clientPresence derives the presence of a client from the heartbeats of its
+// devices; it is online while any device is
+func clientPresence(clientID string, now time.Time) (ClientPresence, error) {
+	presence := ClientPresence{ClientID: clientID, State: PresenceOffline, Devices: []DevicePresence{}}
+
+	keys, err := scanAll(fmt.Sprintf("heartbeat:%s:", clientID))
+	if err != nil {
+		return presence, err
+	}
+	for _, key := range keys {
+		data, err := storage.Get(key)
+		if err != nil {
+			// Expired between the scan and the read
+			continue
+		}
+		var heartbeat Heartbeat
+		if err := json.Unmarshal(data, &heartbeat); err != nil {
+			log.Printf("Skipping unreadable heartbeat %s: %v", key, err)
+			continue
+		}
+
+		device := heartbeat.presence(now)
+		presence.Devices = append(presence.Devices, device)
+		if device.State == PresenceOnline {
+			presence.State = PresenceOnline
+		}
+		if presence.LastHeartbeat == nil || heartbeat.Time.After(*presence.LastHeartbeat) {
+			last := heartbeat.Time
+			presence.LastHeartbeat = &last
+		}
+	}
+
+	sort.Slice(presence.Devices, func(i, j int) bool {
+		return presence.Devices[i].Device < presence.Devices[j].Device
+	})
+	return presence, nil
+}
+
+func handlePresence(w http.ResponseWriter, r *http.Request) {
+	claims, ok := authenticateClient(w, r)
+	if !ok {
+		return
+	}
+
+	presence, err := clientPresence(claims.Subject, time.Now())
+	if err != nil {
+		log.Printf("Failed to read presence of %s: %v", claims.Subject, err)
+		http.Error(w, "Failed to read presence", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(presence)
+}
+
+func handleAdminPresence(w http.ResponseWriter, r *http.Request) {
+	keys, err := scanAll("heartbeat:")
+	if err != nil {
+		log.Printf("Failed to list heartbeats: %v", err)
+		http.Error(w, "Failed to list presence", http.StatusInternalServerError)
+		return
+	}
+
+	seen := map[string]bool{}
+	var clientIDs []string
+	for _, key := range keys {
+		parts := strings.Split(strings.TrimPrefix(key, "heartbeat:"), ":")
+		if len(parts) != 2 || seen[parts[0]] {
+			continue
+		}
+		seen[parts[0]] = true
+		clientIDs = append(clientIDs, parts[0])
+	}
+	sort.Strings(clientIDs)
+
+	now := time.Now()
+	clients := make([]ClientPresence, 0, len(clientIDs))
+	online := 0
+	for _, clientID := range clientIDs {
+		presence, err := clientPresence(clientID, now)
+		if err != nil {
+			log.Printf("Failed to read presence of %s: %v", clientID, err)
+			http.Error(w, "Failed to list presence", http.StatusInternalServerError)
+			return
+		}
+		if presence.State == PresenceOnline {
+			online++
+		}
+		clients = append(clients, presence)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"online":  online,
+		"offline": len(clients) - online,
+		"clients": clients,
+	})
+}
+
+func handleAdminClientPresence(w http.ResponseWriter, r *http.Request, clientID string) {
+	if getClientInfrastructure(clientID) == nil {
+		http.Error(w, "Client not found", http.StatusNotFound)
+		return
+	}
+
+	presence, err := clientPresence(clientID, time.Now())
+	if err != nil {
+		log.Printf("Failed to read presence of %s: %v", clientID, err)
+		http.Error(w, "Failed to read presence", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(presence)
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func heartbeatForTest(t *testing.T, token string, req HeartbeatRequest) HeartbeatResponse {
+	w := requestForTest("POST", "/heartbeat", token, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected heartbeat to succeed, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var resp HeartbeatResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	return resp
+}
+
+func presenceForTest(t *testing.T, token string) ClientPresence {
+	w := requestForTest("GET", "/presence", token, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected presence to succeed, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var presence ClientPresence
+	json.Unmarshal(w.Body.Bytes(), &presence)
+	return presence
+}
+
+func TestHeartbeatPresence(t *testing.T) {
+	storage = NewMockStorage()
+	clientData := getOrCreateClientWithInfrastructure("test@example.com")
+	token := generateToken(clientData.ID, "")
+	upsertPeer(clientData, "laptop", "")
+
+	if presence := presenceForTest(t, token); presence.State != PresenceOffline || len(presence.Devices) != 0 {
+		t.Errorf("Expected a client without heartbeats to be offline, got %+v", presence)
+	}
+
+	resp := heartbeatForTest(t, token, HeartbeatRequest{Device: "laptop", TunnelUp: true, RxBytes: 10})
+	if resp.State != PresenceOnline {
+		t.Errorf("Expected online, got %s", resp.State)
+	}
+	if resp.Interval != int(heartbeatInterval/time.Second) || resp.Timeout != int(heartbeatTimeout/time.Second) {
+		t.Errorf("Unexpected interval/timeout %d/%d", resp.Interval, resp.Timeout)
+	}
+	heartbeatForTest(t, token, HeartbeatRequest{})
+
+	presence := presenceForTest(t, token)
+	if presence.State != PresenceOnline || len(presence.Devices) != 2 || presence.LastHeartbeat == nil {
+		t.Fatalf("Expected two online devices, got %+v", presence)
+	}
+	if presence.Devices[0].Device != defaultPeerName || presence.Devices[1].Device != "laptop" {
+		t.Errorf("Expected devices sorted by name, got %+v", presence.Devices)
+	}
+	if !presence.Devices[1].TunnelUp || presence.Devices[1].RxBytes != 10 {
+		t.Errorf("Expected tunnel stats to be kept, got %+v", presence.Devices[1])
+	}
+
+	// A clean shutdown takes a device offline at once
+	if resp := heartbeatForTest(t, token, HeartbeatRequest{Device: "laptop", Disconnect: true}); resp.State != PresenceOffline {
+		t.Errorf("Expected offline after disconnect, got %s", resp.State)
+	}
+	heartbeatForTest(t, token, HeartbeatRequest{Disconnect: true})
+	if presence := presenceForTest(t, token); presence.State != PresenceOffline {
+		t.Errorf("Expected offline once every device disconnected, got %+v", presence)
+	}
+
+	// A deleted peer drops out of presence
+	if w := requestForTest("DELETE", "/config/peer/laptop", token, nil); w.Code != http.StatusOK {
+		t.Fatalf("Expected peer to be deleted, got %d", w.Code)
+	}
+	if presence := presenceForTest(t, token); len(presence.Devices) != 1 {
+		t.Errorf("Expected only the default device, got %+v", presence.Devices)
+	}
+}
+
+func TestHeartbeatTimeout(t *testing.T) {
+	storage = NewMockStorage()
+	clientData := getOrCreateClientWithInfrastructure("test@example.com")
+
+	stale, _ := json.Marshal(Heartbeat{Device: "laptop", Time: time.Now().Add(-heartbeatTimeout - time.Second)})
+	storage.Put(heartbeatKey(clientData.ID, "laptop"), stale)
+	fresh, _ := json.Marshal(Heartbeat{Device: "phone", Time: time.Now()})
+	storage.Put(heartbeatKey(clientData.ID, "phone"), fresh)
+
+	presence, err := clientPresence(clientData.ID, time.Now())
+	if err != nil {
+		t.Fatalf("clientPresence failed: %v", err)
+	}
+	if presence.State != PresenceOnline {
+		t.Errorf("Expected the client to be online while a device is, got %s", presence.State)
+	}
+	if presence.Devices[0].State != PresenceOffline || presence.Devices[1].State != PresenceOnline {
+		t.Errorf("Expected the silent device offline and the other online, got %+v", presence.Devices)
+	}
+
+	presence, _ = clientPresence(clientData.ID, time.Now().Add(heartbeatTimeout))
+	if presence.State != PresenceOffline {
+		t.Errorf("Expected offline after the timeout, got %s", presence.State)
+	}
+}
+
+func TestHeartbeatValidation(t *testing.T) {
+	storage = NewMockStorage()
+	clientData := getOrCreateClientWithInfrastructure("test@example.com")
+	token := generateToken(clientData.ID, "")
+
+	tests := []struct {
+		name       string
+		req        *http.Request
+		wantStatus int
+	}{
+		{"no token", createTestRequest("POST", "/heartbeat", HeartbeatRequest{}), http.StatusUnauthorized},
+		{"bad device", createAuthRequest("POST", "/heartbeat", token, HeartbeatRequest{Device: "a/b"}), http.StatusBadRequest},
+		{"unregistered device", createAuthRequest("POST", "/heartbeat", token, HeartbeatRequest{Device: "laptop"}), http.StatusNotFound},
+		{"presence without token", createTestRequest("GET", "/presence", nil), http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handleRequest(w, tt.req)
+			if w.Code != tt.wantStatus {
+				t.Errorf("Expected status %d, got %d", tt.wantStatus, w.Code)
+			}
+		})
+	}
+}
+
+func TestSetupHeartbeat(t *testing.T) {
+	defer func(interval, timeout time.Duration) {
+		heartbeatInterval, heartbeatTimeout = interval, timeout
+	}(heartbeatInterval, heartbeatTimeout)
+
+	t.Setenv("HEARTBEAT_INTERVAL", "10s")
+	if err := setupHeartbeat(); err != nil {
+		t.Fatalf("setupHeartbeat failed: %v", err)
+	}
+	if heartbeatInterval != 10*time.Second || heartbeatTimeout != 30*time.Second {
+		t.Errorf("Expected 10s/30s, got %s/%s", heartbeatInterval, heartbeatTimeout)
+	}
+
+	t.Setenv("HEARTBEAT_TIMEOUT", "5s")
+	if err := setupHeartbeat(); err == nil {
+		t.Error("Expected a timeout shorter than the interval to be rejected")
+	}
+}
+
+func TestAdminPresence(t *testing.T) {
+	storage = NewMockStorage()
+	useTestAdminKeys(t)
+	first := getOrCreateClientWithInfrastructure("a@example.com")
+	second := getOrCreateClientWithInfrastructure("b@example.com")
+	upsertPeer(first, "laptop", "")
+	heartbeatForTest(t, generateToken(first.ID, ""), HeartbeatRequest{Device: "laptop"})
+	heartbeatForTest(t, generateToken(second.ID, ""), HeartbeatRequest{Disconnect: true})
+
+	w := requestForTest("GET", "/admin/presence", "viewer-key", nil)
+
+	var resp struct {
+		Online  int              `json:"online"`
+		Offline int              `json:"offline"`
+		Clients []ClientPresence `json:"clients"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if w.Code != http.StatusOK || resp.Online != 1 || resp.Offline != 1 || len(resp.Clients) != 2 {
+		t.Errorf("Expected one online and one offline client, got %d: %s", w.Code, w.Body.String())
+	}
+
+	w = requestForTest("GET", "/admin/clients/"+first.ID+"/presence", "viewer-key", nil)
+
+	var presence ClientPresence
+	json.Unmarshal(w.Body.Bytes(), &presence)
+	if w.Code != http.StatusOK || presence.State != PresenceOnline {
+		t.Errorf("Expected the first client online, got %d: %s", w.Code, w.Body.String())
+	}
+
+	w = requestForTest("GET", "/admin/clients/nope/presence", "viewer-key", nil)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown client, got %d", w.Code)
+	}
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/glassrye/soltar"
+)
+
+type (
+	InfrastructureRevision        = soltar.InfrastructureRevision
+	ResourceChange                = soltar.ResourceChange
+	InfrastructureHistoryResponse = soltar.InfrastructureHistoryResponse
+)
+
+const (
+	ResourceAdded   = soltar.ResourceAdded
+	ResourceRemoved = soltar.ResourceRemoved
+	ResourceChanged = soltar.ResourceChanged
+
+	ErrCodeRevisionMismatch = soltar.ErrCodeRevisionMismatch
+)
+
+// Revision n of a client's infrastructure is stored under
+// infrastructure:revision:<id>:<n>, zero-padded so keys scan in order, and
+// written in the same transaction as the client record
+func infrastructureRevisionKey(clientID string, revision int64) string {
+	return fmt.Sprintf("%s%020d", infrastructureRevisionPrefix(clientID), revision)
+}
+
+func infrastructureRevisionPrefix(clientID string) string {
+	return fmt.Sprintf("infrastructure:revision:%s:", clientID)
+}
+
+// revisionMismatch is returned by writeInfrastructure when If-Match named
+// another revision than the current one
+type revisionMismatch struct {
+	current int64
+}
+
+func (e revisionMismatch) Error() string {
+	return fmt.Sprintf("Infrastructure is at revision %d", e.current)
+}
+
+// infrastructureWrite says who changes a client's infrastructure and what
+// the change was based on
+type infrastructureWrite struct {
+	author string
+	// ifMatch is the revision the change was made against; nil accepts any
+	ifMatch *int64
+	// rollbackOf is the revision a rollback restores
+	rollbackOf int64
+}
+
+// writeInfrastructure validates infrastructure and makes it the client's next
+// revision, appending that revision to the history in the same transaction. A
+// document that fails validation is refused with infrastructureInvalid, and
+// a stale If-Match with revisionMismatch.
+func writeInfrastructure(clientID string, infrastructure Infrastructure, write infrastructureWrite) (*InfrastructureRevision, error) {
+	return commitInfrastructure(clientID, write, func(Infrastructure) (Infrastructure, error) {
+		return infrastructure, nil
+	})
+}
+
+// commitInfrastructure is writeInfrastructure for a document derived from the
+// stored one. build runs inside the transaction, so it always sees the
+// current revision; an error from it refuses the write.
+func commitInfrastructure(clientID string, write infrastructureWrite, build func(current Infrastructure) (Infrastructure, error)) (*InfrastructureRevision, error) {
+	var revision *InfrastructureRevision
+	err := updateClientRecords(clientID, func(client *ClientData) (map[string][]byte, error) {
+		current := client.Infrastructure
+		if write.ifMatch != nil && *write.ifMatch != current.Generation {
+			return nil, revisionMismatch{current: current.Generation}
+		}
+
+		proposed, err := build(cloneInfrastructure(current))
+		if err != nil {
+			return nil, err
+		}
+		next := cloneInfrastructure(proposed)
+		if errs := validateInfrastructure(&next, current, client.Environment.Region); len(errs) > 0 {
+			return nil, infrastructureInvalid(errs)
+		}
+
+		now := time.Now()
+		stampResources(&next, current, now)
+		next.Generation = current.Generation + 1
+		next.Created = current.Created
+		next.LastUpdated = now
+		client.Infrastructure = next
+
+		revision = &InfrastructureRevision{
+			Revision:       next.Generation,
+			Author:         write.author,
+			Time:           now,
+			RollbackOf:     write.rollbackOf,
+			Diff:           diffRevisions(current, next),
+			Infrastructure: &next,
+		}
+		data, err := json.Marshal(revision)
+		if err != nil {
+			return nil, err
+		}
+		return map[string][]byte{infrastructureRevisionKey(clientID, next.Generation): data}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return revision, nil
+}
+
+// diffRevisions lists the resources added, changed and removed between two
+// revisions. Status and timestamps are not part of a change.
+func diffRevisions(before, after Infrastructure) []ResourceChange {
+	changes := []ResourceChange{}
+	for _, kind := range resourceKinds {
+		old := map[string]Resource{}
+		for _, r := range *resourceList(&before, kind) {
+			old[r.ID] = r
+		}
+		kept := map[string]bool{}
+		for _, r := range *resourceList(&after, kind) {
+			r := r
+			r.Status = ""
+			kept[r.ID] = true
+			previous, ok := old[r.ID]
+			switch {
+			case !ok:
+				changes = append(changes, ResourceChange{Op: ResourceAdded, Kind: kind, ID: r.ID, After: &r})
+			case !specEqual(previous.Spec, r.Spec) || previous.Region != r.Region:
+				previous.Status = ""
+				changes = append(changes, ResourceChange{Op: ResourceChanged, Kind: kind, ID: r.ID, Before: &previous, After: &r})
+			}
+		}
+		for _, r := range *resourceList(&before, kind) {
+			if !kept[r.ID] {
+				r := r
+				r.Status = ""
+				changes = append(changes, ResourceChange{Op: ResourceRemoved, Kind: kind, ID: r.ID, Before: &r})
+			}
+		}
+	}
+	return changes
+}
+
+// loadInfrastructureRevision reads revision n of a client, or nil if there is
+// none
+func loadInfrastructureRevision(clientID string, n int64) *InfrastructureRevision {
+	data, err := storage.Get(infrastructureRevisionKey(clientID, n))
+	if err != nil {
+		return nil
+	}
+	var revision InfrastructureRevision
+	if err := json.Unmarshal(data, &revision); err != nil {
+		log.Printf("Ignoring unreadable revision %d of %s: %v", n, clientID, err)
+		return nil
+	}
+	return &revision
+}
+
+// listInfrastructureRevisions returns a client's revisions, newest first,
+// without their documents
+func listInfrastructureRevisions(clientID string) ([]InfrastructureRevision, error) {
+	prefix := infrastructureRevisionPrefix(clientID)
+	keys, err := scanAll(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	revisions := make([]InfrastructureRevision, 0, len(keys))
+	for _, key := range keys {
+		n, err := strconv.ParseInt(strings.TrimPrefix(key, prefix), 10, 64)
+		if err != nil {
+			continue
+		}
+		if revision := loadInfrastructureRevision(clientID, n); revision != nil {
+			revision.Infrastructure = nil
+			revisions = append(revisions, *revision)
+		}
+	}
+	sort.Slice(revisions, func(i, j int) bool { return revisions[i].Revision > revisions[j].Revision })
+	return revisions, nil
+}
+
+// revisionETag is the entity tag of a revision, as sent in ETag and expected
+// in If-Match
+func revisionETag(revision int64) string {
+	return strconv.Quote(strconv.FormatInt(revision, 10))
+}
+
+// parseIfMatch reads the revision a write was made against from If-Match. It
+// returns nil if the header is absent or "*".
+func parseIfMatch(r *http.Request) (*int64, error) {
+	value := strings.TrimSpace(r.Header.Get("If-Match"))
+	if value == "" || value == "*" {
+		return nil, nil
+	}
+	revision, err := strconv.ParseInt(strings.Trim(strings.TrimPrefix(value, "W/"), `"`), 10, 64)
+	if err != nil || revision < 0 {
+		return nil, errors.New("If-Match must be a revision such as \"3\"")
+	}
+	return &revision, nil
+}
+
+// respondInfrastructureWrite answers a write made by writeInfrastructure and
+// starts reconciling the new revision
+func respondInfrastructureWrite(w http.ResponseWriter, clientID string, revision *InfrastructureRevision, err error, message string) {
+	var invalid infrastructureInvalid
+	var mismatch revisionMismatch
+	switch {
+	case errors.As(err, &invalid):
+		writeError(w, http.StatusUnprocessableEntity, ErrorResponse{
+			Error:   ErrCodeValidationFailed,
+			Message: invalid.Error(),
+			Fields:  invalid,
+		})
+		return
+	case errors.As(err, &mismatch):
+		w.Header().Set("ETag", revisionETag(mismatch.current))
+		writeError(w, http.StatusPreconditionFailed, ErrorResponse{
+			Error:   ErrCodeRevisionMismatch,
+			Message: mismatch.Error(),
+		})
+		return
+	case err != nil:
+		log.Printf("Failed to update infrastructure for %s: %v", clientID, err)
+		http.Error(w, "Failed to update infrastructure", http.StatusInternalServerError)
+		return
+	}
+
+	// Apply the new desired state now rather than on the next reconciler pass
+	runAsync(func() {
+		if err := reconcileClient(clientID); err != nil {
+			log.Printf("Failed to reconcile infrastructure of %s: %v", clientID, err)
+		}
+	})
+
+	w.Header().Set("ETag", revisionETag(revision.Revision))
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(MessageResponse{
+		Message:  message,
+		ClientID: clientID,
+		Revision: revision.Revision,
+	})
+}
+
+func handleInfrastructureHistory(w http.ResponseWriter, r *http.Request) {
+	claims, ok := authenticateClient(w, r)
+	if !ok {
+		return
+	}
+	client := getClientInfrastructure(claims.Subject)
+	if client == nil {
+		http.Error(w, "Client not found", http.StatusNotFound)
+		return
+	}
+
+	revisions, err := listInfrastructureRevisions(claims.Subject)
+	if err != nil {
+		log.Printf("Failed to list infrastructure revisions of %s: %v", claims.Subject, err)
+		http.Error(w, "Failed to list infrastructure history", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("ETag", revisionETag(client.Infrastructure.Generation))
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(InfrastructureHistoryResponse{
+		ClientID:  claims.Subject,
+		Revision:  client.Infrastructure.Generation,
+		Revisions: revisions,
+	})
+}
+
+// requestedRevision reads the revision number of a path, answering 404 for
+// one that is not a number or not in the history
+func requestedRevision(w http.ResponseWriter, clientID, param string) (*InfrastructureRevision, bool) {
+	n, err := strconv.ParseInt(param, 10, 64)
+	if err != nil || n < 1 {
+		http.Error(w, "Revision not found", http.StatusNotFound)
+		return nil, false
+	}
+	revision := loadInfrastructureRevision(clientID, n)
+	if revision == nil {
+		http.Error(w, "Revision not found", http.StatusNotFound)
+		return nil, false
+	}
+	return revision, true
+}
+
+func handleInfrastructureRevision(w http.ResponseWriter, r *http.Request, param string) {
+	claims, ok := authenticateClient(w, r)
+	if !ok {
+		return
+	}
+	revision, ok := requestedRevision(w, claims.Subject, param)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("ETag", revisionETag(revision.Revision))
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(revision)
+}
+
+// handleInfrastructureRollback makes the infrastructure of an earlier
+// revision the desired state again, as a new revision
+func handleInfrastructureRollback(w http.ResponseWriter, r *http.Request, param string) {
+	claims, ok := authenticateClient(w, r)
+	if !ok {
+		return
+	}
+	ifMatch, err := parseIfMatch(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	revision, ok := requestedRevision(w, claims.Subject, param)
+	if !ok {
+		return
+	}
+	if revision.Infrastructure == nil {
+		http.Error(w, "Revision has no infrastructure to restore", http.StatusConflict)
+		return
+	}
+
+	written, err := writeInfrastructure(claims.Subject, *revision.Infrastructure, infrastructureWrite{
+		author:     claims.Subject,
+		ifMatch:    ifMatch,
+		rollbackOf: revision.Revision,
+	})
+	respondInfrastructureWrite(w, claims.Subject, written, err, fmt.Sprintf("Infrastructure rolled back to revision %d", revision.Revision))
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestInfrastructureHistoryAndRollback(t *testing.T) {
+	storage = NewMockStorage()
+	client := getOrCreateClientWithInfrastructure("test@example.com")
+	token := generateToken(client.ID, "")
+
+	first := InfrastructureUpdate{Infrastructure: Infrastructure{Databases: []Resource{{ID: "pg-main"}}}}
+	if w := requestForTest("POST", "/infrastructure", token, first); w.Code != http.StatusOK || w.Header().Get("ETag") != `"1"` {
+		t.Fatalf("Expected revision 1, got %d %s: %s", w.Code, w.Header().Get("ETag"), w.Body.String())
+	}
+	second := InfrastructureUpdate{Infrastructure: Infrastructure{
+		Databases: []Resource{{ID: "pg-main", Spec: json.RawMessage(`{"size_gb":5}`)}},
+		Storage:   []Resource{{ID: "backups"}},
+	}}
+	if w := requestForTest("POST", "/infrastructure", token, second); w.Code != http.StatusOK {
+		t.Fatalf("Expected second update to succeed, got %d: %s", w.Code, w.Body.String())
+	}
+
+	w := requestForTest("GET", "/infrastructure/history", token, nil)
+	var history InfrastructureHistoryResponse
+	json.Unmarshal(w.Body.Bytes(), &history)
+	if history.Revision != 2 || len(history.Revisions) != 2 || history.Revisions[0].Revision != 2 {
+		t.Fatalf("Expected revisions 2 and 1, newest first, got %+v", history)
+	}
+	latest := history.Revisions[0]
+	if latest.Author != client.ID || latest.Infrastructure != nil {
+		t.Errorf("Expected the author and no document in the listing, got %+v", latest)
+	}
+	ops := map[string]string{}
+	for _, c := range latest.Diff {
+		ops[c.Kind+"/"+c.ID] = c.Op
+	}
+	if len(ops) != 2 || ops["database/pg-main"] != ResourceChanged || ops["storage/backups"] != ResourceAdded {
+		t.Errorf("Expected pg-main changed and backups added, got %+v", latest.Diff)
+	}
+
+	w = requestForTest("GET", "/infrastructure/revisions/1", token, nil)
+	var revision InfrastructureRevision
+	json.Unmarshal(w.Body.Bytes(), &revision)
+	if w.Code != http.StatusOK || revision.Infrastructure == nil || len(revision.Infrastructure.Databases) != 1 {
+		t.Fatalf("Expected revision 1 with its document, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// Rolling back drops backups and restores pg-main's default spec
+	w = requestForTest("POST", "/infrastructure/rollback/1", token, nil, "If-Match", `"2"`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected rollback to succeed, got %d: %s", w.Code, w.Body.String())
+	}
+	var resp MessageResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if resp.Revision != 3 {
+		t.Errorf("Expected the rollback to be revision 3, got %d", resp.Revision)
+	}
+	infra := getClientInfrastructure(client.ID).Infrastructure
+	if infra.Generation != 3 || len(infra.Storage) != 0 || string(infra.Databases[0].Spec) != `{"engine":"redis","size_gb":1}` {
+		t.Errorf("Expected revision 1's infrastructure back, got %+v", infra)
+	}
+	if rolled := loadInfrastructureRevision(client.ID, 3); rolled == nil || rolled.RollbackOf != 1 || len(rolled.Diff) != 2 {
+		t.Errorf("Expected revision 3 to record the rollback of 1, got %+v", rolled)
+	}
+
+	for _, path := range []string{"/infrastructure/revisions/9", "/infrastructure/revisions/x", "/infrastructure/rollback/0"} {
+		method := "GET"
+		if path == "/infrastructure/rollback/0" {
+			method = "POST"
+		}
+		if w := requestForTest(method, path, token, nil); w.Code != http.StatusNotFound {
+			t.Errorf("Expected 404 for %s, got %d", path, w.Code)
+		}
+	}
+}
+
+func TestInfrastructureIfMatch(t *testing.T) {
+	storage = NewMockStorage()
+	client := getOrCreateClientWithInfrastructure("test@example.com")
+	token := generateToken(client.ID, "")
+
+	if w := requestForTest("GET", "/infrastructure", token, nil); w.Header().Get("ETag") != `"0"` {
+		t.Fatalf("Expected ETag \"0\" before any update, got %q", w.Header().Get("ETag"))
+	}
+
+	update := InfrastructureUpdate{Infrastructure: Infrastructure{VPNInstances: []Resource{{ID: "vpn-1"}}}}
+	if w := requestForTest("POST", "/infrastructure", token, update, "If-Match", `"0"`); w.Code != http.StatusOK {
+		t.Fatalf("Expected a matching If-Match to succeed, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// A writer that read revision 0 lost the race
+	w := requestForTest("POST", "/infrastructure", token, update, "If-Match", `"0"`)
+	if w.Code != http.StatusPreconditionFailed || w.Header().Get("ETag") != `"1"` {
+		t.Fatalf("Expected 412 with the current revision, got %d %q", w.Code, w.Header().Get("ETag"))
+	}
+	var errResp ErrorResponse
+	json.Unmarshal(w.Body.Bytes(), &errResp)
+	if errResp.Error != ErrCodeRevisionMismatch {
+		t.Errorf("Expected %s, got %+v", ErrCodeRevisionMismatch, errResp)
+	}
+	if infra := getClientInfrastructure(client.ID).Infrastructure; infra.Generation != 1 {
+		t.Errorf("Expected the refused write to leave revision 1, got %d", infra.Generation)
+	}
+
+	if w := requestForTest("POST", "/infrastructure/rollback/1", token, nil, "If-Match", `"0"`); w.Code != http.StatusPreconditionFailed {
+		t.Errorf("Expected a stale rollback to be refused, got %d", w.Code)
+	}
+	if w := requestForTest("POST", "/infrastructure", token, update, "If-Match", "*"); w.Code != http.StatusOK {
+		t.Errorf("Expected If-Match * to match any revision, got %d", w.Code)
+	}
+	if w := requestForTest("POST", "/infrastructure", token, update, "If-Match", "latest"); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected an unreadable If-Match to be refused, got %d", w.Code)
+	}
+}
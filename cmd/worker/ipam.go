@@ -0,0 +1,613 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/netip"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Every environment gets one subnet per configured address family, carved
+// out of that family's pool. Devices inside an environment get one host
+// address per family; the first host of each subnet belongs to the VPN server.
+//
+// ipam:pool:<family> maps each handed-out subnet to its environment and is
+// the source of truth for which subnets are taken. ipam:env:<environment_id>
+// holds the environment's subnets and device addresses.
+
+const (
+	FamilyIPv4 = "ipv4"
+	FamilyIPv6 = "ipv6"
+)
+
+var (
+	ErrPoolExhausted   = errors.New("ipam: address pool exhausted")
+	ErrSubnetExhausted = errors.New("ipam: environment subnet exhausted")
+)
+
+// IPAMPool is the configured address range of one family
+type IPAMPool struct {
+	Family     string
+	Prefix     netip.Prefix
+	SubnetBits int
+}
+
+// EnvironmentNetwork is the address plan of one environment
+type EnvironmentNetwork struct {
+	EnvironmentID string              `json:"environment_id"`
+	Subnets       map[string]string   `json:"subnets"`
+	Devices       map[string][]string `json:"devices"`
+	Created       time.Time           `json:"created"`
+}
+
+func ipamPoolKey(family string) string {
+	return fmt.Sprintf("ipam:pool:%s", family)
+}
+
+func ipamEnvironmentKey(environmentID string) string {
+	return fmt.Sprintf("ipam:env:%s", environmentID)
+}
+
+// ipamPools reads the pools from IPAM_POOL_V4/IPAM_POOL_V6 and their subnet
+// sizes from IPAM_SUBNET_BITS_V4/IPAM_SUBNET_BITS_V6. A pool set to "off"
+// disables that family.
+func ipamPools() ([]IPAMPool, error) {
+	specs := []struct {
+		family, poolEnv, poolDefault, bitsEnv, bitsDefault string
+	}{
+		{FamilyIPv4, "IPAM_POOL_V4", "10.13.0.0/16", "IPAM_SUBNET_BITS_V4", "24"},
+		{FamilyIPv6, "IPAM_POOL_V6", "fd13:5017::/48", "IPAM_SUBNET_BITS_V6", "64"},
+	}
+
+	var pools []IPAMPool
+	for _, spec := range specs {
+		value := getEnv(spec.poolEnv, spec.poolDefault)
+		if value == "off" {
+			continue
+		}
+
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %v", spec.poolEnv, err)
+		}
+		if prefix.Addr().Is4() != (spec.family == FamilyIPv4) {
+			return nil, fmt.Errorf("invalid %s: %s is not an %s prefix", spec.poolEnv, value, spec.family)
+		}
+
+		bits, err := strconv.Atoi(getEnv(spec.bitsEnv, spec.bitsDefault))
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %v", spec.bitsEnv, err)
+		}
+		// A subnet needs room for the network address, the server and at
+		// least one device (plus broadcast on IPv4)
+		if bits < prefix.Bits() || bits > prefix.Addr().BitLen()-2 {
+			return nil, fmt.Errorf("invalid %s: /%d does not fit in %s", spec.bitsEnv, bits, prefix)
+		}
+
+		pools = append(pools, IPAMPool{Family: spec.family, Prefix: prefix.Masked(), SubnetBits: bits})
+	}
+
+	if len(pools) == 0 {
+		return nil, fmt.Errorf("no IPAM pools configured")
+	}
+	return pools, nil
+}
+
+// lastAddr returns the highest address inside prefix
+func lastAddr(prefix netip.Prefix) netip.Addr {
+	b := prefix.Masked().Addr().AsSlice()
+	for i := prefix.Bits(); i < len(b)*8; i++ {
+		b[i/8] |= 1 << (7 - i%8)
+	}
+	addr, _ := netip.AddrFromSlice(b)
+	return addr
+}
+
+// saturatingPow2 returns 2^n, capped at math.MaxUint64
+func saturatingPow2(n int) uint64 {
+	if n >= 64 {
+		return math.MaxUint64
+	}
+	return 1 << n
+}
+
+// subnetCapacity is the number of device addresses a subnet can hold
+func subnetCapacity(subnet netip.Prefix) uint64 {
+	size := saturatingPow2(subnet.Addr().BitLen() - subnet.Bits())
+	reserved := uint64(2) // network address and server
+	if subnet.Addr().Is4() {
+		reserved++ // broadcast
+	}
+	if size <= reserved {
+		return 0
+	}
+	return size - reserved
+}
+
+// serverAddress is the VPN server's address inside an environment subnet
+func serverAddress(subnet netip.Prefix) netip.Addr {
+	return subnet.Addr().Next()
+}
+
+func loadPoolIndex(data []byte) (map[string]string, error) {
+	index := map[string]string{}
+	if data == nil {
+		return index, nil
+	}
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, fmt.Errorf("failed to decode pool index: %v", err)
+	}
+	return index, nil
+}
+
+// nextFreeSubnet returns the lowest subnet of pool that overlaps none of the
+// subnets already in use. Overlap rather than equality is checked so that
+// changing the subnet size never hands out a range that is partly taken.
+func nextFreeSubnet(pool IPAMPool, used map[string]string) (netip.Prefix, error) {
+	var taken []netip.Prefix
+	for s := range used {
+		if p, err := netip.ParsePrefix(s); err == nil {
+			taken = append(taken, p)
+		}
+	}
+
+	for candidate := netip.PrefixFrom(pool.Prefix.Addr(), pool.SubnetBits); pool.Prefix.Contains(candidate.Addr()); {
+		free := true
+		for _, t := range taken {
+			if t.Overlaps(candidate) {
+				free = false
+				break
+			}
+		}
+		if free {
+			return candidate, nil
+		}
+
+		next := lastAddr(candidate).Next()
+		if !next.IsValid() {
+			break
+		}
+		candidate = netip.PrefixFrom(next, pool.SubnetBits)
+	}
+	return netip.Prefix{}, fmt.Errorf("%w: %s", ErrPoolExhausted, pool.Prefix)
+}
+
+// getEnvironmentNetwork returns the address plan of an environment, or nil
+// if none has been allocated yet
+func getEnvironmentNetwork(environmentID string) (*EnvironmentNetwork, error) {
+	data, err := storage.Get(ipamEnvironmentKey(environmentID))
+	if err != nil {
+		return nil, nil
+	}
+	var network EnvironmentNetwork
+	if err := json.Unmarshal(data, &network); err != nil {
+		return nil, fmt.Errorf("failed to decode network of %s: %v", environmentID, err)
+	}
+	return &network, nil
+}
+
+// ensureEnvironmentNetwork allocates subnets for an environment on first use
+// and returns its address plan
+func ensureEnvironmentNetwork(environmentID string) (*EnvironmentNetwork, error) {
+	if network, err := getEnvironmentNetwork(environmentID); err != nil || network != nil {
+		return network, err
+	}
+
+	pools, err := ipamPools()
+	if err != nil {
+		return nil, err
+	}
+
+	envKey := ipamEnvironmentKey(environmentID)
+	keys := []string{envKey}
+	for _, pool := range pools {
+		keys = append(keys, ipamPoolKey(pool.Family))
+	}
+
+	var network EnvironmentNetwork
+	err = updateWithRetry(keys, func(current map[string][]byte) (map[string][]byte, error) {
+		if data, ok := current[envKey]; ok {
+			return nil, json.Unmarshal(data, &network)
+		}
+
+		network = EnvironmentNetwork{
+			EnvironmentID: environmentID,
+			Subnets:       map[string]string{},
+			Devices:       map[string][]string{},
+			Created:       time.Now(),
+		}
+		writes := map[string][]byte{}
+
+		for _, pool := range pools {
+			poolKey := ipamPoolKey(pool.Family)
+			index, err := loadPoolIndex(current[poolKey])
+			if err != nil {
+				return nil, err
+			}
+
+			subnet, err := nextFreeSubnet(pool, index)
+			if err != nil {
+				return nil, err
+			}
+			index[subnet.String()] = environmentID
+			network.Subnets[pool.Family] = subnet.String()
+
+			if writes[poolKey], err = json.Marshal(index); err != nil {
+				return nil, err
+			}
+		}
+
+		data, err := json.Marshal(network)
+		if err != nil {
+			return nil, err
+		}
+		writes[envKey] = data
+		return writes, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Allocated subnets %v to environment %s", network.Subnets, environmentID)
+	return &network, nil
+}
+
+// assignClientNetwork makes sure a client's environment has subnets and
+// records them on the client record
+func assignClientNetwork(client *ClientData) (*EnvironmentNetwork, error) {
+	network, err := ensureEnvironmentNetwork(client.Environment.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	subnets := sortedSubnets(network)
+	if !equalStrings(client.Environment.Subnets, subnets) {
+		if err := updateClient(client.ID, func(c *ClientData) {
+			c.Environment.Subnets = subnets
+		}); err != nil {
+			return nil, err
+		}
+		client.Environment.Subnets = subnets
+	}
+	return network, nil
+}
+
+func sortedSubnets(network *EnvironmentNetwork) []string {
+	subnets := make([]string, 0, len(network.Subnets))
+	for _, family := range []string{FamilyIPv4, FamilyIPv6} {
+		if s, ok := network.Subnets[family]; ok {
+			subnets = append(subnets, s)
+		}
+	}
+	return subnets
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// nextFreeHost returns the lowest device address of subnet not in used
+func nextFreeHost(subnet netip.Prefix, used map[netip.Addr]bool) (netip.Addr, error) {
+	for addr := serverAddress(subnet).Next(); subnet.Contains(addr); addr = addr.Next() {
+		// The broadcast address of IPv4 subnets is never handed out
+		if addr.Is4() && addr == lastAddr(subnet) {
+			break
+		}
+		if !used[addr] {
+			return addr, nil
+		}
+	}
+	return netip.Addr{}, fmt.Errorf("%w: %s", ErrSubnetExhausted, subnet)
+}
+
+// allocateDeviceAddresses returns the addresses of a device, allocating one
+// per subnet the first time the device is seen. Addresses are stable until
+// the device is released.
+func allocateDeviceAddresses(environmentID, device string) ([]string, error) {
+	if _, err := ensureEnvironmentNetwork(environmentID); err != nil {
+		return nil, err
+	}
+
+	key := ipamEnvironmentKey(environmentID)
+	var addresses []string
+	err := updateWithRetry([]string{key}, func(current map[string][]byte) (map[string][]byte, error) {
+		data, ok := current[key]
+		if !ok {
+			return nil, fmt.Errorf("network of environment %s disappeared", environmentID)
+		}
+		var network EnvironmentNetwork
+		if err := json.Unmarshal(data, &network); err != nil {
+			return nil, err
+		}
+		if network.Devices == nil {
+			network.Devices = map[string][]string{}
+		}
+
+		if existing, ok := network.Devices[device]; ok {
+			addresses = existing
+			return nil, nil
+		}
+
+		used := map[netip.Addr]bool{}
+		for _, addrs := range network.Devices {
+			for _, a := range addrs {
+				if p, err := netip.ParsePrefix(a); err == nil {
+					used[p.Addr()] = true
+				}
+			}
+		}
+
+		addresses = nil
+		for _, s := range sortedSubnets(&network) {
+			subnet, err := netip.ParsePrefix(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid subnet %s: %v", s, err)
+			}
+			addr, err := nextFreeHost(subnet, used)
+			if err != nil {
+				return nil, err
+			}
+			addresses = append(addresses, netip.PrefixFrom(addr, addr.BitLen()).String())
+		}
+		network.Devices[device] = addresses
+
+		updated, err := json.Marshal(network)
+		if err != nil {
+			return nil, err
+		}
+		return map[string][]byte{key: updated}, nil
+	})
+	return addresses, err
+}
+
+// releaseDeviceAddresses returns a device's addresses to its environment
+func releaseDeviceAddresses(environmentID, device string) error {
+	key := ipamEnvironmentKey(environmentID)
+	return updateWithRetry([]string{key}, func(current map[string][]byte) (map[string][]byte, error) {
+		data, ok := current[key]
+		if !ok {
+			return nil, nil
+		}
+		var network EnvironmentNetwork
+		if err := json.Unmarshal(data, &network); err != nil {
+			return nil, err
+		}
+		if _, ok := network.Devices[device]; !ok {
+			return nil, nil
+		}
+		delete(network.Devices, device)
+
+		updated, err := json.Marshal(network)
+		if err != nil {
+			return nil, err
+		}
+		return map[string][]byte{key: updated}, nil
+	})
+}
+
+// releaseEnvironmentNetwork returns an environment's subnets to the pools
+func releaseEnvironmentNetwork(environmentID string) error {
+	network, err := getEnvironmentNetwork(environmentID)
+	if err != nil || network == nil {
+		return err
+	}
+
+	envKey := ipamEnvironmentKey(environmentID)
+	keys := []string{envKey}
+	for family := range network.Subnets {
+		keys = append(keys, ipamPoolKey(family))
+	}
+
+	err = updateWithRetry(keys, func(current map[string][]byte) (map[string][]byte, error) {
+		writes := map[string][]byte{envKey: nil}
+		for family, subnet := range network.Subnets {
+			poolKey := ipamPoolKey(family)
+			index, err := loadPoolIndex(current[poolKey])
+			if err != nil {
+				return nil, err
+			}
+			if index[subnet] != environmentID {
+				continue
+			}
+			delete(index, subnet)
+			if writes[poolKey], err = json.Marshal(index); err != nil {
+				return nil, err
+			}
+		}
+		return writes, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Released subnets %v of environment %s", network.Subnets, environmentID)
+	return nil
+}
+
+// IPAMPoolUsage summarizes one pool for the admin view
+type IPAMPoolUsage struct {
+	Family       string `json:"family"`
+	Prefix       string `json:"prefix"`
+	SubnetBits   int    `json:"subnet_bits"`
+	SubnetsTotal uint64 `json:"subnets_total"`
+	SubnetsUsed  int    `json:"subnets_used"`
+}
+
+// IPAMEnvironmentUsage summarizes one environment for the admin view
+type IPAMEnvironmentUsage struct {
+	EnvironmentID  string            `json:"environment_id"`
+	Subnets        map[string]string `json:"subnets"`
+	Devices        int               `json:"devices"`
+	AddressesTotal uint64            `json:"addresses_total"`
+}
+
+// IPAMConflict describes an inconsistency found by checkIPAM
+type IPAMConflict struct {
+	Kind          string `json:"kind"`
+	EnvironmentID string `json:"environment_id,omitempty"`
+	Detail        string `json:"detail"`
+}
+
+// IPAMReport is the admin view of address utilization
+type IPAMReport struct {
+	Pools        []IPAMPoolUsage        `json:"pools"`
+	Environments []IPAMEnvironmentUsage `json:"environments"`
+	Conflicts    []IPAMConflict         `json:"conflicts"`
+}
+
+// checkIPAM builds the utilization report and looks for overlapping
+// subnets, subnets outside their pool, and duplicate or stray device
+// addresses
+func checkIPAM() (*IPAMReport, error) {
+	pools, err := ipamPools()
+	if err != nil {
+		return nil, err
+	}
+
+	report := &IPAMReport{
+		Pools:        []IPAMPoolUsage{},
+		Environments: []IPAMEnvironmentUsage{},
+		Conflicts:    []IPAMConflict{},
+	}
+	conflict := func(kind, environmentID, format string, args ...interface{}) {
+		report.Conflicts = append(report.Conflicts, IPAMConflict{Kind: kind, EnvironmentID: environmentID, Detail: fmt.Sprintf(format, args...)})
+	}
+
+	for _, pool := range pools {
+		data, _ := storage.Get(ipamPoolKey(pool.Family))
+		index, err := loadPoolIndex(data)
+		if err != nil {
+			return nil, err
+		}
+
+		subnets := make([]string, 0, len(index))
+		for s := range index {
+			subnets = append(subnets, s)
+		}
+		sort.Strings(subnets)
+
+		for i, s := range subnets {
+			p, err := netip.ParsePrefix(s)
+			if err != nil {
+				conflict("invalid_subnet", index[s], "%s: %v", s, err)
+				continue
+			}
+			if !pool.Prefix.Contains(p.Addr()) || p.Bits() < pool.Prefix.Bits() {
+				conflict("outside_pool", index[s], "%s is not inside %s", s, pool.Prefix)
+			}
+			for _, other := range subnets[i+1:] {
+				if q, err := netip.ParsePrefix(other); err == nil && p.Overlaps(q) {
+					conflict("overlapping_subnets", index[s], "%s (%s) overlaps %s (%s)", s, index[s], other, index[other])
+				}
+			}
+		}
+
+		report.Pools = append(report.Pools, IPAMPoolUsage{
+			Family:       pool.Family,
+			Prefix:       pool.Prefix.String(),
+			SubnetBits:   pool.SubnetBits,
+			SubnetsTotal: saturatingPow2(pool.SubnetBits - pool.Prefix.Bits()),
+			SubnetsUsed:  len(index),
+		})
+	}
+
+	keys, err := scanAll("ipam:env:")
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		data, err := storage.Get(key)
+		if err != nil {
+			continue
+		}
+		var network EnvironmentNetwork
+		if err := json.Unmarshal(data, &network); err != nil {
+			conflict("invalid_record", "", "%s: %v", key, err)
+			continue
+		}
+
+		usage := IPAMEnvironmentUsage{
+			EnvironmentID: network.EnvironmentID,
+			Subnets:       network.Subnets,
+			Devices:       len(network.Devices),
+		}
+
+		var subnets []netip.Prefix
+		for _, s := range network.Subnets {
+			if p, err := netip.ParsePrefix(s); err == nil {
+				subnets = append(subnets, p)
+				usage.AddressesTotal += subnetCapacity(p)
+			}
+		}
+
+		owners := map[netip.Addr]string{}
+		for device, addrs := range network.Devices {
+			for _, a := range addrs {
+				p, err := netip.ParsePrefix(a)
+				if err != nil {
+					conflict("invalid_address", network.EnvironmentID, "device %s: %s", device, a)
+					continue
+				}
+				if owner, ok := owners[p.Addr()]; ok {
+					conflict("duplicate_address", network.EnvironmentID, "%s assigned to %s and %s", p.Addr(), owner, device)
+				}
+				owners[p.Addr()] = device
+
+				inside := false
+				for _, s := range subnets {
+					inside = inside || s.Contains(p.Addr())
+				}
+				if !inside {
+					conflict("address_outside_subnet", network.EnvironmentID, "device %s has %s", device, a)
+				}
+			}
+		}
+
+		report.Environments = append(report.Environments, usage)
+	}
+
+	return report, nil
+}
+
+// handleAdminIPAM shows pool and per-environment utilization plus any conflicts
+func handleAdminIPAM(w http.ResponseWriter, r *http.Request) {
+	report, err := checkIPAM()
+	if err != nil {
+		log.Printf("Failed to build IPAM report: %v", err)
+		http.Error(w, "Failed to build IPAM report", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(report)
+}
+
+// handleAdminIPAMEnvironment shows the device addresses of one environment
+func handleAdminIPAMEnvironment(w http.ResponseWriter, r *http.Request, environmentID string) {
+	network, err := getEnvironmentNetwork(environmentID)
+	if err != nil {
+		http.Error(w, "Failed to load network", http.StatusInternalServerError)
+		return
+	}
+	if network == nil {
+		http.Error(w, "Network not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(network)
+}
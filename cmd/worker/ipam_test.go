@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/netip"
+	"testing"
+)
+
+func TestIPAMPools(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		want    int
+		wantErr bool
+	}{
+		{"defaults", nil, 2, false},
+		{"ipv4 only", map[string]string{"IPAM_POOL_V6": "off"}, 1, false},
+		{"bad prefix", map[string]string{"IPAM_POOL_V4": "10.0.0.0/33"}, 0, true},
+		{"wrong family", map[string]string{"IPAM_POOL_V4": "fd00::/48"}, 0, true},
+		{"subnet larger than pool", map[string]string{"IPAM_SUBNET_BITS_V4": "8"}, 0, true},
+		{"subnet too small", map[string]string{"IPAM_SUBNET_BITS_V4": "31"}, 0, true},
+		{"no pools", map[string]string{"IPAM_POOL_V4": "off", "IPAM_POOL_V6": "off"}, 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			pools, err := ipamPools()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Expected error %v, got %v", tt.wantErr, err)
+			}
+			if len(pools) != tt.want {
+				t.Errorf("Expected %d pools, got %d", tt.want, len(pools))
+			}
+		})
+	}
+}
+
+func TestEnvironmentSubnets(t *testing.T) {
+	storage = NewMockStorage()
+
+	a, err := ensureEnvironmentNetwork("env-a")
+	if err != nil {
+		t.Fatalf("Failed to allocate network: %v", err)
+	}
+	b, _ := ensureEnvironmentNetwork("env-b")
+	if a.Subnets[FamilyIPv4] != "10.13.0.0/24" || b.Subnets[FamilyIPv4] != "10.13.1.0/24" {
+		t.Errorf("Expected consecutive IPv4 subnets, got %v and %v", a.Subnets, b.Subnets)
+	}
+	if a.Subnets[FamilyIPv6] != "fd13:5017::/64" || b.Subnets[FamilyIPv6] != "fd13:5017:0:1::/64" {
+		t.Errorf("Expected consecutive IPv6 subnets, got %v and %v", a.Subnets, b.Subnets)
+	}
+
+	again, _ := ensureEnvironmentNetwork("env-a")
+	if again.Subnets[FamilyIPv4] != a.Subnets[FamilyIPv4] {
+		t.Error("Expected an environment to keep its subnet")
+	}
+
+	// Released subnets are handed out again
+	if err := releaseEnvironmentNetwork("env-a"); err != nil {
+		t.Fatalf("Failed to release network: %v", err)
+	}
+	c, _ := ensureEnvironmentNetwork("env-c")
+	if c.Subnets[FamilyIPv4] != "10.13.0.0/24" {
+		t.Errorf("Expected reclaimed subnet, got %v", c.Subnets)
+	}
+}
+
+func TestDeviceAddresses(t *testing.T) {
+	storage = NewMockStorage()
+
+	laptop, err := allocateDeviceAddresses("env-a", "laptop")
+	if err != nil {
+		t.Fatalf("Failed to allocate addresses: %v", err)
+	}
+	phone, _ := allocateDeviceAddresses("env-a", "phone")
+	if laptop[0] != "10.13.0.2/32" || phone[0] != "10.13.0.3/32" {
+		t.Errorf("Expected sequential addresses, got %v and %v", laptop, phone)
+	}
+
+	again, _ := allocateDeviceAddresses("env-a", "laptop")
+	if !equalStrings(again, laptop) {
+		t.Errorf("Expected stable addresses, got %v then %v", laptop, again)
+	}
+
+	if err := releaseDeviceAddresses("env-a", "laptop"); err != nil {
+		t.Fatalf("Failed to release addresses: %v", err)
+	}
+	tablet, _ := allocateDeviceAddresses("env-a", "tablet")
+	if tablet[0] != "10.13.0.2/32" {
+		t.Errorf("Expected reclaimed address, got %v", tablet)
+	}
+}
+
+func TestIPAMExhaustion(t *testing.T) {
+	storage = NewMockStorage()
+	t.Setenv("IPAM_POOL_V4", "10.99.0.0/29")
+	t.Setenv("IPAM_SUBNET_BITS_V4", "30")
+	t.Setenv("IPAM_POOL_V6", "off")
+
+	// A /30 holds network, server, one device and broadcast
+	if _, err := allocateDeviceAddresses("env-a", "one"); err != nil {
+		t.Fatalf("Expected first device to fit, got %v", err)
+	}
+	if _, err := allocateDeviceAddresses("env-a", "two"); !errors.Is(err, ErrSubnetExhausted) {
+		t.Errorf("Expected subnet exhaustion, got %v", err)
+	}
+
+	ensureEnvironmentNetwork("env-b")
+	if _, err := ensureEnvironmentNetwork("env-c"); !errors.Is(err, ErrPoolExhausted) {
+		t.Errorf("Expected pool exhaustion, got %v", err)
+	}
+}
+
+func TestNextFreeSubnetSkipsOverlaps(t *testing.T) {
+	pool := IPAMPool{Family: FamilyIPv4, Prefix: netip.MustParsePrefix("10.13.0.0/16"), SubnetBits: 24}
+
+	// A subnet handed out under a larger size still blocks what it covers
+	used := map[string]string{"10.13.0.0/23": "env-old"}
+	subnet, err := nextFreeSubnet(pool, used)
+	if err != nil || subnet.String() != "10.13.2.0/24" {
+		t.Errorf("Expected 10.13.2.0/24, got %v (%v)", subnet, err)
+	}
+}
+
+func TestCheckIPAMConflicts(t *testing.T) {
+	storage = NewMockStorage()
+	allocateDeviceAddresses("env-a", "laptop")
+
+	storage.Put(ipamPoolKey(FamilyIPv4), []byte(`{"10.13.0.0/24":"env-a","10.13.0.128/25":"env-b","192.168.0.0/24":"env-c"}`))
+	storage.Put(ipamEnvironmentKey("env-d"), []byte(`{"environment_id":"env-d","subnets":{"ipv4":"10.13.5.0/24"},"devices":{"a":["10.13.5.2/32"],"b":["10.13.5.2/32"],"c":["10.13.9.2/32"]}}`))
+
+	report, err := checkIPAM()
+	if err != nil {
+		t.Fatalf("Failed to check IPAM: %v", err)
+	}
+
+	kinds := map[string]int{}
+	for _, c := range report.Conflicts {
+		kinds[c.Kind]++
+	}
+	for _, kind := range []string{"overlapping_subnets", "outside_pool", "duplicate_address", "address_outside_subnet"} {
+		if kinds[kind] != 1 {
+			t.Errorf("Expected one %s conflict, got %+v", kind, report.Conflicts)
+		}
+	}
+
+	if report.Pools[0].SubnetsTotal != 256 || report.Pools[0].SubnetsUsed != 3 {
+		t.Errorf("Unexpected IPv4 pool usage: %+v", report.Pools[0])
+	}
+}
+
+func TestAdminIPAMView(t *testing.T) {
+	storage = NewMockStorage()
+	useTestAdminKeys(t)
+	allocateDeviceAddresses("env-a", "laptop")
+
+	w := requestForTest("GET", "/admin/ipam", "viewer-key", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var report IPAMReport
+	json.Unmarshal(w.Body.Bytes(), &report)
+	if len(report.Environments) != 1 || report.Environments[0].Devices != 1 || report.Environments[0].AddressesTotal == 0 {
+		t.Errorf("Unexpected environments in report: %+v", report.Environments)
+	}
+
+	w = requestForTest("GET", "/admin/ipam/env-a", "viewer-key", nil)
+
+	var network EnvironmentNetwork
+	json.Unmarshal(w.Body.Bytes(), &network)
+	if w.Code != http.StatusOK || len(network.Devices["laptop"]) != 2 {
+		t.Errorf("Expected laptop addresses, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestDeletePeerReleasesAddresses(t *testing.T) {
+	storage = NewMockStorage()
+	auth := loginForTest(t, "test@example.com", "")
+	client := getClientInfrastructure(auth.ClientID)
+
+	if _, err := upsertPeer(client, "phone", ""); err != nil {
+		t.Fatalf("Failed to create peer: %v", err)
+	}
+	if len(getClientInfrastructure(auth.ClientID).Environment.Subnets) != 2 {
+		t.Error("Expected subnets to be recorded on the environment")
+	}
+	network, _ := getEnvironmentNetwork(client.Environment.ID)
+	phone := network.Devices["phone"]
+
+	w := requestForTest("DELETE", "/config/peer/phone", auth.Token, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected peer to be deleted, got %d", w.Code)
+	}
+
+	network, _ = getEnvironmentNetwork(client.Environment.ID)
+	if _, ok := network.Devices["phone"]; ok {
+		t.Error("Expected deleted peer's addresses to be released")
+	}
+
+	// The next device gets the freed addresses
+	if _, err := upsertPeer(client, "tablet", ""); err != nil {
+		t.Fatalf("Failed to create peer: %v", err)
+	}
+	network, _ = getEnvironmentNetwork(client.Environment.ID)
+	if !equalStrings(network.Devices["tablet"], phone) {
+		t.Errorf("Expected the freed addresses %v, got %v", phone, network.Devices["tablet"])
+	}
+}
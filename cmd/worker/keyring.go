@@ -0,0 +1,419 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// defaultJWTSecret is the placeholder shipped in example configs. The server
+// refuses to sign with it unless DEV_MODE=true.
+const defaultJWTSecret = "your-secret-key-change-in-production"
+
+// Supported signing algorithms
+const (
+	AlgHS256 = "HS256"
+	AlgES256 = "ES256"
+	AlgEdDSA = "EdDSA"
+)
+
+// keyringStorageKey holds the managed keyring shared by all server instances
+const keyringStorageKey = "jwt:keyring"
+
+// SigningKey is one named key in the keyring. Retired keys no longer sign
+// but still verify until the overlap window has passed.
+type SigningKey struct {
+	ID        string    `json:"kid"`
+	Algorithm string    `json:"alg"`
+	Material  []byte    `json:"material"` // HS256 secret or PKCS#8 private key
+	Created   time.Time `json:"created"`
+	Retired   time.Time `json:"retired,omitempty"`
+
+	signKey   interface{}
+	verifyKey interface{}
+}
+
+func newSigningKey(alg string) (*SigningKey, error) {
+	var material []byte
+	switch alg {
+	case AlgHS256:
+		material = make([]byte, 32)
+		if _, err := rand.Read(material); err != nil {
+			return nil, err
+		}
+	case AlgES256:
+		priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		if material, err = x509.MarshalPKCS8PrivateKey(priv); err != nil {
+			return nil, err
+		}
+	case AlgEdDSA:
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		if material, err = x509.MarshalPKCS8PrivateKey(priv); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported JWT algorithm %q", alg)
+	}
+
+	key := &SigningKey{
+		ID:        randomHex(8),
+		Algorithm: alg,
+		Material:  material,
+		Created:   time.Now().UTC(),
+	}
+	return key, key.init()
+}
+
+// init decodes Material into the keys used for signing and verification
+func (k *SigningKey) init() error {
+	if k.Algorithm == AlgHS256 {
+		k.signKey = k.Material
+		k.verifyKey = k.Material
+		return nil
+	}
+
+	priv, err := x509.ParsePKCS8PrivateKey(k.Material)
+	if err != nil {
+		return fmt.Errorf("failed to parse key %s: %v", k.ID, err)
+	}
+
+	switch p := priv.(type) {
+	case *ecdsa.PrivateKey:
+		if k.Algorithm != AlgES256 {
+			return fmt.Errorf("key %s is ECDSA but marked %s", k.ID, k.Algorithm)
+		}
+		k.signKey, k.verifyKey = p, &p.PublicKey
+	case ed25519.PrivateKey:
+		if k.Algorithm != AlgEdDSA {
+			return fmt.Errorf("key %s is Ed25519 but marked %s", k.ID, k.Algorithm)
+		}
+		k.signKey, k.verifyKey = p, p.Public()
+	default:
+		return fmt.Errorf("key %s has unsupported type %T", k.ID, priv)
+	}
+	return nil
+}
+
+func (k *SigningKey) method() jwt.SigningMethod {
+	return jwt.GetSigningMethod(k.Algorithm)
+}
+
+// Keyring signs tokens with its active key and verifies them by kid
+type Keyring struct {
+	mu     sync.RWMutex
+	keys   []*SigningKey // newest first; the first unretired key signs
+	legacy *SigningKey   // verifies tokens issued before kid headers existed
+
+	// reload, when set, is called on an unknown kid so keys created by another
+	// instance are picked up before the next scheduled sync
+	reload     func() error
+	lastReload time.Time
+}
+
+// newStaticKeyring builds a keyring around a single HS256 secret. Its kid is
+// derived from the secret so every instance sharing it agrees on the name.
+func newStaticKeyring(secret []byte) *Keyring {
+	sum := sha256.Sum256(secret)
+	key := &SigningKey{
+		ID:        hex.EncodeToString(sum[:4]),
+		Algorithm: AlgHS256,
+		Material:  secret,
+	}
+	key.init()
+	return &Keyring{keys: []*SigningKey{key}, legacy: key}
+}
+
+func (k *Keyring) active() *SigningKey {
+	for _, key := range k.keys {
+		if key.Retired.IsZero() {
+			return key
+		}
+	}
+	return nil
+}
+
+// Sign signs claims with the active key and sets its kid header
+func (k *Keyring) Sign(claims jwt.Claims) (string, error) {
+	k.mu.RLock()
+	key := k.active()
+	k.mu.RUnlock()
+
+	if key == nil {
+		return "", fmt.Errorf("no active signing key")
+	}
+
+	token := jwt.NewWithClaims(key.method(), claims)
+	token.Header["kid"] = key.ID
+	return token.SignedString(key.signKey)
+}
+
+func (k *Keyring) lookup(kid string) *SigningKey {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	if k.legacy != nil && (kid == "" || kid == k.legacy.ID) {
+		return k.legacy
+	}
+	for _, key := range k.keys {
+		if key.ID == kid {
+			return key
+		}
+	}
+	return nil
+}
+
+// Keyfunc resolves the verification key for a token, refusing any token
+// whose alg does not match the key it names
+func (k *Keyring) Keyfunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+
+	key := k.lookup(kid)
+	if key == nil && kid != "" && k.reload != nil {
+		k.mu.Lock()
+		stale := time.Since(k.lastReload) > 10*time.Second
+		if stale {
+			k.lastReload = time.Now()
+		}
+		k.mu.Unlock()
+
+		if stale {
+			if err := k.reload(); err != nil {
+				log.Printf("Failed to reload JWT keyring: %v", err)
+			}
+			key = k.lookup(kid)
+		}
+	}
+
+	if key == nil {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	if token.Method.Alg() != key.Algorithm {
+		return nil, fmt.Errorf("token alg %s does not match key %s", token.Method.Alg(), key.ID)
+	}
+	return key.verifyKey, nil
+}
+
+// setKeys replaces the managed keys, keeping the legacy key for verification
+func (k *Keyring) setKeys(keys []*SigningKey) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys = keys
+}
+
+// JWK is a public key in RFC 7517 form
+type JWK struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y,omitempty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+}
+
+// JWKS returns the public halves of all asymmetric keys still in the ring
+func (k *Keyring) JWKS() []JWK {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	b64 := base64.RawURLEncoding.EncodeToString
+	jwks := []JWK{}
+	for _, key := range k.keys {
+		switch pub := key.verifyKey.(type) {
+		case ed25519.PublicKey:
+			jwks = append(jwks, JWK{Kty: "OKP", Crv: "Ed25519", X: b64(pub), Kid: key.ID, Alg: key.Algorithm, Use: "sig"})
+		case *ecdsa.PublicKey:
+			ecdhPub, err := pub.ECDH()
+			if err != nil {
+				continue
+			}
+			// Uncompressed point: 0x04 || X || Y
+			point := ecdhPub.Bytes()
+			jwks = append(jwks, JWK{Kty: "EC", Crv: "P-256", X: b64(point[1:33]), Y: b64(point[33:]), Kid: key.ID, Alg: key.Algorithm, Use: "sig"})
+		}
+	}
+	return jwks
+}
+
+// KeyringManager keeps the managed keyring in storage, so every instance
+// signs with the same key, and rotates it on a schedule
+type KeyringManager struct {
+	Keyring   *Keyring
+	Algorithm string
+	// Interval between rotations; zero generates one key and keeps it
+	Interval time.Duration
+	// Overlap is how long a retired key keeps verifying tokens
+	Overlap time.Duration
+}
+
+// Sync rotates and prunes the stored keyring if due, then loads it
+func (m *KeyringManager) Sync() error {
+	var stored []*SigningKey
+	err := updateWithRetry([]string{keyringStorageKey}, func(current map[string][]byte) (map[string][]byte, error) {
+		stored = nil
+		if data, ok := current[keyringStorageKey]; ok {
+			if err := json.Unmarshal(data, &stored); err != nil {
+				return nil, fmt.Errorf("failed to decode keyring: %v", err)
+			}
+		}
+
+		now := time.Now().UTC()
+		changed := false
+
+		var active *SigningKey
+		for _, key := range stored {
+			if key.Retired.IsZero() && key.Algorithm == m.Algorithm {
+				active = key
+				break
+			}
+		}
+
+		if active == nil || (m.Interval > 0 && now.Sub(active.Created) >= m.Interval) {
+			next, err := newSigningKey(m.Algorithm)
+			if err != nil {
+				return nil, err
+			}
+			for _, key := range stored {
+				if key.Retired.IsZero() {
+					key.Retired = now
+				}
+			}
+			stored = append([]*SigningKey{next}, stored...)
+			changed = true
+			log.Printf("Rotated JWT signing key: new %s key %s", next.Algorithm, next.ID)
+		}
+
+		kept := stored[:0]
+		for _, key := range stored {
+			if !key.Retired.IsZero() && now.Sub(key.Retired) > m.Overlap {
+				log.Printf("Dropping JWT signing key %s retired at %s", key.ID, key.Retired.Format(time.RFC3339))
+				changed = true
+				continue
+			}
+			kept = append(kept, key)
+		}
+		stored = kept
+
+		if !changed {
+			return nil, nil
+		}
+		data, err := json.Marshal(stored)
+		if err != nil {
+			return nil, err
+		}
+		return map[string][]byte{keyringStorageKey: data}, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, key := range stored {
+		if key.signKey == nil {
+			if err := key.init(); err != nil {
+				return err
+			}
+		}
+	}
+	m.Keyring.setKeys(stored)
+	return nil
+}
+
+// Run syncs the keyring every interval until the process exits
+func (m *KeyringManager) Run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := m.Sync(); err != nil {
+			log.Printf("JWT keyring sync failed: %v", err)
+		}
+	}
+}
+
+// setupKeyring configures the global keyring from the environment.
+// JWT_ALGORITHM or JWT_ROTATION_INTERVAL switch to a managed, rotating
+// keyring; otherwise JWT_SECRET is the only (HS256) key. JWT_SECRET, when set,
+// keeps verifying tokens issued before the switch.
+func setupKeyring() (*KeyringManager, error) {
+	jwtSecret := getEnv("JWT_SECRET", defaultJWTSecret)
+	devMode := getEnv("DEV_MODE", "false") == "true"
+	alg := getEnv("JWT_ALGORITHM", "")
+
+	interval, err := parseDurationEnv("JWT_ROTATION_INTERVAL", 0)
+	if err != nil {
+		return nil, err
+	}
+	overlap, err := parseDurationEnv("JWT_KEY_OVERLAP", 24*time.Hour)
+	if err != nil {
+		return nil, err
+	}
+
+	if alg == "" && interval == 0 {
+		if jwtSecret == defaultJWTSecret && !devMode {
+			return nil, fmt.Errorf("JWT_SECRET is unset or still the default; set a real secret, configure JWT_ALGORITHM, or set DEV_MODE=true")
+		}
+		keyring = newStaticKeyring([]byte(jwtSecret))
+		return nil, nil
+	}
+
+	if alg == "" {
+		alg = AlgEdDSA
+	}
+	if overlap < accessTokenTTL {
+		return nil, fmt.Errorf("JWT_KEY_OVERLAP must be at least the access token lifetime (%s)", accessTokenTTL)
+	}
+
+	kr := &Keyring{}
+	if jwtSecret != defaultJWTSecret {
+		kr.legacy = newStaticKeyring([]byte(jwtSecret)).legacy
+	}
+
+	manager := &KeyringManager{Keyring: kr, Algorithm: alg, Interval: interval, Overlap: overlap}
+	kr.reload = manager.Sync
+	if err := manager.Sync(); err != nil {
+		return nil, err
+	}
+
+	keyring = kr
+	return manager, nil
+}
+
+func parseDurationEnv(key string, defaultValue time.Duration) (time.Duration, error) {
+	value := getEnv(key, "")
+	if value == "" {
+		return defaultValue, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %v", key, err)
+	}
+	return d, nil
+}
+
+func handleJWKS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"keys": keyring.JWKS(),
+	})
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// useManagedKeyring installs a storage-backed keyring for the duration of a test
+func useManagedKeyring(t *testing.T, alg string, interval time.Duration) *KeyringManager {
+	previous := keyring
+	t.Cleanup(func() { keyring = previous })
+
+	kr := &Keyring{}
+	m := &KeyringManager{Keyring: kr, Algorithm: alg, Interval: interval, Overlap: time.Hour}
+	kr.reload = m.Sync
+	if err := m.Sync(); err != nil {
+		t.Fatalf("Failed to sync keyring: %v", err)
+	}
+	keyring = kr
+	return m
+}
+
+// ageStoredKeys rewrites the stored keyring, applying fn to every key
+func ageStoredKeys(t *testing.T, fn func(*SigningKey)) {
+	data, err := storage.Get(keyringStorageKey)
+	if err != nil {
+		t.Fatalf("Expected stored keyring: %v", err)
+	}
+	var keys []*SigningKey
+	json.Unmarshal(data, &keys)
+	for _, k := range keys {
+		fn(k)
+	}
+	data, _ = json.Marshal(keys)
+	storage.Put(keyringStorageKey, data)
+}
+
+func TestKeyringAlgorithms(t *testing.T) {
+	for _, alg := range []string{AlgHS256, AlgES256, AlgEdDSA} {
+		t.Run(alg, func(t *testing.T) {
+			storage = NewMockStorage()
+			useManagedKeyring(t, alg, 0)
+
+			token := generateToken("client-123", "")
+			parsed, _, err := jwt.NewParser().ParseUnverified(token, &ClientClaims{})
+			if err != nil {
+				t.Fatalf("Failed to parse token: %v", err)
+			}
+			if parsed.Method.Alg() != alg {
+				t.Errorf("Expected alg %s, got %s", alg, parsed.Method.Alg())
+			}
+			if kid, _ := parsed.Header["kid"].(string); kid == "" {
+				t.Error("Expected kid header")
+			}
+
+			if clientID, err := validateToken(token); err != nil || clientID != "client-123" {
+				t.Errorf("Expected token to validate, got %s (%v)", clientID, err)
+			}
+		})
+	}
+}
+
+// Test scheduled rotation with an overlap window
+func TestKeyringRotation(t *testing.T) {
+	storage = NewMockStorage()
+	m := useManagedKeyring(t, AlgEdDSA, time.Hour)
+
+	oldToken := generateToken("client-123", "")
+	oldKid := keyring.active().ID
+
+	// Not due yet: no rotation
+	m.Sync()
+	if keyring.active().ID != oldKid {
+		t.Fatal("Expected no rotation before the interval elapsed")
+	}
+
+	ageStoredKeys(t, func(k *SigningKey) { k.Created = k.Created.Add(-2 * time.Hour) })
+	m.Sync()
+
+	if keyring.active().ID == oldKid {
+		t.Fatal("Expected a new active key after the interval")
+	}
+	if _, err := validateToken(oldToken); err != nil {
+		t.Errorf("Expected token from retired key to verify during overlap, got %v", err)
+	}
+	if len(keyring.JWKS()) != 2 {
+		t.Errorf("Expected both keys in JWKS during overlap, got %d", len(keyring.JWKS()))
+	}
+
+	ageStoredKeys(t, func(k *SigningKey) {
+		if !k.Retired.IsZero() {
+			k.Retired = k.Retired.Add(-2 * time.Hour)
+		}
+	})
+	m.Sync()
+
+	if _, err := validateToken(oldToken); err == nil {
+		t.Error("Expected token from pruned key to be rejected")
+	}
+	if _, err := validateToken(generateToken("client-123", "")); err != nil {
+		t.Errorf("Expected token from new key to verify, got %v", err)
+	}
+}
+
+// Test that a key created by another instance is picked up on first use
+func TestKeyringReloadsUnknownKid(t *testing.T) {
+	storage = NewMockStorage()
+	useManagedKeyring(t, AlgES256, 0)
+
+	other := &Keyring{}
+	otherManager := &KeyringManager{Keyring: other, Algorithm: AlgES256, Overlap: time.Hour}
+	ageStoredKeys(t, func(k *SigningKey) { k.Retired = time.Now() })
+	if err := otherManager.Sync(); err != nil {
+		t.Fatalf("Failed to sync second instance: %v", err)
+	}
+
+	token, _ := other.Sign(jwt.RegisteredClaims{Subject: "client-123", ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute))})
+	if _, err := validateToken(token); err != nil {
+		t.Errorf("Expected token signed by another instance to verify, got %v", err)
+	}
+}
+
+// Test that a token cannot switch algorithms under a known kid
+func TestKeyringRejectsAlgorithmMismatch(t *testing.T) {
+	storage = NewMockStorage()
+	useManagedKeyring(t, AlgEdDSA, 0)
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{Subject: "client-123"})
+	token.Header["kid"] = keyring.active().ID
+	forged, _ := token.SignedString([]byte("attacker-secret"))
+
+	if _, err := validateToken(forged); err == nil {
+		t.Error("Expected HS256 token under an EdDSA kid to be rejected")
+	}
+}
+
+func TestHandleJWKS(t *testing.T) {
+	storage = NewMockStorage()
+	useManagedKeyring(t, AlgES256, 0)
+
+	w := requestForTest("GET", "/.well-known/jwks.json", "", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+
+	var body struct {
+		Keys []JWK `json:"keys"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &body)
+	if len(body.Keys) != 1 {
+		t.Fatalf("Expected 1 key, got %d", len(body.Keys))
+	}
+	k := body.Keys[0]
+	if k.Kty != "EC" || k.Crv != "P-256" || k.X == "" || k.Y == "" || k.Kid != keyring.active().ID {
+		t.Errorf("Unexpected JWK: %+v", k)
+	}
+}
+
+// Test that startup refuses the default secret outside dev mode
+func TestSetupKeyringDefaultSecret(t *testing.T) {
+	previous := keyring
+	defer func() { keyring = previous }()
+	storage = NewMockStorage()
+
+	tests := []struct {
+		name    string
+		env     map[string]string
+		wantErr bool
+	}{
+		{"default secret", map[string]string{}, true},
+		{"default secret in dev mode", map[string]string{"DEV_MODE": "true"}, false},
+		{"explicit secret", map[string]string{"JWT_SECRET": "a-real-secret"}, false},
+		{"managed keyring", map[string]string{"JWT_ALGORITHM": "EdDSA"}, false},
+		{"overlap shorter than token lifetime", map[string]string{"JWT_ALGORITHM": "EdDSA", "JWT_KEY_OVERLAP": "1m"}, true},
+		{"unknown algorithm", map[string]string{"JWT_ALGORITHM": "none"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, key := range []string{"JWT_SECRET", "DEV_MODE", "JWT_ALGORITHM", "JWT_ROTATION_INTERVAL", "JWT_KEY_OVERLAP"} {
+				t.Setenv(key, tt.env[key])
+			}
+			storage = NewMockStorage()
+
+			_, err := setupKeyring()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Expected error %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/glassrye/soltar"
+)
+
+type (
+	StatusTransition    = soltar.StatusTransition
+	EnvironmentAction   = soltar.EnvironmentAction
+	EnvironmentResponse = soltar.EnvironmentResponse
+)
+
+const (
+	EnvironmentPending        = soltar.EnvironmentPending
+	EnvironmentProvisioning   = soltar.EnvironmentProvisioning
+	EnvironmentActive         = soltar.EnvironmentActive
+	EnvironmentSuspended      = soltar.EnvironmentSuspended
+	EnvironmentDeprovisioning = soltar.EnvironmentDeprovisioning
+	EnvironmentDeleted        = soltar.EnvironmentDeleted
+	EnvironmentFailed         = soltar.EnvironmentFailed
+
+	ErrCodeEnvironmentNotActive = soltar.ErrCodeEnvironmentNotActive
+	ErrCodeEnvironmentDeleted   = soltar.ErrCodeEnvironmentDeleted
+	ErrCodeInvalidTransition    = soltar.ErrCodeInvalidTransition
+)
+
+// Actors recorded on transitions; operators are recorded as admin:<name>
+const (
+	actorClient = "client"
+	actorSystem = "system"
+)
+
+// maxTransitions bounds the history kept on an environment
+const maxTransitions = 20
+
+// environmentTransitions lists the states each state may move to
+var environmentTransitions = map[string][]string{
+	EnvironmentPending:        {EnvironmentProvisioning, EnvironmentDeprovisioning, EnvironmentFailed},
+	EnvironmentProvisioning:   {EnvironmentActive, EnvironmentFailed},
+	EnvironmentActive:         {EnvironmentSuspended, EnvironmentDeprovisioning},
+	EnvironmentSuspended:      {EnvironmentActive, EnvironmentDeprovisioning},
+	EnvironmentFailed:         {EnvironmentProvisioning, EnvironmentDeprovisioning},
+	EnvironmentDeprovisioning: {EnvironmentDeleted, EnvironmentFailed},
+	EnvironmentDeleted:        {},
+}
+
+// TransitionError is returned for a transition the current state does not allow
+type TransitionError struct {
+	From, To string
+}
+
+func (e *TransitionError) Error() string {
+	return fmt.Sprintf("environment is %s and cannot become %s", e.From, e.To)
+}
+
+// errResumeForbidden refuses a client resuming an operator's suspension
+var errResumeForbidden = errors.New("environment was suspended by an operator")
+
+// environmentState is the lifecycle state of env. Records written before
+// the lifecycle existed are active.
+func environmentState(env Environment) string {
+	if env.Status == "" {
+		return EnvironmentActive
+	}
+	return env.Status
+}
+
+func canTransition(from, to string) bool {
+	for _, next := range environmentTransitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// applyTransition moves env to state, recording when, why and by whom
+func applyTransition(env *Environment, to, reason, actor string) error {
+	from := environmentState(*env)
+	if !canTransition(from, to) {
+		return &TransitionError{From: from, To: to}
+	}
+
+	now := time.Now()
+	env.Status = to
+	env.StatusReason = reason
+	env.StatusChanged = &now
+	env.Transitions = append(env.Transitions, StatusTransition{From: from, To: to, Time: now, Reason: reason, Actor: actor})
+	if len(env.Transitions) > maxTransitions {
+		env.Transitions = env.Transitions[len(env.Transitions)-maxTransitions:]
+	}
+	return nil
+}
+
+// transitionEnvironment atomically moves the environment of clientID to
+// state and returns the updated environment. A deleted environment drops its
+// environment:<id> index in the same write; the client record keeps it as a
+// tombstone.
+func transitionEnvironment(clientID, to, reason, actor string) (*Environment, error) {
+	var env Environment
+	err := updateClientRecords(clientID, func(client *ClientData) (map[string][]byte, error) {
+		if err := applyTransition(&client.Environment, to, reason, actor); err != nil {
+			return nil, err
+		}
+		env = client.Environment
+		if to == EnvironmentDeleted {
+			return map[string][]byte{environmentKey(env.ID): nil}, nil
+		}
+		return nil, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Environment %s of client %s is now %s (%s)", env.ID, clientID, to, actor)
+	return &env, nil
+}
+
+// suspendEnvironment stops an active environment from handing out configs
+func suspendEnvironment(clientID, reason, actor string) (*Environment, error) {
+	return transitionEnvironment(clientID, EnvironmentSuspended, reason, actor)
+}
+
+// resumeEnvironment reactivates a suspended environment. Clients may only
+// lift their own suspensions.
+func resumeEnvironment(clientID, actor string) (*Environment, error) {
+	var env Environment
+	err := updateClientChecked(clientID, func(client *ClientData) error {
+		if actor == actorClient && environmentState(client.Environment) == EnvironmentSuspended {
+			if by := lastTransitionActor(client.Environment, EnvironmentSuspended); by != actorClient {
+				return errResumeForbidden
+			}
+		}
+		if err := applyTransition(&client.Environment, EnvironmentActive, "", actor); err != nil {
+			return err
+		}
+		env = client.Environment
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Environment %s of client %s resumed (%s)", env.ID, clientID, actor)
+	return &env, nil
+}
+
+func lastTransitionActor(env Environment, to string) string {
+	for i := len(env.Transitions) - 1; i >= 0; i-- {
+		if env.Transitions[i].To == to {
+			return env.Transitions[i].Actor
+		}
+	}
+	return ""
+}
+
+// deleteEnvironment deprovisions an environment: the provisioner destroys its
+// infrastructure, its subnets go back to the pools and its WireGuard keys,
+// peers and database passwords are removed. A failed teardown leaves it failed, from where deleting
+// can be retried.
+func deleteEnvironment(clientID, reason, actor string) (*Environment, error) {
+	env, err := transitionEnvironment(clientID, EnvironmentDeprovisioning, reason, actor)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := teardownEnvironment(clientID, env.ID); err != nil {
+		log.Printf("Failed to deprovision environment %s: %v", env.ID, err)
+		if _, ferr := transitionEnvironment(clientID, EnvironmentFailed, fmt.Sprintf("deprovisioning failed: %v", err), actorSystem); ferr != nil {
+			log.Printf("Failed to mark environment %s failed: %v", env.ID, ferr)
+		}
+		return nil, err
+	}
+
+	return transitionEnvironment(clientID, EnvironmentDeleted, reason, actor)
+}
+
+func teardownEnvironment(clientID, environmentID string) error {
+	if err := destroyProvisioned(environmentID); err != nil {
+		return fmt.Errorf("failed to destroy infrastructure: %v", err)
+	}
+	if err := releaseEnvironmentNetwork(environmentID); err != nil {
+		return fmt.Errorf("failed to release subnets: %v", err)
+	}
+	if err := deleteDatabasePasswords(environmentID); err != nil {
+		return fmt.Errorf("failed to delete database passwords: %v", err)
+	}
+	for _, key := range []string{wireGuardServerKey(environmentID), wireGuardPeersKey(clientID), reconcileStatusKey(clientID)} {
+		if err := storage.Delete(key); err != nil {
+			return fmt.Errorf("failed to delete %s: %v", key, err)
+		}
+	}
+	return updateClient(clientID, func(client *ClientData) {
+		client.Environment.Subnets = nil
+	})
+}
+
+// requireActiveEnvironment answers 403 with the state and its reason unless
+// the client's environment is active, or 410 once it is deleted
+func requireActiveEnvironment(w http.ResponseWriter, client *ClientData) bool {
+	state := environmentState(client.Environment)
+	if state == EnvironmentActive {
+		return true
+	}
+	if state == EnvironmentDeleted {
+		writeError(w, http.StatusGone, ErrorResponse{
+			Error:   ErrCodeEnvironmentDeleted,
+			Message: "Environment was deleted",
+		})
+		return false
+	}
+
+	message := fmt.Sprintf("Environment is %s", state)
+	if client.Environment.StatusReason != "" {
+		message += ": " + client.Environment.StatusReason
+	}
+	writeError(w, http.StatusForbidden, ErrorResponse{
+		Error:   ErrCodeEnvironmentNotActive,
+		Message: message,
+	})
+	return false
+}
+
+// writeTransitionResult answers an environment action with the updated
+// environment, or the reason it was refused
+func writeTransitionResult(w http.ResponseWriter, clientID string, env *Environment, err error) {
+	var transitionErr *TransitionError
+	switch {
+	case errors.As(err, &transitionErr):
+		writeError(w, http.StatusConflict, ErrorResponse{
+			Error:   ErrCodeInvalidTransition,
+			Message: transitionErr.Error(),
+		})
+	case err == errResumeForbidden:
+		writeError(w, http.StatusForbidden, ErrorResponse{
+			Error:   ErrCodeInvalidTransition,
+			Message: "Environment was suspended by an operator and can only be resumed by one",
+		})
+	case err != nil:
+		log.Printf("Environment action for %s failed: %v", clientID, err)
+		http.Error(w, "Failed to update environment", http.StatusInternalServerError)
+	default:
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(EnvironmentResponse{ClientID: clientID, Environment: *env})
+	}
+}
+
+// decodeEnvironmentAction reads the optional body of an environment action
+func decodeEnvironmentAction(w http.ResponseWriter, r *http.Request) (EnvironmentAction, bool) {
+	var action EnvironmentAction
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&action); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return action, false
+		}
+	}
+	return action, true
+}
+
+func handleGetEnvironment(w http.ResponseWriter, r *http.Request) {
+	claims, ok := authenticateClient(w, r)
+	if !ok {
+		return
+	}
+
+	clientData := getClientInfrastructure(claims.Subject)
+	if clientData == nil {
+		http.Error(w, "Client not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(EnvironmentResponse{ClientID: clientData.ID, Environment: clientData.Environment})
+}
+
+// handleEnvironmentAction serves POST /environment/{suspend,resume} and
+// DELETE /environment for the client's own environment
+func handleEnvironmentAction(w http.ResponseWriter, r *http.Request, action string) {
+	claims, ok := authenticateClient(w, r)
+	if !ok {
+		return
+	}
+	req, ok := decodeEnvironmentAction(w, r)
+	if !ok {
+		return
+	}
+	if getClientInfrastructure(claims.Subject) == nil {
+		http.Error(w, "Client not found", http.StatusNotFound)
+		return
+	}
+
+	env, err := runEnvironmentAction(claims.Subject, action, req.Reason, actorClient)
+	writeTransitionResult(w, claims.Subject, env, err)
+}
+
+// handleAdminEnvironmentAction serves the operator versions of the actions,
+// addressed by environment ID
+func handleAdminEnvironmentAction(w http.ResponseWriter, r *http.Request, identity AdminIdentity, environmentID, action string) {
+	req, ok := decodeEnvironmentAction(w, r)
+	if !ok {
+		return
+	}
+	clientData := getClientByEnvironment(environmentID)
+	if clientData == nil {
+		http.Error(w, "Environment not found", http.StatusNotFound)
+		return
+	}
+
+	env, err := runEnvironmentAction(clientData.ID, action, req.Reason, "admin:"+identity.Name)
+	writeTransitionResult(w, clientData.ID, env, err)
+}
+
+func runEnvironmentAction(clientID, action, reason, actor string) (*Environment, error) {
+	switch action {
+	case "suspend":
+		return suspendEnvironment(clientID, reason, actor)
+	case "resume":
+		return resumeEnvironment(clientID, actor)
+	default:
+		return deleteEnvironment(clientID, reason, actor)
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestEnvironmentTransitions(t *testing.T) {
+	tests := []struct {
+		from, to string
+		want     bool
+	}{
+		{EnvironmentPending, EnvironmentProvisioning, true},
+		{EnvironmentProvisioning, EnvironmentActive, true},
+		{EnvironmentActive, EnvironmentSuspended, true},
+		{EnvironmentSuspended, EnvironmentActive, true},
+		{EnvironmentActive, EnvironmentDeprovisioning, true},
+		{EnvironmentDeprovisioning, EnvironmentDeleted, true},
+		{EnvironmentFailed, EnvironmentProvisioning, true},
+		{EnvironmentPending, EnvironmentActive, false},
+		{EnvironmentActive, EnvironmentDeleted, false},
+		{EnvironmentSuspended, EnvironmentSuspended, false},
+		{EnvironmentDeleted, EnvironmentActive, false},
+		{EnvironmentDeleted, EnvironmentDeprovisioning, false},
+	}
+
+	for _, tt := range tests {
+		if got := canTransition(tt.from, tt.to); got != tt.want {
+			t.Errorf("canTransition(%s, %s) = %v, want %v", tt.from, tt.to, got, tt.want)
+		}
+	}
+
+	// Every state a transition leads to must itself be known
+	for from, targets := range environmentTransitions {
+		for _, to := range targets {
+			if _, ok := environmentTransitions[to]; !ok {
+				t.Errorf("%s leads to unknown state %s", from, to)
+			}
+		}
+	}
+}
+
+func TestNewEnvironmentIsProvisioned(t *testing.T) {
+	storage = NewMockStorage()
+	client := getOrCreateClientWithInfrastructure("test@example.com")
+
+	env := client.Environment
+	if env.Status != EnvironmentActive || env.StatusChanged == nil {
+		t.Fatalf("Expected an active environment with a transition time, got %+v", env)
+	}
+	var path []string
+	for _, tr := range env.Transitions {
+		path = append(path, tr.From+">"+tr.To)
+		if tr.Actor != actorSystem {
+			t.Errorf("Expected provisioning by %s, got %s", actorSystem, tr.Actor)
+		}
+	}
+	if got := strings.Join(path, ","); got != "pending>provisioning,provisioning>active" {
+		t.Errorf("Unexpected transitions %s", got)
+	}
+
+	// Records from before the lifecycle have no status history
+	if environmentState(Environment{}) != EnvironmentActive {
+		t.Error("Expected an environment without status to count as active")
+	}
+}
+
+func TestSuspendedEnvironmentRefusesConnect(t *testing.T) {
+	storage = NewMockStorage()
+	client := getOrCreateClientWithInfrastructure("test@example.com")
+	token := generateToken(client.ID, "")
+
+	w := requestForTest("POST", "/environment/suspend", token, EnvironmentAction{Reason: "travelling"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected suspend to succeed, got %d: %s", w.Code, w.Body.String())
+	}
+	var resp EnvironmentResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if resp.Environment.Status != EnvironmentSuspended || resp.Environment.StatusReason != "travelling" {
+		t.Errorf("Unexpected environment %+v", resp.Environment)
+	}
+
+	for _, path := range []string{"/connect", "/config"} {
+		method := "GET"
+		if path == "/connect" {
+			method = "POST"
+		}
+		w := requestForTest(method, path, token, nil)
+		var errResp ErrorResponse
+		json.Unmarshal(w.Body.Bytes(), &errResp)
+		if w.Code != http.StatusForbidden || errResp.Error != ErrCodeEnvironmentNotActive {
+			t.Errorf("%s: expected 403 %s, got %d: %s", path, ErrCodeEnvironmentNotActive, w.Code, w.Body.String())
+		}
+		if errResp.Message != "Environment is suspended: travelling" {
+			t.Errorf("%s: expected the state and reason, got %q", path, errResp.Message)
+		}
+	}
+
+	// Suspending twice is not a transition
+	if w := requestForTest("POST", "/environment/suspend", token, nil); w.Code != http.StatusConflict {
+		t.Errorf("Expected 409 when suspending a suspended environment, got %d", w.Code)
+	}
+
+	if w := requestForTest("POST", "/environment/resume", token, nil); w.Code != http.StatusOK {
+		t.Fatalf("Expected resume to succeed, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := requestForTest("POST", "/connect", token, nil); w.Code != http.StatusOK {
+		t.Errorf("Expected connect to work after resume, got %d", w.Code)
+	}
+}
+
+func TestOperatorSuspension(t *testing.T) {
+	storage = NewMockStorage()
+	useTestAdminKeys(t)
+	client := getOrCreateClientWithInfrastructure("test@example.com")
+	token := generateToken(client.ID, "")
+	path := "/admin/environments/" + client.Environment.ID
+
+	if w := requestForTest("POST", path+"/suspend", "viewer-key", nil); w.Code != http.StatusForbidden {
+		t.Errorf("Expected viewers to be refused, got %d", w.Code)
+	}
+	if w := requestForTest("POST", path+"/suspend", "operator-key", EnvironmentAction{Reason: "unpaid"}); w.Code != http.StatusOK {
+		t.Fatalf("Expected operator suspend to succeed, got %d: %s", w.Code, w.Body.String())
+	}
+
+	env := getClientInfrastructure(client.ID).Environment
+	if last := env.Transitions[len(env.Transitions)-1]; last.Actor != "admin:alice" || last.Reason != "unpaid" {
+		t.Errorf("Expected the operator and reason to be recorded, got %+v", last)
+	}
+
+	// The client cannot lift an operator's suspension
+	if w := requestForTest("POST", "/environment/resume", token, nil); w.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 for a client resuming an operator suspension, got %d", w.Code)
+	}
+	if w := requestForTest("POST", path+"/resume", "operator-key", nil); w.Code != http.StatusOK {
+		t.Errorf("Expected operator resume to succeed, got %d", w.Code)
+	}
+	if w := requestForTest("POST", "/admin/environments/nope/suspend", "operator-key", nil); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown environment, got %d", w.Code)
+	}
+}
+
+func TestDeleteEnvironmentReleasesNetwork(t *testing.T) {
+	storage = NewMockStorage()
+	useTestAdminKeys(t)
+	client := getOrCreateClientWithInfrastructure("test@example.com")
+	token := generateToken(client.ID, "")
+
+	if w := requestForTest("GET", "/config", token, nil); w.Code != http.StatusOK {
+		t.Fatalf("Expected config to succeed, got %d: %s", w.Code, w.Body.String())
+	}
+	if network, _ := getEnvironmentNetwork(client.Environment.ID); network == nil {
+		t.Fatal("Expected config to allocate subnets")
+	}
+
+	w := requestForTest("DELETE", "/environment", token, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected delete to succeed, got %d: %s", w.Code, w.Body.String())
+	}
+	var resp EnvironmentResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if resp.Environment.Status != EnvironmentDeleted || len(resp.Environment.Subnets) != 0 {
+		t.Errorf("Expected a deleted environment without subnets, got %+v", resp.Environment)
+	}
+
+	if network, _ := getEnvironmentNetwork(client.Environment.ID); network != nil {
+		t.Error("Expected subnets to be released")
+	}
+	// The next environment gets the freed subnets
+	if next, err := ensureEnvironmentNetwork("env-next"); err != nil || next.Subnets[FamilyIPv4] != "10.13.0.0/24" {
+		t.Errorf("Expected the freed subnet 10.13.0.0/24, got %+v, %v", next, err)
+	}
+	for _, key := range []string{wireGuardServerKey(client.Environment.ID), wireGuardPeersKey(client.ID)} {
+		if _, err := storage.Get(key); err == nil {
+			t.Errorf("Expected %s to be removed", key)
+		}
+	}
+
+	// Deleted is final
+	if w := requestForTest("POST", "/environment/resume", token, nil); w.Code != http.StatusConflict {
+		t.Errorf("Expected 409 resuming a deleted environment, got %d", w.Code)
+	}
+	for _, path := range []string{"/connect", "/config"} {
+		method := "GET"
+		if path == "/connect" {
+			method = "POST"
+		}
+		w := requestForTest(method, path, token, nil)
+		var errResp ErrorResponse
+		json.Unmarshal(w.Body.Bytes(), &errResp)
+		if w.Code != http.StatusGone || errResp.Error != ErrCodeEnvironmentDeleted {
+			t.Errorf("%s: expected 410 %s, got %d: %s", path, ErrCodeEnvironmentDeleted, w.Code, w.Body.String())
+		}
+	}
+
+	// The index is gone; the client record keeps the tombstone
+	if _, err := storage.Get(environmentKey(client.Environment.ID)); err == nil {
+		t.Error("Expected the environment index to be removed")
+	}
+	if w := requestForTest("POST", "/admin/environments/"+client.Environment.ID+"/resume", "operator-key", nil); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a deleted environment, got %d", w.Code)
+	}
+	if current := getClientInfrastructure(client.ID); current.Environment.ID != client.Environment.ID || current.Environment.Status != EnvironmentDeleted {
+		t.Errorf("Expected the client to keep the deleted environment, got %+v", current.Environment)
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Mailer delivers one-time passwords to a client's email address
+type Mailer interface {
+	SendOTP(to, otp string) error
+}
+
+const defaultOTPBodyTemplate = `Your Soltar VPN one-time password is: {{.OTP}}
+
+This code will expire in {{.ExpiresIn}}.
+If you did not request it, you can ignore this email.
+`
+
+// MailTemplate holds the sender details and body template shared by all
+// mailers that produce a real message
+type MailTemplate struct {
+	From    string
+	Subject string
+	Body    *template.Template
+}
+
+// otpTemplateData is the data passed to the OTP body template
+type otpTemplateData struct {
+	Email     string
+	OTP       string
+	ExpiresIn string
+}
+
+func NewMailTemplate(from, subject, bodyPath string) (MailTemplate, error) {
+	text := defaultOTPBodyTemplate
+	if bodyPath != "" {
+		data, err := os.ReadFile(bodyPath)
+		if err != nil {
+			return MailTemplate{}, fmt.Errorf("failed to read email template: %v", err)
+		}
+		text = string(data)
+	}
+
+	body, err := template.New("otp").Parse(text)
+	if err != nil {
+		return MailTemplate{}, fmt.Errorf("failed to parse email template: %v", err)
+	}
+
+	return MailTemplate{From: from, Subject: subject, Body: body}, nil
+}
+
+// render builds an RFC 5322 message for the given recipient and OTP
+func (t MailTemplate) render(to, otp string) ([]byte, error) {
+	if strings.ContainsAny(to, "\r\n") {
+		return nil, fmt.Errorf("invalid recipient %q", to)
+	}
+
+	data := otpTemplateData{
+		Email:     to,
+		OTP:       otp,
+		ExpiresIn: fmt.Sprintf("%d minutes", int(otpTTL.Minutes())),
+	}
+
+	var body bytes.Buffer
+	if err := t.Body.Execute(&body, data); err != nil {
+		return nil, fmt.Errorf("failed to render email template: %v", err)
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", t.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", to)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", t.Subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Message-ID: <%s@%s>\r\n", randomHex(16), senderDomain(t.From))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	msg.WriteString("\r\n")
+	msg.WriteString(strings.ReplaceAll(strings.ReplaceAll(body.String(), "\r\n", "\n"), "\n", "\r\n"))
+
+	return msg.Bytes(), nil
+}
+
+// SMTPMailer sends OTP emails through an SMTP relay, upgrading to TLS with
+// STARTTLS whenever the server offers it
+type SMTPMailer struct {
+	Host       string
+	Port       string
+	Username   string
+	Password   string
+	RequireTLS bool
+	Timeout    time.Duration
+	Template   MailTemplate
+}
+
+func (m *SMTPMailer) SendOTP(to, otp string) error {
+	msg, err := m.Template.render(to, otp)
+	if err != nil {
+		return err
+	}
+
+	timeout := m.Timeout
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(m.Host, m.Port), timeout)
+	if err != nil {
+		return fmt.Errorf("failed to connect to SMTP server: %v", err)
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	c, err := smtp.NewClient(conn, m.Host)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("failed to start SMTP session: %v", err)
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: m.Host}); err != nil {
+			return fmt.Errorf("STARTTLS failed: %v", err)
+		}
+	} else if m.RequireTLS {
+		return fmt.Errorf("SMTP server %s does not support STARTTLS", m.Host)
+	}
+
+	if m.Username != "" {
+		auth := smtp.PlainAuth("", m.Username, m.Password, m.Host)
+		if err := c.Auth(auth); err != nil {
+			return fmt.Errorf("SMTP authentication failed: %v", err)
+		}
+	}
+
+	if err := c.Mail(envelopeAddress(m.Template.From)); err != nil {
+		return fmt.Errorf("SMTP MAIL FROM rejected: %v", err)
+	}
+	if err := c.Rcpt(to); err != nil {
+		return fmt.Errorf("SMTP RCPT TO rejected: %v", err)
+	}
+
+	wc, err := c.Data()
+	if err != nil {
+		return fmt.Errorf("SMTP DATA rejected: %v", err)
+	}
+	if _, err := wc.Write(msg); err != nil {
+		wc.Close()
+		return fmt.Errorf("failed to write message: %v", err)
+	}
+	if err := wc.Close(); err != nil {
+		return fmt.Errorf("SMTP server rejected message: %v", err)
+	}
+
+	return c.Quit()
+}
+
+// LogMailer prints the OTP to the server log. It is meant for development only.
+type LogMailer struct{}
+
+func (LogMailer) SendOTP(to, otp string) error {
+	log.Printf("OTP for %s: %s", to, otp)
+	return nil
+}
+
+// FileMailer writes each message into a maildir-style directory, so tests
+// and local tooling can pick up the OTP without an SMTP server
+type FileMailer struct {
+	Dir      string
+	Template MailTemplate
+}
+
+func (m *FileMailer) SendOTP(to, otp string) error {
+	msg, err := m.Template.render(to, otp)
+	if err != nil {
+		return err
+	}
+
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(m.Dir, sub), 0700); err != nil {
+			return fmt.Errorf("failed to create maildir: %v", err)
+		}
+	}
+
+	// Write to tmp/ first and rename into new/ so readers never see a partial message
+	name := fmt.Sprintf("%d.%s.soltar", time.Now().UnixNano(), randomHex(8))
+	tmpPath := filepath.Join(m.Dir, "tmp", name)
+	if err := os.WriteFile(tmpPath, msg, 0600); err != nil {
+		return fmt.Errorf("failed to write message: %v", err)
+	}
+	if err := os.Rename(tmpPath, filepath.Join(m.Dir, "new", name)); err != nil {
+		return fmt.Errorf("failed to deliver message: %v", err)
+	}
+
+	return nil
+}
+
+// newMailerFromEnv selects the mailer named by MAILER (smtp, file or log)
+func newMailerFromEnv() (Mailer, error) {
+	kind := getEnv("MAILER", "log")
+	if kind == "log" {
+		return LogMailer{}, nil
+	}
+
+	tmpl, err := NewMailTemplate(
+		getEnv("SMTP_FROM", "noreply@soltar.com"),
+		getEnv("SMTP_SUBJECT", "Soltar VPN OTP"),
+		getEnv("OTP_EMAIL_TEMPLATE", ""),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	switch kind {
+	case "smtp":
+		host := getEnv("SMTP_HOST", "")
+		if host == "" {
+			return nil, fmt.Errorf("SMTP_HOST is required when MAILER=smtp")
+		}
+		return &SMTPMailer{
+			Host:       host,
+			Port:       getEnv("SMTP_PORT", "587"),
+			Username:   getEnv("SMTP_USER", ""),
+			Password:   getEnv("SMTP_PASS", ""),
+			RequireTLS: getEnv("SMTP_REQUIRE_TLS", "true") == "true",
+			Template:   tmpl,
+		}, nil
+	case "file":
+		return &FileMailer{
+			Dir:      getEnv("MAIL_DIR", "mail"),
+			Template: tmpl,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown MAILER %q", kind)
+	}
+}
+
+// envelopeAddress strips a display name such as "Soltar <noreply@soltar.com>"
+// down to the bare address SMTP expects in MAIL FROM
+func envelopeAddress(from string) string {
+	if addr, err := mail.ParseAddress(from); err == nil {
+		return addr.Address
+	}
+	return from
+}
+
+func senderDomain(from string) string {
+	addr := envelopeAddress(from)
+	if i := strings.LastIndex(addr, "@"); i >= 0 {
+		return addr[i+1:]
+	}
+	return "soltar"
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
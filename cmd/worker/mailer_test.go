@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeSMTPServer is a minimal SMTP stand-in that records the messages it accepts
+type fakeSMTPServer struct {
+	listener net.Listener
+	mu       sync.Mutex
+	messages []string
+	rcpts    []string
+}
+
+func startFakeSMTPServer(t *testing.T) *fakeSMTPServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+
+	s := &fakeSMTPServer{listener: l}
+	go s.serve()
+	t.Cleanup(func() { l.Close() })
+	return s
+}
+
+func (s *fakeSMTPServer) addr() (string, string) {
+	host, port, _ := net.SplitHostPort(s.listener.Addr().String())
+	return host, port
+}
+
+func (s *fakeSMTPServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *fakeSMTPServer) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+
+	reply("220 localhost ESMTP fake")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(strings.TrimSpace(line))
+		switch {
+		case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+			reply("250 localhost")
+		case strings.HasPrefix(cmd, "MAIL FROM"):
+			reply("250 OK")
+		case strings.HasPrefix(cmd, "RCPT TO"):
+			s.mu.Lock()
+			s.rcpts = append(s.rcpts, strings.TrimSpace(line))
+			s.mu.Unlock()
+			reply("250 OK")
+		case cmd == "DATA":
+			reply("354 End data with <CR><LF>.<CR><LF>")
+			var msg strings.Builder
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if l == ".\r\n" {
+					break
+				}
+				msg.WriteString(l)
+			}
+			s.mu.Lock()
+			s.messages = append(s.messages, msg.String())
+			s.mu.Unlock()
+			reply("250 OK")
+		case cmd == "QUIT":
+			reply("221 Bye")
+			return
+		default:
+			reply("502 Command not implemented")
+		}
+	}
+}
+
+func newTestMailTemplate(t *testing.T) MailTemplate {
+	tmpl, err := NewMailTemplate("Soltar <noreply@soltar.test>", "Your code", "")
+	if err != nil {
+		t.Fatalf("Failed to build template: %v", err)
+	}
+	return tmpl
+}
+
+// Test SMTP delivery against a local stand-in
+func TestSMTPMailer(t *testing.T) {
+	server := startFakeSMTPServer(t)
+	host, port := server.addr()
+
+	m := &SMTPMailer{Host: host, Port: port, Template: newTestMailTemplate(t)}
+	if err := m.SendOTP("test@example.com", "123456"); err != nil {
+		t.Fatalf("Expected delivery to succeed, got %v", err)
+	}
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	if len(server.messages) != 1 {
+		t.Fatalf("Expected 1 message, got %d", len(server.messages))
+	}
+	if !strings.Contains(server.rcpts[0], "test@example.com") {
+		t.Errorf("Expected recipient test@example.com, got %s", server.rcpts[0])
+	}
+
+	msg := server.messages[0]
+	for _, want := range []string{"Subject: Your code", "To: test@example.com", "123456", "5 minutes"} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("Expected message to contain %q, got:\n%s", want, msg)
+		}
+	}
+}
+
+// Test that a server without STARTTLS is refused when TLS is required
+func TestSMTPMailerRequireTLS(t *testing.T) {
+	server := startFakeSMTPServer(t)
+	host, port := server.addr()
+
+	m := &SMTPMailer{Host: host, Port: port, RequireTLS: true, Template: newTestMailTemplate(t)}
+	if err := m.SendOTP("test@example.com", "123456"); err == nil {
+		t.Error("Expected error when server does not offer STARTTLS")
+	}
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if len(server.messages) != 0 {
+		t.Errorf("Expected no message to be delivered, got %d", len(server.messages))
+	}
+}
+
+// Test maildir delivery
+func TestFileMailer(t *testing.T) {
+	dir := t.TempDir()
+	m := &FileMailer{Dir: dir, Template: newTestMailTemplate(t)}
+
+	if err := m.SendOTP("test@example.com", "654321"); err != nil {
+		t.Fatalf("Expected delivery to succeed, got %v", err)
+	}
+
+	entries, err := os.ReadDir(filepath.Join(dir, "new"))
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("Expected 1 message in maildir, got %d (%v)", len(entries), err)
+	}
+
+	data, _ := os.ReadFile(filepath.Join(dir, "new", entries[0].Name()))
+	if !strings.Contains(string(data), "654321") {
+		t.Errorf("Expected message to contain OTP, got:\n%s", data)
+	}
+
+	if err := m.SendOTP("test@example.com\r\nBcc: victim@example.com", "654321"); err == nil {
+		t.Error("Expected a recipient with a line break to be refused")
+	}
+}
+
+// Test that a non-ASCII subject is encoded as an RFC 2047 word
+func TestMailTemplateEncodesSubject(t *testing.T) {
+	tmpl, err := NewMailTemplate("Soltar <noreply@soltar.test>", "Votre code à usage unique", "")
+	if err != nil {
+		t.Fatalf("Failed to build template: %v", err)
+	}
+
+	msg, err := tmpl.render("test@example.com", "123456")
+	if err != nil {
+		t.Fatalf("Expected the message to render, got %v", err)
+	}
+	if !strings.Contains(string(msg), "Subject: =?utf-8?q?Votre_code_=C3=A0_usage_unique?=\r\n") {
+		t.Errorf("Expected an encoded subject, got:\n%s", msg)
+	}
+}
+
+type failingMailer struct{}
+
+func (failingMailer) SendOTP(to, otp string) error {
+	return errors.New("relay unavailable")
+}
+
+// Test that delivery failures reach the /register response
+func TestHandleRegisterMailerFailure(t *testing.T) {
+	storage = NewMockStorage()
+	mailer = failingMailer{}
+	defer func() { mailer = LogMailer{} }()
+
+	req := createTestRequest("POST", "/register", OTPRequest{Email: "test@example.com"})
+	w := httptest.NewRecorder()
+	handleRegister(w, req)
+
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("Expected status 502, got %d", w.Code)
+	}
+
+	if _, err := storage.Get("otp:test@example.com"); err == nil {
+		t.Error("Expected OTP to be discarded after failed delivery")
+	}
+}
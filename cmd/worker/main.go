@@ -3,11 +3,16 @@ package main
 import (
 	"context"
 	"crypto/rand"
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"net/mail"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -15,6 +20,8 @@ import (
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
 	"github.com/redis/go-redis/v9"
+
+	"github.com/glassrye/soltar"
 )
 
 type Client struct {
@@ -24,59 +31,111 @@ type Client struct {
 	LastSeen time.Time `json:"last_seen"`
 }
 
-type Environment struct {
-	ID        string    `json:"id"`
-	ClientID  string    `json:"client_id"`
-	VPNServer string    `json:"vpn_server"`
-	VPNPort   int       `json:"vpn_port"`
-	Created   time.Time `json:"created"`
-	Status    string    `json:"status"`
-	Region    string    `json:"region"`
-	Instances []string  `json:"instances"`
-	Databases []string  `json:"databases"`
-	Storage   []string  `json:"storage"`
-}
-
-type Infrastructure struct {
-	VPNInstances  []string  `json:"vpn_instances"`
-	LoadBalancers []string  `json:"load_balancers"`
-	Databases     []string  `json:"databases"`
-	Storage       []string  `json:"storage"`
-	Created       time.Time `json:"created"`
-	LastUpdated   time.Time `json:"last_updated"`
-}
-
-type OTPRequest struct {
-	Email string `json:"email"`
-}
-
-type OTPVerify struct {
-	Email string `json:"email"`
-	OTP   string `json:"otp"`
-}
+// Wire types are shared with clients through package soltar
+type (
+	Environment            = soltar.Environment
+	Infrastructure         = soltar.Infrastructure
+	OTPRequest             = soltar.OTPRequest
+	OTPVerify              = soltar.OTPVerify
+	AuthResponse           = soltar.AuthResponse
+	VPNConfig              = soltar.VPNConfig
+	InfrastructureUpdate   = soltar.InfrastructureUpdate
+	InfrastructureResponse = soltar.InfrastructureResponse
+	ConnectResponse        = soltar.ConnectResponse
+	MessageResponse        = soltar.MessageResponse
+	ErrorResponse          = soltar.ErrorResponse
+)
 
-type AuthResponse struct {
-	ClientID    string      `json:"client_id"`
-	Token       string      `json:"token"`
-	Environment Environment `json:"environment"`
+// ClientClaims are the claims of a client access token. SessionID ties the
+// token to the session whose refresh token minted it.
+type ClientClaims struct {
+	SessionID string `json:"sid,omitempty"`
+	jwt.RegisteredClaims
 }
 
-type VPNConfig struct {
-	Server        string `json:"server"`
-	Port          int    `json:"port"`
-	Token         string `json:"token"`
-	EnvironmentID string `json:"environment_id"`
+// OTPRecord is stored under otp:<email> while a code is pending
+type OTPRecord struct {
+	OTP      string `json:"otp"`
+	Expires  int64  `json:"expires"`
+	Attempts int    `json:"attempts"`
+	Locked   bool   `json:"locked,omitempty"`
 }
 
-type InfrastructureUpdate struct {
-	Infrastructure Infrastructure `json:"infrastructure"`
-}
+// Error codes returned by /register and /verify
+const (
+	ErrCodeInvalidRequest = soltar.ErrCodeInvalidRequest
+	ErrCodeRateLimited    = soltar.ErrCodeRateLimited
+	ErrCodeOTPNotFound    = soltar.ErrCodeOTPNotFound
+	ErrCodeOTPExpired     = soltar.ErrCodeOTPExpired
+	ErrCodeOTPLocked      = soltar.ErrCodeOTPLocked
+	ErrCodeOTPMismatch    = soltar.ErrCodeOTPMismatch
+)
 
 // Storage interface
 type Storage interface {
 	Get(key string) ([]byte, error)
 	Put(key string, value []byte) error
+	// PutWithTTL stores value under key and removes it once ttl has elapsed.
+	// A zero ttl never expires; a negative one deletes the key.
+	PutWithTTL(key string, value []byte, ttl time.Duration) error
 	Delete(key string) error
+	// Update reads keys, passes their current values to fn and atomically
+	// writes back what fn returns. See UpdateFunc.
+	Update(keys []string, fn UpdateFunc) error
+	// Incr atomically adds one to the counter under key and returns the new
+	// count and the time left until the counter expires. A counter that does
+	// not exist yet starts from zero and expires after ttl.
+	Incr(key string, ttl time.Duration) (int64, time.Duration, error)
+	// Scan returns a page of keys starting with prefix, resuming from cursor
+	// ("" for the first page). The returned cursor is "" once iteration is
+	// complete. limit is a hint; Redis may return a few more or fewer keys.
+	Scan(prefix, cursor string, limit int) ([]string, string, error)
+}
+
+// UpdateFunc receives the current values of the watched keys (missing keys are
+// absent from the map) and returns the values to write. Written keys keep any
+// TTL they already had; new keys get none. A nil value deletes its key. fn
+// may be called more than once and must not use storage itself.
+type UpdateFunc func(current map[string][]byte) (map[string][]byte, error)
+
+// ErrConflict is returned by Update when a watched key changed before the
+// write could be committed
+var ErrConflict = errors.New("storage: concurrent update conflict")
+
+// defaultScanLimit is the page size used when Scan is given no limit
+const defaultScanLimit = 100
+
+// scanAll walks every page of a Scan and returns all matching keys
+func scanAll(prefix string) ([]string, error) {
+	var keys []string
+	cursor := ""
+	for {
+		page, next, err := storage.Scan(prefix, cursor, defaultScanLimit)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, page...)
+		if next == "" {
+			return keys, nil
+		}
+		cursor = next
+	}
+}
+
+// maxUpdateRetries bounds how often updateWithRetry re-runs a conflicting update
+const maxUpdateRetries = 10
+
+// updateWithRetry runs storage.Update, retrying with a short backoff while
+// other writers keep winning the race
+func updateWithRetry(keys []string, fn UpdateFunc) error {
+	for attempt := 1; ; attempt++ {
+		err := storage.Update(keys, fn)
+		if err != ErrConflict || attempt == maxUpdateRetries {
+			return err
+		}
+		log.Printf("Storage update conflict on %v (attempt %d/%d), retrying", keys, attempt, maxUpdateRetries)
+		time.Sleep(time.Duration(attempt) * 5 * time.Millisecond)
+	}
 }
 
 // Redis Storage implementation
@@ -123,11 +182,21 @@ func (rs *RedisStorage) Get(key string) ([]byte, error) {
 }
 
 func (rs *RedisStorage) Put(key string, value []byte) error {
-	log.Printf("Redis Put: key='%s', value=%d bytes", key, len(value))
+	return rs.PutWithTTL(key, value, 0)
+}
+
+func (rs *RedisStorage) PutWithTTL(key string, value []byte, ttl time.Duration) error {
+	// go-redis treats negative expirations as KEEPTTL, so handle them here
+	if ttl < 0 {
+		return rs.Delete(key)
+	}
+
+	log.Printf("Redis Put: key='%s', value=%d bytes, ttl=%s", key, len(value), ttl)
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	err := rs.client.Set(ctx, key, value, 0).Err()
+	// A zero TTL maps to a plain SET, anything else to SET EX/PX
+	err := rs.client.Set(ctx, key, value, ttl).Err()
 	if err != nil {
 		log.Printf("Redis Put error for key '%s': %v", key, err)
 	}
@@ -140,31 +209,195 @@ func (rs *RedisStorage) Delete(key string) error {
 	return rs.client.Del(ctx, key).Err()
 }
 
+// Update uses WATCH/MULTI/EXEC so the write only lands if none of the keys
+// changed since they were read
+func (rs *RedisStorage) Update(keys []string, fn UpdateFunc) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := rs.client.Watch(ctx, func(tx *redis.Tx) error {
+		current := make(map[string][]byte, len(keys))
+		for _, key := range keys {
+			data, err := tx.Get(ctx, key).Bytes()
+			if err == redis.Nil {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			current[key] = data
+		}
+
+		updated, err := fn(current)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			for key, value := range updated {
+				if value == nil {
+					pipe.Del(ctx, key)
+				} else {
+					pipe.Set(ctx, key, value, redis.KeepTTL)
+				}
+			}
+			return nil
+		})
+		return err
+	}, keys...)
+
+	if err == redis.TxFailedErr {
+		log.Printf("Redis Update conflict on keys %v", keys)
+		return ErrConflict
+	}
+	return err
+}
+
+// incrScript is INCR plus PEXPIRE on the first increment, run as one script
+// so a counter can never be left without an expiry
+var incrScript = redis.NewScript(`
+local count = redis.call('INCR', KEYS[1])
+local ttl = redis.call('PTTL', KEYS[1])
+if ttl < 0 then
+	redis.call('PEXPIRE', KEYS[1], ARGV[1])
+	ttl = tonumber(ARGV[1])
+end
+return {count, ttl}
+`)
+
+func (rs *RedisStorage) Incr(key string, ttl time.Duration) (int64, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	result, err := incrScript.Run(ctx, rs.client, []string{key}, ttl.Milliseconds()).Int64Slice()
+	if err != nil {
+		log.Printf("Redis Incr error for key '%s': %v", key, err)
+		return 0, 0, err
+	}
+	return result[0], time.Duration(result[1]) * time.Millisecond, nil
+}
+
+func (rs *RedisStorage) Scan(prefix, cursor string, limit int) ([]string, string, error) {
+	if limit <= 0 {
+		limit = defaultScanLimit
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var pos uint64
+	if cursor != "" {
+		var err error
+		if pos, err = strconv.ParseUint(cursor, 10, 64); err != nil {
+			return nil, "", fmt.Errorf("invalid cursor: %s", cursor)
+		}
+	}
+
+	// SCAN may return empty batches, so keep going until there is something
+	// to hand back or the keyspace is exhausted
+	pattern := escapeGlob(prefix) + "*"
+	var keys []string
+	for {
+		batch, next, err := rs.client.Scan(ctx, pos, pattern, int64(limit)).Result()
+		if err != nil {
+			return nil, "", err
+		}
+		keys = append(keys, batch...)
+		pos = next
+		if pos == 0 {
+			return keys, "", nil
+		}
+		if len(keys) >= limit {
+			return keys, strconv.FormatUint(pos, 10), nil
+		}
+	}
+}
+
+// escapeGlob escapes the characters Redis treats specially in MATCH patterns
+func escapeGlob(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch r {
+		case '*', '?', '[', ']', '\\':
+			b.WriteRune('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
 // InMemoryStorage implementation for fallback
 type InMemoryStorage struct {
-	data map[string][]byte
+	data map[string]memoryEntry
 	mu   sync.RWMutex
 }
 
+type memoryEntry struct {
+	value   []byte
+	expires time.Time // zero means no expiry
+}
+
+func (e memoryEntry) expired(now time.Time) bool {
+	return !e.expires.IsZero() && now.After(e.expires)
+}
+
+// inMemoryJanitorInterval is how often expired keys are swept from memory
+const inMemoryJanitorInterval = time.Minute
+
 func NewInMemoryStorage() Storage {
-	return &InMemoryStorage{
-		data: make(map[string][]byte),
+	m := &InMemoryStorage{
+		data: make(map[string]memoryEntry),
+	}
+	go m.janitor(inMemoryJanitorInterval)
+	return m
+}
+
+// janitor removes expired keys that nobody reads again; Get handles the rest lazily
+func (m *InMemoryStorage) janitor(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		m.removeExpired()
+	}
+}
+
+func (m *InMemoryStorage) removeExpired() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	for key, entry := range m.data {
+		if entry.expired(now) {
+			delete(m.data, key)
+		}
 	}
 }
 
 func (m *InMemoryStorage) Get(key string) ([]byte, error) {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
-	if data, exists := m.data[key]; exists {
-		return data, nil
+	if entry, exists := m.data[key]; exists && !entry.expired(time.Now()) {
+		return entry.value, nil
 	}
 	return nil, fmt.Errorf("key not found: %s", key)
 }
 
 func (m *InMemoryStorage) Put(key string, value []byte) error {
+	return m.PutWithTTL(key, value, 0)
+}
+
+func (m *InMemoryStorage) PutWithTTL(key string, value []byte, ttl time.Duration) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	m.data[key] = value
+	if ttl < 0 {
+		delete(m.data, key)
+		return nil
+	}
+	entry := memoryEntry{value: value}
+	if ttl > 0 {
+		entry.expires = time.Now().Add(ttl)
+	}
+	m.data[key] = entry
 	return nil
 }
 
@@ -175,9 +408,91 @@ func (m *InMemoryStorage) Delete(key string) error {
 	return nil
 }
 
+// Scan iterates keys in sorted order; the cursor is the last key returned
+func (m *InMemoryStorage) Scan(prefix, cursor string, limit int) ([]string, string, error) {
+	if limit <= 0 {
+		limit = defaultScanLimit
+	}
+
+	m.mu.RLock()
+	now := time.Now()
+	var matched []string
+	for key, entry := range m.data {
+		if strings.HasPrefix(key, prefix) && key > cursor && !entry.expired(now) {
+			matched = append(matched, key)
+		}
+	}
+	m.mu.RUnlock()
+
+	sort.Strings(matched)
+	if len(matched) > limit {
+		return matched[:limit], matched[limit-1], nil
+	}
+	return matched, "", nil
+}
+
+// Update holds the write lock for the whole read-modify-write, so it never conflicts
+func (m *InMemoryStorage) Update(keys []string, fn UpdateFunc) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	current := make(map[string][]byte, len(keys))
+	for _, key := range keys {
+		if entry, exists := m.data[key]; exists && !entry.expired(now) {
+			current[key] = entry.value
+		}
+	}
+
+	updated, err := fn(current)
+	if err != nil {
+		return err
+	}
+
+	for key, value := range updated {
+		if value == nil {
+			delete(m.data, key)
+			continue
+		}
+		entry := memoryEntry{value: value}
+		if existing, exists := m.data[key]; exists && !existing.expired(now) {
+			entry.expires = existing.expires
+		}
+		m.data[key] = entry
+	}
+	return nil
+}
+
+func (m *InMemoryStorage) Incr(key string, ttl time.Duration) (int64, time.Duration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	entry, exists := m.data[key]
+	if !exists || entry.expired(now) {
+		entry = memoryEntry{value: []byte("0"), expires: now.Add(ttl)}
+	}
+	count, err := strconv.ParseInt(string(entry.value), 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("value of %s is not a counter", key)
+	}
+	count++
+	entry.value = []byte(strconv.FormatInt(count, 10))
+	m.data[key] = entry
+	return count, entry.expires.Sub(now), nil
+}
+
 var (
 	storage Storage
-	secret  = []byte(getEnv("JWT_SECRET", "your-secret-key-change-in-production"))
+	mailer  Mailer = LogMailer{}
+	keyring        = newStaticKeyring([]byte(getEnv("JWT_SECRET", defaultJWTSecret)))
+)
+
+const (
+	// otpTTL is how long a one-time password stays valid after /register
+	otpTTL = 5 * time.Minute
+	// maxOTPAttempts failed guesses invalidate the pending OTP
+	maxOTPAttempts = 5
 )
 
 func getEnv(key, defaultValue string) string {
@@ -188,27 +503,96 @@ func getEnv(key, defaultValue string) string {
 }
 
 func main() {
+	// `soltar-vpn admin-token <name> <role>` prints an admin-scoped JWT. It
+	// only needs storage for the signing keys, so it neither waits long for
+	// Redis nor migrates anything.
+	adminToken := len(os.Args) > 1 && os.Args[1] == "admin-token"
+	if adminToken && len(os.Args) != 4 {
+		log.Fatalf("Usage: %s admin-token <name> <viewer|operator>", os.Args[0])
+	}
+
 	// Initialize Redis storage with retry
 	redisURL := getEnv("REDIS_URL", "redis://localhost:6379")
+	attempts := 20
+	if adminToken {
+		attempts = 1
+	}
 	var err error
 
 	// Retry Redis connection
-	for i := 0; i < 20; i++ {
+	for i := 0; i < attempts; i++ {
 		storage, err = NewRedisStorage(redisURL)
 		if err == nil {
 			break
 		}
-		log.Printf("Failed to connect to Redis (attempt %d/20): %v", i+1, err)
-		time.Sleep(5 * time.Second)
+		log.Printf("Failed to connect to Redis (attempt %d/%d): %v", i+1, attempts, err)
+		if i+1 < attempts {
+			time.Sleep(5 * time.Second)
+		}
 	}
 
+	if err != nil && adminToken {
+		// A token signed with in-memory keys would not be accepted by any server
+		log.Fatalf("Failed to connect to Redis at %s: %v", redisURL, err)
+	}
 	if err != nil {
-		log.Printf("Warning: Failed to initialize Redis storage after 20 attempts: %v", err)
+		log.Printf("Warning: Failed to initialize Redis storage after %d attempts: %v", attempts, err)
 		log.Printf("Starting with in-memory storage fallback")
 		// Use in-memory storage as fallback
 		storage = NewInMemoryStorage()
 	} else {
 		log.Printf("Connected to Redis at %s", redisURL)
+
+		if !adminToken {
+			if err := migrateClientRecords(); err != nil {
+				log.Printf("Warning: client record migration failed: %v", err)
+			}
+		}
+	}
+
+	keyManager, err := setupKeyring()
+	if err != nil {
+		log.Fatalf("Failed to set up JWT signing keys: %v", err)
+	}
+
+	if adminToken {
+		token, err := generateAdminToken(os.Args[2], os.Args[3], 12*time.Hour)
+		if err != nil {
+			log.Fatalf("Failed to generate admin token: %v", err)
+		}
+		fmt.Println(token)
+		return
+	}
+
+	if keyManager != nil {
+		go keyManager.Run(time.Minute)
+	}
+
+	mailer, err = newMailerFromEnv()
+	if err != nil {
+		log.Fatalf("Failed to configure mailer: %v", err)
+	}
+
+	provisioner, err = newProvisionerFromEnv()
+	if err != nil {
+		log.Fatalf("Failed to configure provisioner: %v", err)
+	}
+
+	if err := setupReconciler(); err != nil {
+		log.Fatalf("Failed to configure reconciler: %v", err)
+	}
+	go runReconciler(reconcileInterval)
+
+	if err := setupHeartbeat(); err != nil {
+		log.Fatalf("Failed to configure heartbeats: %v", err)
+	}
+
+	adminKeys, err = parseAdminKeys(getEnv("ADMIN_API_KEYS", ""))
+	if err != nil {
+		log.Fatalf("Failed to load admin API keys: %v", err)
+	}
+	if !adminEndpointsEnabled {
+		log.Printf("Admin and debug endpoints are disabled")
 	}
 
 	// Start HTTP server
@@ -220,28 +604,48 @@ func main() {
 }
 
 func handleRequest(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/.well-known/jwks.json" && r.Method == "GET" {
+		handleJWKS(w, r)
+		return
+	}
+
 	// Handle API requests
 	if strings.HasPrefix(r.URL.Path, "/register") ||
 		strings.HasPrefix(r.URL.Path, "/verify") ||
 		strings.HasPrefix(r.URL.Path, "/connect") ||
 		strings.HasPrefix(r.URL.Path, "/config") ||
 		strings.HasPrefix(r.URL.Path, "/infrastructure") ||
+		strings.HasPrefix(r.URL.Path, "/token") ||
+		strings.HasPrefix(r.URL.Path, "/sessions") ||
+		strings.HasPrefix(r.URL.Path, "/environment") ||
+		strings.HasPrefix(r.URL.Path, "/heartbeat") ||
+		strings.HasPrefix(r.URL.Path, "/presence") ||
+		strings.HasPrefix(r.URL.Path, "/logout") ||
 		strings.HasPrefix(r.URL.Path, "/health") ||
-		strings.HasPrefix(r.URL.Path, "/debug") {
+		strings.HasPrefix(r.URL.Path, "/debug") ||
+		strings.HasPrefix(r.URL.Path, "/admin") {
+
+		path := strings.TrimPrefix(r.URL.Path, "/")
+		parts := strings.Split(path, "/")
 
 		w.Header().Set("Content-Type", "application/json")
+
+		// Operator endpoints are not meant for browsers, so they get no CORS headers
+		if parts[0] == "debug" || parts[0] == "admin" {
+			handleAdminRequest(w, r, parts)
+			return
+		}
+
 		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PATCH, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, If-Match")
+		w.Header().Set("Access-Control-Expose-Headers", "ETag")
 
 		if r.Method == "OPTIONS" {
 			w.WriteHeader(http.StatusOK)
 			return
 		}
 
-		path := strings.TrimPrefix(r.URL.Path, "/")
-		parts := strings.Split(path, "/")
-
 		switch {
 		case r.Method == "GET" && parts[0] == "health":
 			w.WriteHeader(http.StatusOK)
@@ -249,22 +653,54 @@ func handleRequest(w http.ResponseWriter, r *http.Request) {
 				"status":  "healthy",
 				"service": "soltar-vpn",
 			})
-		case r.Method == "GET" && parts[0] == "debug" && len(parts) > 1:
-			handleDebug(w, r, parts[1])
-		case r.Method == "GET" && parts[0] == "debug" && len(parts) == 1:
-			handleDebugList(w, r)
 		case r.Method == "POST" && parts[0] == "register":
 			handleRegister(w, r)
 		case r.Method == "POST" && parts[0] == "verify":
 			handleVerify(w, r)
 		case r.Method == "POST" && parts[0] == "connect":
 			handleConnect(w, r)
-		case r.Method == "GET" && parts[0] == "config":
+		case r.Method == "GET" && parts[0] == "environment" && len(parts) == 1:
+			handleGetEnvironment(w, r)
+		case r.Method == "POST" && parts[0] == "environment" && len(parts) == 2 && (parts[1] == "suspend" || parts[1] == "resume"):
+			handleEnvironmentAction(w, r, parts[1])
+		case r.Method == "DELETE" && parts[0] == "environment" && len(parts) == 1:
+			handleEnvironmentAction(w, r, "delete")
+		case r.Method == "POST" && parts[0] == "heartbeat" && len(parts) == 1:
+			handleHeartbeat(w, r)
+		case r.Method == "GET" && parts[0] == "presence" && len(parts) == 1:
+			handlePresence(w, r)
+		case r.Method == "GET" && parts[0] == "config" && len(parts) == 1:
 			handleConfig(w, r)
-		case r.Method == "POST" && parts[0] == "infrastructure":
+		case r.Method == "POST" && parts[0] == "config" && len(parts) == 2 && parts[1] == "peer":
+			handleUpsertPeer(w, r)
+		case r.Method == "POST" && parts[0] == "config" && len(parts) == 3 && parts[1] == "qr" && parts[2] == "token":
+			handleQRToken(w, r)
+		case r.Method == "GET" && parts[0] == "config" && len(parts) == 2 && parts[1] == "qr":
+			handleConfigQR(w, r)
+		case r.Method == "GET" && parts[0] == "config" && len(parts) == 2 && parts[1] == "peers":
+			handleListPeers(w, r)
+		case r.Method == "DELETE" && parts[0] == "config" && len(parts) == 3 && parts[1] == "peer":
+			handleDeletePeer(w, r, parts[2])
+		case r.Method == "POST" && parts[0] == "infrastructure" && len(parts) == 1:
 			handleInfrastructure(w, r)
-		case r.Method == "GET" && parts[0] == "infrastructure":
+		case r.Method == "GET" && parts[0] == "infrastructure" && len(parts) == 1:
 			handleGetInfrastructure(w, r)
+		case r.Method == "PATCH" && parts[0] == "infrastructure" && len(parts) == 1:
+			handlePatchInfrastructure(w, r)
+		case r.Method == "GET" && parts[0] == "infrastructure" && len(parts) == 2 && parts[1] == "history":
+			handleInfrastructureHistory(w, r)
+		case r.Method == "GET" && parts[0] == "infrastructure" && len(parts) == 3 && parts[1] == "revisions":
+			handleInfrastructureRevision(w, r, parts[2])
+		case r.Method == "POST" && parts[0] == "infrastructure" && len(parts) == 3 && parts[1] == "rollback":
+			handleInfrastructureRollback(w, r, parts[2])
+		case r.Method == "POST" && parts[0] == "token" && len(parts) == 2 && parts[1] == "refresh":
+			handleTokenRefresh(w, r)
+		case r.Method == "GET" && parts[0] == "sessions" && len(parts) == 1:
+			handleListSessions(w, r)
+		case r.Method == "DELETE" && parts[0] == "sessions" && len(parts) == 2:
+			handleDeleteSession(w, r, parts[1])
+		case r.Method == "POST" && parts[0] == "logout":
+			handleLogout(w, r)
 		default:
 			http.Error(w, "Not found", http.StatusNotFound)
 		}
@@ -276,6 +712,14 @@ func handleRequest(w http.ResponseWriter, r *http.Request) {
 	fs.ServeHTTP(w, r)
 }
 
+// validEmail accepts a bare address such as user@example.com. Display names,
+// comments and anything else that would end up in the To: header or in
+// storage keys are refused.
+func validEmail(email string) bool {
+	addr, err := mail.ParseAddress(email)
+	return err == nil && addr.Name == "" && addr.Address == email
+}
+
 func handleRegister(w http.ResponseWriter, r *http.Request) {
 	log.Printf("Received registration request from %s", r.RemoteAddr)
 
@@ -293,25 +737,83 @@ func handleRegister(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Missing email", http.StatusBadRequest)
 		return
 	}
+	if !validEmail(req.Email) {
+		log.Printf("Invalid email in request: %q", req.Email)
+		writeError(w, http.StatusBadRequest, ErrorResponse{
+			Error:   ErrCodeInvalidRequest,
+			Message: "Invalid email address",
+		})
+		return
+	}
+
+	if ok, retry := checkRegisterRateLimit(r, req.Email); !ok {
+		log.Printf("Registration rate limited for %s from %s", req.Email, clientIP(r))
+		retrySeconds := int(retry.Seconds()) + 1
+		w.Header().Set("Retry-After", fmt.Sprintf("%d", retrySeconds))
+		writeError(w, http.StatusTooManyRequests, ErrorResponse{
+			Error:      ErrCodeRateLimited,
+			Message:    "Too many OTP requests, try again later",
+			RetryAfter: retrySeconds,
+		})
+		return
+	}
+
+	// A locked code stays locked until it expires; a new one would start the
+	// attempt count again. Any other code is dropped in the same transaction,
+	// so a guess cannot lock it between the check and the write below.
+	otpKey := fmt.Sprintf("otp:%s", req.Email)
+	var lockedUntil int64
+	err := updateWithRetry([]string{otpKey}, func(current map[string][]byte) (map[string][]byte, error) {
+		lockedUntil = 0
+		var record OTPRecord
+		if data, ok := current[otpKey]; !ok || json.Unmarshal(data, &record) != nil {
+			return nil, nil
+		}
+		if record.Locked && time.Now().Unix() <= record.Expires {
+			lockedUntil = record.Expires
+			return nil, nil
+		}
+		return map[string][]byte{otpKey: nil}, nil
+	})
+	if err != nil {
+		log.Printf("Failed to read OTP for %s: %v", req.Email, err)
+		http.Error(w, "Failed to store OTP", http.StatusInternalServerError)
+		return
+	}
+	if lockedUntil != 0 {
+		log.Printf("Registration refused for %s: OTP locked", req.Email)
+		retrySeconds := int(lockedUntil-time.Now().Unix()) + 1
+		w.Header().Set("Retry-After", fmt.Sprintf("%d", retrySeconds))
+		writeError(w, http.StatusTooManyRequests, ErrorResponse{
+			Error:      ErrCodeOTPLocked,
+			Message:    "Too many failed attempts, try again later",
+			RetryAfter: retrySeconds,
+		})
+		return
+	}
 
 	// Generate OTP
 	otp := generateOTP()
-	log.Printf("Generated OTP for %s: %s", req.Email, otp)
 
 	// Store OTP temporarily (5 minutes expiry)
 	// Use a safe key format for Redis
-	otpKey := fmt.Sprintf("otp:%s", req.Email)
-	otpData := map[string]interface{}{
-		"otp":      otp,
-		"expires":  time.Now().Add(5 * time.Minute).Unix(),
-		"attempts": 0,
+	otpBytes, _ := json.Marshal(OTPRecord{
+		OTP:     otp,
+		Expires: time.Now().Add(otpTTL).Unix(),
+	})
+	if err := storage.PutWithTTL(otpKey, otpBytes, otpTTL); err != nil {
+		log.Printf("Failed to store OTP for %s: %v", req.Email, err)
+		http.Error(w, "Failed to store OTP", http.StatusInternalServerError)
+		return
 	}
 
-	otpBytes, _ := json.Marshal(otpData)
-	storage.Put(otpKey, otpBytes)
-
-	// Send OTP via email (implement your email service)
-	sendOTPEmail(req.Email, otp)
+	// Send OTP via email; drop the code again if it never reached the client
+	if err := mailer.SendOTP(req.Email, otp); err != nil {
+		log.Printf("Failed to send OTP email to %s: %v", req.Email, err)
+		storage.Delete(otpKey)
+		http.Error(w, "Failed to send OTP email", http.StatusBadGateway)
+		return
+	}
 
 	log.Printf("Registration successful for %s", req.Email)
 	w.WriteHeader(http.StatusOK)
@@ -326,43 +828,97 @@ func handleVerify(w http.ResponseWriter, r *http.Request) {
 	var req OTPVerify
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		log.Printf("Failed to decode verification request: %v", err)
-		http.Error(w, "Invalid request", http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, ErrorResponse{
+			Error:   ErrCodeInvalidRequest,
+			Message: "Invalid request",
+		})
 		return
 	}
 
-	log.Printf("Verification request for email: %s, OTP: %s", req.Email, req.OTP)
+	log.Printf("Verification request for email: %s", req.Email)
 
-	// Verify OTP
-	// Use the same safe key format for Redis
+	// Verify OTP. The compare, the attempt count and the delete on success
+	// happen in one transaction on the record, so parallel guesses cannot
+	// get past the lockout and a used code cannot be written back.
 	otpKey := fmt.Sprintf("otp:%s", req.Email)
-	otpBytes, err := storage.Get(otpKey)
-	if err != nil {
-		log.Printf("Failed to get OTP for %s: %v", req.Email, err)
-		http.Error(w, "Invalid OTP", http.StatusBadRequest)
-		return
-	}
-
-	var otpData map[string]interface{}
-	if err := json.Unmarshal(otpBytes, &otpData); err != nil {
-		log.Printf("Failed to unmarshal OTP data: %v", err)
-		http.Error(w, "Invalid OTP", http.StatusBadRequest)
-		return
-	}
+	var outcome string
+	var attempts int
+	err := updateWithRetry([]string{otpKey}, func(current map[string][]byte) (map[string][]byte, error) {
+		outcome, attempts = "", 0
+		var record OTPRecord
+		data, ok := current[otpKey]
+		if !ok || json.Unmarshal(data, &record) != nil {
+			outcome = ErrCodeOTPNotFound
+			return nil, nil
+		}
 
-	log.Printf("Stored OTP data: %+v", otpData)
-	log.Printf("Comparing stored OTP '%s' with provided OTP '%s'", otpData["otp"], req.OTP)
+		switch {
+		case time.Now().Unix() > record.Expires:
+			outcome = ErrCodeOTPExpired
+			return map[string][]byte{otpKey: nil}, nil
+		case record.Locked:
+			outcome = ErrCodeOTPLocked
+			return nil, nil
+		case subtle.ConstantTimeCompare([]byte(record.OTP), []byte(req.OTP)) == 1:
+			return map[string][]byte{otpKey: nil}, nil
+		}
 
-	if otpData["otp"] != req.OTP {
-		log.Printf("OTP mismatch for %s", req.Email)
-		http.Error(w, "Invalid OTP", http.StatusBadRequest)
+		record.Attempts++
+		attempts = record.Attempts
+		outcome = ErrCodeOTPMismatch
+		if record.Attempts >= maxOTPAttempts {
+			// Keep the record until it expires so the lockout is reported
+			// consistently; Update keeps the original expiry
+			record.Locked = true
+			record.OTP = ""
+			outcome = ErrCodeOTPLocked
+		}
+		updated, err := json.Marshal(record)
+		if err != nil {
+			return nil, err
+		}
+		return map[string][]byte{otpKey: updated}, nil
+	})
+	if err != nil {
+		log.Printf("Failed to verify OTP for %s: %v", req.Email, err)
+		http.Error(w, "Failed to verify OTP", http.StatusInternalServerError)
 		return
 	}
 
-	// Check expiry
-	if time.Now().Unix() > int64(otpData["expires"].(float64)) {
+	switch outcome {
+	case ErrCodeOTPNotFound:
+		log.Printf("No OTP for %s", req.Email)
+		writeError(w, http.StatusBadRequest, ErrorResponse{
+			Error:   ErrCodeOTPNotFound,
+			Message: "Invalid OTP",
+		})
+		return
+	case ErrCodeOTPExpired:
 		log.Printf("OTP expired for %s", req.Email)
-		storage.Delete(otpKey)
-		http.Error(w, "OTP expired", http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, ErrorResponse{
+			Error:   ErrCodeOTPExpired,
+			Message: "OTP expired",
+		})
+		return
+	case ErrCodeOTPLocked:
+		if attempts > 0 {
+			log.Printf("OTP locked for %s after %d failed attempts", req.Email, attempts)
+		} else {
+			log.Printf("OTP locked for %s", req.Email)
+		}
+		writeError(w, http.StatusTooManyRequests, ErrorResponse{
+			Error:   ErrCodeOTPLocked,
+			Message: "Too many failed attempts, request a new OTP",
+		})
+		return
+	case ErrCodeOTPMismatch:
+		log.Printf("OTP mismatch for %s (attempt %d/%d)", req.Email, attempts, maxOTPAttempts)
+		remaining := maxOTPAttempts - attempts
+		writeError(w, http.StatusBadRequest, ErrorResponse{
+			Error:             ErrCodeOTPMismatch,
+			Message:           "Invalid OTP",
+			AttemptsRemaining: &remaining,
+		})
 		return
 	}
 
@@ -370,19 +926,28 @@ func handleVerify(w http.ResponseWriter, r *http.Request) {
 
 	// Create or get client with infrastructure
 	clientData := getOrCreateClientWithInfrastructure(req.Email)
+	if clientData == nil {
+		http.Error(w, "Failed to create client", http.StatusInternalServerError)
+		return
+	}
 
-	// Generate JWT token
-	token := generateToken(clientData.ID)
-
-	// Clean up OTP
-	storage.Delete(otpKey)
+	// Start a session and issue its first access and refresh tokens
+	sessionID, refreshToken, err := createSession(clientData.ID, r, req.Device)
+	if err != nil {
+		log.Printf("Failed to create session for %s: %v", req.Email, err)
+		http.Error(w, "Failed to create session", http.StatusInternalServerError)
+		return
+	}
+	token := generateToken(clientData.ID, sessionID)
 
 	log.Printf("Verification completed successfully for %s", req.Email)
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(AuthResponse{
-		ClientID:    clientData.ID,
-		Token:       token,
-		Environment: clientData.Environment,
+		ClientID:     clientData.ID,
+		Token:        token,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int(accessTokenTTL.Seconds()),
+		Environment:  clientData.Environment,
 	})
 }
 
@@ -407,14 +972,20 @@ func handleConnect(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !requireActiveEnvironment(w, clientData) {
+		return
+	}
+
 	// Update last seen
-	updateClientLastSeen(clientID)
+	if err := updateClientLastSeen(clientID); err != nil {
+		log.Printf("Failed to update last seen for %s: %v", clientID, err)
+	}
 
 	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"status":      "connected",
-		"client_id":   clientID,
-		"environment": clientData.Environment,
+	json.NewEncoder(w).Encode(ConnectResponse{
+		Status:      "connected",
+		ClientID:    clientID,
+		Environment: clientData.Environment,
 	})
 }
 
@@ -439,15 +1010,22 @@ func handleConfig(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	config := VPNConfig{
-		Server:        clientData.Environment.VPNServer,
-		Port:          clientData.Environment.VPNPort,
-		Token:         token,
-		EnvironmentID: clientData.Environment.ID,
+	if !requireActiveEnvironment(w, clientData) {
+		return
 	}
 
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(config)
+	config, err := buildVPNConfig(clientData, token, r.URL.Query().Get("peer"))
+	if err == errPeerNotFound {
+		http.Error(w, "Peer not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to build config for %s: %v", clientID, err)
+		http.Error(w, "Failed to build config", http.StatusInternalServerError)
+		return
+	}
+
+	writeConfig(w, r, config)
 }
 
 func handleInfrastructure(w http.ResponseWriter, r *http.Request) {
@@ -470,14 +1048,15 @@ func handleInfrastructure(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Update client infrastructure
-	updateClientInfrastructure(clientID, req.Infrastructure)
+	ifMatch, err := parseIfMatch(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]string{
-		"message":   "Infrastructure updated",
-		"client_id": clientID,
-	})
+	// Update client infrastructure
+	revision, err := writeInfrastructure(clientID, req.Infrastructure, infrastructureWrite{author: clientID, ifMatch: ifMatch})
+	respondInfrastructureWrite(w, clientID, revision, err, "Infrastructure updated")
 }
 
 func handleGetInfrastructure(w http.ResponseWriter, r *http.Request) {
@@ -501,14 +1080,25 @@ func handleGetInfrastructure(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	status := infrastructureStatus(clientData)
+	w.Header().Set("ETag", revisionETag(clientData.Infrastructure.Generation))
+	w.Header().Set("Accept-Patch", MergePatchContentType+", "+JSONPatchContentType)
 	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"client_id":      clientID,
-		"infrastructure": clientData.Infrastructure,
-		"environment":    clientData.Environment,
+	json.NewEncoder(w).Encode(InfrastructureResponse{
+		ClientID:       clientID,
+		Infrastructure: withResourceStatus(clientData.Infrastructure, status),
+		Status:         status,
+		Environment:    clientData.Environment,
 	})
 }
 
+// writeError sends a JSON error body with the given status
+func writeError(w http.ResponseWriter, status int, resp ErrorResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
+
 func generateOTP() string {
 	bytes := make([]byte, 3)
 	rand.Read(bytes)
@@ -524,16 +1114,36 @@ type ClientData struct {
 	Infrastructure Infrastructure `json:"infrastructure"`
 }
 
+// Client records are stored once under client_id:<id>. client:<email> and
+// environment:<id> are lightweight indexes holding just the client ID.
+func clientIDKey(clientID string) string {
+	return fmt.Sprintf("client_id:%s", clientID)
+}
+
+func clientEmailKey(email string) string {
+	return fmt.Sprintf("client:%s", email)
+}
+
+func environmentKey(environmentID string) string {
+	return fmt.Sprintf("environment:%s", environmentID)
+}
+
+// indexValue reads a client ID out of an index key. Records written before
+// the index layout held a full ClientData blob, so fall back to its ID.
+func indexValue(data []byte) string {
+	if len(data) > 0 && data[0] == '{' {
+		var legacy ClientData
+		if err := json.Unmarshal(data, &legacy); err == nil {
+			return legacy.ID
+		}
+	}
+	return string(data)
+}
+
 func getOrCreateClientWithInfrastructure(email string) *ClientData {
 	// Check if client exists
-	clientKey := fmt.Sprintf("client:%s", email)
-	clientBytes, err := storage.Get(clientKey)
-
-	if err == nil {
-		// Client exists, return existing data
-		var client ClientData
-		json.Unmarshal(clientBytes, &client)
-		return &client
+	if clientData := getClientByEmail(email); clientData != nil {
+		return clientData
 	}
 
 	// Create new client with infrastructure
@@ -544,21 +1154,19 @@ func getOrCreateClientWithInfrastructure(email string) *ClientData {
 	environment := Environment{
 		ID:        environmentID,
 		ClientID:  clientID,
-		VPNServer: fmt.Sprintf("vpn-%s.soltar.com", clientID[:8]),
-		VPNPort:   443,
 		Created:   time.Now(),
-		Status:    "active",
+		Status:    EnvironmentPending,
 		Region:    getEnv("REGION", "us-east-1"),
-		Instances: []string{},
-		Databases: []string{},
-		Storage:   []string{},
+		Instances: []Resource{},
+		Databases: []Resource{},
+		Storage:   []Resource{},
 	}
 
 	infrastructure := Infrastructure{
-		VPNInstances:  []string{},
-		LoadBalancers: []string{},
-		Databases:     []string{},
-		Storage:       []string{},
+		VPNInstances:  []Resource{},
+		LoadBalancers: []Resource{},
+		Databases:     []Resource{},
+		Storage:       []Resource{},
 		Created:       time.Now(),
 		LastUpdated:   time.Now(),
 	}
@@ -573,22 +1181,41 @@ func getOrCreateClientWithInfrastructure(email string) *ClientData {
 	}
 
 	newClientBytes, _ := json.Marshal(client)
-	storage.Put(clientKey, newClientBytes)
-
-	// Also store by ID for reverse lookup
-	idKey := fmt.Sprintf("client_id:%s", clientID)
-	storage.Put(idKey, newClientBytes)
+	emailKey := clientEmailKey(email)
+
+	// Claim the email index atomically so two concurrent verifications for
+	// the same address cannot create two clients
+	existingID := ""
+	err := updateWithRetry([]string{emailKey}, func(current map[string][]byte) (map[string][]byte, error) {
+		if data, exists := current[emailKey]; exists {
+			existingID = indexValue(data)
+			return nil, nil
+		}
+		existingID = ""
+		return map[string][]byte{
+			clientIDKey(clientID):         newClientBytes,
+			emailKey:                      []byte(clientID),
+			environmentKey(environmentID): []byte(clientID),
+		}, nil
+	})
+	if err != nil {
+		log.Printf("Failed to create client for %s: %v", email, err)
+		return nil
+	}
 
-	// Store environment separately
-	envKey := fmt.Sprintf("environment:%s", environmentID)
-	envBytes, _ := json.Marshal(environment)
-	storage.Put(envKey, envBytes)
+	if existingID != "" {
+		return getClientInfrastructure(existingID)
+	}
 
-	return &client
+	// The environment stays provisioning until the provisioner reports back
+	if _, err := provisionEnvironment(clientID); err != nil {
+		log.Printf("Failed to provision environment %s: %v", environmentID, err)
+	}
+	return getClientInfrastructure(clientID)
 }
 
 func getClientInfrastructure(clientID string) *ClientData {
-	clientBytes, err := storage.Get(fmt.Sprintf("client_id:%s", clientID))
+	clientBytes, err := storage.Get(clientIDKey(clientID))
 	if err != nil {
 		return nil
 	}
@@ -598,98 +1225,178 @@ func getClientInfrastructure(clientID string) *ClientData {
 	return &client
 }
 
-func updateClientInfrastructure(clientID string, infrastructure Infrastructure) {
-	clientData := getClientInfrastructure(clientID)
-	if clientData == nil {
-		return
+func getClientByEmail(email string) *ClientData {
+	data, err := storage.Get(clientEmailKey(email))
+	if err != nil {
+		return nil
 	}
+	return getClientInfrastructure(indexValue(data))
+}
 
-	clientData.Infrastructure = infrastructure
-	clientData.Infrastructure.LastUpdated = time.Now()
+func getClientByEnvironment(environmentID string) *ClientData {
+	data, err := storage.Get(environmentKey(environmentID))
+	if err != nil {
+		return nil
+	}
+	return getClientInfrastructure(string(data))
+}
 
-	updatedBytes, _ := json.Marshal(clientData)
-	storage.Put(fmt.Sprintf("client_id:%s", clientID), updatedBytes)
-	storage.Put(fmt.Sprintf("client:%s", clientData.Email), updatedBytes)
+// updateClient atomically applies mutate to a client record, retrying if a
+// concurrent writer got there first
+func updateClient(clientID string, mutate func(*ClientData)) error {
+	return updateClientChecked(clientID, func(client *ClientData) error {
+		mutate(client)
+		return nil
+	})
 }
 
-func updateClientLastSeen(clientID string) {
-	clientData := getClientInfrastructure(clientID)
-	if clientData == nil {
-		return
-	}
+// updateClientChecked is updateClient for mutations that may refuse; an
+// error from mutate leaves the record unchanged and is returned as is
+func updateClientChecked(clientID string, mutate func(*ClientData) error) error {
+	return updateClientRecords(clientID, func(client *ClientData) (map[string][]byte, error) {
+		return nil, mutate(client)
+	})
+}
+
+// updateClientRecords is updateClientChecked for mutations that write other
+// keys along with the client record, in the same transaction
+func updateClientRecords(clientID string, mutate func(*ClientData) (map[string][]byte, error)) error {
+	idKey := clientIDKey(clientID)
 
-	clientData.LastSeen = time.Now()
+	return updateWithRetry([]string{idKey}, func(current map[string][]byte) (map[string][]byte, error) {
+		data, ok := current[idKey]
+		if !ok {
+			return nil, fmt.Errorf("client not found: %s", clientID)
+		}
+
+		var client ClientData
+		if err := json.Unmarshal(data, &client); err != nil {
+			return nil, fmt.Errorf("failed to decode client %s: %v", clientID, err)
+		}
+
+		writes, err := mutate(&client)
+		if err != nil {
+			return nil, err
+		}
+
+		updatedBytes, err := json.Marshal(client)
+		if err != nil {
+			return nil, err
+		}
+		if writes == nil {
+			writes = map[string][]byte{}
+		}
+		writes[idKey] = updatedBytes
+		return writes, nil
+	})
+}
+
+// updateClientInfrastructure writes infrastructure as the client itself,
+// whatever revision it is at
+func updateClientInfrastructure(clientID string, infrastructure Infrastructure) error {
+	_, err := writeInfrastructure(clientID, infrastructure, infrastructureWrite{author: clientID})
+	return err
+}
 
-	updatedBytes, _ := json.Marshal(clientData)
-	storage.Put(fmt.Sprintf("client_id:%s", clientID), updatedBytes)
-	storage.Put(fmt.Sprintf("client:%s", clientData.Email), updatedBytes)
+func updateClientLastSeen(clientID string) error {
+	return updateClient(clientID, func(client *ClientData) {
+		client.LastSeen = time.Now()
+	})
 }
 
-func generateToken(clientID string) string {
-	claims := jwt.RegisteredClaims{
-		Subject:   clientID,
-		IssuedAt:  jwt.NewNumericDate(time.Now()),
-		ExpiresAt: jwt.NewNumericDate(time.Now().Add(24 * time.Hour)),
+func generateToken(clientID, sessionID string) string {
+	claims := ClientClaims{
+		SessionID: sessionID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.New().String(),
+			Subject:   clientID,
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(accessTokenTTL)),
+		},
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	tokenString, _ := token.SignedString(secret)
+	tokenString, err := keyring.Sign(claims)
+	if err != nil {
+		log.Printf("Failed to sign token for %s: %v", clientID, err)
+	}
 	return tokenString
 }
 
-func validateToken(tokenString string) (string, error) {
-	token, err := jwt.ParseWithClaims(tokenString, &jwt.RegisteredClaims{}, func(token *jwt.Token) (interface{}, error) {
-		return secret, nil
-	})
+func parseClientToken(tokenString string) (*ClientClaims, error) {
+	token, err := jwt.ParseWithClaims(tokenString, &ClientClaims{}, keyring.Keyfunc)
 
 	if err != nil || !token.Valid {
-		return "", fmt.Errorf("invalid token")
+		return nil, fmt.Errorf("invalid token")
 	}
 
-	claims, ok := token.Claims.(*jwt.RegisteredClaims)
+	claims, ok := token.Claims.(*ClientClaims)
 	if !ok {
-		return "", fmt.Errorf("invalid claims")
+		return nil, fmt.Errorf("invalid claims")
 	}
 
+	// Admin tokens share the signing key but must not act as client tokens
+	for _, aud := range claims.Audience {
+		if aud == adminAudience {
+			return nil, fmt.Errorf("invalid claims")
+		}
+	}
+
+	if isTokenRevoked(claims) {
+		return nil, fmt.Errorf("token revoked")
+	}
+
+	return claims, nil
+}
+
+func validateToken(tokenString string) (string, error) {
+	claims, err := parseClientToken(tokenString)
+	if err != nil {
+		return "", err
+	}
 	return claims.Subject, nil
 }
 
-func sendOTPEmail(email, otp string) {
-	// For development, just print the OTP to console
-	// In production, implement actual email sending
-	log.Printf("OTP for %s: %s", email, otp)
-
-	// TODO: Implement actual email sending with your preferred service:
-	// - SendGrid: https://sendgrid.com/
-	// - AWS SES: https://aws.amazon.com/ses/
-	// - SMTP with your own server
-	// - Resend: https://resend.com/
-
-	// Example with SMTP:
-	/*
-		from := getEnv("SMTP_FROM", "noreply@soltar.com")
-		smtpHost := getEnv("SMTP_HOST", "smtp.gmail.com")
-		smtpPort := getEnv("SMTP_PORT", "587")
-		smtpUser := getEnv("SMTP_USER", "")
-		smtpPass := getEnv("SMTP_PASS", "")
-
-		msg := fmt.Sprintf("From: %s\r\n"+
-			"To: %s\r\n"+
-			"Subject: Soltar VPN OTP\r\n\r\n"+
-			"Your one-time password is: %s\r\n"+
-			"This code will expire in 10 minutes.\r\n", from, email, otp)
-
-		auth := smtp.PlainAuth("", smtpUser, smtpPass, smtpHost)
-		err := smtp.SendMail(smtpHost+":"+smtpPort, auth, from, []string{email}, []byte(msg))
-		if err != nil {
-			log.Printf("Failed to send email: %v", err)
+// authenticateClient validates the bearer token of a client request, writing
+// the 401 response itself when it is missing or invalid
+func authenticateClient(w http.ResponseWriter, r *http.Request) (*ClientClaims, bool) {
+	authHeader := r.Header.Get("Authorization")
+	if authHeader == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return nil, false
+	}
+
+	claims, err := parseClientToken(strings.TrimPrefix(authHeader, "Bearer "))
+	if err != nil {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return nil, false
+	}
+	return claims, true
+}
+
+// debugSecretPrefixes are key families holding secrets: the JWT signing
+// keyring, WireGuard server keys, server-generated peer keys and database
+// passwords. /debug never returns them, since anyone holding them can forge
+// tokens, impersonate a VPN endpoint or log in to a database.
+var debugSecretPrefixes = []string{keyringStorageKey, "wg:server:", "wg:peers:", "db:password:"}
+
+func isDebugSecret(key string) bool {
+	for _, prefix := range debugSecretPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
 		}
-	*/
+	}
+	return false
 }
 
 func handleDebug(w http.ResponseWriter, r *http.Request, key string) {
 	log.Printf("Debug request for key: %s", key)
 
+	if isDebugSecret(key) {
+		log.Printf("Debug: refused to reveal key material under '%s'", key)
+		http.Error(w, "Key holds private key material", http.StatusForbidden)
+		return
+	}
+
 	data, err := storage.Get(key)
 	if err != nil {
 		log.Printf("Debug: failed to get key '%s': %v", key, err)
@@ -708,31 +1415,53 @@ func handleDebug(w http.ResponseWriter, r *http.Request, key string) {
 	})
 }
 
-func handleDebugList(w http.ResponseWriter, r *http.Request) {
-	log.Printf("Debug list request")
+// debugPrefixes are the key families offered as filters by /debug
+var debugPrefixes = []string{"otp:", "client:", "client_id:", "environment:"}
 
-	// Try to get all keys from Redis
-	// Note: Redis doesn't have a direct "list all keys" method in this implementation
-	// We'll try some common key patterns
-
-	keys := []string{}
+const (
+	debugPageSize    = 50
+	maxDebugPageSize = 500
+)
 
-	// Try to get the client data
-	_, err := storage.Get("client_ac5f3df0-4f70-4cb2-846d-5cc0e4f2e2c9")
-	if err == nil {
-		keys = append(keys, "client_ac5f3df0-4f70-4cb2-846d-5cc0e4f2e2c9")
+// handleDebugList pages through stored keys, optionally filtered by
+// ?prefix=, resuming from ?cursor= with up to ?limit= keys per page
+func handleDebugList(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	prefix := query.Get("prefix")
+	cursor := query.Get("cursor")
+
+	limit := debugPageSize
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
 	}
+	if limit > maxDebugPageSize {
+		limit = maxDebugPageSize
+	}
+
+	log.Printf("Debug list request: prefix='%s', cursor='%s', limit=%d", prefix, cursor, limit)
 
-	// Try to get OTP data
-	_, err = storage.Get("otp:glassrye@gmail.com")
-	if err == nil {
-		keys = append(keys, "otp:glassrye@gmail.com")
+	keys, next, err := storage.Scan(prefix, cursor, limit)
+	if err != nil {
+		log.Printf("Debug: failed to scan keys: %v", err)
+		http.Error(w, fmt.Sprintf("Failed to list keys: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if keys == nil {
+		keys = []string{}
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]interface{}{
-		"available_keys": keys,
-		"total_keys":     len(keys),
+		"keys":        keys,
+		"count":       len(keys),
+		"prefix":      prefix,
+		"next_cursor": next,
+		"prefixes":    debugPrefixes,
 	})
 }
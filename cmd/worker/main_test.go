@@ -2,10 +2,15 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"testing"
@@ -13,23 +18,37 @@ import (
 
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
+
+	"github.com/glassrye/soltar"
 )
 
+// TestMain runs background provisioning inline so environments are active
+// as soon as their client is created
+func TestMain(m *testing.M) {
+	runAsync = func(fn func()) { fn() }
+	os.Exit(m.Run())
+}
+
 // Mock storage for testing
 type MockStorage struct {
-	data map[string][]byte
-	mu   sync.RWMutex
+	data    map[string][]byte
+	expires map[string]time.Time
+	mu      sync.RWMutex
 }
 
 func NewMockStorage() Storage {
 	return &MockStorage{
-		data: make(map[string][]byte),
+		data:    make(map[string][]byte),
+		expires: make(map[string]time.Time),
 	}
 }
 
 func (m *MockStorage) Get(key string) ([]byte, error) {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
+	if exp, ok := m.expires[key]; ok && time.Now().After(exp) {
+		return nil, fmt.Errorf("key not found: %s", key)
+	}
 	if data, exists := m.data[key]; exists {
 		return data, nil
 	}
@@ -37,9 +56,21 @@ func (m *MockStorage) Get(key string) ([]byte, error) {
 }
 
 func (m *MockStorage) Put(key string, value []byte) error {
+	return m.PutWithTTL(key, value, 0)
+}
+
+func (m *MockStorage) PutWithTTL(key string, value []byte, ttl time.Duration) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
+	delete(m.expires, key)
+	if ttl < 0 {
+		delete(m.data, key)
+		return nil
+	}
 	m.data[key] = value
+	if ttl > 0 {
+		m.expires[key] = time.Now().Add(ttl)
+	}
 	return nil
 }
 
@@ -47,9 +78,152 @@ func (m *MockStorage) Delete(key string) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	delete(m.data, key)
+	delete(m.expires, key)
+	return nil
+}
+
+func (m *MockStorage) Update(keys []string, fn UpdateFunc) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	current := make(map[string][]byte, len(keys))
+	for _, key := range keys {
+		if exp, ok := m.expires[key]; ok && time.Now().After(exp) {
+			continue
+		}
+		if data, exists := m.data[key]; exists {
+			current[key] = data
+		}
+	}
+
+	updated, err := fn(current)
+	if err != nil {
+		return err
+	}
+
+	for key, value := range updated {
+		if value == nil {
+			delete(m.data, key)
+			delete(m.expires, key)
+		} else {
+			if exp, ok := m.expires[key]; ok && time.Now().After(exp) {
+				delete(m.expires, key)
+			}
+			m.data[key] = value
+		}
+	}
 	return nil
 }
 
+func (m *MockStorage) Incr(key string, ttl time.Duration) (int64, time.Duration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	if exp, ok := m.expires[key]; !ok || now.After(exp) {
+		m.data[key] = []byte("0")
+		m.expires[key] = now.Add(ttl)
+	}
+	count, err := strconv.ParseInt(string(m.data[key]), 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("value of %s is not a counter", key)
+	}
+	count++
+	m.data[key] = []byte(strconv.FormatInt(count, 10))
+	return count, m.expires[key].Sub(now), nil
+}
+
+func (m *MockStorage) Scan(prefix, cursor string, limit int) ([]string, string, error) {
+	if limit <= 0 {
+		limit = defaultScanLimit
+	}
+
+	m.mu.RLock()
+	var matched []string
+	for key := range m.data {
+		if exp, ok := m.expires[key]; ok && time.Now().After(exp) {
+			continue
+		}
+		if strings.HasPrefix(key, prefix) && key > cursor {
+			matched = append(matched, key)
+		}
+	}
+	m.mu.RUnlock()
+
+	sort.Strings(matched)
+	if len(matched) > limit {
+		return matched[:limit], matched[limit-1], nil
+	}
+	return matched, "", nil
+}
+
+// conflictingStorage fails the first n Update calls with ErrConflict
+type conflictingStorage struct {
+	Storage
+	conflicts int
+	calls     int
+}
+
+func (c *conflictingStorage) Update(keys []string, fn UpdateFunc) error {
+	c.calls++
+	if c.calls <= c.conflicts {
+		return ErrConflict
+	}
+	return c.Storage.Update(keys, fn)
+}
+
+// Test key expiry in the in-memory fallback storage
+func TestInMemoryStorageTTL(t *testing.T) {
+	m := &InMemoryStorage{data: make(map[string]memoryEntry)}
+
+	m.PutWithTTL("short", []byte("a"), 20*time.Millisecond)
+	m.PutWithTTL("long", []byte("b"), time.Hour)
+	m.Put("forever", []byte("c"))
+
+	if _, err := m.Get("short"); err != nil {
+		t.Errorf("Expected short-lived key before expiry, got %v", err)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+
+	if _, err := m.Get("short"); err == nil {
+		t.Error("Expected short-lived key to expire")
+	}
+
+	m.removeExpired()
+	if _, exists := m.data["short"]; exists {
+		t.Error("Expected janitor to remove expired key")
+	}
+
+	for _, key := range []string{"long", "forever"} {
+		if _, err := m.Get(key); err != nil {
+			t.Errorf("Expected key %s to remain, got %v", key, err)
+		}
+	}
+
+	m.PutWithTTL("long", []byte("b"), -1)
+	if _, err := m.Get("long"); err == nil {
+		t.Error("Expected negative TTL to delete the key")
+	}
+}
+
+// Test that /register stores the OTP with a TTL
+func TestHandleRegisterOTPExpiry(t *testing.T) {
+	mock := NewMockStorage().(*MockStorage)
+	storage = mock
+
+	w := httptest.NewRecorder()
+	handleRegister(w, createTestRequest("POST", "/register", OTPRequest{Email: "test@example.com"}))
+
+	exp, ok := mock.expires["otp:test@example.com"]
+	if !ok {
+		t.Fatal("Expected OTP to be stored with a TTL")
+	}
+	if d := time.Until(exp); d <= 0 || d > otpTTL {
+		t.Errorf("Expected OTP TTL within %s, got %s", otpTTL, d)
+	}
+}
+
 // Test helper functions
 func createTestRequest(method, path string, body interface{}) *http.Request {
 	var reqBody []byte
@@ -68,6 +242,25 @@ func createAuthRequest(method, path string, token string, body interface{}) *htt
 	return req
 }
 
+// requestForTest sends a request through the router and returns the recorded
+// response. token, when set, is sent as a bearer credential; headers are
+// name/value pairs set after that, skipping empty values, e.g. "If-Match",
+// `"3"`. A json.RawMessage body is sent as is.
+func requestForTest(method, path, token string, body interface{}, headers ...string) *httptest.ResponseRecorder {
+	req := createTestRequest(method, path, body)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		if headers[i+1] != "" {
+			req.Header.Set(headers[i], headers[i+1])
+		}
+	}
+	w := httptest.NewRecorder()
+	handleRequest(w, req)
+	return w
+}
+
 // Test OTP generation
 func TestGenerateOTP(t *testing.T) {
 	otp := generateOTP()
@@ -109,12 +302,131 @@ func TestGetOrCreateClient(t *testing.T) {
 	}
 }
 
+// Test that concurrent client updates do not lose each other's changes
+func TestConcurrentClientUpdates(t *testing.T) {
+	storage = NewMockStorage()
+	clientData := getOrCreateClientWithInfrastructure("test@example.com")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			infra := Infrastructure{VPNInstances: []Resource{{ID: fmt.Sprintf("vpn-%d", i)}}}
+			if err := updateClientInfrastructure(clientData.ID, infra); err != nil {
+				t.Errorf("Unexpected error updating infrastructure: %v", err)
+			}
+		}(i)
+		go func() {
+			defer wg.Done()
+			if err := updateClientLastSeen(clientData.ID); err != nil {
+				t.Errorf("Unexpected error updating last seen: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	updated := getClientInfrastructure(clientData.ID)
+	if len(updated.Infrastructure.VPNInstances) != 1 {
+		t.Errorf("Expected infrastructure update to survive last-seen updates, got %v", updated.Infrastructure)
+	}
+}
+
+// Test that client updates retry on storage conflicts
+func TestUpdateClientRetriesOnConflict(t *testing.T) {
+	storage = NewMockStorage()
+	clientData := getOrCreateClientWithInfrastructure("test@example.com")
+
+	cs := &conflictingStorage{Storage: storage, conflicts: 2}
+	storage = cs
+
+	infra := Infrastructure{Databases: []Resource{{ID: "db-1"}}}
+	if err := updateClientInfrastructure(clientData.ID, infra); err != nil {
+		t.Fatalf("Expected update to succeed after retries, got %v", err)
+	}
+	if cs.calls != 3 {
+		t.Errorf("Expected 3 update attempts, got %d", cs.calls)
+	}
+
+	cs = &conflictingStorage{Storage: cs.Storage, conflicts: maxUpdateRetries}
+	storage = cs
+	if err := updateClientLastSeen(clientData.ID); err != ErrConflict {
+		t.Errorf("Expected ErrConflict after %d attempts, got %v", maxUpdateRetries, err)
+	}
+}
+
+// Test that client records are stored once and reached through indexes
+func TestClientRecordIndexes(t *testing.T) {
+	storage = NewMockStorage()
+	clientData := getOrCreateClientWithInfrastructure("test@example.com")
+
+	if data, _ := storage.Get("client:test@example.com"); string(data) != clientData.ID {
+		t.Errorf("Expected email index to hold client ID, got %q", data)
+	}
+	if data, _ := storage.Get("environment:" + clientData.Environment.ID); string(data) != clientData.ID {
+		t.Errorf("Expected environment index to hold client ID, got %q", data)
+	}
+
+	updateClientLastSeen(clientData.ID)
+
+	byEmail := getClientByEmail("test@example.com")
+	byEnv := getClientByEnvironment(clientData.Environment.ID)
+	byID := getClientInfrastructure(clientData.ID)
+	if byEmail == nil || byEnv == nil || byID == nil {
+		t.Fatal("Expected client to be found by email, environment and ID")
+	}
+	if !byEmail.LastSeen.Equal(byID.LastSeen) || !byEnv.LastSeen.Equal(byID.LastSeen) {
+		t.Error("Expected all lookups to return the same record")
+	}
+}
+
+// Test rewriting a legacy duplicated client record
+func TestMigrateClientRecord(t *testing.T) {
+	storage = NewMockStorage()
+
+	legacy := ClientData{
+		ID:          uuid.New().String(),
+		Email:       "legacy@example.com",
+		Environment: Environment{ID: uuid.New().String()},
+	}
+	stale, _ := json.Marshal(legacy)
+	legacy.Infrastructure.VPNInstances = []Resource{{ID: "vpn-1"}}
+	fresh, _ := json.Marshal(legacy)
+	envBytes, _ := json.Marshal(legacy.Environment)
+
+	storage.Put("client:legacy@example.com", stale)
+	storage.Put("client_id:"+legacy.ID, fresh)
+	storage.Put("environment:"+legacy.Environment.ID, envBytes)
+
+	migrated, err := migrateClientRecord("client:legacy@example.com")
+	if err != nil || !migrated {
+		t.Fatalf("Expected record to be migrated, got %v, %v", migrated, err)
+	}
+
+	if data, _ := storage.Get("client:legacy@example.com"); string(data) != legacy.ID {
+		t.Errorf("Expected email index to hold client ID, got %q", data)
+	}
+	if data, _ := storage.Get("environment:" + legacy.Environment.ID); string(data) != legacy.ID {
+		t.Errorf("Expected environment index to hold client ID, got %q", data)
+	}
+
+	client := getClientByEmail("legacy@example.com")
+	if client == nil || len(client.Infrastructure.VPNInstances) != 1 {
+		t.Errorf("Expected client_id: copy to be kept, got %+v", client)
+	}
+
+	// Running again is a no-op
+	if migrated, _ := migrateClientRecord("client:legacy@example.com"); migrated {
+		t.Error("Expected already migrated record to be skipped")
+	}
+}
+
 // Test JWT token generation and validation
 func TestJWTToken(t *testing.T) {
 	clientID := uuid.New().String()
 
 	// Test token generation
-	token := generateToken(clientID)
+	token := generateToken(clientID, "")
 
 	if token == "" {
 		t.Error("Expected non-empty token")
@@ -151,8 +463,7 @@ func createExpiredToken(clientID string) string {
 		ExpiresAt: jwt.NewNumericDate(time.Now().Add(-1 * time.Hour)),
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	tokenString, _ := token.SignedString(secret)
+	tokenString, _ := keyring.Sign(claims)
 	return tokenString
 }
 
@@ -192,6 +503,28 @@ func TestHandleRegister(t *testing.T) {
 	}
 }
 
+// Test that /register refuses anything but a bare email address
+func TestHandleRegisterInvalidEmail(t *testing.T) {
+	storage = NewMockStorage()
+
+	for _, email := range []string{
+		"not-an-email",
+		"test@example.com\r\nBcc: victim@example.com",
+		"Eve <eve@example.com>",
+		"test@example.com, other@example.com",
+		" test@example.com",
+	} {
+		w := httptest.NewRecorder()
+		handleRegister(w, createTestRequest("POST", "/register", OTPRequest{Email: email}))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected %q to be refused, got %d", email, w.Code)
+		}
+		if _, err := storage.Get("otp:" + email); err == nil {
+			t.Errorf("Expected no OTP to be stored for %q", email)
+		}
+	}
+}
+
 // Test OTP verification
 func TestHandleVerify(t *testing.T) {
 	storage = NewMockStorage()
@@ -249,70 +582,148 @@ func TestHandleVerify(t *testing.T) {
 // Test connection endpoint
 func TestHandleConnect(t *testing.T) {
 	storage = NewMockStorage()
-
-	// Create client and token
 	clientData := getOrCreateClientWithInfrastructure("test@example.com")
-	token := generateToken(clientData.ID)
+	client := sdkForTest(t, generateToken(clientData.ID, ""))
 
-	// Test successful connection
-	req := createAuthRequest("POST", "/connect", token, nil)
+	connect, err := client.Connect(context.Background())
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	if connect.Status != "connected" || connect.ClientID != clientData.ID || connect.Environment.ID != clientData.Environment.ID {
+		t.Errorf("Unexpected connect response %+v", connect)
+	}
 
-	w := httptest.NewRecorder()
-	handleConnect(w, req)
+	// Test unauthorized request
+	client.Token = "not-a-token"
+	if _, err := client.Connect(context.Background()); apiStatus(err) != http.StatusUnauthorized {
+		t.Errorf("Expected status 401 for unauthorized request, got %v", err)
+	}
+}
 
-	if w.Code != http.StatusOK {
-		t.Errorf("Expected status 200, got %d", w.Code)
+// Test config endpoint
+func TestHandleConfig(t *testing.T) {
+	storage = NewMockStorage()
+	clientData := getOrCreateClientWithInfrastructure("test@example.com")
+	client := sdkForTest(t, generateToken(clientData.ID, ""))
+
+	config, err := client.Config(context.Background(), "")
+	if err != nil {
+		t.Fatalf("Config failed: %v", err)
+	}
+	if config.Server == "" {
+		t.Error("Expected server in config")
+	}
+	if config.Port == 0 {
+		t.Error("Expected port in config")
+	}
+	if config.Token == "" {
+		t.Error("Expected token in config")
 	}
 
-	var response map[string]interface{}
-	json.Unmarshal(w.Body.Bytes(), &response)
+	if _, err := client.Config(context.Background(), "nope"); apiStatus(err) != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown peer, got %v", err)
+	}
+}
 
-	if response["status"] != "connected" {
-		t.Errorf("Expected connected status, got %v", response["status"])
+// Test prefix scanning with pagination in the in-memory storage
+func TestInMemoryStorageScan(t *testing.T) {
+	m := &InMemoryStorage{data: make(map[string]memoryEntry)}
+	for i := 0; i < 5; i++ {
+		m.Put(fmt.Sprintf("otp:user%d@example.com", i), []byte("x"))
+	}
+	m.Put("client:user@example.com", []byte("id"))
+	m.Put("client_id:id", []byte("{}"))
+	m.PutWithTTL("otp:expired@example.com", []byte("x"), -1)
+
+	var all []string
+	cursor := ""
+	for pages := 0; ; pages++ {
+		keys, next, err := m.Scan("otp:", cursor, 2)
+		if err != nil {
+			t.Fatalf("Unexpected scan error: %v", err)
+		}
+		if len(keys) > 2 {
+			t.Errorf("Expected at most 2 keys per page, got %d", len(keys))
+		}
+		all = append(all, keys...)
+		if next == "" {
+			break
+		}
+		if pages > 5 {
+			t.Fatal("Scan did not terminate")
+		}
+		cursor = next
 	}
 
-	// Test unauthorized request
-	req = createTestRequest("POST", "/connect", nil)
+	if len(all) != 5 || !sort.StringsAreSorted(all) {
+		t.Errorf("Expected 5 sorted otp: keys, got %v", all)
+	}
 
-	w = httptest.NewRecorder()
-	handleConnect(w, req)
+	keys, _, _ := m.Scan("client:", "", 10)
+	if len(keys) != 1 || keys[0] != "client:user@example.com" {
+		t.Errorf("Expected only the client: key, got %v", keys)
+	}
+}
 
-	if w.Code != http.StatusUnauthorized {
-		t.Errorf("Expected status 401 for unauthorized request, got %d", w.Code)
+// Test that a Scan without a limit uses the default page size
+func TestScanDefaultLimit(t *testing.T) {
+	for name, s := range map[string]Storage{
+		"memory": &InMemoryStorage{data: make(map[string]memoryEntry)},
+		"mock":   NewMockStorage(),
+	} {
+		for i := 0; i < defaultScanLimit+1; i++ {
+			s.Put(fmt.Sprintf("otp:user%03d@example.com", i), []byte("x"))
+		}
+		keys, next, err := s.Scan("otp:", "", 0)
+		if err != nil || len(keys) != defaultScanLimit || next == "" {
+			t.Errorf("%s: expected a first page of %d keys, got %d (next %q, %v)", name, defaultScanLimit, len(keys), next, err)
+		}
 	}
 }
 
-// Test config endpoint
-func TestHandleConfig(t *testing.T) {
+// Test the paginated /debug key browser
+func TestHandleDebugList(t *testing.T) {
 	storage = NewMockStorage()
+	useTestAdminKeys(t)
+	getOrCreateClientWithInfrastructure("a@example.com")
+	getOrCreateClientWithInfrastructure("b@example.com")
+	getOrCreateClientWithInfrastructure("c@example.com")
 
-	// Create client and token
-	clientData := getOrCreateClientWithInfrastructure("test@example.com")
-	token := generateToken(clientData.ID)
-
-	// Test successful config retrieval
-	req := createAuthRequest("GET", "/config", token, nil)
-
+	req := httptest.NewRequest("GET", "/debug?prefix=client:&limit=2", nil)
+	req.Header.Set("Authorization", "Bearer viewer-key")
 	w := httptest.NewRecorder()
-	handleConfig(w, req)
+	handleRequest(w, req)
 
 	if w.Code != http.StatusOK {
-		t.Errorf("Expected status 200, got %d", w.Code)
+		t.Fatalf("Expected status 200, got %d", w.Code)
 	}
 
-	var config VPNConfig
-	json.Unmarshal(w.Body.Bytes(), &config)
+	var page struct {
+		Keys       []string `json:"keys"`
+		NextCursor string   `json:"next_cursor"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &page)
 
-	if config.Server == "" {
-		t.Error("Expected server in config")
+	if len(page.Keys) != 2 || page.NextCursor == "" {
+		t.Fatalf("Expected first page of 2 keys with a cursor, got %+v", page)
 	}
 
-	if config.Port == 0 {
-		t.Error("Expected port in config")
+	req = httptest.NewRequest("GET", "/debug?prefix=client:&limit=2&cursor="+page.NextCursor, nil)
+	req.Header.Set("Authorization", "Bearer viewer-key")
+	w = httptest.NewRecorder()
+	handleRequest(w, req)
+	json.Unmarshal(w.Body.Bytes(), &page)
+
+	if len(page.Keys) != 1 || page.Keys[0] != "client:c@example.com" || page.NextCursor != "" {
+		t.Errorf("Expected final page with client:c@example.com, got %+v", page)
 	}
 
-	if config.Token == "" {
-		t.Error("Expected token in config")
+	req = httptest.NewRequest("GET", "/debug?limit=abc", nil)
+	req.Header.Set("Authorization", "Bearer viewer-key")
+	w = httptest.NewRecorder()
+	handleRequest(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for invalid limit, got %d", w.Code)
 	}
 }
 
@@ -393,16 +804,436 @@ func BenchmarkGenerateOTP(b *testing.B) {
 func BenchmarkGenerateToken(b *testing.B) {
 	clientID := uuid.New().String()
 	for i := 0; i < b.N; i++ {
-		generateToken(clientID)
+		generateToken(clientID, "")
 	}
 }
 
 func BenchmarkValidateToken(b *testing.B) {
 	clientID := uuid.New().String()
-	token := generateToken(clientID)
+	token := generateToken(clientID, "")
 
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
 		validateToken(token)
 	}
 }
+
+func storeTestOTP(email, otp string, expires time.Time) {
+	otpBytes, _ := json.Marshal(OTPRecord{OTP: otp, Expires: expires.Unix()})
+	storage.Put("otp:"+email, otpBytes)
+}
+
+// Test OTP attempt counting, lockout and error codes
+func TestHandleVerifyErrorCodes(t *testing.T) {
+	email := "test@example.com"
+
+	tests := []struct {
+		name       string
+		setup      func()
+		guesses    []string
+		wantStatus int
+		wantCode   string
+	}{
+		{
+			name:       "no pending OTP",
+			setup:      func() {},
+			guesses:    []string{"123456"},
+			wantStatus: http.StatusBadRequest,
+			wantCode:   ErrCodeOTPNotFound,
+		},
+		{
+			name:       "expired OTP",
+			setup:      func() { storeTestOTP(email, "123456", time.Now().Add(-time.Minute)) },
+			guesses:    []string{"123456"},
+			wantStatus: http.StatusBadRequest,
+			wantCode:   ErrCodeOTPExpired,
+		},
+		{
+			name:       "single mismatch",
+			setup:      func() { storeTestOTP(email, "123456", time.Now().Add(otpTTL)) },
+			guesses:    []string{"000000"},
+			wantStatus: http.StatusBadRequest,
+			wantCode:   ErrCodeOTPMismatch,
+		},
+		{
+			name:       "brute force locks the OTP",
+			setup:      func() { storeTestOTP(email, "123456", time.Now().Add(otpTTL)) },
+			guesses:    []string{"000000", "000001", "000002", "000003", "000004"},
+			wantStatus: http.StatusTooManyRequests,
+			wantCode:   ErrCodeOTPLocked,
+		},
+		{
+			name:       "correct OTP after lockout is rejected",
+			setup:      func() { storeTestOTP(email, "123456", time.Now().Add(otpTTL)) },
+			guesses:    []string{"000000", "000001", "000002", "000003", "000004", "123456"},
+			wantStatus: http.StatusTooManyRequests,
+			wantCode:   ErrCodeOTPLocked,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storage = NewMockStorage()
+			tt.setup()
+
+			var w *httptest.ResponseRecorder
+			for _, guess := range tt.guesses {
+				w = httptest.NewRecorder()
+				handleVerify(w, createTestRequest("POST", "/verify", OTPVerify{Email: email, OTP: guess}))
+			}
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("Expected status %d, got %d", tt.wantStatus, w.Code)
+			}
+
+			var resp ErrorResponse
+			json.Unmarshal(w.Body.Bytes(), &resp)
+			if resp.Error != tt.wantCode {
+				t.Errorf("Expected error code %s, got %s", tt.wantCode, resp.Error)
+			}
+		})
+	}
+}
+
+// Test that remaining attempts are reported on mismatch
+func TestHandleVerifyAttemptsRemaining(t *testing.T) {
+	storage = NewMockStorage()
+	storeTestOTP("test@example.com", "123456", time.Now().Add(otpTTL))
+
+	for i := 1; i < maxOTPAttempts; i++ {
+		w := httptest.NewRecorder()
+		handleVerify(w, createTestRequest("POST", "/verify", OTPVerify{Email: "test@example.com", OTP: "000000"}))
+
+		var resp ErrorResponse
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		if resp.AttemptsRemaining == nil || *resp.AttemptsRemaining != maxOTPAttempts-i {
+			t.Errorf("Attempt %d: expected %d attempts remaining, got %v", i, maxOTPAttempts-i, resp.AttemptsRemaining)
+		}
+	}
+}
+
+// Test that parallel guesses cannot get past the lockout or revive a used OTP
+func TestHandleVerifyConcurrentGuesses(t *testing.T) {
+	storage = NewMockStorage()
+	storeTestOTP("test@example.com", "123456", time.Now().Add(otpTTL))
+
+	var wg sync.WaitGroup
+	codes := make(chan int, 50)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			handleVerify(w, createTestRequest("POST", "/verify", OTPVerify{Email: "test@example.com", OTP: fmt.Sprintf("%06d", i)}))
+			codes <- w.Code
+		}(i)
+	}
+	wg.Wait()
+	close(codes)
+
+	mismatches := 0
+	for code := range codes {
+		if code == http.StatusBadRequest {
+			mismatches++
+		}
+	}
+	if mismatches != maxOTPAttempts-1 {
+		t.Errorf("Expected %d mismatches before the lockout, got %d", maxOTPAttempts-1, mismatches)
+	}
+
+	w := httptest.NewRecorder()
+	handleVerify(w, createTestRequest("POST", "/verify", OTPVerify{Email: "test@example.com", OTP: "123456"}))
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected the correct OTP to stay locked out, got %d", w.Code)
+	}
+
+	// A wrong guess after a successful verify must not bring the record back
+	storeTestOTP("other@example.com", "654321", time.Now().Add(otpTTL))
+	w = httptest.NewRecorder()
+	handleVerify(w, createTestRequest("POST", "/verify", OTPVerify{Email: "other@example.com", OTP: "654321"}))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected verification to succeed, got %d: %s", w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	handleVerify(w, createTestRequest("POST", "/verify", OTPVerify{Email: "other@example.com", OTP: "000000"}))
+	if _, err := storage.Get("otp:other@example.com"); err == nil || w.Code != http.StatusBadRequest {
+		t.Errorf("Expected the used OTP to stay deleted, got %d", w.Code)
+	}
+}
+
+// Test per-email and per-IP resend cooldowns on /register
+func TestHandleRegisterRateLimit(t *testing.T) {
+	tests := []struct {
+		name       string
+		requests   []string // email per request, all from the same IP
+		wantStatus []int
+	}{
+		{
+			name:       "resend to same email within cooldown",
+			requests:   []string{"a@example.com", "a@example.com"},
+			wantStatus: []int{http.StatusOK, http.StatusTooManyRequests},
+		},
+		{
+			name:       "different emails are independent",
+			requests:   []string{"a@example.com", "b@example.com"},
+			wantStatus: []int{http.StatusOK, http.StatusOK},
+		},
+		{
+			name: "resend flood from one IP",
+			requests: []string{
+				"a@example.com", "b@example.com", "c@example.com",
+				"d@example.com", "e@example.com", "f@example.com",
+			},
+			wantStatus: []int{
+				http.StatusOK, http.StatusOK, http.StatusOK,
+				http.StatusOK, http.StatusOK, http.StatusTooManyRequests,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storage = NewMockStorage()
+
+			for i, email := range tt.requests {
+				w := httptest.NewRecorder()
+				handleRegister(w, createTestRequest("POST", "/register", OTPRequest{Email: email}))
+
+				if w.Code != tt.wantStatus[i] {
+					t.Errorf("Request %d (%s): expected status %d, got %d", i, email, tt.wantStatus[i], w.Code)
+				}
+
+				if w.Code == http.StatusTooManyRequests {
+					var resp ErrorResponse
+					json.Unmarshal(w.Body.Bytes(), &resp)
+					if resp.Error != ErrCodeRateLimited {
+						t.Errorf("Expected error code %s, got %s", ErrCodeRateLimited, resp.Error)
+					}
+					if w.Header().Get("Retry-After") == "" {
+						t.Error("Expected Retry-After header")
+					}
+				}
+			}
+		})
+	}
+}
+
+// Test that a resend does not lift the lockout of the current code
+func TestHandleRegisterKeepsLock(t *testing.T) {
+	storage = NewMockStorage()
+	locked, _ := json.Marshal(OTPRecord{Expires: time.Now().Add(time.Minute).Unix(), Attempts: maxOTPAttempts, Locked: true})
+	storage.Put("otp:test@example.com", locked)
+
+	w := httptest.NewRecorder()
+	handleRegister(w, createTestRequest("POST", "/register", OTPRequest{Email: "test@example.com"}))
+	var resp ErrorResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if w.Code != http.StatusTooManyRequests || resp.Error != ErrCodeOTPLocked || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("Expected the resend to be refused while locked, got %d: %s", w.Code, w.Body.String())
+	}
+	var record OTPRecord
+	data, _ := storage.Get("otp:test@example.com")
+	json.Unmarshal(data, &record)
+	if !record.Locked || record.Attempts != maxOTPAttempts {
+		t.Errorf("Expected the lock to be kept, got %+v", record)
+	}
+
+	// Once the locked code has expired a new one is sent
+	storage = NewMockStorage()
+	expired, _ := json.Marshal(OTPRecord{Expires: time.Now().Add(-time.Second).Unix(), Attempts: maxOTPAttempts, Locked: true})
+	storage.Put("otp:test@example.com", expired)
+	w = httptest.NewRecorder()
+	handleRegister(w, createTestRequest("POST", "/register", OTPRequest{Email: "test@example.com"}))
+	data, _ = storage.Get("otp:test@example.com")
+	record = OTPRecord{}
+	json.Unmarshal(data, &record)
+	if w.Code != http.StatusOK || record.Locked || record.Attempts != 0 || record.OTP == "" {
+		t.Errorf("Expected a fresh code after the lock expired, got %d and %+v", w.Code, record)
+	}
+}
+
+// failingPutStorage refuses every PutWithTTL
+type failingPutStorage struct {
+	Storage
+}
+
+func (failingPutStorage) PutWithTTL(key string, value []byte, ttl time.Duration) error {
+	return errors.New("storage unavailable")
+}
+
+// countingMailer counts the codes it was asked to send
+type countingMailer struct {
+	sent int
+}
+
+func (m *countingMailer) SendOTP(to, otp string) error {
+	m.sent++
+	return nil
+}
+
+// Test that no email is sent for a code that could not be stored
+func TestHandleRegisterStoreFailure(t *testing.T) {
+	storage = failingPutStorage{NewMockStorage()}
+	counter := &countingMailer{}
+	mailer = counter
+	defer func() { mailer = LogMailer{} }()
+
+	w := httptest.NewRecorder()
+	handleRegister(w, createTestRequest("POST", "/register", OTPRequest{Email: "test@example.com"}))
+	if w.Code != http.StatusInternalServerError || counter.sent != 0 {
+		t.Errorf("Expected 500 and no email, got %d after %d emails", w.Code, counter.sent)
+	}
+}
+
+// Test that parallel resends share one counter instead of each passing the limit
+func TestHandleRegisterConcurrentRateLimit(t *testing.T) {
+	storage = NewMockStorage()
+
+	var wg sync.WaitGroup
+	codes := make(chan int, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			handleRegister(w, createTestRequest("POST", "/register", OTPRequest{Email: "a@example.com"}))
+			codes <- w.Code
+		}()
+	}
+	wg.Wait()
+	close(codes)
+
+	sent := 0
+	for code := range codes {
+		if code == http.StatusOK {
+			sent++
+		}
+	}
+	if sent != 1 {
+		t.Errorf("Expected exactly one OTP to be sent, got %d", sent)
+	}
+}
+
+// Test the full client flow through the shared SDK against the real router
+// sdkForTest serves the worker on a test server and returns an SDK client
+// for it holding token
+func sdkForTest(t *testing.T, token string) *soltar.Client {
+	server := httptest.NewServer(http.HandlerFunc(handleRequest))
+	t.Cleanup(server.Close)
+
+	client := soltar.NewClient(server.URL)
+	client.Token = token
+	return client
+}
+
+// apiStatus is the HTTP status of an SDK error, or 0 if it is not one
+func apiStatus(err error) int {
+	var apiErr *soltar.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.StatusCode
+	}
+	return 0
+}
+
+func TestClientSDKFlow(t *testing.T) {
+	storage = NewMockStorage()
+	ctx := context.Background()
+	client := sdkForTest(t, "")
+	email := "sdk@example.com"
+
+	if err := client.Register(ctx, email); err != nil {
+		t.Fatalf("Register failed: %v", err)
+	}
+	data, err := storage.Get("otp:" + email)
+	if err != nil {
+		t.Fatalf("Expected OTP to be stored: %v", err)
+	}
+	var record OTPRecord
+	json.Unmarshal(data, &record)
+
+	// A wrong code surfaces the structured error
+	_, err = client.Verify(ctx, soltar.OTPVerify{Email: email, OTP: "000000"})
+	var apiErr *soltar.APIError
+	if !errors.As(err, &apiErr) || apiErr.Code != ErrCodeOTPMismatch || apiErr.AttemptsRemaining == nil {
+		t.Fatalf("Expected %s error with attempts remaining, got %v", ErrCodeOTPMismatch, err)
+	}
+
+	auth, err := client.Verify(ctx, soltar.OTPVerify{Email: email, OTP: record.OTP, Device: "sdk-test"})
+	if err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+	if client.Token != auth.Token || auth.RefreshToken == "" {
+		t.Error("Expected Verify to keep the access token and return a refresh token")
+	}
+
+	connect, err := client.Connect(ctx)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	if connect.Status != "connected" || connect.ClientID != auth.ClientID || connect.Environment.ID != auth.Environment.ID {
+		t.Errorf("Unexpected connect response %+v", connect)
+	}
+
+	config, err := client.Config(ctx, "")
+	if err != nil {
+		t.Fatalf("Config failed: %v", err)
+	}
+	if config.EnvironmentID != auth.Environment.ID || config.WireGuard == nil || config.WireGuard.Interface.PrivateKey == "" {
+		t.Errorf("Unexpected config %+v", config)
+	}
+	file, err := client.ConfigFile(ctx, "", "wg-quick")
+	if err != nil || !strings.Contains(string(file), "[Interface]") {
+		t.Errorf("Expected a wg-quick file, got %q (%v)", file, err)
+	}
+
+	if _, err := client.Heartbeat(ctx, soltar.HeartbeatRequest{TunnelUp: true}); err != nil {
+		t.Fatalf("Heartbeat failed: %v", err)
+	}
+	presence, err := client.Presence(ctx)
+	if err != nil {
+		t.Fatalf("Presence failed: %v", err)
+	}
+	if presence.State != soltar.PresenceOnline || len(presence.Devices) != 1 || !presence.Devices[0].TunnelUp {
+		t.Errorf("Unexpected presence %+v", presence)
+	}
+
+	suspended, err := client.SuspendEnvironment(ctx, "maintenance")
+	if err != nil || suspended.Environment.Status != soltar.EnvironmentSuspended {
+		t.Fatalf("Expected SuspendEnvironment to suspend, got %+v (%v)", suspended, err)
+	}
+	_, err = client.Config(ctx, "")
+	if !errors.As(err, &apiErr) || apiErr.Code != soltar.ErrCodeEnvironmentNotActive {
+		t.Errorf("Expected %s while suspended, got %v", soltar.ErrCodeEnvironmentNotActive, err)
+	}
+	if _, err := client.ResumeEnvironment(ctx); err != nil {
+		t.Fatalf("ResumeEnvironment failed: %v", err)
+	}
+
+	update := Infrastructure{Databases: []Resource{{ID: "pg-main"}}, Storage: []Resource{{ID: "backups"}}}
+	if _, err := client.UpdateInfrastructure(ctx, update); err != nil {
+		t.Fatalf("UpdateInfrastructure failed: %v", err)
+	}
+	infra, err := client.GetInfrastructure(ctx)
+	if err != nil {
+		t.Fatalf("GetInfrastructure failed: %v", err)
+	}
+	if infra.ClientID != auth.ClientID || len(infra.Infrastructure.Databases) != 1 || infra.Infrastructure.Databases[0].ID != "pg-main" {
+		t.Errorf("Unexpected infrastructure %+v", infra)
+	}
+
+	tokens, err := client.Refresh(ctx, auth.RefreshToken)
+	if err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	if client.Token != tokens.Token || tokens.RefreshToken == auth.RefreshToken {
+		t.Error("Expected Refresh to keep the new access token and rotate the refresh token")
+	}
+
+	if err := client.Logout(ctx); err != nil {
+		t.Fatalf("Logout failed: %v", err)
+	}
+	_, err = client.Connect(ctx)
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected 401 after logout, got %v", err)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+)
+
+// clientRecordMigrationKey marks that duplicated client records have been
+// rewritten into the client_id: record plus index layout
+const clientRecordMigrationKey = "migration:client_records:v1"
+
+// migrateClientRecords rewrites client records written before the index
+// layout, where client:<email>, client_id:<id> and environment:<id> each held
+// a full copy. It runs once per Redis database.
+func migrateClientRecords() error {
+	if _, err := storage.Get(clientRecordMigrationKey); err == nil {
+		return nil
+	}
+
+	keys, err := scanAll("client:")
+	if err != nil {
+		return fmt.Errorf("failed to list client keys: %v", err)
+	}
+
+	migrated := 0
+	for _, key := range keys {
+		ok, err := migrateClientRecord(key)
+		if err != nil {
+			return fmt.Errorf("failed to migrate %s: %v", key, err)
+		}
+		if ok {
+			migrated++
+		}
+	}
+
+	log.Printf("Client record migration complete: %d of %d records rewritten", migrated, len(keys))
+	return storage.Put(clientRecordMigrationKey, []byte(time.Now().UTC().Format(time.RFC3339)))
+}
+
+// migrateClientRecord converts one legacy client:<email> blob. It reports
+// false when the key already holds a plain client ID.
+func migrateClientRecord(emailKey string) (bool, error) {
+	data, err := storage.Get(emailKey)
+	if err != nil || len(data) == 0 || data[0] != '{' {
+		return false, nil
+	}
+
+	var legacy ClientData
+	if err := json.Unmarshal(data, &legacy); err != nil {
+		return false, err
+	}
+	if legacy.ID == "" {
+		return false, fmt.Errorf("record has no client ID")
+	}
+
+	idKey := clientIDKey(legacy.ID)
+	envKey := environmentKey(legacy.Environment.ID)
+
+	err = updateWithRetry([]string{emailKey, idKey, envKey}, func(current map[string][]byte) (map[string][]byte, error) {
+		// Both copies were always written together, but client_id: is the one
+		// lookups by token have been reading, so it wins if present
+		record, ok := current[idKey]
+		if !ok {
+			record = current[emailKey]
+		}
+
+		updates := map[string][]byte{
+			idKey:    record,
+			emailKey: []byte(legacy.ID),
+		}
+		if legacy.Environment.ID != "" {
+			updates[envKey] = []byte(legacy.ID)
+		}
+		return updates, nil
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
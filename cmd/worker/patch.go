@@ -0,0 +1,451 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/glassrye/soltar"
+)
+
+type PatchOperation = soltar.PatchOperation
+
+const (
+	MergePatchContentType = soltar.MergePatchContentType
+	JSONPatchContentType  = soltar.JSONPatchContentType
+
+	ErrCodePatchConflict = soltar.ErrCodePatchConflict
+)
+
+// maxPatchBytes bounds the body of PATCH /infrastructure
+const maxPatchBytes = 1 << 20
+
+// patchConflict is returned when a JSON Patch cannot be applied to the stored
+// document
+type patchConflict struct {
+	index int
+	op    string
+	err   error
+}
+
+func (e patchConflict) Error() string {
+	return fmt.Sprintf("Patch operation %d (%s) failed: %v", e.index, e.op, e.err)
+}
+
+// Fields of an infrastructure document and of its resources, as a patched
+// document may hold them; anything else violates the schema
+var (
+	infrastructureFields = map[string]bool{
+		"vpn_instances": true, "load_balancers": true, "databases": true, "storage": true,
+		"generation": true, "created": true, "last_updated": true,
+	}
+	resourceFields = map[string]bool{
+		"id": true, "kind": true, "spec": true, "status": true, "region": true, "created": true, "updated": true,
+	}
+)
+
+// infrastructurePatch is a parsed PATCH body
+type infrastructurePatch struct {
+	merge interface{}
+	ops   []PatchOperation
+}
+
+// parseInfrastructurePatch reads a merge patch or JSON Patch according to
+// contentType and checks that it is well-formed
+func parseInfrastructurePatch(contentType string, body []byte) (*infrastructurePatch, error) {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = ""
+	}
+
+	switch mediaType {
+	case MergePatchContentType:
+		var merge interface{}
+		if err := json.Unmarshal(body, &merge); err != nil {
+			return nil, fmt.Errorf("invalid merge patch: %v", err)
+		}
+		if _, ok := merge.(map[string]interface{}); !ok {
+			return nil, errors.New("a merge patch of the infrastructure must be an object")
+		}
+		return &infrastructurePatch{merge: merge}, nil
+	case JSONPatchContentType:
+		var ops []PatchOperation
+		if err := json.Unmarshal(body, &ops); err != nil {
+			return nil, fmt.Errorf("invalid JSON Patch: %v", err)
+		}
+		for n, op := range ops {
+			if err := checkPatchOperation(op); err != nil {
+				return nil, fmt.Errorf("invalid JSON Patch operation %d: %v", n, err)
+			}
+		}
+		return &infrastructurePatch{ops: ops}, nil
+	default:
+		return nil, errUnsupportedPatch
+	}
+}
+
+var errUnsupportedPatch = fmt.Errorf("PATCH takes %s or %s", MergePatchContentType, JSONPatchContentType)
+
+func checkPatchOperation(op PatchOperation) error {
+	if _, err := parsePointer(op.Path); err != nil {
+		return err
+	}
+	switch op.Op {
+	case "add", "replace", "test":
+		if op.Value == nil {
+			return fmt.Errorf("%s needs a value", op.Op)
+		}
+	case "remove":
+	case "move", "copy":
+		if _, err := parsePointer(op.From); err != nil {
+			return fmt.Errorf("from: %v", err)
+		}
+		if op.Op == "move" && strings.HasPrefix(op.Path+"/", op.From+"/") && op.Path != op.From {
+			return errors.New("cannot move a value into itself")
+		}
+	default:
+		return fmt.Errorf("unknown op %q", op.Op)
+	}
+	return nil
+}
+
+// apply patches current and decodes the result, refusing documents that do
+// not fit the Infrastructure schema
+func (p *infrastructurePatch) apply(current Infrastructure) (Infrastructure, error) {
+	data, err := json.Marshal(current)
+	if err != nil {
+		return Infrastructure{}, err
+	}
+	var doc interface{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return Infrastructure{}, err
+	}
+
+	if p.merge != nil {
+		doc = mergePatch(doc, p.merge)
+	}
+	for n, op := range p.ops {
+		if doc, err = applyPatchOperation(doc, op); err != nil {
+			return Infrastructure{}, patchConflict{index: n, op: op.Op, err: err}
+		}
+	}
+
+	if errs := checkInfrastructureDocument(doc); len(errs) > 0 {
+		return Infrastructure{}, infrastructureInvalid(errs)
+	}
+	patched, _ := json.Marshal(doc)
+	var infra Infrastructure
+	if err := json.Unmarshal(patched, &infra); err != nil {
+		field := "infrastructure"
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) && typeErr.Field != "" {
+			field += "." + typeErr.Field
+		}
+		return Infrastructure{}, infrastructureInvalid{{Field: field, Message: fmt.Sprintf("invalid value: %v", err)}}
+	}
+	return infra, nil
+}
+
+// checkInfrastructureDocument rejects fields the schema does not have, which
+// decoding would otherwise drop silently. Specs are checked per kind later.
+func checkInfrastructureDocument(doc interface{}) []ValidationError {
+	v := &validator{}
+	object, ok := doc.(map[string]interface{})
+	if !ok {
+		v.addf("infrastructure", "must be an object")
+		return v.errs
+	}
+	for key, value := range object {
+		if !infrastructureFields[key] {
+			v.addf("infrastructure."+key, "unknown field")
+			continue
+		}
+		list, ok := value.([]interface{})
+		if !ok {
+			continue
+		}
+		for n, item := range list {
+			resource, ok := item.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			for field := range resource {
+				if !resourceFields[field] {
+					v.addf(fmt.Sprintf("infrastructure.%s[%d].%s", key, n, field), "unknown field")
+				}
+			}
+		}
+	}
+	return v.errs
+}
+
+// mergePatch applies a JSON Merge Patch (RFC 7396) to target
+func mergePatch(target, patch interface{}) interface{} {
+	patchObject, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	targetObject, ok := target.(map[string]interface{})
+	if !ok {
+		targetObject = map[string]interface{}{}
+	}
+	for key, value := range patchObject {
+		if value == nil {
+			delete(targetObject, key)
+		} else {
+			targetObject[key] = mergePatch(targetObject[key], value)
+		}
+	}
+	return targetObject
+}
+
+// applyPatchOperation applies one JSON Patch (RFC 6902) operation to doc
+func applyPatchOperation(doc interface{}, op PatchOperation) (interface{}, error) {
+	path, _ := parsePointer(op.Path)
+
+	var value interface{}
+	if op.Value != nil {
+		if err := json.Unmarshal(op.Value, &value); err != nil {
+			return nil, fmt.Errorf("invalid value: %v", err)
+		}
+	}
+
+	switch op.Op {
+	case "add":
+		return addValue(doc, path, value)
+	case "remove":
+		return removeValue(doc, path)
+	case "replace":
+		if _, err := getValue(doc, path); err != nil {
+			return nil, err
+		}
+		if len(path) == 0 {
+			return value, nil
+		}
+		return changeParent(doc, path, func(parent interface{}, key string) (interface{}, error) {
+			switch parent := parent.(type) {
+			case map[string]interface{}:
+				parent[key] = value
+				return parent, nil
+			default:
+				list := parent.([]interface{})
+				i, _ := arrayIndex(key, len(list), false)
+				list[i] = value
+				return list, nil
+			}
+		})
+	case "move", "copy":
+		from, _ := parsePointer(op.From)
+		moved, err := getValue(doc, from)
+		if err != nil {
+			return nil, fmt.Errorf("from: %v", err)
+		}
+		if op.Op == "move" {
+			if doc, err = removeValue(doc, from); err != nil {
+				return nil, err
+			}
+		} else {
+			moved = copyValue(moved)
+		}
+		return addValue(doc, path, moved)
+	default:
+		actual, err := getValue(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		if !reflect.DeepEqual(actual, value) {
+			return nil, fmt.Errorf("%s does not hold the tested value", op.Path)
+		}
+		return doc, nil
+	}
+}
+
+// parsePointer splits a JSON Pointer (RFC 6901) into its reference tokens
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("path %q must start with /", pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for n, token := range tokens {
+		tokens[n] = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+// arrayIndex reads an array index token; "-" means the end of the array
+// where end is allowed
+func arrayIndex(token string, length int, end bool) (int, error) {
+	if token == "-" && end {
+		return length, nil
+	}
+	if token == "" || (len(token) > 1 && token[0] == '0') {
+		return 0, fmt.Errorf("invalid array index %q", token)
+	}
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 {
+		return 0, fmt.Errorf("invalid array index %q", token)
+	}
+	limit := length
+	if end {
+		limit++
+	}
+	if i >= limit {
+		return 0, fmt.Errorf("array index %d out of range", i)
+	}
+	return i, nil
+}
+
+func getValue(doc interface{}, path []string) (interface{}, error) {
+	node := doc
+	for _, token := range path {
+		switch current := node.(type) {
+		case map[string]interface{}:
+			value, ok := current[token]
+			if !ok {
+				return nil, fmt.Errorf("no member %q", token)
+			}
+			node = value
+		case []interface{}:
+			i, err := arrayIndex(token, len(current), false)
+			if err != nil {
+				return nil, err
+			}
+			node = current[i]
+		default:
+			return nil, fmt.Errorf("cannot descend into %q", token)
+		}
+	}
+	return node, nil
+}
+
+// changeParent replaces the container holding the last token of path with
+// what change returns for it, rebuilding the containers above it
+func changeParent(node interface{}, path []string, change func(parent interface{}, key string) (interface{}, error)) (interface{}, error) {
+	if len(path) == 1 {
+		switch node.(type) {
+		case map[string]interface{}, []interface{}:
+			return change(node, path[0])
+		default:
+			return nil, fmt.Errorf("cannot descend into %q", path[0])
+		}
+	}
+
+	child, err := getValue(node, path[:1])
+	if err != nil {
+		return nil, err
+	}
+	updated, err := changeParent(child, path[1:], change)
+	if err != nil {
+		return nil, err
+	}
+	switch current := node.(type) {
+	case map[string]interface{}:
+		current[path[0]] = updated
+	case []interface{}:
+		i, _ := arrayIndex(path[0], len(current), false)
+		current[i] = updated
+	}
+	return node, nil
+}
+
+func addValue(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	return changeParent(doc, path, func(parent interface{}, key string) (interface{}, error) {
+		switch parent := parent.(type) {
+		case map[string]interface{}:
+			parent[key] = value
+			return parent, nil
+		default:
+			list := parent.([]interface{})
+			i, err := arrayIndex(key, len(list), true)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, nil)
+			copy(list[i+1:], list[i:])
+			list[i] = value
+			return list, nil
+		}
+	})
+}
+
+func removeValue(doc interface{}, path []string) (interface{}, error) {
+	if len(path) == 0 {
+		return nil, errors.New("cannot remove the whole document")
+	}
+	return changeParent(doc, path, func(parent interface{}, key string) (interface{}, error) {
+		switch parent := parent.(type) {
+		case map[string]interface{}:
+			if _, ok := parent[key]; !ok {
+				return nil, fmt.Errorf("no member %q", key)
+			}
+			delete(parent, key)
+			return parent, nil
+		default:
+			list := parent.([]interface{})
+			i, err := arrayIndex(key, len(list), false)
+			if err != nil {
+				return nil, err
+			}
+			return append(list[:i:i], list[i+1:]...), nil
+		}
+	})
+}
+
+func copyValue(value interface{}) interface{} {
+	data, _ := json.Marshal(value)
+	var copied interface{}
+	json.Unmarshal(data, &copied)
+	return copied
+}
+
+// handlePatchInfrastructure applies a merge patch or JSON Patch to the stored
+// infrastructure in one transaction, so concurrent patches cannot lose each
+// other's changes
+func handlePatchInfrastructure(w http.ResponseWriter, r *http.Request) {
+	claims, ok := authenticateClient(w, r)
+	if !ok {
+		return
+	}
+	ifMatch, err := parseIfMatch(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxPatchBytes+1))
+	if err != nil || len(body) > maxPatchBytes {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	patch, err := parseInfrastructurePatch(r.Header.Get("Content-Type"), bytes.TrimSpace(body))
+	if err == errUnsupportedPatch {
+		w.Header().Set("Accept-Patch", MergePatchContentType+", "+JSONPatchContentType)
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, ErrorResponse{Error: ErrCodeInvalidRequest, Message: err.Error()})
+		return
+	}
+
+	revision, err := commitInfrastructure(claims.Subject, infrastructureWrite{author: claims.Subject, ifMatch: ifMatch}, patch.apply)
+	var conflict patchConflict
+	if errors.As(err, &conflict) {
+		writeError(w, http.StatusConflict, ErrorResponse{Error: ErrCodePatchConflict, Message: conflict.Error()})
+		return
+	}
+	respondInfrastructureWrite(w, claims.Subject, revision, err, "Infrastructure patched")
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/glassrye/soltar"
+)
+
+func TestMergePatchInfrastructure(t *testing.T) {
+	storage = NewMockStorage()
+	client := getOrCreateClientWithInfrastructure("test@example.com")
+	token := generateToken(client.ID, "")
+
+	update := InfrastructureUpdate{Infrastructure: Infrastructure{
+		VPNInstances: []Resource{{ID: "vpn-1"}},
+		Databases:    []Resource{{ID: "pg-main"}},
+	}}
+	if w := requestForTest("POST", "/infrastructure", token, update); w.Code != http.StatusOK {
+		t.Fatalf("Expected the initial update to succeed, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// A merge patch replaces lists whole and leaves the others alone
+	w := requestForTest("PATCH", "/infrastructure", token, json.RawMessage(`{"databases":null,"storage":[{"id":"backups","spec":{"size_gb":20}}]}`), "Content-Type", "application/merge-patch+json; charset=utf-8", "If-Match", `"1"`)
+	if w.Code != http.StatusOK || w.Header().Get("ETag") != `"2"` {
+		t.Fatalf("Expected revision 2, got %d %s: %s", w.Code, w.Header().Get("ETag"), w.Body.String())
+	}
+	infra := getClientInfrastructure(client.ID).Infrastructure
+	if len(infra.VPNInstances) != 1 || len(infra.Databases) != 0 || len(infra.Storage) != 1 {
+		t.Fatalf("Expected vpn-1 and backups only, got %+v", infra)
+	}
+	if string(infra.Storage[0].Spec) != `{"size_gb":20}` || infra.Storage[0].Kind != ResourceStorage {
+		t.Errorf("Expected a typed storage resource with its spec, got %+v", infra.Storage[0])
+	}
+	if revision := loadInfrastructureRevision(client.ID, 2); revision == nil || revision.Author != client.ID || len(revision.Diff) != 2 {
+		t.Errorf("Expected the patch to be recorded as revision 2, got %+v", revision)
+	}
+
+	w = requestForTest("PATCH", "/infrastructure", token, json.RawMessage(`{"databases":[{"id":"pg-2","spec":{"engine":"mysql"}}]}`), "Content-Type", MergePatchContentType)
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("Expected an invalid spec to be refused, got %d: %s", w.Code, w.Body.String())
+	}
+	var errResp ErrorResponse
+	json.Unmarshal(w.Body.Bytes(), &errResp)
+	if len(errResp.Fields) != 1 || errResp.Fields[0].Field != "infrastructure.databases[0].spec.engine" {
+		t.Errorf("Expected the engine to be named, got %+v", errResp.Fields)
+	}
+
+	if w := requestForTest("PATCH", "/infrastructure", token, json.RawMessage(`{"routers":[]}`), "Content-Type", MergePatchContentType); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected an unknown list to be refused, got %d", w.Code)
+	}
+	if w := requestForTest("PATCH", "/infrastructure", token, json.RawMessage(`{"vpn_instances":"vpn-2"}`), "Content-Type", MergePatchContentType); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected a list of the wrong type to be refused, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := requestForTest("PATCH", "/infrastructure", token, json.RawMessage(`[]`), "Content-Type", MergePatchContentType); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected a merge patch that is not an object to be refused, got %d", w.Code)
+	}
+	if infra := getClientInfrastructure(client.ID).Infrastructure; infra.Generation != 2 {
+		t.Errorf("Expected refused patches to leave revision 2, got %d", infra.Generation)
+	}
+}
+
+func TestJSONPatchInfrastructure(t *testing.T) {
+	storage = NewMockStorage()
+	client := getOrCreateClientWithInfrastructure("test@example.com")
+	token := generateToken(client.ID, "")
+
+	w := requestForTest("PATCH", "/infrastructure", token, json.RawMessage(`[
+		{"op":"add","path":"/vpn_instances/-","value":{"id":"vpn-1"}},
+		{"op":"add","path":"/vpn_instances/-","value":"vpn-2"},
+		{"op":"add","path":"/load_balancers/0","value":{"id":"lb-1","spec":{"targets":["vpn-1","vpn-2"]}}}
+	]`), "Content-Type", JSONPatchContentType)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected the patch to apply, got %d: %s", w.Code, w.Body.String())
+	}
+	infra := getClientInfrastructure(client.ID).Infrastructure
+	if ids := soltar.ResourceIDs(infra.VPNInstances); len(ids) != 2 || ids[1] != "vpn-2" || len(infra.LoadBalancers) != 1 {
+		t.Fatalf("Expected vpn-1, vpn-2 and lb-1, got %+v", infra)
+	}
+
+	// Each writer appends to the stored list, so neither loses the other's
+	// instance the way a read-modify-write of the whole document would
+	for _, id := range []string{"vpn-3", "vpn-4"} {
+		if w := requestForTest("PATCH", "/infrastructure", token, json.RawMessage(`[{"op":"add","path":"/vpn_instances/-","value":{"id":"`+id+`"}}]`), "Content-Type", JSONPatchContentType); w.Code != http.StatusOK {
+			t.Fatalf("Expected adding %s to succeed, got %d: %s", id, w.Code, w.Body.String())
+		}
+	}
+	if infra := getClientInfrastructure(client.ID).Infrastructure; len(infra.VPNInstances) != 4 || infra.Generation != 3 {
+		t.Errorf("Expected four instances at revision 3, got %+v", infra)
+	}
+
+	w = requestForTest("PATCH", "/infrastructure", token, json.RawMessage(`[
+		{"op":"test","path":"/vpn_instances/0/id","value":"vpn-1"},
+		{"op":"replace","path":"/vpn_instances/0/spec/port","value":51821},
+		{"op":"remove","path":"/vpn_instances/3"}
+	]`), "Content-Type", JSONPatchContentType)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected test, replace and remove to apply, got %d: %s", w.Code, w.Body.String())
+	}
+	infra = getClientInfrastructure(client.ID).Infrastructure
+	if len(infra.VPNInstances) != 3 || string(infra.VPNInstances[0].Spec) != `{"protocol":"wireguard","port":51821}` {
+		t.Errorf("Expected vpn-1 on port 51821 and vpn-4 removed, got %+v", infra.VPNInstances)
+	}
+
+	// A failed test refuses the whole patch
+	w = requestForTest("PATCH", "/infrastructure", token, json.RawMessage(`[
+		{"op":"remove","path":"/vpn_instances/2"},
+		{"op":"test","path":"/vpn_instances/0/id","value":"vpn-9"}
+	]`), "Content-Type", JSONPatchContentType)
+	var errResp ErrorResponse
+	json.Unmarshal(w.Body.Bytes(), &errResp)
+	if w.Code != http.StatusConflict || errResp.Error != ErrCodePatchConflict {
+		t.Fatalf("Expected a failed test to be a conflict, got %d: %s", w.Code, w.Body.String())
+	}
+	if infra := getClientInfrastructure(client.ID).Infrastructure; len(infra.VPNInstances) != 3 || infra.Generation != 4 {
+		t.Errorf("Expected the refused patch to change nothing, got %+v", infra)
+	}
+
+	// Removing vpn-2 leaves lb-1 targeting an instance that does not exist
+	w = requestForTest("PATCH", "/infrastructure", token, json.RawMessage(`[{"op":"remove","path":"/vpn_instances/1"}]`), "Content-Type", JSONPatchContentType)
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected a dangling target to be refused, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := requestForTest("PATCH", "/infrastructure", token, json.RawMessage(`[{"op":"add","path":"/vpn_instances/0/owner","value":"me"}]`), "Content-Type", JSONPatchContentType); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected an unknown resource field to be refused, got %d", w.Code)
+	}
+	if w := requestForTest("PATCH", "/infrastructure", token, json.RawMessage(`[{"op":"remove","path":"/databases/0"}]`), "Content-Type", JSONPatchContentType); w.Code != http.StatusConflict {
+		t.Errorf("Expected removing a missing resource to be a conflict, got %d", w.Code)
+	}
+	if w := requestForTest("PATCH", "/infrastructure", token, json.RawMessage(`[{"op":"remove","path":"/vpn_instances/2"}]`), "Content-Type", JSONPatchContentType, "If-Match", `"1"`); w.Code != http.StatusPreconditionFailed {
+		t.Errorf("Expected a stale If-Match to be refused, got %d", w.Code)
+	}
+	for _, body := range []string{`{}`, `[{"op":"frobnicate","path":"/storage"}]`, `[{"op":"add","path":"storage"}]`, `[{"op":"move","from":"/storage","path":"/storage/0"}]`} {
+		if w := requestForTest("PATCH", "/infrastructure", token, json.RawMessage(body), "Content-Type", JSONPatchContentType); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected %s to be refused as malformed, got %d", body, w.Code)
+		}
+	}
+	if w := requestForTest("PATCH", "/infrastructure", token, json.RawMessage(`{}`), "Content-Type", "application/json"); w.Code != http.StatusUnsupportedMediaType || w.Header().Get("Accept-Patch") == "" {
+		t.Errorf("Expected plain JSON to be refused with Accept-Patch, got %d", w.Code)
+	}
+}
+
+func TestApplyPatchOperation(t *testing.T) {
+	doc := func() interface{} {
+		var v interface{}
+		json.Unmarshal([]byte(`{"a/b":{"~c":[1,2]},"list":[{"x":1}]}`), &v)
+		return v
+	}
+
+	tests := []struct {
+		name string
+		op   PatchOperation
+		want string
+	}{
+		{"escaped pointer", PatchOperation{Op: "add", Path: "/a~1b/~0c/1", Value: json.RawMessage(`5`)}, `{"a/b":{"~c":[1,5,2]},"list":[{"x":1}]}`},
+		{"move", PatchOperation{Op: "move", From: "/list/0/x", Path: "/y"}, `{"a/b":{"~c":[1,2]},"list":[{}],"y":1}`},
+		{"copy", PatchOperation{Op: "copy", From: "/list/0", Path: "/list/-"}, `{"a/b":{"~c":[1,2]},"list":[{"x":1},{"x":1}]}`},
+		{"replace root", PatchOperation{Op: "replace", Path: "", Value: json.RawMessage(`{}`)}, `{}`},
+	}
+	for _, tt := range tests {
+		got, err := applyPatchOperation(doc(), tt.op)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+			continue
+		}
+		if data, _ := json.Marshal(got); string(data) != tt.want {
+			t.Errorf("%s: expected %s, got %s", tt.name, tt.want, data)
+		}
+	}
+
+	for _, op := range []PatchOperation{
+		{Op: "add", Path: "/list/2", Value: json.RawMessage(`1`)},
+		{Op: "replace", Path: "/missing", Value: json.RawMessage(`1`)},
+		{Op: "remove", Path: "/list/01"},
+		{Op: "test", Path: "/list/0/x", Value: json.RawMessage(`"1"`)},
+	} {
+		if _, err := applyPatchOperation(doc(), op); err == nil {
+			t.Errorf("Expected %+v to fail", op)
+		}
+	}
+}
@@ -0,0 +1,438 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Provisioner creates and tears down the infrastructure behind an
+// environment. Create brings up the environment's own VPN server and Redis
+// plus the requested infrastructure; Update converges the requested
+// infrastructure on spec. All methods must be safe to retry.
+type Provisioner interface {
+	Create(ctx context.Context, spec ProvisionSpec) (*Provisioned, error)
+	Update(ctx context.Context, spec ProvisionSpec) (*Provisioned, error)
+	Destroy(ctx context.Context, environmentID string) error
+	// Status reports what currently exists, or ErrNotProvisioned
+	Status(ctx context.Context, environmentID string) (*Provisioned, error)
+}
+
+// ProvisionSpec is what a provisioner is asked to bring up for an environment
+type ProvisionSpec struct {
+	EnvironmentID  string
+	ClientID       string
+	Region         string
+	Infrastructure Infrastructure
+	// WireGuard is the interface the environment's VPN server runs
+	WireGuard *ServerWireGuard
+	// DatabasePasswords holds the password of each postgres database by ID
+	DatabasePasswords map[string]string
+}
+
+// Provisioned is what a provisioner reports as running for an environment
+type Provisioned struct {
+	VPNServer string `json:"vpn_server"`
+	VPNPort   int    `json:"vpn_port"`
+	// Instances, Databases and Storage belong to the environment itself
+	Instances []Resource `json:"instances"`
+	Databases []Resource `json:"databases"`
+	Storage   []Resource `json:"storage"`
+	// Infrastructure is the part of the requested infrastructure that exists
+	Infrastructure Infrastructure `json:"infrastructure"`
+}
+
+// ErrNotProvisioned is returned by Status and Update for an environment the
+// provisioner has nothing for
+var ErrNotProvisioned = errors.New("environment is not provisioned")
+
+var (
+	provisioner Provisioner = NewMemoryProvisioner()
+	// provisionTimeout bounds one call into the provisioner
+	provisionTimeout = 5 * time.Minute
+	// runAsync starts background provisioning work; tests run it inline
+	runAsync = func(fn func()) { go fn() }
+)
+
+// newProvisionerFromEnv selects the provisioner named by PROVISIONER (memory
+// or docker)
+func newProvisionerFromEnv() (Provisioner, error) {
+	timeout, err := parseDurationEnv("PROVISION_TIMEOUT", provisionTimeout)
+	if err != nil {
+		return nil, err
+	}
+	provisionTimeout = timeout
+
+	switch kind := getEnv("PROVISIONER", "memory"); kind {
+	case "memory":
+		return NewMemoryProvisioner(), nil
+	case "docker":
+		return &DockerProvisioner{
+			Binary:        getEnv("DOCKER_BIN", "docker"),
+			Host:          getEnv("PROVISIONER_HOST", "localhost"),
+			VPNImage:      getEnv("PROVISIONER_VPN_IMAGE", "lscr.io/linuxserver/wireguard:latest"),
+			RedisImage:    getEnv("PROVISIONER_REDIS_IMAGE", "redis:7-alpine"),
+			PostgresImage: getEnv("PROVISIONER_POSTGRES_IMAGE", "postgres:16-alpine"),
+			LBImage:       getEnv("PROVISIONER_LB_IMAGE", "nginx:alpine"),
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown PROVISIONER %q", kind)
+	}
+}
+
+func provisionSpec(client *ClientData) ProvisionSpec {
+	return ProvisionSpec{
+		EnvironmentID:  client.Environment.ID,
+		ClientID:       client.ID,
+		Region:         client.Environment.Region,
+		Infrastructure: client.Infrastructure,
+	}
+}
+
+// addProvisionSecrets fills in what a provisioner needs beyond the desired
+// state: the VPN server's keys and peers and the database passwords
+func addProvisionSecrets(spec *ProvisionSpec) error {
+	wg, err := serverWireGuard(spec.EnvironmentID, spec.ClientID)
+	if err != nil {
+		return fmt.Errorf("failed to assemble the VPN server's interface: %v", err)
+	}
+	passwords, err := databasePasswords(spec.EnvironmentID, spec.Infrastructure)
+	if err != nil {
+		return fmt.Errorf("failed to read database passwords: %v", err)
+	}
+	spec.WireGuard, spec.DatabasePasswords = wg, passwords
+	return nil
+}
+
+// Each postgres database gets a password of its own, stored under
+// db:password:<environment>:<database> when it is first provisioned
+func databasePasswordKey(environmentID, databaseID string) string {
+	return fmt.Sprintf("db:password:%s:%s", environmentID, databaseID)
+}
+
+func databasePasswords(environmentID string, infra Infrastructure) (map[string]string, error) {
+	passwords := map[string]string{}
+	for _, r := range infra.Databases {
+		var db DatabaseSpec
+		if len(r.Spec) > 0 {
+			if err := json.Unmarshal(r.Spec, &db); err != nil {
+				return nil, fmt.Errorf("invalid spec of database %s: %v", r.ID, err)
+			}
+		}
+		if db.Engine != "postgres" {
+			continue
+		}
+
+		key := databasePasswordKey(environmentID, r.ID)
+		fresh := generateDatabasePassword()
+		err := updateWithRetry([]string{key}, func(current map[string][]byte) (map[string][]byte, error) {
+			if data, ok := current[key]; ok {
+				passwords[r.ID] = string(data)
+				return nil, nil
+			}
+			passwords[r.ID] = fresh
+			return map[string][]byte{key: []byte(fresh)}, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return passwords, nil
+}
+
+func generateDatabasePassword() string {
+	b := make([]byte, 24)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// deleteDatabasePasswords forgets the passwords of an environment's databases
+func deleteDatabasePasswords(environmentID string) error {
+	keys, err := scanAll(databasePasswordKey(environmentID, ""))
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := storage.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recordProvisioned copies what the provisioner reported about the
+// environment's own resources into it. The client's Infrastructure is the
+// desired state and is left to the reconciler.
+func recordProvisioned(env *Environment, p *Provisioned) {
+	if p.VPNServer != "" {
+		env.VPNServer = p.VPNServer
+		env.VPNPort = p.VPNPort
+	}
+	env.Instances = nonNil(p.Instances)
+	env.Databases = nonNil(p.Databases)
+	env.Storage = nonNil(p.Storage)
+}
+
+func nonNil(resources []Resource) []Resource {
+	if resources == nil {
+		return []Resource{}
+	}
+	return resources
+}
+
+// provisionEnvironment moves a new environment to provisioning and asks the
+// provisioner for its infrastructure in the background. The environment
+// becomes active once that succeeds and failed if it does not.
+func provisionEnvironment(clientID string) (*Environment, error) {
+	env, err := transitionEnvironment(clientID, EnvironmentProvisioning, "", actorSystem)
+	if err != nil {
+		return nil, err
+	}
+
+	client := getClientInfrastructure(clientID)
+	if client == nil {
+		return nil, fmt.Errorf("client not found: %s", clientID)
+	}
+	spec := provisionSpec(client)
+	runAsync(func() { completeProvisioning(clientID, spec) })
+	return env, nil
+}
+
+func completeProvisioning(clientID string, spec ProvisionSpec) {
+	ctx, cancel := context.WithTimeout(context.Background(), provisionTimeout)
+	defer cancel()
+
+	err := addProvisionSecrets(&spec)
+	var provisioned *Provisioned
+	if err == nil {
+		provisioned, err = provisioner.Create(ctx, spec)
+	}
+	if err != nil {
+		log.Printf("Failed to provision environment %s: %v", spec.EnvironmentID, err)
+		if _, ferr := transitionEnvironment(clientID, EnvironmentFailed, fmt.Sprintf("provisioning failed: %v", err), actorSystem); ferr != nil {
+			log.Printf("Failed to mark environment %s failed: %v", spec.EnvironmentID, ferr)
+		}
+		return
+	}
+
+	err = updateClientChecked(clientID, func(client *ClientData) error {
+		recordProvisioned(&client.Environment, provisioned)
+		return applyTransition(&client.Environment, EnvironmentActive, "", actorSystem)
+	})
+	if err != nil {
+		log.Printf("Failed to record provisioned environment %s: %v", spec.EnvironmentID, err)
+		return
+	}
+	log.Printf("Environment %s of client %s is now %s (%s)", spec.EnvironmentID, clientID, EnvironmentActive, actorSystem)
+
+	// Record the status of the infrastructure Create brought up
+	if err := reconcileClient(clientID); err != nil {
+		log.Printf("Failed to reconcile infrastructure of %s: %v", clientID, err)
+	}
+}
+
+// provisionStale is how long an environment may stay provisioning before the
+// reconciler assumes the worker running Create stopped and starts it again
+func provisionStale() time.Duration {
+	return provisionTimeout + time.Minute
+}
+
+// provisioningFailures counts the provisioning attempts that failed in a row
+// most recently
+func provisioningFailures(env Environment) int {
+	failures := 0
+	for i := len(env.Transitions) - 1; i >= 0; i-- {
+		t := env.Transitions[i]
+		switch {
+		case t.From == EnvironmentProvisioning && t.To == EnvironmentFailed:
+			failures++
+		case t.From == EnvironmentFailed && t.To == EnvironmentProvisioning:
+		default:
+			return failures
+		}
+	}
+	return failures
+}
+
+// provisioningDue reports whether env needs provisioning started again: it
+// failed to provision and its backoff has passed, or it has been
+// provisioning for longer than any Create can take
+func provisioningDue(env Environment, now time.Time) bool {
+	var wait time.Duration
+	switch environmentState(env) {
+	case EnvironmentProvisioning:
+		wait = provisionStale()
+	case EnvironmentFailed:
+		failures := provisioningFailures(env)
+		if failures == 0 {
+			return false
+		}
+		wait = reconcileBackoff(failures)
+	default:
+		return false
+	}
+	return env.StatusChanged == nil || now.Sub(*env.StatusChanged) >= wait
+}
+
+// retryProvisioning runs Create again for an environment provisioningDue
+// picked. Claiming it is one transaction on the client record, so only one
+// worker retries at a time.
+func retryProvisioning(clientID string, now time.Time) error {
+	claimed := false
+	var spec ProvisionSpec
+	err := updateClientChecked(clientID, func(client *ClientData) error {
+		claimed = false
+		if !provisioningDue(client.Environment, now) {
+			return nil
+		}
+		if environmentState(client.Environment) == EnvironmentFailed {
+			if err := applyTransition(&client.Environment, EnvironmentProvisioning, "retrying after failure", actorSystem); err != nil {
+				return err
+			}
+		} else {
+			// Still provisioning: restart the clock so other workers wait
+			// for this attempt
+			changed := time.Now()
+			client.Environment.StatusChanged = &changed
+			client.Environment.StatusReason = "restarted stale provisioning"
+		}
+		claimed = true
+		spec = provisionSpec(client)
+		return nil
+	})
+	if err != nil || !claimed {
+		return err
+	}
+
+	log.Printf("Retrying provisioning of environment %s of client %s", spec.EnvironmentID, clientID)
+	completeProvisioning(clientID, spec)
+	return nil
+}
+
+// destroyProvisioned tears down everything the provisioner runs for an
+// environment
+func destroyProvisioned(environmentID string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), provisionTimeout)
+	defer cancel()
+	return provisioner.Destroy(ctx, environmentID)
+}
+
+func handleAdminEnvironmentResources(w http.ResponseWriter, r *http.Request, environmentID string) {
+	if getClientByEnvironment(environmentID) == nil {
+		http.Error(w, "Environment not found", http.StatusNotFound)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), provisionTimeout)
+	defer cancel()
+
+	provisioned, err := provisioner.Status(ctx, environmentID)
+	if err == ErrNotProvisioned {
+		http.Error(w, "Environment is not provisioned", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to read provisioner status of %s: %v", environmentID, err)
+		http.Error(w, "Failed to read provisioner status", http.StatusBadGateway)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(provisioned)
+}
+
+// MemoryProvisioner only records what it was asked to run. It is the
+// development default and stands in for real provisioners in tests; set Err
+// to make every call fail.
+type MemoryProvisioner struct {
+	mu           sync.Mutex
+	environments map[string]*Provisioned
+	Err          error
+}
+
+func NewMemoryProvisioner() *MemoryProvisioner {
+	return &MemoryProvisioner{environments: make(map[string]*Provisioned)}
+}
+
+func (m *MemoryProvisioner) Create(ctx context.Context, spec ProvisionSpec) (*Provisioned, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.Err != nil {
+		return nil, m.Err
+	}
+
+	short := shortID(spec.EnvironmentID)
+	p := &Provisioned{
+		VPNServer:      fmt.Sprintf("vpn-%s.soltar.com", shortID(spec.ClientID)),
+		VPNPort:        443,
+		Instances:      []Resource{{ID: "vpn-" + short, Kind: ResourceInstance, Region: spec.Region}},
+		Databases:      []Resource{{ID: "redis-" + short, Kind: ResourceDatabase, Region: spec.Region}},
+		Storage:        []Resource{},
+		Infrastructure: spec.Infrastructure,
+	}
+	m.environments[spec.EnvironmentID] = p
+	return copyProvisioned(p), nil
+}
+
+func (m *MemoryProvisioner) Update(ctx context.Context, spec ProvisionSpec) (*Provisioned, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.Err != nil {
+		return nil, m.Err
+	}
+
+	p, ok := m.environments[spec.EnvironmentID]
+	if !ok {
+		return nil, ErrNotProvisioned
+	}
+	p.Infrastructure = spec.Infrastructure
+	return copyProvisioned(p), nil
+}
+
+func (m *MemoryProvisioner) Destroy(ctx context.Context, environmentID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.Err != nil {
+		return m.Err
+	}
+	delete(m.environments, environmentID)
+	return nil
+}
+
+func (m *MemoryProvisioner) Status(ctx context.Context, environmentID string) (*Provisioned, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.Err != nil {
+		return nil, m.Err
+	}
+
+	p, ok := m.environments[environmentID]
+	if !ok {
+		return nil, ErrNotProvisioned
+	}
+	return copyProvisioned(p), nil
+}
+
+func copyProvisioned(p *Provisioned) *Provisioned {
+	c := *p
+	c.Instances = append([]Resource{}, p.Instances...)
+	c.Databases = append([]Resource{}, p.Databases...)
+	c.Storage = append([]Resource{}, p.Storage...)
+	c.Infrastructure = cloneInfrastructure(p.Infrastructure)
+	return &c
+}
+
+// shortID is the prefix of a UUID used in resource names
+func shortID(id string) string {
+	if len(id) > 8 {
+		return id[:8]
+	}
+	return id
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// useTestProvisioner installs p for the duration of the test
+func useTestProvisioner(t *testing.T, p Provisioner) {
+	previous := provisioner
+	provisioner = p
+	t.Cleanup(func() { provisioner = previous })
+}
+
+func TestProvisioningRunsInBackground(t *testing.T) {
+	storage = NewMockStorage()
+	fake := NewMemoryProvisioner()
+	useTestProvisioner(t, fake)
+
+	var pending []func()
+	runAsync = func(fn func()) { pending = append(pending, fn) }
+	defer func() { runAsync = func(fn func()) { fn() } }()
+
+	client := getOrCreateClientWithInfrastructure("test@example.com")
+	if client.Environment.Status != EnvironmentProvisioning {
+		t.Fatalf("Expected a provisioning environment before the provisioner reports, got %s", client.Environment.Status)
+	}
+	if len(pending) != 1 {
+		t.Fatalf("Expected one background provisioning job, got %d", len(pending))
+	}
+
+	pending[0]()
+
+	env := getClientInfrastructure(client.ID).Environment
+	if env.Status != EnvironmentActive {
+		t.Fatalf("Expected the environment to be active once provisioned, got %s", env.Status)
+	}
+	if env.VPNServer != "vpn-"+client.ID[:8]+".soltar.com" || env.VPNPort != 443 {
+		t.Errorf("Expected the provisioned VPN server to be recorded, got %s:%d", env.VPNServer, env.VPNPort)
+	}
+	if len(env.Instances) != 1 || len(env.Databases) != 1 {
+		t.Errorf("Expected the environment's own VPN server and Redis, got %+v", env)
+	}
+	if _, err := fake.Status(context.Background(), env.ID); err != nil {
+		t.Errorf("Expected the provisioner to know the environment, got %v", err)
+	}
+}
+
+func TestProvisioningFailure(t *testing.T) {
+	storage = NewMockStorage()
+	fake := NewMemoryProvisioner()
+	fake.Err = errors.New("quota exceeded")
+	useTestProvisioner(t, fake)
+
+	client := getOrCreateClientWithInfrastructure("test@example.com")
+	env := client.Environment
+	if env.Status != EnvironmentFailed || env.StatusReason != "provisioning failed: quota exceeded" {
+		t.Fatalf("Expected a failed environment with the provisioner's error, got %s (%s)", env.Status, env.StatusReason)
+	}
+
+	token := generateToken(client.ID, "")
+	if w := requestForTest("GET", "/config", token, nil); w.Code != http.StatusForbidden {
+		t.Errorf("Expected config of a failed environment to be refused, got %d", w.Code)
+	}
+}
+
+func TestFailedProvisioningIsRetried(t *testing.T) {
+	storage = NewMockStorage()
+	fake := NewMemoryProvisioner()
+	fake.Err = errors.New("quota exceeded")
+	useTestProvisioner(t, fake)
+
+	client := getOrCreateClientWithInfrastructure("test@example.com")
+	changed := *client.Environment.StatusChanged
+
+	// Not before the backoff has passed
+	reconcileDue(changed.Add(reconcileBackoffBase / 2))
+	if state := environmentState(getClientInfrastructure(client.ID).Environment); state != EnvironmentFailed {
+		t.Fatalf("Expected no retry during the backoff, got %s", state)
+	}
+
+	// A second failure doubles the wait
+	reconcileDue(changed.Add(reconcileBackoffBase))
+	env := getClientInfrastructure(client.ID).Environment
+	if env.Status != EnvironmentFailed || provisioningFailures(env) != 2 {
+		t.Fatalf("Expected a second failed attempt, got %s after %d failures", env.Status, provisioningFailures(env))
+	}
+	if provisioningDue(env, env.StatusChanged.Add(reconcileBackoffBase)) {
+		t.Error("Expected the second retry to wait longer")
+	}
+
+	fake.Err = nil
+	reconcileDue(env.StatusChanged.Add(2 * reconcileBackoffBase))
+	env = getClientInfrastructure(client.ID).Environment
+	if env.Status != EnvironmentActive || env.VPNServer == "" {
+		t.Fatalf("Expected the retry to activate the environment, got %s (%s)", env.Status, env.StatusReason)
+	}
+	if provisioningDue(env, time.Now().Add(time.Hour)) {
+		t.Error("Expected an active environment not to be provisioned again")
+	}
+}
+
+func TestStaleProvisioningIsRestarted(t *testing.T) {
+	storage = NewMockStorage()
+	fake := NewMemoryProvisioner()
+	useTestProvisioner(t, fake)
+
+	// A worker that stopped during Create leaves the environment provisioning
+	client := getOrCreateClientWithInfrastructure("test@example.com")
+	started := time.Now()
+	updateClientChecked(client.ID, func(c *ClientData) error {
+		c.Environment.Status = EnvironmentProvisioning
+		c.Environment.StatusChanged = &started
+		return nil
+	})
+	fake.environments = map[string]*Provisioned{}
+
+	reconcileDue(started.Add(provisionTimeout))
+	if state := environmentState(getClientInfrastructure(client.ID).Environment); state != EnvironmentProvisioning {
+		t.Fatalf("Expected provisioning still in time to be left alone, got %s", state)
+	}
+
+	reconcileDue(started.Add(provisionStale()))
+	if state := environmentState(getClientInfrastructure(client.ID).Environment); state != EnvironmentActive {
+		t.Fatalf("Expected stale provisioning to be restarted, got %s", state)
+	}
+	if _, err := fake.Status(context.Background(), client.Environment.ID); err != nil {
+		t.Errorf("Expected the environment to be created again, got %v", err)
+	}
+}
+
+func TestInfrastructureUpdateReachesProvisioner(t *testing.T) {
+	storage = NewMockStorage()
+	fake := NewMemoryProvisioner()
+	useTestProvisioner(t, fake)
+
+	client := getOrCreateClientWithInfrastructure("test@example.com")
+	token := generateToken(client.ID, "")
+
+	update := InfrastructureUpdate{Infrastructure: Infrastructure{Databases: []Resource{{ID: "pg-main"}}}}
+	if w := requestForTest("POST", "/infrastructure", token, update); w.Code != http.StatusOK {
+		t.Fatalf("Expected update to succeed, got %d: %s", w.Code, w.Body.String())
+	}
+
+	p, err := fake.Status(context.Background(), client.Environment.ID)
+	if err != nil || len(p.Infrastructure.Databases) != 1 || p.Infrastructure.Databases[0].ID != "pg-main" {
+		t.Fatalf("Expected the provisioner to run pg-main, got %+v, %v", p, err)
+	}
+}
+
+// specRecorder keeps the last spec the provisioner was asked to run
+type specRecorder struct {
+	*MemoryProvisioner
+	last ProvisionSpec
+}
+
+func (r *specRecorder) Create(ctx context.Context, spec ProvisionSpec) (*Provisioned, error) {
+	r.last = spec
+	return r.MemoryProvisioner.Create(ctx, spec)
+}
+
+func (r *specRecorder) Update(ctx context.Context, spec ProvisionSpec) (*Provisioned, error) {
+	r.last = spec
+	return r.MemoryProvisioner.Update(ctx, spec)
+}
+
+func TestPeersReachProvisioner(t *testing.T) {
+	storage = NewMockStorage()
+	fake := &specRecorder{MemoryProvisioner: NewMemoryProvisioner()}
+	useTestProvisioner(t, fake)
+
+	client := getOrCreateClientWithInfrastructure("test@example.com")
+	token := generateToken(client.ID, "")
+	serverKeys, _ := getWireGuardServerKeys(client.Environment.ID)
+	if fake.last.WireGuard == nil || fake.last.WireGuard.PrivateKey != serverKeys.PrivateKey || len(fake.last.WireGuard.Peers) != 0 {
+		t.Fatalf("Expected the server key without peers at creation, got %+v", fake.last.WireGuard)
+	}
+
+	peer, err := upsertPeer(getClientInfrastructure(client.ID), "laptop", "")
+	if err != nil {
+		t.Fatalf("Failed to create peer: %v", err)
+	}
+	wg := fake.last.WireGuard
+	if len(wg.Peers) != 1 || wg.Peers[0].PublicKey != peer.PublicKey || wg.Peers[0].PresharedKey != peer.PresharedKey || len(wg.Peers[0].AllowedIPs) != 2 {
+		t.Fatalf("Expected the new peer to reach the provisioner, got %+v", wg.Peers)
+	}
+	if len(wg.Addresses) != 2 || wg.Addresses[0] != "10.13.0.1/24" {
+		t.Errorf("Expected the server's tunnel addresses, got %v", wg.Addresses)
+	}
+
+	if w := requestForTest("DELETE", "/config/peer/laptop", token, nil); w.Code != http.StatusOK {
+		t.Fatalf("Expected peer to be deleted, got %d", w.Code)
+	}
+	if len(fake.last.WireGuard.Peers) != 0 {
+		t.Errorf("Expected the deleted peer to leave the provisioner, got %+v", fake.last.WireGuard.Peers)
+	}
+}
+
+func TestDatabasePasswords(t *testing.T) {
+	storage = NewMockStorage()
+	fake := &specRecorder{MemoryProvisioner: NewMemoryProvisioner()}
+	useTestProvisioner(t, fake)
+
+	client := getOrCreateClientWithInfrastructure("test@example.com")
+	infra := Infrastructure{Databases: []Resource{
+		{ID: "pg-main", Spec: json.RawMessage(`{"engine":"postgres"}`)},
+		{ID: "cache"},
+	}}
+	if err := updateClientInfrastructure(client.ID, infra); err != nil {
+		t.Fatalf("Failed to update infrastructure: %v", err)
+	}
+	if err := reconcileClient(client.ID); err != nil {
+		t.Fatalf("Reconcile failed: %v", err)
+	}
+
+	passwords := fake.last.DatabasePasswords
+	if len(passwords) != 1 || len(passwords["pg-main"]) < 32 {
+		t.Fatalf("Expected a password for the postgres database only, got %v", passwords)
+	}
+	if again, _ := databasePasswords(client.Environment.ID, infra); again["pg-main"] != passwords["pg-main"] {
+		t.Error("Expected the password to be kept")
+	}
+	if other, _ := databasePasswords("other-env", infra); other["pg-main"] == passwords["pg-main"] {
+		t.Error("Expected every database to get its own password")
+	}
+
+	if _, err := deleteEnvironment(client.ID, "", actorClient); err != nil {
+		t.Fatalf("Expected delete to succeed, got %v", err)
+	}
+	if _, err := storage.Get(databasePasswordKey(client.Environment.ID, "pg-main")); err == nil {
+		t.Error("Expected the password to be deleted with the environment")
+	}
+}
+
+func TestDeleteEnvironmentDestroysInfrastructure(t *testing.T) {
+	storage = NewMockStorage()
+	fake := NewMemoryProvisioner()
+	useTestProvisioner(t, fake)
+
+	client := getOrCreateClientWithInfrastructure("test@example.com")
+	if _, err := deleteEnvironment(client.ID, "", actorClient); err != nil {
+		t.Fatalf("Expected delete to succeed, got %v", err)
+	}
+	if _, err := fake.Status(context.Background(), client.Environment.ID); err != ErrNotProvisioned {
+		t.Errorf("Expected the infrastructure to be destroyed, got %v", err)
+	}
+
+	// A provisioner that cannot tear down leaves the environment failed
+	other := getOrCreateClientWithInfrastructure("other@example.com")
+	fake.Err = errors.New("daemon unreachable")
+	if _, err := deleteEnvironment(other.ID, "", actorClient); err == nil {
+		t.Fatal("Expected delete to fail")
+	}
+	if state := environmentState(getClientInfrastructure(other.ID).Environment); state != EnvironmentFailed {
+		t.Errorf("Expected a failed environment, got %s", state)
+	}
+}
+
+func TestAdminEnvironmentResources(t *testing.T) {
+	storage = NewMockStorage()
+	useTestAdminKeys(t)
+	useTestProvisioner(t, NewMemoryProvisioner())
+
+	client := getOrCreateClientWithInfrastructure("test@example.com")
+	w := requestForTest("GET", "/admin/environments/"+client.Environment.ID+"/resources", "viewer-key", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected resources, got %d: %s", w.Code, w.Body.String())
+	}
+	var p Provisioned
+	json.Unmarshal(w.Body.Bytes(), &p)
+	if p.VPNServer != client.Environment.VPNServer {
+		t.Errorf("Expected VPN server %s, got %s", client.Environment.VPNServer, p.VPNServer)
+	}
+
+	if w := requestForTest("GET", "/admin/environments/nope/resources", "viewer-key", nil); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown environment, got %d", w.Code)
+	}
+}
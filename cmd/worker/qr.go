@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/glassrye/soltar/qrcode"
+)
+
+const (
+	// qrTokenTTL is how long a QR download link stays valid
+	qrTokenTTL = 2 * time.Minute
+	// qrDefaultScale and qrMaxScale bound the pixels per module of PNG codes
+	qrDefaultScale = 8
+	qrMaxScale     = 20
+)
+
+// QRDownload is stored under qr:token:<sha256 of token> until the code is
+// fetched once
+type QRDownload struct {
+	ClientID string `json:"client_id"`
+	Peer     string `json:"peer"`
+}
+
+type QRTokenRequest struct {
+	Peer string `json:"peer"`
+}
+
+type QRTokenResponse struct {
+	Token     string `json:"token"`
+	URL       string `json:"url"`
+	ExpiresIn int    `json:"expires_in"`
+}
+
+// qrTokenKey names the record of a download token by its hash, so the
+// token itself cannot be read back from storage (or /debug) and redeemed
+func qrTokenKey(token string) string {
+	return fmt.Sprintf("qr:token:%s", hashRefreshSecret(token))
+}
+
+// consumeQRToken returns the download behind token and deletes it, so a
+// leaked link cannot be replayed
+func consumeQRToken(token string) (*QRDownload, error) {
+	key := qrTokenKey(token)
+	var download *QRDownload
+	err := updateWithRetry([]string{key}, func(current map[string][]byte) (map[string][]byte, error) {
+		data, ok := current[key]
+		if !ok {
+			download = nil
+			return nil, nil
+		}
+		download = &QRDownload{}
+		if err := json.Unmarshal(data, download); err != nil {
+			return nil, err
+		}
+		return map[string][]byte{key: nil}, nil
+	})
+	return download, err
+}
+
+// handleQRToken issues a single-use link for the QR code of a peer's
+// wg-quick config. The link carries no bearer token, so it works as the src
+// of an <img> on the webapp.
+func handleQRToken(w http.ResponseWriter, r *http.Request) {
+	claims, ok := authenticateClient(w, r)
+	if !ok {
+		return
+	}
+
+	var req QRTokenRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+	}
+	if req.Peer == "" {
+		req.Peer = defaultPeerName
+	}
+
+	clientData := getClientInfrastructure(claims.Subject)
+	if clientData == nil {
+		http.Error(w, "Client not found", http.StatusNotFound)
+		return
+	}
+	if !requireActiveEnvironment(w, clientData) {
+		return
+	}
+
+	// Make sure the peer exists (or create the default one) before handing
+	// out a link, and refuse peers whose private key only the device knows
+	config, err := buildVPNConfig(clientData, "", req.Peer)
+	if err == errPeerNotFound {
+		http.Error(w, "Peer not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to build config for %s: %v", claims.Subject, err)
+		http.Error(w, "Failed to build config", http.StatusInternalServerError)
+		return
+	}
+	if config.WireGuard.Interface.PrivateKey == "" {
+		http.Error(w, "The private key of this peer is kept on its device", http.StatusConflict)
+		return
+	}
+
+	token := randomHex(32)
+	data, _ := json.Marshal(QRDownload{ClientID: claims.Subject, Peer: config.Peer})
+	if err := storage.PutWithTTL(qrTokenKey(token), data, qrTokenTTL); err != nil {
+		log.Printf("Failed to store QR token for %s: %v", claims.Subject, err)
+		http.Error(w, "Failed to create download token", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(QRTokenResponse{
+		Token:     token,
+		URL:       "/config/qr?token=" + url.QueryEscape(token),
+		ExpiresIn: int(qrTokenTTL.Seconds()),
+	})
+}
+
+// handleConfigQR serves GET /config/qr?token=, a PNG (default) or SVG
+// (?format=svg) QR code of the wg-quick config
+func handleConfigQR(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	format := query.Get("format")
+	if format == "" {
+		format = "png"
+	}
+	if format != "png" && format != "svg" {
+		http.Error(w, "Unknown format, supported: png, svg", http.StatusBadRequest)
+		return
+	}
+
+	scale := qrDefaultScale
+	if s := query.Get("scale"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > qrMaxScale {
+			http.Error(w, fmt.Sprintf("Invalid scale, must be 1-%d", qrMaxScale), http.StatusBadRequest)
+			return
+		}
+		scale = n
+	}
+
+	token := query.Get("token")
+	if token == "" {
+		http.Error(w, "Missing download token", http.StatusUnauthorized)
+		return
+	}
+	download, err := consumeQRToken(token)
+	if err != nil {
+		log.Printf("Failed to redeem QR token: %v", err)
+		http.Error(w, "Failed to redeem download token", http.StatusInternalServerError)
+		return
+	}
+	if download == nil {
+		http.Error(w, "Download token is invalid, expired or already used", http.StatusNotFound)
+		return
+	}
+
+	clientData := getClientInfrastructure(download.ClientID)
+	if clientData == nil {
+		http.Error(w, "Client not found", http.StatusNotFound)
+		return
+	}
+	if !requireActiveEnvironment(w, clientData) {
+		return
+	}
+	config, err := buildVPNConfig(clientData, "", download.Peer)
+	if err == errPeerNotFound {
+		http.Error(w, "Peer not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to build config for %s: %v", download.ClientID, err)
+		http.Error(w, "Failed to build config", http.StatusInternalServerError)
+		return
+	}
+
+	conf, err := renderWgQuickConfig(config)
+	if err != nil {
+		http.Error(w, "Failed to render config", http.StatusInternalServerError)
+		return
+	}
+	code, err := qrcode.Encode(conf, qrcode.Medium)
+	if err != nil {
+		log.Printf("Failed to encode QR code for %s: %v", download.ClientID, err)
+		http.Error(w, "Failed to encode QR code", http.StatusInternalServerError)
+		return
+	}
+
+	var body []byte
+	if format == "svg" {
+		w.Header().Set("Content-Type", "image/svg+xml")
+		body = code.SVG()
+	} else {
+		w.Header().Set("Content-Type", "image/png")
+		if body, err = code.PNG(scale); err != nil {
+			http.Error(w, "Failed to render QR code", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	log.Printf("Served QR code of peer %s to client %s", download.Peer, download.ClientID)
+	// The image embeds a private key
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
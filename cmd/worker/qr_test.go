@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"image/png"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func qrTokenForTest(t *testing.T, token string, req interface{}) QRTokenResponse {
+	w := requestForTest("POST", "/config/qr/token", token, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected QR token, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var resp QRTokenResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	return resp
+}
+
+func TestConfigQRCode(t *testing.T) {
+	storage = NewMockStorage()
+	auth := loginForTest(t, "test@example.com", "")
+
+	link := qrTokenForTest(t, auth.Token, nil)
+	if link.ExpiresIn != int(qrTokenTTL.Seconds()) || !strings.HasPrefix(link.URL, "/config/qr?token=") {
+		t.Errorf("Unexpected token response: %+v", link)
+	}
+
+	// Only a hash of the token is stored, so listing keys does not reveal it
+	keys, _ := scanAll("qr:token:")
+	if len(keys) != 1 || strings.Contains(keys[0], link.Token) {
+		t.Errorf("Expected one hashed token key, got %v", keys)
+	}
+
+	// The link works without an Authorization header
+	w := requestForTest("GET", link.URL, "", nil)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "image/png" {
+		t.Fatalf("Expected PNG, got %d %q: %s", w.Code, w.Header().Get("Content-Type"), w.Body.String())
+	}
+	if w.Header().Get("Cache-Control") != "no-store" {
+		t.Error("Expected QR code not to be cached")
+	}
+	if _, err := png.Decode(bytes.NewReader(w.Body.Bytes())); err != nil {
+		t.Errorf("Invalid PNG: %v", err)
+	}
+
+	// Single use
+	w = requestForTest("GET", link.URL, "", nil)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected reused token to be rejected, got %d", w.Code)
+	}
+
+	link = qrTokenForTest(t, auth.Token, QRTokenRequest{Peer: "default"})
+	w = requestForTest("GET", link.URL+"&format=svg", "", nil)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "image/svg+xml" || !strings.HasPrefix(w.Body.String(), "<svg") {
+		t.Errorf("Expected SVG, got %d %q", w.Code, w.Header().Get("Content-Type"))
+	}
+}
+
+func TestConfigQRCodeErrors(t *testing.T) {
+	storage = NewMockStorage()
+	auth := loginForTest(t, "test@example.com", "")
+
+	tests := []struct {
+		name   string
+		path   string
+		status int
+	}{
+		{"missing token", "/config/qr", http.StatusUnauthorized},
+		{"unknown token", "/config/qr?token=nope", http.StatusNotFound},
+		{"bad format", "/config/qr?token=nope&format=gif", http.StatusBadRequest},
+		{"bad scale", "/config/qr?token=nope&scale=100", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := requestForTest("GET", tt.path, "", nil)
+			if w.Code != tt.status {
+				t.Errorf("Expected %d, got %d", tt.status, w.Code)
+			}
+		})
+	}
+
+	// A device that keeps its own private key cannot be shown as a QR code
+	keys, _ := generateWireGuardKeyPair()
+	requestForTest("POST", "/config/peer", auth.Token, PeerRequest{Name: "phone", PublicKey: keys.PublicKey})
+	w := requestForTest("POST", "/config/qr/token", auth.Token, QRTokenRequest{Peer: "phone"})
+	if w.Code != http.StatusConflict {
+		t.Errorf("Expected 409 for client-held key, got %d", w.Code)
+	}
+
+	w = requestForTest("POST", "/config/qr/token", "", nil)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without credentials, got %d", w.Code)
+	}
+}
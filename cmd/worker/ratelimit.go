@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// registerEmailCooldown is the minimum gap between two OTPs for one email
+	registerEmailCooldown = time.Minute
+	// registerIPLimit OTP requests are allowed per registerIPWindow from one IP
+	registerIPLimit  = 5
+	registerIPWindow = 10 * time.Minute
+)
+
+// allowRequest counts one request against the fixed-window counter under
+// ratelimit:<scope>:<id> and reports whether it is within limit for the
+// current window. When it is not, the time until the window resets is
+// returned. The counter is incremented atomically, so parallel requests
+// cannot all slip in under the limit.
+func allowRequest(key string, limit int, window time.Duration) (bool, time.Duration) {
+	count, remaining, err := storage.Incr(key, window)
+	if err != nil {
+		// Refuse rather than send mail unthrottled
+		log.Printf("Failed to count request against %s: %v", key, err)
+		return false, window
+	}
+	if count > int64(limit) {
+		return false, remaining
+	}
+	return true, 0
+}
+
+// checkRegisterRateLimit applies the per-IP and per-email resend limits for /register
+func checkRegisterRateLimit(r *http.Request, email string) (bool, time.Duration) {
+	ipKey := fmt.Sprintf("ratelimit:register:ip:%s", clientIP(r))
+	if ok, retry := allowRequest(ipKey, registerIPLimit, registerIPWindow); !ok {
+		return false, retry
+	}
+
+	emailKey := fmt.Sprintf("ratelimit:register:email:%s", email)
+	return allowRequest(emailKey, 1, registerEmailCooldown)
+}
+
+// clientIP returns the caller's address. Proxy headers are only honoured when
+// TRUST_PROXY is set, since anyone can send them.
+func clientIP(r *http.Request) string {
+	if getEnv("TRUST_PROXY", "false") == "true" {
+		if ip := r.Header.Get("Fly-Client-IP"); ip != "" {
+			return ip
+		}
+		if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+			return strings.TrimSpace(strings.Split(fwd, ",")[0])
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
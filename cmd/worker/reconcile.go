@@ -0,0 +1,497 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/glassrye/soltar"
+)
+
+type (
+	ResourceStatus       = soltar.ResourceStatus
+	InfrastructureStatus = soltar.InfrastructureStatus
+)
+
+const (
+	ResourceVPNInstance  = soltar.ResourceVPNInstance
+	ResourceLoadBalancer = soltar.ResourceLoadBalancer
+	ResourceDatabase     = soltar.ResourceDatabase
+	ResourceStorage      = soltar.ResourceStorage
+
+	ResourcePending  = soltar.ResourcePending
+	ResourceReady    = soltar.ResourceReady
+	ResourceDeleting = soltar.ResourceDeleting
+)
+
+// resourceKinds orders the kinds in statuses and diffs
+var resourceKinds = []string{ResourceVPNInstance, ResourceLoadBalancer, ResourceDatabase, ResourceStorage}
+
+var (
+	// reconcileInterval is how often the reconciler looks for clients to
+	// reconcile
+	reconcileInterval = 15 * time.Second
+	// reconcileResync is how often an up-to-date client is compared with the
+	// provisioner anyway, to catch resources that changed behind its back
+	reconcileResync = 5 * time.Minute
+)
+
+const (
+	// A failed action is retried after reconcileBackoffBase, doubling with
+	// every further failure up to reconcileBackoffMax
+	reconcileBackoffBase = 5 * time.Second
+	reconcileBackoffMax  = 5 * time.Minute
+)
+
+// The last reconciliation of a client is stored under reconcile:status:<id>;
+// reconcile:lease:<id> keeps two workers from reconciling it at once
+func reconcileStatusKey(clientID string) string {
+	return fmt.Sprintf("reconcile:status:%s", clientID)
+}
+
+func reconcileLeaseKey(clientID string) string {
+	return fmt.Sprintf("reconcile:lease:%s", clientID)
+}
+
+// setupReconciler reads RECONCILE_INTERVAL and RECONCILE_RESYNC
+func setupReconciler() error {
+	interval, err := parseDurationEnv("RECONCILE_INTERVAL", reconcileInterval)
+	if err != nil {
+		return err
+	}
+	resync, err := parseDurationEnv("RECONCILE_RESYNC", reconcileResync)
+	if err != nil {
+		return err
+	}
+	if interval <= 0 || resync < interval {
+		return fmt.Errorf("RECONCILE_RESYNC (%s) must be at least RECONCILE_INTERVAL (%s), which must be positive", resync, interval)
+	}
+	reconcileInterval, reconcileResync = interval, resync
+	return nil
+}
+
+// runReconciler reconciles due clients every interval
+func runReconciler(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := reconcileDue(time.Now()); err != nil {
+			log.Printf("Reconciler pass failed: %v", err)
+		}
+	}
+}
+
+// reconcileDue reconciles every client with an active environment whose
+// infrastructure changed, has a retry due or has not been checked for
+// reconcileResync. Environments that failed to provision, or whose
+// provisioning was cut short, are provisioned again first.
+func reconcileDue(now time.Time) error {
+	keys, err := scanAll("client_id:")
+	if err != nil {
+		return fmt.Errorf("failed to list clients: %v", err)
+	}
+
+	for _, key := range keys {
+		clientID := strings.TrimPrefix(key, "client_id:")
+		client := getClientInfrastructure(clientID)
+		if client == nil {
+			continue
+		}
+		if provisioningDue(client.Environment, now) {
+			if err := retryProvisioning(clientID, now); err != nil {
+				log.Printf("Failed to retry provisioning of %s: %v", clientID, err)
+			}
+			continue
+		}
+		if environmentState(client.Environment) != EnvironmentActive {
+			continue
+		}
+		if !reconcileIsDue(client.Infrastructure, loadInfrastructureStatus(clientID), now) {
+			continue
+		}
+		if err := reconcileClient(clientID); err != nil {
+			log.Printf("Failed to reconcile infrastructure of %s: %v", clientID, err)
+		}
+	}
+	return nil
+}
+
+func reconcileIsDue(infra Infrastructure, status *InfrastructureStatus, now time.Time) bool {
+	if status == nil || status.LastReconciled == nil || status.ObservedGeneration != infra.Generation {
+		return true
+	}
+	if now.Sub(*status.LastReconciled) >= reconcileResync {
+		return true
+	}
+	for _, r := range status.Resources {
+		if r.State != ResourceReady && (r.NextAttempt == nil || !now.Before(*r.NextAttempt)) {
+			return true
+		}
+	}
+	return false
+}
+
+// reconcileAction creates, updates or deletes one resource
+type reconcileAction struct {
+	kind     string
+	id       string
+	resource Resource
+	verb     string
+}
+
+const (
+	actionCreate = "create"
+	actionUpdate = "update"
+	actionDelete = "delete"
+)
+
+// diffInfrastructure lists the actions that turn observed into desired:
+// creations and spec updates in the order they were requested, then deletions
+func diffInfrastructure(desired, observed Infrastructure) []reconcileAction {
+	var changes, deletes []reconcileAction
+	for _, kind := range resourceKinds {
+		have := map[string]Resource{}
+		for _, r := range *resourceList(&observed, kind) {
+			have[r.ID] = r
+		}
+		want := map[string]bool{}
+		for _, r := range *resourceList(&desired, kind) {
+			if want[r.ID] {
+				continue
+			}
+			want[r.ID] = true
+			existing, ok := have[r.ID]
+			switch {
+			case !ok:
+				changes = append(changes, reconcileAction{kind: kind, id: r.ID, resource: r, verb: actionCreate})
+			case !specEqual(r.Spec, existing.Spec):
+				changes = append(changes, reconcileAction{kind: kind, id: r.ID, resource: r, verb: actionUpdate})
+			}
+		}
+		for _, r := range *resourceList(&observed, kind) {
+			if !want[r.ID] {
+				deletes = append(deletes, reconcileAction{kind: kind, id: r.ID, verb: actionDelete})
+			}
+		}
+	}
+	return append(changes, deletes...)
+}
+
+// resourceList returns the list of infra holding resources of kind
+func resourceList(infra *Infrastructure, kind string) *[]Resource {
+	switch kind {
+	case ResourceVPNInstance:
+		return &infra.VPNInstances
+	case ResourceLoadBalancer:
+		return &infra.LoadBalancers
+	case ResourceDatabase:
+		return &infra.Databases
+	default:
+		return &infra.Storage
+	}
+}
+
+// apply returns infra with the action's resource added, replaced or removed
+func (a reconcileAction) apply(infra Infrastructure) Infrastructure {
+	next := cloneInfrastructure(infra)
+	list := resourceList(&next, a.kind)
+	kept := (*list)[:0]
+	for _, r := range *list {
+		if r.ID != a.id {
+			kept = append(kept, r)
+		}
+	}
+	if a.verb != actionDelete {
+		kept = append(kept, a.resource)
+	}
+	*list = kept
+	return next
+}
+
+func reconcileBackoff(attempts int) time.Duration {
+	backoff := reconcileBackoffBase
+	for i := 1; i < attempts && backoff < reconcileBackoffMax; i++ {
+		backoff *= 2
+	}
+	if backoff > reconcileBackoffMax {
+		backoff = reconcileBackoffMax
+	}
+	return backoff
+}
+
+// reconcileClient compares the client's desired infrastructure with what the
+// provisioner reports and applies the difference one resource at a time. A
+// failed action is recorded on its resource and retried with backoff by later
+// passes; the other actions still run.
+func reconcileClient(clientID string) error {
+	owner, err := acquireReconcileLease(clientID)
+	if err != nil || owner == "" {
+		return err
+	}
+	defer releaseReconcileLease(clientID, owner)
+
+	client := getClientInfrastructure(clientID)
+	if client == nil {
+		return fmt.Errorf("client not found: %s", clientID)
+	}
+	if environmentState(client.Environment) != EnvironmentActive {
+		return nil
+	}
+
+	now := time.Now()
+	previous := loadInfrastructureStatus(clientID)
+	status := InfrastructureStatus{
+		ObservedGeneration: client.Infrastructure.Generation,
+		LastReconciled:     &now,
+		Resources:          []ResourceStatus{},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), provisionTimeout)
+	defer cancel()
+
+	spec := provisionSpec(client)
+	if err := addProvisionSecrets(&spec); err != nil {
+		status.LastError = err.Error()
+		saveInfrastructureStatus(clientID, status)
+		return err
+	}
+	observed, err := provisioner.Status(ctx, spec.EnvironmentID)
+	if err == ErrNotProvisioned {
+		// The provisioner has nothing for an active environment, e.g. the
+		// memory provisioner restarted: nothing desired exists any more, so
+		// bring the environment up again with its infrastructure
+		log.Printf("Environment %s of client %s is gone from the provisioner, creating it again", spec.EnvironmentID, clientID)
+		observed, err = recreateEnvironment(ctx, clientID, spec)
+		if err != nil {
+			status.Resources = pendingResourceStatuses(client.Infrastructure)
+			status.LastError = fmt.Sprintf("failed to create the environment again: %v", err)
+			saveInfrastructureStatus(clientID, status)
+			return err
+		}
+	}
+	if err != nil {
+		if previous != nil {
+			status.Resources = previous.Resources
+		}
+		status.LastError = fmt.Sprintf("failed to read provisioned state: %v", err)
+		saveInfrastructureStatus(clientID, status)
+		return err
+	}
+
+	// Bring the VPN server's peers up to date; provisioners leave the server
+	// alone while they have not changed
+	spec.Infrastructure = observed.Infrastructure
+	if synced, err := provisioner.Update(ctx, spec); err != nil {
+		log.Printf("Failed to update the VPN server of client %s: %v", clientID, err)
+	} else if synced.VPNPort != client.Environment.VPNPort || synced.VPNServer != client.Environment.VPNServer {
+		if err := updateClient(clientID, func(c *ClientData) { recordProvisioned(&c.Environment, synced) }); err != nil {
+			log.Printf("Failed to record the VPN server of client %s: %v", clientID, err)
+		}
+	}
+
+	// Backoff carries over only while the desired state stays the same
+	retries := map[string]ResourceStatus{}
+	if previous != nil && previous.ObservedGeneration == client.Infrastructure.Generation {
+		for _, r := range previous.Resources {
+			retries[r.Kind+"/"+r.ID] = r
+		}
+	}
+
+	current := observed.Infrastructure
+	pending := map[string]ResourceStatus{}
+	for _, action := range diffInfrastructure(client.Infrastructure, current) {
+		key := action.kind + "/" + action.id
+		state := ResourcePending
+		if action.verb == actionDelete {
+			state = ResourceDeleting
+		}
+		resource := ResourceStatus{Kind: action.kind, ID: action.id, State: state}
+		if last, ok := retries[key]; ok && last.State == state {
+			resource.Attempts, resource.LastError, resource.LastAttempt, resource.NextAttempt = last.Attempts, last.LastError, last.LastAttempt, last.NextAttempt
+		}
+		if resource.NextAttempt != nil && now.Before(*resource.NextAttempt) {
+			pending[key] = resource
+			continue
+		}
+
+		attempted := time.Now()
+		resource.Attempts++
+		resource.LastAttempt = &attempted
+		spec.Infrastructure = action.apply(current)
+		provisioned, err := provisioner.Update(ctx, spec)
+		if err != nil {
+			next := attempted.Add(reconcileBackoff(resource.Attempts))
+			resource.LastError = err.Error()
+			resource.NextAttempt = &next
+			pending[key] = resource
+			log.Printf("Failed to %s %s %s of client %s (attempt %d, retry at %s): %v", action.verb, action.kind, action.id, clientID, resource.Attempts, next.Format(time.RFC3339), err)
+			continue
+		}
+		current = provisioned.Infrastructure
+		log.Printf("Reconciler: %sd %s %s of client %s", action.verb, action.kind, action.id, clientID)
+	}
+
+	// Whatever is desired and now exists is ready
+	for _, kind := range resourceKinds {
+		exists := map[string]bool{}
+		for _, r := range *resourceList(&current, kind) {
+			exists[r.ID] = true
+		}
+		for _, r := range *resourceList(&client.Infrastructure, kind) {
+			if exists[r.ID] && pending[kind+"/"+r.ID].State == "" {
+				status.Resources = append(status.Resources, ResourceStatus{Kind: kind, ID: r.ID, State: ResourceReady})
+				delete(exists, r.ID)
+			}
+		}
+	}
+	for _, resource := range pending {
+		status.Resources = append(status.Resources, resource)
+	}
+	sortResourceStatuses(status.Resources)
+
+	status.Synced = len(pending) == 0
+	for _, resource := range status.Resources {
+		if resource.LastError != "" {
+			status.LastError = fmt.Sprintf("%s %s: %s", resource.Kind, resource.ID, resource.LastError)
+			break
+		}
+	}
+	return saveInfrastructureStatus(clientID, status)
+}
+
+func sortResourceStatuses(resources []ResourceStatus) {
+	order := map[string]int{}
+	for i, kind := range resourceKinds {
+		order[kind] = i
+	}
+	sort.Slice(resources, func(i, j int) bool {
+		if resources[i].Kind != resources[j].Kind {
+			return order[resources[i].Kind] < order[resources[j].Kind]
+		}
+		return resources[i].ID < resources[j].ID
+	})
+}
+
+// resyncClient reconciles a client in the background after a change the
+// provisioner follows outside the infrastructure, such as its peers
+func resyncClient(clientID string) {
+	runAsync(func() {
+		if err := reconcileClient(clientID); err != nil {
+			log.Printf("Failed to reconcile infrastructure of %s: %v", clientID, err)
+		}
+	})
+}
+
+// acquireReconcileLease claims the client for one reconciliation and returns
+// the owner token to release it with, or "" while another worker holds it. A
+// lease left behind by a crashed worker expires after the longest a pass can
+// take. Leases are stored as <expiry in Unix nanoseconds>:<owner>.
+func acquireReconcileLease(clientID string) (string, error) {
+	key := reconcileLeaseKey(clientID)
+	now := time.Now()
+	expires := now.Add(2*provisionTimeout + time.Minute)
+	owner := uuid.New().String()
+
+	acquired := false
+	err := updateWithRetry([]string{key}, func(current map[string][]byte) (map[string][]byte, error) {
+		acquired = false
+		if data, ok := current[key]; ok {
+			held, _, _ := strings.Cut(string(data), ":")
+			if until, err := strconv.ParseInt(held, 10, 64); err == nil && now.UnixNano() < until {
+				return nil, nil
+			}
+		}
+		acquired = true
+		return map[string][]byte{key: []byte(strconv.FormatInt(expires.UnixNano(), 10) + ":" + owner)}, nil
+	})
+	if err != nil || !acquired {
+		return "", err
+	}
+	return owner, nil
+}
+
+// releaseReconcileLease drops the lease if owner still holds it; a pass that
+// outlived its lease must not release the one another worker took over
+func releaseReconcileLease(clientID, owner string) {
+	key := reconcileLeaseKey(clientID)
+	err := updateWithRetry([]string{key}, func(current map[string][]byte) (map[string][]byte, error) {
+		_, holder, _ := strings.Cut(string(current[key]), ":")
+		if holder != owner {
+			return nil, nil
+		}
+		return map[string][]byte{key: nil}, nil
+	})
+	if err != nil {
+		log.Printf("Failed to release reconcile lease of %s: %v", clientID, err)
+	}
+}
+
+func loadInfrastructureStatus(clientID string) *InfrastructureStatus {
+	data, err := storage.Get(reconcileStatusKey(clientID))
+	if err != nil {
+		return nil
+	}
+	var status InfrastructureStatus
+	if err := json.Unmarshal(data, &status); err != nil {
+		log.Printf("Ignoring unreadable reconcile status of %s: %v", clientID, err)
+		return nil
+	}
+	return &status
+}
+
+func saveInfrastructureStatus(clientID string, status InfrastructureStatus) error {
+	data, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+	return storage.Put(reconcileStatusKey(clientID), data)
+}
+
+// infrastructureStatus is the status reported by GET /infrastructure. Before
+// the first reconciliation every desired resource is pending.
+func infrastructureStatus(client *ClientData) InfrastructureStatus {
+	if status := loadInfrastructureStatus(client.ID); status != nil {
+		if status.ObservedGeneration != client.Infrastructure.Generation {
+			status.Synced = false
+		}
+		return *status
+	}
+
+	return InfrastructureStatus{Resources: pendingResourceStatuses(client.Infrastructure)}
+}
+
+// pendingResourceStatuses reports every resource of infra as pending
+func pendingResourceStatuses(infra Infrastructure) []ResourceStatus {
+	resources := []ResourceStatus{}
+	for _, kind := range resourceKinds {
+		for _, r := range *resourceList(&infra, kind) {
+			resources = append(resources, ResourceStatus{Kind: kind, ID: r.ID, State: ResourcePending})
+		}
+	}
+	return resources
+}
+
+// recreateEnvironment runs Create again for an active environment the
+// provisioner lost and records what it reports, as provisioning does
+func recreateEnvironment(ctx context.Context, clientID string, spec ProvisionSpec) (*Provisioned, error) {
+	provisioned, err := provisioner.Create(ctx, spec)
+	if err != nil {
+		return nil, err
+	}
+	err = updateClientChecked(clientID, func(client *ClientData) error {
+		recordProvisioned(&client.Environment, provisioned)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return provisioned, nil
+}
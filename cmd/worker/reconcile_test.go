@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// flakyProvisioner refuses to run the resource with ID fail
+type flakyProvisioner struct {
+	*MemoryProvisioner
+	fail string
+}
+
+func (f *flakyProvisioner) Update(ctx context.Context, spec ProvisionSpec) (*Provisioned, error) {
+	for _, kind := range resourceKinds {
+		for _, r := range *resourceList(&spec.Infrastructure, kind) {
+			if r.ID == f.fail {
+				return nil, errors.New("no capacity")
+			}
+		}
+	}
+	return f.MemoryProvisioner.Update(ctx, spec)
+}
+
+// downProvisioner fails Create while err is set
+type downProvisioner struct {
+	*MemoryProvisioner
+	err error
+}
+
+func (d *downProvisioner) Create(ctx context.Context, spec ProvisionSpec) (*Provisioned, error) {
+	if d.err != nil {
+		return nil, d.err
+	}
+	return d.MemoryProvisioner.Create(ctx, spec)
+}
+
+func resourceStates(status InfrastructureStatus) map[string]ResourceStatus {
+	states := map[string]ResourceStatus{}
+	for _, r := range status.Resources {
+		states[r.Kind+"/"+r.ID] = r
+	}
+	return states
+}
+
+func TestDiffInfrastructure(t *testing.T) {
+	desired := Infrastructure{
+		VPNInstances: []Resource{{ID: "vpn-1"}, {ID: "vpn-2"}, {ID: "vpn-2"}},
+		Databases:    []Resource{{ID: "pg"}, {ID: "cache", Spec: json.RawMessage(`{"size_gb":2}`)}},
+	}
+	observed := Infrastructure{
+		VPNInstances: []Resource{{ID: "vpn-1"}, {ID: "vpn-old"}},
+		Databases:    []Resource{{ID: "cache", Spec: json.RawMessage(`{"size_gb":1}`)}},
+		Storage:      []Resource{{ID: "tmp"}},
+	}
+
+	var got []string
+	for _, a := range diffInfrastructure(desired, observed) {
+		got = append(got, a.verb+" "+a.kind+"/"+a.id)
+	}
+	want := []string{
+		"create vpn_instance/vpn-2",
+		"create database/pg",
+		"update database/cache",
+		"delete vpn_instance/vpn-old",
+		"delete storage/tmp",
+	}
+	if len(got) != len(want) {
+		t.Fatalf("Expected %v, got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Action %d: expected %s, got %s", i, want[i], got[i])
+		}
+	}
+
+	if diff := diffInfrastructure(desired, desired); len(diff) != 0 {
+		t.Errorf("Expected no actions for an up-to-date infrastructure, got %v", diff)
+	}
+}
+
+func TestReconcileRetriesFailedResources(t *testing.T) {
+	storage = NewMockStorage()
+	fake := &flakyProvisioner{MemoryProvisioner: NewMemoryProvisioner(), fail: "pg-main"}
+	useTestProvisioner(t, fake)
+
+	client := getOrCreateClientWithInfrastructure("test@example.com")
+	desired := Infrastructure{VPNInstances: []Resource{{ID: "vpn-1"}}, Databases: []Resource{{ID: "pg-main"}}}
+	if err := updateClientInfrastructure(client.ID, desired); err != nil {
+		t.Fatalf("Failed to update infrastructure: %v", err)
+	}
+	if err := reconcileClient(client.ID); err != nil {
+		t.Fatalf("Reconcile failed: %v", err)
+	}
+
+	status := loadInfrastructureStatus(client.ID)
+	if status == nil || status.Synced || status.ObservedGeneration != 1 {
+		t.Fatalf("Expected an unsynced status for generation 1, got %+v", status)
+	}
+	states := resourceStates(*status)
+	if states["vpn_instance/vpn-1"].State != ResourceReady {
+		t.Errorf("Expected vpn-1 to be ready despite the failing database, got %+v", states["vpn_instance/vpn-1"])
+	}
+	db := states["database/pg-main"]
+	if db.State != ResourcePending || db.LastError != "no capacity" || db.Attempts != 1 || db.NextAttempt == nil {
+		t.Fatalf("Expected pg-main to wait for a retry, got %+v", db)
+	}
+
+	// Nothing is due until the backoff has passed
+	infra := getClientInfrastructure(client.ID).Infrastructure
+	if reconcileIsDue(infra, status, time.Now()) {
+		t.Error("Expected no reconciliation before the retry is due")
+	}
+	if !reconcileIsDue(infra, status, db.NextAttempt.Add(time.Millisecond)) {
+		t.Error("Expected a reconciliation once the retry is due")
+	}
+
+	// A retry before the backoff has passed is not attempted
+	reconcileClient(client.ID)
+	if db := resourceStates(*loadInfrastructureStatus(client.ID))["database/pg-main"]; db.Attempts != 1 {
+		t.Errorf("Expected no attempt during backoff, got %d", db.Attempts)
+	}
+
+	// Once the provisioner recovers, the next due pass catches up
+	fake.fail = ""
+	for i := range status.Resources {
+		status.Resources[i].NextAttempt = nil
+	}
+	saveInfrastructureStatus(client.ID, *status)
+	if err := reconcileDue(time.Now()); err != nil {
+		t.Fatalf("Reconciler pass failed: %v", err)
+	}
+	status = loadInfrastructureStatus(client.ID)
+	if !status.Synced || status.LastError != "" {
+		t.Errorf("Expected the infrastructure to be synced, got %+v", status)
+	}
+}
+
+func TestReconcileRecreatesLostEnvironment(t *testing.T) {
+	storage = NewMockStorage()
+	fake := &downProvisioner{MemoryProvisioner: NewMemoryProvisioner()}
+	useTestProvisioner(t, fake)
+
+	client := getOrCreateClientWithInfrastructure("test@example.com")
+	if err := updateClientInfrastructure(client.ID, Infrastructure{Databases: []Resource{{ID: "db1"}}}); err != nil {
+		t.Fatalf("Failed to update infrastructure: %v", err)
+	}
+	reconcileClient(client.ID)
+	if states := resourceStates(*loadInfrastructureStatus(client.ID)); states["database/db1"].State != ResourceReady {
+		t.Fatalf("Expected db1 to be ready, got %+v", states)
+	}
+
+	// The provisioner forgets everything, as the memory provisioner does on
+	// a restart, and cannot create it again for now
+	fake.environments = map[string]*Provisioned{}
+	fake.err = errors.New("daemon unreachable")
+	if err := reconcileClient(client.ID); err == nil {
+		t.Fatal("Expected the reconcile to fail while the provisioner is down")
+	}
+	status := loadInfrastructureStatus(client.ID)
+	if db := resourceStates(*status)["database/db1"]; db.State != ResourcePending || status.Synced {
+		t.Errorf("Expected db1 to stop being reported ready, got %+v", status)
+	}
+
+	fake.err = nil
+	if err := reconcileClient(client.ID); err != nil {
+		t.Fatalf("Reconcile failed: %v", err)
+	}
+	status = loadInfrastructureStatus(client.ID)
+	if db := resourceStates(*status)["database/db1"]; db.State != ResourceReady || !status.Synced {
+		t.Errorf("Expected db1 to be created again, got %+v", status)
+	}
+	provisioned, err := fake.Status(context.Background(), client.Environment.ID)
+	if err != nil || len(provisioned.Infrastructure.Databases) != 1 {
+		t.Errorf("Expected the environment and db1 to exist again, got %+v, %v", provisioned, err)
+	}
+}
+
+func TestReconcileDeletesUndesiredResources(t *testing.T) {
+	storage = NewMockStorage()
+	fake := NewMemoryProvisioner()
+	useTestProvisioner(t, fake)
+
+	client := getOrCreateClientWithInfrastructure("test@example.com")
+
+	// Something the client never asked for appears behind the reconciler's back
+	spec := provisionSpec(client)
+	spec.Infrastructure.Storage = []Resource{{ID: "stray"}}
+	if _, err := fake.Update(context.Background(), spec); err != nil {
+		t.Fatalf("Failed to seed provisioner: %v", err)
+	}
+
+	if err := reconcileClient(client.ID); err != nil {
+		t.Fatalf("Reconcile failed: %v", err)
+	}
+	p, _ := fake.Status(context.Background(), client.Environment.ID)
+	if len(p.Infrastructure.Storage) != 0 {
+		t.Errorf("Expected the stray volume to be deleted, got %v", p.Infrastructure.Storage)
+	}
+	if status := infrastructureStatus(getClientInfrastructure(client.ID)); !status.Synced {
+		t.Errorf("Expected a synced status, got %+v", status)
+	}
+
+	// A newer generation is not synced until reconciled
+	updateClientInfrastructure(client.ID, Infrastructure{Databases: []Resource{{ID: "pg-main"}}})
+	if status := infrastructureStatus(getClientInfrastructure(client.ID)); status.Synced {
+		t.Error("Expected a stale status not to count as synced")
+	}
+}
+
+func TestReconcileLease(t *testing.T) {
+	storage = NewMockStorage()
+	fake := NewMemoryProvisioner()
+	useTestProvisioner(t, fake)
+
+	client := getOrCreateClientWithInfrastructure("test@example.com")
+	updateClientInfrastructure(client.ID, Infrastructure{Databases: []Resource{{ID: "pg-main"}}})
+
+	// Another worker holds the client
+	held := strconv.FormatInt(time.Now().Add(time.Minute).UnixNano(), 10)
+	storage.Put(reconcileLeaseKey(client.ID), []byte(held))
+	reconcileClient(client.ID)
+	if p, _ := fake.Status(context.Background(), client.Environment.ID); len(p.Infrastructure.Databases) != 0 {
+		t.Fatal("Expected no reconciliation while another worker holds the lease")
+	}
+
+	// An expired lease is taken over, and released afterwards
+	expired := strconv.FormatInt(time.Now().Add(-time.Minute).UnixNano(), 10)
+	storage.Put(reconcileLeaseKey(client.ID), []byte(expired))
+	reconcileClient(client.ID)
+	if p, _ := fake.Status(context.Background(), client.Environment.ID); len(p.Infrastructure.Databases) != 1 {
+		t.Error("Expected an expired lease to be taken over")
+	}
+	if _, err := storage.Get(reconcileLeaseKey(client.ID)); err == nil {
+		t.Error("Expected the lease to be released")
+	}
+
+	// A pass that outlived its lease leaves the new holder's alone
+	owner, err := acquireReconcileLease(client.ID)
+	if err != nil || owner == "" {
+		t.Fatalf("Expected to acquire the lease, got %q, %v", owner, err)
+	}
+	taken := strconv.FormatInt(time.Now().Add(time.Minute).UnixNano(), 10) + ":other-worker"
+	storage.Put(reconcileLeaseKey(client.ID), []byte(taken))
+	releaseReconcileLease(client.ID, owner)
+	if data, _ := storage.Get(reconcileLeaseKey(client.ID)); string(data) != taken {
+		t.Errorf("Expected the other worker's lease to stay, got %q", data)
+	}
+	if again, _ := acquireReconcileLease(client.ID); again != "" {
+		t.Error("Expected the lease to stay held by the other worker")
+	}
+	releaseReconcileLease(client.ID, "other-worker")
+	if _, err := storage.Get(reconcileLeaseKey(client.ID)); err == nil {
+		t.Error("Expected the holder to release its lease")
+	}
+}
+
+func TestGetInfrastructureReportsStatus(t *testing.T) {
+	storage = NewMockStorage()
+	useTestProvisioner(t, &flakyProvisioner{MemoryProvisioner: NewMemoryProvisioner(), fail: "pg-main"})
+
+	client := getOrCreateClientWithInfrastructure("test@example.com")
+	token := generateToken(client.ID, "")
+
+	update := InfrastructureUpdate{Infrastructure: Infrastructure{Databases: []Resource{{ID: "pg-main"}}, Storage: []Resource{{ID: "backups"}}}}
+	if w := requestForTest("POST", "/infrastructure", token, update); w.Code != http.StatusOK {
+		t.Fatalf("Expected update to succeed, got %d: %s", w.Code, w.Body.String())
+	}
+
+	w := requestForTest("GET", "/infrastructure", token, nil)
+	var resp InfrastructureResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if resp.Infrastructure.Generation != 1 || resp.Status.ObservedGeneration != 1 {
+		t.Errorf("Expected generation 1 to be observed, got %d/%d", resp.Infrastructure.Generation, resp.Status.ObservedGeneration)
+	}
+	if resp.Status.Synced || resp.Status.LastError != "database pg-main: no capacity" {
+		t.Errorf("Expected the failing database to be reported, got %+v", resp.Status)
+	}
+	if states := resourceStates(resp.Status); states["storage/backups"].State != ResourceReady {
+		t.Errorf("Expected backups to be ready, got %+v", resp.Status.Resources)
+	}
+}
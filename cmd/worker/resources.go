@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/glassrye/soltar"
+)
+
+type (
+	Resource         = soltar.Resource
+	ValidationError  = soltar.ValidationError
+	VPNInstanceSpec  = soltar.VPNInstanceSpec
+	LoadBalancerSpec = soltar.LoadBalancerSpec
+	DatabaseSpec     = soltar.DatabaseSpec
+	StorageSpec      = soltar.StorageSpec
+)
+
+const (
+	ResourceInstance        = soltar.ResourceInstance
+	ErrCodeValidationFailed = soltar.ErrCodeValidationFailed
+)
+
+var (
+	// resourceIDPattern keeps IDs usable in container and volume names
+	resourceIDPattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]{0,62}$`)
+	regionPattern     = regexp.MustCompile(`^[a-z0-9-]{1,32}$`)
+	versionPattern    = regexp.MustCompile(`^[0-9]+(\.[0-9]+){0,2}$`)
+)
+
+// resourceListNames are the JSON names of the Infrastructure lists, used in
+// validation error paths
+var resourceListNames = map[string]string{
+	ResourceVPNInstance:  "vpn_instances",
+	ResourceLoadBalancer: "load_balancers",
+	ResourceDatabase:     "databases",
+	ResourceStorage:      "storage",
+}
+
+// infrastructureInvalid is returned by writeInfrastructure for a
+// document that fails validation
+type infrastructureInvalid []ValidationError
+
+func (e infrastructureInvalid) Error() string {
+	if len(e) == 1 {
+		return fmt.Sprintf("Invalid infrastructure: %s %s", e[0].Field, e[0].Message)
+	}
+	return fmt.Sprintf("Invalid infrastructure: %d problems", len(e))
+}
+
+// validator collects the problems of one document
+type validator struct {
+	errs []ValidationError
+}
+
+func (v *validator) addf(field, format string, args ...interface{}) {
+	v.errs = append(v.errs, ValidationError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// validateInfrastructure checks a posted infrastructure against the schema of
+// each kind and fills in what was left out: kinds, regions and spec
+// defaults. Resources already in current keep their region, and storage its
+// spec. It returns every problem found.
+func validateInfrastructure(infra *Infrastructure, current Infrastructure, region string) []ValidationError {
+	v := &validator{}
+
+	vpnInstances := map[string]bool{}
+	for _, r := range infra.VPNInstances {
+		vpnInstances[r.ID] = true
+	}
+
+	for _, kind := range resourceKinds {
+		list := *resourceList(infra, kind)
+		existing := map[string]Resource{}
+		for _, r := range *resourceList(&current, kind) {
+			existing[r.ID] = r
+		}
+
+		seen := map[string]bool{}
+		for n := range list {
+			r := &list[n]
+			field := fmt.Sprintf("infrastructure.%s[%d]", resourceListNames[kind], n)
+
+			if r.Kind == "" {
+				r.Kind = kind
+			} else if r.Kind != kind {
+				v.addf(field+".kind", "must be %s in %s", kind, resourceListNames[kind])
+			}
+			if !resourceIDPattern.MatchString(r.ID) {
+				v.addf(field+".id", "must be 1-63 letters, digits, '.', '-' or '_', starting with a letter or digit")
+			} else if seen[r.ID] {
+				v.addf(field+".id", "duplicate %s %q", kind, r.ID)
+			}
+			seen[r.ID] = true
+
+			previous, exists := existing[r.ID]
+			switch {
+			case r.Region == "" && exists && previous.Region != "":
+				r.Region = previous.Region
+			case r.Region == "":
+				r.Region = region
+			case !regionPattern.MatchString(r.Region):
+				v.addf(field+".region", "must be 1-32 lowercase letters, digits or '-'")
+			case exists && previous.Region != "" && r.Region != previous.Region:
+				v.addf(field+".region", "cannot change once created (is %s)", previous.Region)
+			}
+
+			spec, ok := validateSpec(v, field+".spec", kind, r.Spec, vpnInstances)
+			if !ok {
+				continue
+			}
+			if kind == ResourceStorage && exists && len(previous.Spec) > 0 && !bytes.Equal(spec, previous.Spec) {
+				v.addf(field+".spec", "storage cannot change once created")
+				continue
+			}
+			r.Spec = spec
+		}
+	}
+	return v.errs
+}
+
+// validateSpec decodes raw as the spec type of kind, rejecting unknown
+// fields, and returns it with defaults filled in
+func validateSpec(v *validator, field, kind string, raw json.RawMessage, vpnInstances map[string]bool) (json.RawMessage, bool) {
+	decode := func(spec interface{}) bool {
+		if len(raw) == 0 || string(raw) == "null" {
+			return true
+		}
+		dec := json.NewDecoder(bytes.NewReader(raw))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(spec); err != nil {
+			v.addf(field, "invalid %s spec: %v", kind, err)
+			return false
+		}
+		return true
+	}
+
+	before := len(v.errs)
+	var spec interface{}
+	switch kind {
+	case ResourceVPNInstance:
+		s := VPNInstanceSpec{}
+		if !decode(&s) {
+			return nil, false
+		}
+		if s.Protocol == "" {
+			s.Protocol = "wireguard"
+		}
+		if s.Port == 0 {
+			s.Port = map[string]int{"wireguard": 51820, "openvpn": 1194}[s.Protocol]
+		}
+		if s.Protocol != "wireguard" && s.Protocol != "openvpn" {
+			v.addf(field+".protocol", "must be wireguard or openvpn")
+		}
+		validatePort(v, field+".port", s.Port)
+		if s.MaxPeers < 0 {
+			v.addf(field+".max_peers", "must not be negative")
+		}
+		spec = s
+	case ResourceLoadBalancer:
+		s := LoadBalancerSpec{}
+		if !decode(&s) {
+			return nil, false
+		}
+		if s.Protocol == "" {
+			s.Protocol = "tcp"
+		}
+		if s.Port == 0 {
+			s.Port = 443
+		}
+		switch s.Protocol {
+		case "tcp", "udp", "http", "https":
+		default:
+			v.addf(field+".protocol", "must be tcp, udp, http or https")
+		}
+		validatePort(v, field+".port", s.Port)
+		for n, target := range s.Targets {
+			if !vpnInstances[target] {
+				v.addf(fmt.Sprintf("%s.targets[%d]", field, n), "no VPN instance %q in this infrastructure", target)
+			}
+		}
+		spec = s
+	case ResourceDatabase:
+		s := DatabaseSpec{}
+		if !decode(&s) {
+			return nil, false
+		}
+		if s.Engine == "" {
+			s.Engine = "redis"
+		}
+		if s.SizeGB == 0 {
+			s.SizeGB = 1
+		}
+		if s.Engine != "redis" && s.Engine != "postgres" {
+			v.addf(field+".engine", "must be redis or postgres")
+		}
+		if s.Version != "" && !versionPattern.MatchString(s.Version) {
+			v.addf(field+".version", "must be a version such as 7 or 16.2")
+		}
+		if s.SizeGB < 1 || s.SizeGB > 1024 {
+			v.addf(field+".size_gb", "must be between 1 and 1024")
+		}
+		spec = s
+	default:
+		s := StorageSpec{}
+		if !decode(&s) {
+			return nil, false
+		}
+		if s.SizeGB == 0 {
+			s.SizeGB = 10
+		}
+		if s.SizeGB < 1 || s.SizeGB > 10240 {
+			v.addf(field+".size_gb", "must be between 1 and 10240")
+		}
+		spec = s
+	}
+	if len(v.errs) > before {
+		return nil, false
+	}
+
+	data, err := json.Marshal(spec)
+	if err != nil {
+		v.addf(field, "invalid %s spec: %v", kind, err)
+		return nil, false
+	}
+	return data, true
+}
+
+func validatePort(v *validator, field string, port int) {
+	if port < 1 || port > 65535 {
+		v.addf(field, "must be between 1 and 65535")
+	}
+}
+
+// stampResources sets the server-maintained fields of infra's resources:
+// Created is kept from current, and Updated moves when the spec changed
+func stampResources(infra *Infrastructure, current Infrastructure, now time.Time) {
+	for _, kind := range resourceKinds {
+		existing := map[string]Resource{}
+		for _, r := range *resourceList(&current, kind) {
+			existing[r.ID] = r
+		}
+
+		list := *resourceList(infra, kind)
+		for n := range list {
+			r := &list[n]
+			r.Kind = kind
+			r.Status = ""
+			previous, ok := existing[r.ID]
+			switch {
+			case !ok:
+				r.Created, r.Updated = now, now
+			case specEqual(r.Spec, previous.Spec):
+				r.Created, r.Updated = previous.Created, previous.Updated
+			default:
+				r.Created, r.Updated = previous.Created, now
+			}
+		}
+	}
+}
+
+// specEqual compares two specs; an absent spec equals an empty one
+func specEqual(a, b json.RawMessage) bool {
+	empty := func(s json.RawMessage) bool { return len(s) == 0 || string(s) == "null" || string(s) == "{}" }
+	if empty(a) || empty(b) {
+		return empty(a) && empty(b)
+	}
+	return bytes.Equal(a, b)
+}
+
+// withResourceStatus returns infra with each resource's Status set from the
+// reconciler's view of it
+func withResourceStatus(infra Infrastructure, status InfrastructureStatus) Infrastructure {
+	states := map[string]string{}
+	for _, r := range status.Resources {
+		states[r.Kind+"/"+r.ID] = r.State
+	}
+
+	infra = cloneInfrastructure(infra)
+	for _, kind := range resourceKinds {
+		list := *resourceList(&infra, kind)
+		for n := range list {
+			list[n].Status = states[kind+"/"+list[n].ID]
+		}
+	}
+	return infra
+}
+
+// cloneInfrastructure copies infra so its resource lists can be changed
+// without affecting the original
+func cloneInfrastructure(infra Infrastructure) Infrastructure {
+	for _, kind := range resourceKinds {
+		list := resourceList(&infra, kind)
+		*list = append([]Resource{}, *list...)
+	}
+	return infra
+}
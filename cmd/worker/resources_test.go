@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestValidateInfrastructureDefaults(t *testing.T) {
+	infra := Infrastructure{
+		VPNInstances:  []Resource{{ID: "vpn-1"}},
+		LoadBalancers: []Resource{{ID: "edge", Spec: json.RawMessage(`{"targets":["vpn-1"]}`)}},
+		Databases:     []Resource{{ID: "pg", Spec: json.RawMessage(`{"engine":"postgres","version":"16"}`), Region: "eu-west-1"}},
+		Storage:       []Resource{{ID: "backups"}},
+	}
+	if errs := validateInfrastructure(&infra, Infrastructure{}, "us-east-1"); len(errs) != 0 {
+		t.Fatalf("Expected a valid document, got %v", errs)
+	}
+
+	tests := []struct {
+		resource Resource
+		kind     string
+		spec     string
+		region   string
+	}{
+		{infra.VPNInstances[0], ResourceVPNInstance, `{"protocol":"wireguard","port":51820}`, "us-east-1"},
+		{infra.LoadBalancers[0], ResourceLoadBalancer, `{"protocol":"tcp","port":443,"targets":["vpn-1"]}`, "us-east-1"},
+		{infra.Databases[0], ResourceDatabase, `{"engine":"postgres","version":"16","size_gb":1}`, "eu-west-1"},
+		{infra.Storage[0], ResourceStorage, `{"size_gb":10}`, "us-east-1"},
+	}
+	for _, tt := range tests {
+		if tt.resource.Kind != tt.kind || string(tt.resource.Spec) != tt.spec || tt.resource.Region != tt.region {
+			t.Errorf("Expected %s %s in %s, got %+v", tt.kind, tt.spec, tt.region, tt.resource)
+		}
+	}
+}
+
+func TestValidateInfrastructureErrors(t *testing.T) {
+	current := Infrastructure{Storage: []Resource{{ID: "backups", Spec: json.RawMessage(`{"size_gb":10}`), Region: "us-east-1"}}}
+	infra := Infrastructure{
+		VPNInstances:  []Resource{{ID: "vpn-1", Spec: json.RawMessage(`{"protocol":"ipsec"}`)}, {ID: "vpn-1"}},
+		LoadBalancers: []Resource{{ID: "edge", Spec: json.RawMessage(`{"targets":["vpn-9"]}`)}},
+		Databases:     []Resource{{ID: "--privileged", Kind: ResourceStorage, Spec: json.RawMessage(`{"size":5}`)}},
+		Storage:       []Resource{{ID: "backups", Spec: json.RawMessage(`{"size_gb":20}`), Region: "eu-west-1"}},
+	}
+
+	got := map[string]bool{}
+	for _, e := range validateInfrastructure(&infra, current, "us-east-1") {
+		got[e.Field] = true
+	}
+	for _, field := range []string{
+		"infrastructure.vpn_instances[0].spec.protocol",
+		"infrastructure.vpn_instances[1].id",
+		"infrastructure.load_balancers[0].spec.targets[0]",
+		"infrastructure.databases[0].kind",
+		"infrastructure.databases[0].id",
+		"infrastructure.databases[0].spec",
+		"infrastructure.storage[0].region",
+		"infrastructure.storage[0].spec",
+	} {
+		if !got[field] {
+			t.Errorf("Expected a validation error for %s, got %v", field, got)
+		}
+	}
+}
+
+func TestStampResources(t *testing.T) {
+	created := time.Now().Add(-time.Hour)
+	current := Infrastructure{Databases: []Resource{
+		{ID: "same", Spec: json.RawMessage(`{"engine":"redis","size_gb":1}`), Created: created, Updated: created},
+		{ID: "grown", Spec: json.RawMessage(`{"engine":"redis","size_gb":1}`), Created: created, Updated: created},
+	}}
+	next := Infrastructure{Databases: []Resource{
+		{ID: "same", Spec: json.RawMessage(`{"engine":"redis","size_gb":1}`), Status: ResourceReady},
+		{ID: "grown", Spec: json.RawMessage(`{"engine":"redis","size_gb":2}`)},
+		{ID: "new"},
+	}}
+
+	now := time.Now()
+	stampResources(&next, current, now)
+	same, grown, added := next.Databases[0], next.Databases[1], next.Databases[2]
+	if !same.Created.Equal(created) || !same.Updated.Equal(created) || same.Status != "" {
+		t.Errorf("Expected an unchanged resource to keep its timestamps, got %+v", same)
+	}
+	if !grown.Created.Equal(created) || !grown.Updated.Equal(now) {
+		t.Errorf("Expected a changed resource to be updated now, got %+v", grown)
+	}
+	if !added.Created.Equal(now) || added.Kind != ResourceDatabase {
+		t.Errorf("Expected a new resource to be created now, got %+v", added)
+	}
+}
+
+func TestDecodeLegacyInfrastructure(t *testing.T) {
+	var infra Infrastructure
+	legacy := `{"vpn_instances":["vpn-1"],"load_balancers":[],"databases":["pg-main"],"storage":null}`
+	if err := json.Unmarshal([]byte(legacy), &infra); err != nil {
+		t.Fatalf("Failed to decode a string-only document: %v", err)
+	}
+	if len(infra.VPNInstances) != 1 || infra.VPNInstances[0].ID != "vpn-1" || infra.VPNInstances[0].Kind != ResourceVPNInstance {
+		t.Errorf("Expected vpn-1 as a typed VPN instance, got %+v", infra.VPNInstances)
+	}
+	if len(infra.Databases) != 1 || infra.Databases[0].Kind != ResourceDatabase {
+		t.Errorf("Expected pg-main as a typed database, got %+v", infra.Databases)
+	}
+
+	var env Environment
+	if err := json.Unmarshal([]byte(`{"instances":["vpn-1234"],"databases":["redis-1234"],"storage":[]}`), &env); err != nil {
+		t.Fatalf("Failed to decode a string-only environment: %v", err)
+	}
+	if len(env.Instances) != 1 || env.Instances[0].Kind != ResourceInstance {
+		t.Errorf("Expected a typed instance, got %+v", env.Instances)
+	}
+}
+
+func TestPostInvalidInfrastructure(t *testing.T) {
+	storage = NewMockStorage()
+	client := getOrCreateClientWithInfrastructure("test@example.com")
+	token := generateToken(client.ID, "")
+
+	body := json.RawMessage(`{"infrastructure":{"databases":[{"id":"pg","spec":{"engine":"mysql"}}]}}`)
+	w := requestForTest("POST", "/infrastructure", token, body)
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("Expected 422, got %d: %s", w.Code, w.Body.String())
+	}
+	var resp ErrorResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if resp.Error != ErrCodeValidationFailed || len(resp.Fields) != 1 || resp.Fields[0].Field != "infrastructure.databases[0].spec.engine" {
+		t.Errorf("Expected the engine to be reported, got %+v", resp)
+	}
+	if infra := getClientInfrastructure(client.ID).Infrastructure; infra.Generation != 0 {
+		t.Errorf("Expected a refused document not to be stored, got generation %d", infra.Generation)
+	}
+
+	// Bare IDs are still accepted and come back typed, with their status
+	body = json.RawMessage(`{"infrastructure":{"vpn_instances":["vpn-1"]}}`)
+	if w := requestForTest("POST", "/infrastructure", token, body); w.Code != http.StatusOK {
+		t.Fatalf("Expected bare IDs to be accepted, got %d: %s", w.Code, w.Body.String())
+	}
+	var infra InfrastructureResponse
+	json.Unmarshal(requestForTest("GET", "/infrastructure", token, nil).Body.Bytes(), &infra)
+	vpn := infra.Infrastructure.VPNInstances
+	if len(vpn) != 1 || vpn[0].Kind != ResourceVPNInstance || vpn[0].Status != ResourceReady || vpn[0].Created.IsZero() {
+		t.Errorf("Expected a ready, typed vpn-1, got %+v", vpn)
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Revoked access tokens are remembered by jti until they would have expired
+// anyway. Revoking every token of a client records a cut-off instead: tokens
+// issued at or before it are rejected.
+
+// legacyAccessTokenTTL is the lifetime of access tokens issued before
+// sessions. They carry no sid and are accepted until they expire, so a
+// cut-off is kept that long.
+const legacyAccessTokenTTL = 24 * time.Hour
+
+func init() {
+	// Issue times carry milliseconds, so a cut-off can tell a token issued
+	// just before it from one issued later in the same second
+	jwt.TimePrecision = time.Millisecond
+}
+
+func revokedTokenKey(jti string) string {
+	return fmt.Sprintf("revoked:token:%s", jti)
+}
+
+func revokedClientKey(clientID string) string {
+	return fmt.Sprintf("revoked:client:%s", clientID)
+}
+
+// revokeToken adds a single access token to the revocation list
+func revokeToken(claims *ClientClaims) error {
+	if claims.ID == "" || claims.ExpiresAt == nil {
+		return fmt.Errorf("token has no jti")
+	}
+
+	ttl := time.Until(claims.ExpiresAt.Time)
+	if ttl <= 0 {
+		return nil
+	}
+	return storage.PutWithTTL(revokedTokenKey(claims.ID), []byte(claims.Subject), ttl)
+}
+
+// revokeAllForClient invalidates every access token issued to clientID so far
+// and ends all of its sessions, so no refresh token can mint new ones
+func revokeAllForClient(clientID string) (int, error) {
+	cutoff := strconv.FormatInt(time.Now().UnixMilli(), 10)
+	if err := storage.PutWithTTL(revokedClientKey(clientID), []byte(cutoff), legacyAccessTokenTTL); err != nil {
+		return 0, err
+	}
+
+	sessions, err := listSessions(clientID)
+	if err != nil {
+		return 0, err
+	}
+	for _, s := range sessions {
+		if err := storage.Delete(sessionKey(clientID, s.ID)); err != nil {
+			return 0, err
+		}
+	}
+	return len(sessions), nil
+}
+
+// isTokenRevoked checks the revocation store for an otherwise valid token. A
+// token bound to a session dies with it, so ending a session (remotely, by
+// logout or on refresh token reuse) also cuts off its access tokens.
+func isTokenRevoked(claims *ClientClaims) bool {
+	if claims.SessionID != "" {
+		if _, err := storage.Get(sessionKey(claims.Subject, claims.SessionID)); err != nil {
+			return true
+		}
+	}
+
+	if claims.ID != "" {
+		if _, err := storage.Get(revokedTokenKey(claims.ID)); err == nil {
+			return true
+		}
+	}
+
+	if data, err := storage.Get(revokedClientKey(claims.Subject)); err == nil {
+		cutoff, err := strconv.ParseInt(string(data), 10, 64)
+		if err == nil && (claims.IssuedAt == nil || claims.IssuedAt.UnixMilli() <= cutoff) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// handleLogout revokes the presented access token and ends its session
+func handleLogout(w http.ResponseWriter, r *http.Request) {
+	claims, ok := authenticateClient(w, r)
+	if !ok {
+		return
+	}
+
+	// Tokens issued before jti was added cannot be listed; ending the session still stops renewal
+	if claims.ID != "" {
+		if err := revokeToken(claims); err != nil {
+			log.Printf("Failed to revoke token for %s: %v", claims.Subject, err)
+			http.Error(w, "Failed to log out", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if claims.SessionID != "" {
+		if err := storage.Delete(sessionKey(claims.Subject, claims.SessionID)); err != nil {
+			log.Printf("Failed to delete session %s: %v", claims.SessionID, err)
+		}
+	}
+
+	log.Printf("Client %s logged out", claims.Subject)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Logged out",
+	})
+}
+
+// handleAdminRevokeClient revokes all tokens and sessions of a client
+func handleAdminRevokeClient(w http.ResponseWriter, r *http.Request, clientID string) {
+	if getClientInfrastructure(clientID) == nil {
+		http.Error(w, "Client not found", http.StatusNotFound)
+		return
+	}
+
+	sessions, err := revokeAllForClient(clientID)
+	if err != nil {
+		log.Printf("Failed to revoke tokens for %s: %v", clientID, err)
+		http.Error(w, "Failed to revoke tokens", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Revoked all tokens for client %s (%d sessions)", clientID, sessions)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":          "All tokens revoked",
+		"client_id":        clientID,
+		"sessions_revoked": sessions,
+	})
+}
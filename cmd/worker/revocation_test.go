@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestGenerateTokenHasJTI(t *testing.T) {
+	first, _ := parseClientToken(generateToken("client-123", ""))
+	second, _ := parseClientToken(generateToken("client-123", ""))
+
+	if first.ID == "" || first.ID == second.ID {
+		t.Errorf("Expected unique jti per token, got %q and %q", first.ID, second.ID)
+	}
+}
+
+// Test that /logout revokes the access token and ends its session
+func TestHandleLogout(t *testing.T) {
+	storage = NewMockStorage()
+	auth := loginForTest(t, "test@example.com", "laptop")
+	other := loginForTest(t, "test@example.com", "phone")
+	client := sdkForTest(t, auth.Token)
+	ctx := context.Background()
+
+	if err := client.Logout(ctx); err != nil {
+		t.Fatalf("Expected logout to succeed, got %v", err)
+	}
+
+	if _, err := client.Connect(ctx); apiStatus(err) != http.StatusUnauthorized {
+		t.Errorf("Expected revoked token to be rejected by /connect, got %v", err)
+	}
+	if _, err := client.Config(ctx, ""); apiStatus(err) != http.StatusUnauthorized {
+		t.Errorf("Expected revoked token to be rejected by /config, got %v", err)
+	}
+	if _, err := client.Refresh(ctx, auth.RefreshToken); apiStatus(err) != http.StatusUnauthorized {
+		t.Errorf("Expected logged out session to be gone, got %v", err)
+	}
+
+	// Other sessions of the same client are unaffected
+	client.Token = other.Token
+	if _, err := client.Connect(ctx); err != nil {
+		t.Errorf("Expected other session's token to remain valid, got %v", err)
+	}
+}
+
+// Test the admin revoke-all endpoint
+func TestAdminRevokeClient(t *testing.T) {
+	storage = NewMockStorage()
+	useTestAdminKeys(t)
+	laptop := loginForTest(t, "test@example.com", "laptop")
+	phone := loginForTest(t, "test@example.com", "phone")
+	bystander := loginForTest(t, "other@example.com", "laptop")
+
+	w := requestForTest("POST", "/admin/clients/"+laptop.ClientID+"/revoke", "viewer-key", nil)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected viewer to be forbidden, got %d", w.Code)
+	}
+
+	w = requestForTest("POST", "/admin/clients/"+laptop.ClientID+"/revoke", "operator-key", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+
+	for _, auth := range []AuthResponse{laptop, phone} {
+		if _, err := validateToken(auth.Token); err == nil {
+			t.Error("Expected access token to be revoked")
+		}
+		if w, _ := refreshForTest(auth.RefreshToken); w.Code != http.StatusUnauthorized {
+			t.Errorf("Expected refresh token to be revoked, got %d", w.Code)
+		}
+	}
+
+	if _, err := validateToken(bystander.Token); err != nil {
+		t.Errorf("Expected other client's token to remain valid, got %v", err)
+	}
+
+	w = requestForTest("POST", "/admin/clients/does-not-exist/revoke", "operator-key", nil)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 for unknown client, got %d", w.Code)
+	}
+}
+
+// Test that only tokens issued up to the revoke-all cut-off are rejected
+func TestIsTokenRevokedCutoff(t *testing.T) {
+	storage = NewMockStorage()
+	now := time.Now()
+	storage.PutWithTTL(revokedClientKey("client-123"), []byte(strconv.FormatInt(now.UnixMilli(), 10)), legacyAccessTokenTTL)
+
+	tests := []struct {
+		issued time.Time
+		want   bool
+	}{
+		{now.Add(-time.Minute), true},
+		{now, true},
+		{now.Add(5 * time.Millisecond), false},
+		{now.Add(2 * time.Second), false},
+	}
+
+	for _, tt := range tests {
+		claims := &ClientClaims{RegisteredClaims: jwt.RegisteredClaims{
+			Subject:  "client-123",
+			IssuedAt: jwt.NewNumericDate(tt.issued),
+		}}
+		if got := isTokenRevoked(claims); got != tt.want {
+			t.Errorf("Token issued at %v: expected revoked=%v, got %v", tt.issued.Sub(now), tt.want, got)
+		}
+	}
+}
+
+// Test that a token issued right after a revoke-all, in the same second, is
+// accepted, and that the cut-off outlives tokens without a session
+func TestRevokeAllThenIssue(t *testing.T) {
+	mock := NewMockStorage().(*MockStorage)
+	storage = mock
+	before := generateToken("client-123", "")
+
+	if _, err := revokeAllForClient("client-123"); err != nil {
+		t.Fatalf("Expected revoke-all to succeed, got %v", err)
+	}
+	time.Sleep(2 * time.Millisecond)
+	after := generateToken("client-123", "")
+
+	if _, err := validateToken(before); err == nil {
+		t.Error("Expected the earlier token to be revoked")
+	}
+	if _, err := validateToken(after); err != nil {
+		t.Errorf("Expected a token issued after the cut-off to be valid, got %v", err)
+	}
+	if d := time.Until(mock.expires[revokedClientKey("client-123")]); d < legacyAccessTokenTTL-time.Minute {
+		t.Errorf("Expected the cut-off to be kept for %s, got %s", legacyAccessTokenTTL, d)
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/glassrye/soltar"
+)
+
+const (
+	// accessTokenTTL is the lifetime of the JWTs handed to clients
+	accessTokenTTL = 15 * time.Minute
+	// refreshTokenTTL is the absolute lifetime of a session and its refresh tokens
+	refreshTokenTTL = 30 * 24 * time.Hour
+	// maxRotatedRefreshHashes is how many spent refresh tokens a session
+	// remembers for reuse detection
+	maxRotatedRefreshHashes = 20
+)
+
+// Session is one login of a client on one device, stored under
+// session:<client_id>:<session_id>. Every refresh rotates its token; a
+// session is the token family that reuse detection revokes.
+type Session struct {
+	ID            string    `json:"id"`
+	ClientID      string    `json:"client_id"`
+	Device        string    `json:"device"`
+	IP            string    `json:"ip"`
+	Created       time.Time `json:"created"`
+	LastUsed      time.Time `json:"last_used"`
+	Expires       time.Time `json:"expires"`
+	RefreshHash   string    `json:"refresh_hash"`
+	RotatedHashes []string  `json:"rotated_hashes,omitempty"`
+}
+
+// SessionInfo is the client-facing view of a session returned by GET /sessions
+type SessionInfo struct {
+	ID       string    `json:"id"`
+	Device   string    `json:"device"`
+	IP       string    `json:"ip"`
+	Created  time.Time `json:"created"`
+	LastUsed time.Time `json:"last_used"`
+	Expires  time.Time `json:"expires"`
+	Current  bool      `json:"current"`
+}
+
+type (
+	RefreshRequest = soltar.RefreshRequest
+	TokenResponse  = soltar.TokenResponse
+)
+
+func sessionKey(clientID, sessionID string) string {
+	return fmt.Sprintf("session:%s:%s", clientID, sessionID)
+}
+
+func hashRefreshSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// Refresh tokens are <client_id>.<session_id>.<secret>; only a hash of the
+// secret is stored
+func formatRefreshToken(clientID, sessionID, secret string) string {
+	return clientID + "." + sessionID + "." + secret
+}
+
+func parseRefreshToken(token string) (clientID, sessionID, secret string, err error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+		return "", "", "", fmt.Errorf("malformed refresh token")
+	}
+	return parts[0], parts[1], parts[2], nil
+}
+
+// createSession starts a new session for clientID and returns its ID and
+// first refresh token
+func createSession(clientID string, r *http.Request, device string) (string, string, error) {
+	if device == "" {
+		device = r.UserAgent()
+	}
+
+	now := time.Now()
+	secret := randomHex(32)
+	session := Session{
+		ID:          uuid.New().String(),
+		ClientID:    clientID,
+		Device:      device,
+		IP:          clientIP(r),
+		Created:     now,
+		LastUsed:    now,
+		Expires:     now.Add(refreshTokenTTL),
+		RefreshHash: hashRefreshSecret(secret),
+	}
+
+	data, _ := json.Marshal(session)
+	if err := storage.PutWithTTL(sessionKey(clientID, session.ID), data, refreshTokenTTL); err != nil {
+		return "", "", err
+	}
+
+	return session.ID, formatRefreshToken(clientID, session.ID, secret), nil
+}
+
+// Outcomes of rotateRefreshToken
+var (
+	errRefreshInvalid = fmt.Errorf("invalid refresh token")
+	errRefreshReused  = fmt.Errorf("refresh token reuse detected")
+)
+
+// rotateRefreshToken exchanges a refresh token for a new one. Presenting a
+// token that was already rotated away revokes the whole session.
+func rotateRefreshToken(refreshToken string, r *http.Request) (*Session, string, error) {
+	clientID, sessionID, secret, err := parseRefreshToken(refreshToken)
+	if err != nil {
+		return nil, "", errRefreshInvalid
+	}
+
+	key := sessionKey(clientID, sessionID)
+	presented := hashRefreshSecret(secret)
+	newSecret := randomHex(32)
+
+	var session Session
+	var outcome error
+	err = updateWithRetry([]string{key}, func(current map[string][]byte) (map[string][]byte, error) {
+		data, ok := current[key]
+		if !ok {
+			outcome = errRefreshInvalid
+			return nil, nil
+		}
+		if err := json.Unmarshal(data, &session); err != nil {
+			return nil, err
+		}
+
+		if subtle.ConstantTimeCompare([]byte(session.RefreshHash), []byte(presented)) != 1 {
+			for _, used := range session.RotatedHashes {
+				if subtle.ConstantTimeCompare([]byte(used), []byte(presented)) == 1 {
+					outcome = errRefreshReused
+					return map[string][]byte{key: nil}, nil
+				}
+			}
+			outcome = errRefreshInvalid
+			return nil, nil
+		}
+
+		session.RotatedHashes = append(session.RotatedHashes, session.RefreshHash)
+		if len(session.RotatedHashes) > maxRotatedRefreshHashes {
+			session.RotatedHashes = session.RotatedHashes[len(session.RotatedHashes)-maxRotatedRefreshHashes:]
+		}
+		session.RefreshHash = hashRefreshSecret(newSecret)
+		session.LastUsed = time.Now()
+		session.IP = clientIP(r)
+		outcome = nil
+
+		updated, err := json.Marshal(session)
+		if err != nil {
+			return nil, err
+		}
+		return map[string][]byte{key: updated}, nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	if outcome != nil {
+		return nil, "", outcome
+	}
+
+	return &session, formatRefreshToken(clientID, sessionID, newSecret), nil
+}
+
+func listSessions(clientID string) ([]Session, error) {
+	keys, err := scanAll(fmt.Sprintf("session:%s:", clientID))
+	if err != nil {
+		return nil, err
+	}
+
+	sessions := make([]Session, 0, len(keys))
+	for _, key := range keys {
+		data, err := storage.Get(key)
+		if err != nil {
+			// Expired between the scan and the read
+			continue
+		}
+		var session Session
+		if err := json.Unmarshal(data, &session); err != nil {
+			log.Printf("Skipping unreadable session %s: %v", key, err)
+			continue
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, nil
+}
+
+func handleTokenRefresh(w http.ResponseWriter, r *http.Request) {
+	var req RefreshRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RefreshToken == "" {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	session, refreshToken, err := rotateRefreshToken(req.RefreshToken, r)
+	switch {
+	case err == errRefreshReused:
+		log.Printf("Refresh token reuse detected, session revoked")
+		http.Error(w, "Refresh token reused, session revoked", http.StatusUnauthorized)
+		return
+	case err == errRefreshInvalid:
+		http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	case err != nil:
+		log.Printf("Failed to refresh token: %v", err)
+		http.Error(w, "Failed to refresh token", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(TokenResponse{
+		Token:        generateToken(session.ClientID, session.ID),
+		RefreshToken: refreshToken,
+		ExpiresIn:    int(accessTokenTTL.Seconds()),
+	})
+}
+
+func handleListSessions(w http.ResponseWriter, r *http.Request) {
+	claims, ok := authenticateClient(w, r)
+	if !ok {
+		return
+	}
+
+	sessions, err := listSessions(claims.Subject)
+	if err != nil {
+		log.Printf("Failed to list sessions for %s: %v", claims.Subject, err)
+		http.Error(w, "Failed to list sessions", http.StatusInternalServerError)
+		return
+	}
+
+	infos := make([]SessionInfo, 0, len(sessions))
+	for _, s := range sessions {
+		infos = append(infos, SessionInfo{
+			ID:       s.ID,
+			Device:   s.Device,
+			IP:       s.IP,
+			Created:  s.Created,
+			LastUsed: s.LastUsed,
+			Expires:  s.Expires,
+			Current:  s.ID == claims.SessionID,
+		})
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"client_id": claims.Subject,
+		"sessions":  infos,
+	})
+}
+
+func handleDeleteSession(w http.ResponseWriter, r *http.Request, sessionID string) {
+	claims, ok := authenticateClient(w, r)
+	if !ok {
+		return
+	}
+
+	key := sessionKey(claims.Subject, sessionID)
+	if _, err := storage.Get(key); err != nil {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+
+	if err := storage.Delete(key); err != nil {
+		log.Printf("Failed to delete session %s: %v", sessionID, err)
+		http.Error(w, "Failed to revoke session", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Session %s of client %s revoked", sessionID, claims.Subject)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{
+		"message":    "Session revoked",
+		"session_id": sessionID,
+	})
+}
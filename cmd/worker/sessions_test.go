@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// loginForTest runs /verify for email and returns the auth response
+func loginForTest(t *testing.T, email, device string) AuthResponse {
+	storeTestOTP(email, "123456", time.Now().Add(otpTTL))
+
+	w := httptest.NewRecorder()
+	handleVerify(w, createTestRequest("POST", "/verify", OTPVerify{Email: email, OTP: "123456", Device: device}))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected login to succeed, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var resp AuthResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	return resp
+}
+
+func refreshForTest(refreshToken string) (*httptest.ResponseRecorder, TokenResponse) {
+	w := requestForTest("POST", "/token/refresh", "", RefreshRequest{RefreshToken: refreshToken})
+
+	var resp TokenResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	return w, resp
+}
+
+func TestVerifyIssuesRefreshToken(t *testing.T) {
+	storage = NewMockStorage()
+	auth := loginForTest(t, "test@example.com", "laptop")
+
+	if auth.RefreshToken == "" {
+		t.Error("Expected refresh token in verify response")
+	}
+	if auth.ExpiresIn != int(accessTokenTTL.Seconds()) {
+		t.Errorf("Expected expires_in %d, got %d", int(accessTokenTTL.Seconds()), auth.ExpiresIn)
+	}
+
+	claims, err := parseClientToken(auth.Token)
+	if err != nil || claims.SessionID == "" {
+		t.Errorf("Expected access token bound to a session, got %+v (%v)", claims, err)
+	}
+}
+
+// Test refresh token rotation and reuse detection
+func TestTokenRefreshRotation(t *testing.T) {
+	storage = NewMockStorage()
+	auth := loginForTest(t, "test@example.com", "laptop")
+	client := sdkForTest(t, "")
+	ctx := context.Background()
+
+	first, err := client.Refresh(ctx, auth.RefreshToken)
+	if err != nil {
+		t.Fatalf("Expected refresh to succeed, got %v", err)
+	}
+	if first.RefreshToken == auth.RefreshToken || first.Token == "" {
+		t.Error("Expected a new access and refresh token")
+	}
+	if clientID, err := validateToken(first.Token); err != nil || clientID != auth.ClientID {
+		t.Errorf("Expected refreshed token for %s, got %s (%v)", auth.ClientID, clientID, err)
+	}
+
+	second, err := client.Refresh(ctx, first.RefreshToken)
+	if err != nil {
+		t.Fatalf("Expected second refresh to succeed, got %v", err)
+	}
+
+	// Replaying a rotated token revokes the whole family
+	if _, err := client.Refresh(ctx, auth.RefreshToken); apiStatus(err) != http.StatusUnauthorized {
+		t.Errorf("Expected reused refresh token to be rejected, got %v", err)
+	}
+	if _, err := client.Refresh(ctx, second.RefreshToken); apiStatus(err) != http.StatusUnauthorized {
+		t.Errorf("Expected latest refresh token to be revoked after reuse, got %v", err)
+	}
+	if _, err := validateToken(second.Token); err == nil {
+		t.Error("Expected the access token of the revoked family to be rejected")
+	}
+}
+
+func TestTokenRefreshInvalid(t *testing.T) {
+	storage = NewMockStorage()
+	auth := loginForTest(t, "test@example.com", "laptop")
+	clientID, sessionID, _, _ := parseRefreshToken(auth.RefreshToken)
+
+	for _, token := range []string{"", "garbage", clientID + "." + sessionID + ".wrong", clientID + ".nope.secret"} {
+		if w, _ := refreshForTest(token); w.Code != http.StatusUnauthorized && w.Code != http.StatusBadRequest {
+			t.Errorf("Expected refresh with %q to fail, got %d", token, w.Code)
+		}
+	}
+
+	// A wrong secret is not reuse, so the session survives
+	if w, _ := refreshForTest(auth.RefreshToken); w.Code != http.StatusOK {
+		t.Errorf("Expected session to survive invalid attempts, got %d", w.Code)
+	}
+}
+
+// Test listing sessions and remote logout
+func TestSessionsEndpoints(t *testing.T) {
+	storage = NewMockStorage()
+	laptop := loginForTest(t, "test@example.com", "laptop")
+	phone := loginForTest(t, "test@example.com", "phone")
+	other := loginForTest(t, "other@example.com", "desktop")
+
+	w := requestForTest("GET", "/sessions", laptop.Token, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+
+	var list struct {
+		Sessions []SessionInfo `json:"sessions"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &list)
+	if len(list.Sessions) != 2 {
+		t.Fatalf("Expected 2 sessions, got %d", len(list.Sessions))
+	}
+
+	var phoneSession string
+	for _, s := range list.Sessions {
+		if s.Device == "laptop" && !s.Current {
+			t.Error("Expected laptop session to be marked current")
+		}
+		if s.Device == "phone" {
+			phoneSession = s.ID
+		}
+	}
+
+	// Another client cannot revoke this session
+	w = requestForTest("DELETE", "/sessions/"+phoneSession, other.Token, nil)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 for another client's session, got %d", w.Code)
+	}
+
+	w = requestForTest("DELETE", "/sessions/"+phoneSession, laptop.Token, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+
+	if w, _ := refreshForTest(phone.RefreshToken); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected revoked session's refresh token to be rejected, got %d", w.Code)
+	}
+	if _, err := validateToken(phone.Token); err == nil {
+		t.Error("Expected revoked session's access token to be rejected")
+	}
+	if w, _ := refreshForTest(laptop.RefreshToken); w.Code != http.StatusOK {
+		t.Errorf("Expected other session to remain usable, got %d", w.Code)
+	}
+}
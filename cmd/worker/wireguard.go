@@ -0,0 +1,513 @@
+package main
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/glassrye/soltar"
+)
+
+// defaultPeerName is used when a client asks for a config without naming a device
+const defaultPeerName = "default"
+
+var peerNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,32}$`)
+
+// WireGuardKeyPair is a Curve25519 key pair in WireGuard's base64 encoding
+type WireGuardKeyPair struct {
+	PrivateKey string `json:"private_key"`
+	PublicKey  string `json:"public_key"`
+}
+
+func generateWireGuardKeyPair() (WireGuardKeyPair, error) {
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return WireGuardKeyPair{}, err
+	}
+	return WireGuardKeyPair{
+		PrivateKey: base64.StdEncoding.EncodeToString(priv.Bytes()),
+		PublicKey:  base64.StdEncoding.EncodeToString(priv.PublicKey().Bytes()),
+	}, nil
+}
+
+func generatePresharedKey() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+// validateWireGuardKey checks that key is a base64-encoded Curve25519 key
+func validateWireGuardKey(key string) error {
+	raw, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || len(raw) != 32 {
+		return fmt.Errorf("invalid WireGuard key: expected 32 bytes of base64")
+	}
+	if _, err := ecdh.X25519().NewPublicKey(raw); err != nil {
+		return fmt.Errorf("invalid WireGuard key: %v", err)
+	}
+	return nil
+}
+
+// Peer is the server-side entry for one device of a client. PrivateKey is
+// only kept when the server generated the key pair; a client that supplies
+// its own public key keeps its private key to itself.
+type Peer struct {
+	Name         string    `json:"name"`
+	PublicKey    string    `json:"public_key"`
+	PrivateKey   string    `json:"private_key,omitempty"`
+	PresharedKey string    `json:"preshared_key"`
+	Created      time.Time `json:"created"`
+}
+
+// PeerInfo is what GET /config/peers shows about a peer
+type PeerInfo struct {
+	Name            string    `json:"name"`
+	PublicKey       string    `json:"public_key"`
+	Addresses       []string  `json:"addresses"`
+	ServerGenerated bool      `json:"server_generated"`
+	Created         time.Time `json:"created"`
+}
+
+type PeerRequest struct {
+	Name      string `json:"name"`
+	PublicKey string `json:"public_key,omitempty"`
+}
+
+// The tunnel definition of a peer is a wire type of package soltar
+type (
+	WireGuardConfig    = soltar.WireGuardConfig
+	WireGuardInterface = soltar.WireGuardInterface
+	WireGuardPeer      = soltar.WireGuardPeer
+)
+
+func wireGuardServerKey(environmentID string) string {
+	return fmt.Sprintf("wg:server:%s", environmentID)
+}
+
+func wireGuardPeersKey(clientID string) string {
+	return fmt.Sprintf("wg:peers:%s", clientID)
+}
+
+// getWireGuardServerKeys returns the key pair of an environment's VPN server,
+// creating it on first use
+func getWireGuardServerKeys(environmentID string) (WireGuardKeyPair, error) {
+	key := wireGuardServerKey(environmentID)
+	fresh, err := generateWireGuardKeyPair()
+	if err != nil {
+		return WireGuardKeyPair{}, err
+	}
+
+	var keys WireGuardKeyPair
+	err = updateWithRetry([]string{key}, func(current map[string][]byte) (map[string][]byte, error) {
+		if data, ok := current[key]; ok {
+			return nil, json.Unmarshal(data, &keys)
+		}
+		keys = fresh
+		data, err := json.Marshal(keys)
+		if err != nil {
+			return nil, err
+		}
+		return map[string][]byte{key: data}, nil
+	})
+	return keys, err
+}
+
+func loadPeers(clientID string) (map[string]*Peer, error) {
+	peers := map[string]*Peer{}
+	data, err := storage.Get(wireGuardPeersKey(clientID))
+	if err != nil {
+		return peers, nil
+	}
+	if err := json.Unmarshal(data, &peers); err != nil {
+		return nil, fmt.Errorf("failed to decode peers: %v", err)
+	}
+	return peers, nil
+}
+
+// wireGuardListenPort is the port environment VPN servers listen on
+const wireGuardListenPort = 51820
+
+// ServerWireGuard is the WireGuard interface an environment's VPN server
+// runs: its key, the first address of each subnet and the client's peers
+type ServerWireGuard struct {
+	PrivateKey string
+	Addresses  []string
+	ListenPort int
+	Peers      []ServerPeer
+}
+
+// ServerPeer is a device as the VPN server sees it
+type ServerPeer struct {
+	Name         string
+	PublicKey    string
+	PresharedKey string
+	AllowedIPs   []string
+}
+
+// serverWireGuard assembles the VPN server's interface from the stored key
+// pair, subnets and peers. An environment without subnets yet has no peers
+// either and gets an interface without addresses.
+func serverWireGuard(environmentID, clientID string) (*ServerWireGuard, error) {
+	keys, err := getWireGuardServerKeys(environmentID)
+	if err != nil {
+		return nil, err
+	}
+	network, err := getEnvironmentNetwork(environmentID)
+	if err != nil {
+		return nil, err
+	}
+	peers, err := loadPeers(clientID)
+	if err != nil {
+		return nil, err
+	}
+
+	wg := &ServerWireGuard{PrivateKey: keys.PrivateKey, ListenPort: wireGuardListenPort, Peers: []ServerPeer{}}
+	if network == nil {
+		network = &EnvironmentNetwork{}
+	}
+	for _, s := range sortedSubnets(network) {
+		subnet, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid subnet %s: %v", s, err)
+		}
+		wg.Addresses = append(wg.Addresses, netip.PrefixFrom(serverAddress(subnet), subnet.Bits()).String())
+	}
+
+	names := make([]string, 0, len(peers))
+	for name := range peers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		wg.Peers = append(wg.Peers, ServerPeer{
+			Name:         name,
+			PublicKey:    peers[name].PublicKey,
+			PresharedKey: peers[name].PresharedKey,
+			AllowedIPs:   network.Devices[name],
+		})
+	}
+	return wg, nil
+}
+
+// upsertPeer creates or replaces the named peer of a client. An empty
+// publicKey makes the server generate the key pair. The peer's tunnel
+// addresses come from IPAM and survive re-keying. The VPN server picks up
+// the change in the background, as it does a deleted peer.
+func upsertPeer(client *ClientData, name, publicKey string) (*Peer, error) {
+	network, err := assignClientNetwork(client)
+	if err != nil {
+		return nil, err
+	}
+	_, allocated := network.Devices[name]
+	if _, err := allocateDeviceAddresses(client.Environment.ID, name); err != nil {
+		return nil, err
+	}
+
+	peer := &Peer{
+		Name:         name,
+		PublicKey:    publicKey,
+		PresharedKey: generatePresharedKey(),
+		Created:      time.Now(),
+	}
+	if publicKey == "" {
+		keys, err := generateWireGuardKeyPair()
+		if err != nil {
+			return nil, err
+		}
+		peer.PublicKey = keys.PublicKey
+		peer.PrivateKey = keys.PrivateKey
+	}
+
+	key := wireGuardPeersKey(client.ID)
+	err = updateWithRetry([]string{key}, func(current map[string][]byte) (map[string][]byte, error) {
+		peers := map[string]*Peer{}
+		if data, ok := current[key]; ok {
+			if err := json.Unmarshal(data, &peers); err != nil {
+				return nil, err
+			}
+		}
+
+		for other, p := range peers {
+			if other != name && p.PublicKey == peer.PublicKey {
+				return nil, fmt.Errorf("public key already registered for peer %s", other)
+			}
+		}
+
+		peers[name] = peer
+		data, err := json.Marshal(peers)
+		if err != nil {
+			return nil, err
+		}
+		return map[string][]byte{key: data}, nil
+	})
+	if err != nil {
+		// Don't leak the addresses of a device that was never stored
+		if !allocated {
+			releaseDeviceAddresses(client.Environment.ID, name)
+		}
+		return nil, err
+	}
+	resyncClient(client.ID)
+	return peer, nil
+}
+
+func deletePeer(clientID, name string) (bool, error) {
+	key := wireGuardPeersKey(clientID)
+	found := false
+	err := updateWithRetry([]string{key}, func(current map[string][]byte) (map[string][]byte, error) {
+		peers := map[string]*Peer{}
+		if data, ok := current[key]; ok {
+			if err := json.Unmarshal(data, &peers); err != nil {
+				return nil, err
+			}
+		}
+		if _, found = peers[name]; !found {
+			return nil, nil
+		}
+		delete(peers, name)
+		data, err := json.Marshal(peers)
+		if err != nil {
+			return nil, err
+		}
+		return map[string][]byte{key: data}, nil
+	})
+	if found && err == nil {
+		resyncClient(clientID)
+	}
+	return found, err
+}
+
+// buildWireGuardConfig assembles the tunnel definition for one peer
+func buildWireGuardConfig(clientData *ClientData, peer *Peer) (*WireGuardConfig, error) {
+	serverKeys, err := getWireGuardServerKeys(clientData.Environment.ID)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := assignClientNetwork(clientData); err != nil {
+		return nil, err
+	}
+	addresses, err := allocateDeviceAddresses(clientData.Environment.ID, peer.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &WireGuardConfig{
+		Interface: WireGuardInterface{
+			PrivateKey: peer.PrivateKey,
+			Address:    addresses,
+			DNS:        splitList(getEnv("WG_DNS", "1.1.1.1, 1.0.0.1")),
+		},
+		Peer: WireGuardPeer{
+			PublicKey:           serverKeys.PublicKey,
+			PresharedKey:        peer.PresharedKey,
+			Endpoint:            net.JoinHostPort(clientData.Environment.VPNServer, strconv.Itoa(clientData.Environment.VPNPort)),
+			AllowedIPs:          splitList(getEnv("WG_ALLOWED_IPS", "0.0.0.0/0, ::/0")),
+			PersistentKeepalive: 25,
+		},
+	}, nil
+}
+
+var errPeerNotFound = fmt.Errorf("peer not found")
+
+// buildVPNConfig assembles the /config document for the named peer of a
+// client. An empty name selects the default peer, which is created with a
+// server-generated key pair on first use.
+func buildVPNConfig(clientData *ClientData, token, peerName string) (*VPNConfig, error) {
+	if peerName == "" {
+		peerName = defaultPeerName
+	}
+
+	peers, err := loadPeers(clientData.ID)
+	if err != nil {
+		return nil, err
+	}
+	peer, ok := peers[peerName]
+	if !ok {
+		if peerName != defaultPeerName {
+			return nil, errPeerNotFound
+		}
+		if peer, err = upsertPeer(clientData, defaultPeerName, ""); err != nil {
+			return nil, fmt.Errorf("failed to create default peer: %v", err)
+		}
+	}
+
+	wg, err := buildWireGuardConfig(clientData, peer)
+	if err != nil {
+		return nil, err
+	}
+
+	return &VPNConfig{
+		Server:        clientData.Environment.VPNServer,
+		Port:          clientData.Environment.VPNPort,
+		Token:         token,
+		EnvironmentID: clientData.Environment.ID,
+		Peer:          peer.Name,
+		WireGuard:     wg,
+	}, nil
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// handleUpsertPeer registers a device with POST /config/peer. Clients that
+// send a public_key keep their private key; otherwise one is generated.
+func handleUpsertPeer(w http.ResponseWriter, r *http.Request) {
+	claims, ok := authenticateClient(w, r)
+	if !ok {
+		return
+	}
+
+	var req PeerRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if req.Name == "" {
+		req.Name = defaultPeerName
+	}
+	if !peerNamePattern.MatchString(req.Name) {
+		http.Error(w, "Invalid peer name", http.StatusBadRequest)
+		return
+	}
+	if req.PublicKey != "" {
+		if err := validateWireGuardKey(req.PublicKey); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	clientData := getClientInfrastructure(claims.Subject)
+	if clientData == nil {
+		http.Error(w, "Client not found", http.StatusNotFound)
+		return
+	}
+	if !requireActiveEnvironment(w, clientData) {
+		return
+	}
+
+	peer, err := upsertPeer(clientData, req.Name, req.PublicKey)
+	if err != nil {
+		log.Printf("Failed to register peer %s for %s: %v", req.Name, claims.Subject, err)
+		status := http.StatusConflict
+		if errors.Is(err, ErrPoolExhausted) {
+			status = http.StatusServiceUnavailable
+		}
+		http.Error(w, fmt.Sprintf("Failed to register peer: %v", err), status)
+		return
+	}
+
+	wg, err := buildWireGuardConfig(clientData, peer)
+	if err != nil {
+		log.Printf("Failed to build WireGuard config for %s: %v", claims.Subject, err)
+		http.Error(w, "Failed to build config", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Registered WireGuard peer %s for client %s", peer.Name, claims.Subject)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"peer":      peer.Name,
+		"wireguard": wg,
+	})
+}
+
+func handleListPeers(w http.ResponseWriter, r *http.Request) {
+	claims, ok := authenticateClient(w, r)
+	if !ok {
+		return
+	}
+
+	clientData := getClientInfrastructure(claims.Subject)
+	if clientData == nil {
+		http.Error(w, "Client not found", http.StatusNotFound)
+		return
+	}
+
+	peers, err := loadPeers(claims.Subject)
+	if err != nil {
+		http.Error(w, "Failed to load peers", http.StatusInternalServerError)
+		return
+	}
+	network, err := getEnvironmentNetwork(clientData.Environment.ID)
+	if err != nil {
+		http.Error(w, "Failed to load network", http.StatusInternalServerError)
+		return
+	}
+
+	infos := make([]PeerInfo, 0, len(peers))
+	for _, p := range peers {
+		var addresses []string
+		if network != nil {
+			addresses = network.Devices[p.Name]
+		}
+		infos = append(infos, PeerInfo{
+			Name:            p.Name,
+			PublicKey:       p.PublicKey,
+			Addresses:       addresses,
+			ServerGenerated: p.PrivateKey != "",
+			Created:         p.Created,
+		})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"peers": infos,
+	})
+}
+
+func handleDeletePeer(w http.ResponseWriter, r *http.Request, name string) {
+	claims, ok := authenticateClient(w, r)
+	if !ok {
+		return
+	}
+
+	clientData := getClientInfrastructure(claims.Subject)
+	if clientData == nil {
+		http.Error(w, "Client not found", http.StatusNotFound)
+		return
+	}
+
+	found, err := deletePeer(claims.Subject, name)
+	if err != nil {
+		http.Error(w, "Failed to delete peer", http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, "Peer not found", http.StatusNotFound)
+		return
+	}
+
+	if err := releaseDeviceAddresses(clientData.Environment.ID, name); err != nil {
+		log.Printf("Failed to release addresses of peer %s for %s: %v", name, claims.Subject, err)
+	}
+	if err := storage.Delete(heartbeatKey(claims.Subject, name)); err != nil {
+		log.Printf("Failed to delete heartbeat of peer %s for %s: %v", name, claims.Subject, err)
+	}
+
+	log.Printf("Deleted WireGuard peer %s for client %s", name, claims.Subject)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Peer deleted",
+		"peer":    name,
+	})
+}
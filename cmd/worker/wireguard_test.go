@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+func configForTest(t *testing.T, token, path string) VPNConfig {
+	w := requestForTest("GET", path, token, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected config, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var config VPNConfig
+	json.Unmarshal(w.Body.Bytes(), &config)
+	return config
+}
+
+func TestGenerateWireGuardKeyPair(t *testing.T) {
+	keys, err := generateWireGuardKeyPair()
+	if err != nil {
+		t.Fatalf("Failed to generate keys: %v", err)
+	}
+	if err := validateWireGuardKey(keys.PublicKey); err != nil {
+		t.Errorf("Generated public key is invalid: %v", err)
+	}
+	if keys.PublicKey == keys.PrivateKey {
+		t.Error("Expected distinct public and private keys")
+	}
+
+	for _, bad := range []string{"", "not-base64!", "c2hvcnQ="} {
+		if validateWireGuardKey(bad) == nil {
+			t.Errorf("Expected %q to be rejected", bad)
+		}
+	}
+}
+
+func TestHandleConfigWireGuard(t *testing.T) {
+	storage = NewMockStorage()
+	auth := loginForTest(t, "test@example.com", "laptop")
+
+	config := configForTest(t, auth.Token, "/config")
+	wg := config.WireGuard
+	if wg == nil {
+		t.Fatal("Expected a WireGuard section")
+	}
+	if config.Peer != defaultPeerName {
+		t.Errorf("Expected default peer, got %q", config.Peer)
+	}
+	if validateWireGuardKey(wg.Peer.PublicKey) != nil || wg.Interface.PrivateKey == "" {
+		t.Errorf("Expected server public key and generated private key, got %+v", wg)
+	}
+	if len(wg.Interface.Address) != 2 || wg.Interface.Address[0] != "10.13.0.2/32" || wg.Interface.Address[1] != "fd13:5017::2/128" {
+		t.Errorf("Expected first tunnel addresses, got %v", wg.Interface.Address)
+	}
+	if wg.Peer.Endpoint != net.JoinHostPort(config.Server, strconv.Itoa(config.Port)) {
+		t.Errorf("Expected endpoint, got %q", wg.Peer.Endpoint)
+	}
+
+	// The same keys come back on the next request
+	again := configForTest(t, auth.Token, "/config")
+	if again.WireGuard.Interface.PrivateKey != wg.Interface.PrivateKey || again.WireGuard.Peer.PublicKey != wg.Peer.PublicKey {
+		t.Error("Expected config to be stable across requests")
+	}
+}
+
+func TestClientSuppliedPublicKey(t *testing.T) {
+	storage = NewMockStorage()
+	auth := loginForTest(t, "test@example.com", "laptop")
+	keys, _ := generateWireGuardKeyPair()
+
+	w := requestForTest("POST", "/config/peer", auth.Token, PeerRequest{Name: "phone", PublicKey: keys.PublicKey})
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected peer to be registered, got %d: %s", w.Code, w.Body.String())
+	}
+
+	config := configForTest(t, auth.Token, "/config?peer=phone")
+	if config.WireGuard.Interface.PrivateKey != "" {
+		t.Error("Server must not hand out a private key it never had")
+	}
+
+	peers, _ := loadPeers(auth.ClientID)
+	if peers["phone"].PrivateKey != "" || peers["phone"].PublicKey != keys.PublicKey {
+		t.Errorf("Expected only the public key to be stored, got %+v", peers["phone"])
+	}
+
+	// Registering the same key under another name is refused
+	w = requestForTest("POST", "/config/peer", auth.Token, PeerRequest{Name: "tablet", PublicKey: keys.PublicKey})
+	if w.Code != http.StatusConflict {
+		t.Errorf("Expected 409 for duplicate key, got %d", w.Code)
+	}
+
+	w = requestForTest("POST", "/config/peer", auth.Token, PeerRequest{Name: "tablet", PublicKey: "bogus"})
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for invalid key, got %d", w.Code)
+	}
+}
+
+func TestPeerLifecycle(t *testing.T) {
+	storage = NewMockStorage()
+	auth := loginForTest(t, "test@example.com", "laptop")
+
+	first := configForTest(t, auth.Token, "/config")
+
+	w := requestForTest("POST", "/config/peer", auth.Token, PeerRequest{Name: "phone"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected peer to be created, got %d", w.Code)
+	}
+
+	phone := configForTest(t, auth.Token, "/config?peer=phone")
+	if phone.WireGuard.Interface.Address[0] == first.WireGuard.Interface.Address[0] {
+		t.Error("Expected peers to get distinct addresses")
+	}
+
+	// Re-keying keeps the address
+	requestForTest("POST", "/config/peer", auth.Token, PeerRequest{Name: "phone"})
+	rekeyed := configForTest(t, auth.Token, "/config?peer=phone")
+	if rekeyed.WireGuard.Interface.PrivateKey == phone.WireGuard.Interface.PrivateKey {
+		t.Error("Expected new keys after re-registering")
+	}
+	if rekeyed.WireGuard.Interface.Address[0] != phone.WireGuard.Interface.Address[0] {
+		t.Error("Expected address to survive re-keying")
+	}
+
+	w = requestForTest("GET", "/config/peers", auth.Token, nil)
+	var list struct {
+		Peers []PeerInfo `json:"peers"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &list)
+	if len(list.Peers) != 2 || list.Peers[0].Name != "default" || list.Peers[1].Name != "phone" {
+		t.Errorf("Expected two peers, got %+v", list.Peers)
+	}
+
+	w = requestForTest("DELETE", "/config/peer/phone", auth.Token, nil)
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected peer to be deleted, got %d", w.Code)
+	}
+
+	w = requestForTest("GET", "/config?peer=phone", auth.Token, nil)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for deleted peer, got %d", w.Code)
+	}
+}
+
+func TestServerKeysPerEnvironment(t *testing.T) {
+	storage = NewMockStorage()
+	alice := loginForTest(t, "alice@example.com", "")
+	bob := loginForTest(t, "bob@example.com", "")
+
+	a := configForTest(t, alice.Token, "/config")
+	b := configForTest(t, bob.Token, "/config")
+	if a.WireGuard.Peer.PublicKey == b.WireGuard.Peer.PublicKey {
+		t.Error("Expected each environment to have its own server key")
+	}
+}
@@ -8,6 +8,7 @@ set -e
 # Default values
 SERVER_URL="${SOLTAR_SERVER_URL:-http://localhost:8080}"
 EMAIL="${SOLTAR_EMAIL:-test@example.com}"
+ADMIN_KEY="${SOLTAR_ADMIN_KEY:-}"
 TOKEN_FILE="/tmp/soltar_debug_token.txt"
 CLIENT_ID_FILE="/tmp/soltar_debug_client_id.txt"
 
@@ -127,7 +128,12 @@ test_webapp() {
 # Function to debug storage
 debug_storage() {
     echo "🔍 Debugging storage..."
-    response=$(api_call "GET" "/debug")
+    if [ -z "$ADMIN_KEY" ]; then
+        echo "⚠️  Set SOLTAR_ADMIN_KEY to an admin API key to list storage"
+        echo ""
+        return
+    fi
+    response=$(curl -s "$SERVER_URL/debug" -H "Authorization: Bearer $ADMIN_KEY")
     echo "Debug response: $response"
     echo ""
 }
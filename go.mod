@@ -1,4 +1,4 @@
-module soltar
+module github.com/glassrye/soltar
 
 go 1.21
 
@@ -0,0 +1,113 @@
+package qrcode
+
+import (
+	"bytes"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+// Codewords of the "HELLO WORLD" 1-M example from the standard's annex
+func TestReedSolomonRemainder(t *testing.T) {
+	data := []byte{32, 91, 11, 120, 209, 114, 220, 77, 67, 64, 236, 17, 236, 17, 236, 17}
+	want := []byte{196, 35, 39, 119, 235, 215, 231, 226, 93, 23}
+
+	got := reedSolomonRemainder(data, reedSolomonDivisor(len(want)))
+	if !bytes.Equal(got, want) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+}
+
+func TestEncodePicksSmallestVersion(t *testing.T) {
+	tests := []struct {
+		length  int
+		level   Level
+		version int
+	}{
+		{17, Low, 1},
+		{18, Low, 2},
+		{14, Medium, 1},
+		{15, Medium, 2},
+		{271, Low, 10},
+		{2953, Low, 40},
+		{1273, High, 40},
+	}
+
+	for _, tt := range tests {
+		c, err := Encode(bytes.Repeat([]byte("a"), tt.length), tt.level)
+		if err != nil {
+			t.Fatalf("Encode(%d bytes, %d) failed: %v", tt.length, tt.level, err)
+		}
+		if c.Version != tt.version || c.Size != tt.version*4+17 {
+			t.Errorf("%d bytes at level %d: expected version %d, got %d (size %d)", tt.length, tt.level, tt.version, c.Version, c.Size)
+		}
+	}
+
+	if _, err := Encode(bytes.Repeat([]byte("a"), 2954), Low); err != ErrTooLong {
+		t.Errorf("Expected ErrTooLong, got %v", err)
+	}
+}
+
+func TestFunctionPatterns(t *testing.T) {
+	c, err := Encode([]byte("[Interface]\nPrivateKey = x\n"), Medium)
+	if err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+
+	// Finder pattern rows: dark ring, light ring, dark 3x3 center
+	for _, corner := range [][2]int{{0, 0}, {c.Size - 7, 0}, {0, c.Size - 7}} {
+		for i := 0; i < 7; i++ {
+			if !c.Dark(corner[0]+i, corner[1]) || !c.Dark(corner[0], corner[1]+i) {
+				t.Errorf("Expected dark finder border at %v", corner)
+			}
+		}
+		if c.Dark(corner[0]+1, corner[1]+1) || !c.Dark(corner[0]+3, corner[1]+3) {
+			t.Errorf("Unexpected finder interior at %v", corner)
+		}
+	}
+
+	// Timing pattern and the always-dark module
+	for i := 8; i < c.Size-8; i++ {
+		if c.Dark(i, 6) != (i%2 == 0) || c.Dark(6, i) != (i%2 == 0) {
+			t.Errorf("Unexpected timing module at %d", i)
+		}
+	}
+	if !c.Dark(8, c.Size-8) {
+		t.Error("Expected dark module next to the bottom left finder")
+	}
+}
+
+func TestEncodeIsDeterministic(t *testing.T) {
+	a, _ := Encode([]byte("soltar"), Quartile)
+	b, _ := Encode([]byte("soltar"), Quartile)
+	if !bytes.Equal(a.SVG(), b.SVG()) {
+		t.Error("Expected identical symbols for identical input")
+	}
+}
+
+func TestRenderers(t *testing.T) {
+	c, _ := Encode([]byte("soltar"), Medium)
+	width := c.Size + 2*QuietZone
+
+	data, err := c.PNG(4)
+	if err != nil {
+		t.Fatalf("PNG failed: %v", err)
+	}
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Invalid PNG: %v", err)
+	}
+	if img.Bounds().Dx() != width*4 {
+		t.Errorf("Expected %d pixel wide PNG, got %d", width*4, img.Bounds().Dx())
+	}
+
+	svg := string(c.SVG())
+	if !strings.HasPrefix(svg, "<svg") || !strings.Contains(svg, "viewBox=\"0 0 29 29\"") {
+		t.Errorf("Unexpected SVG: %.80s", svg)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(c.ANSI(), "\n"), "\n")
+	if len(lines) != width {
+		t.Errorf("Expected %d terminal lines, got %d", width, len(lines))
+	}
+}
@@ -0,0 +1,85 @@
+package qrcode
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"strings"
+)
+
+// QuietZone is the light border, in modules, that scanners need around a symbol
+const QuietZone = 4
+
+// Image returns the symbol as a grayscale image with scale pixels per module
+func (c *Code) Image(scale int) image.Image {
+	if scale < 1 {
+		scale = 1
+	}
+	size := (c.Size + 2*QuietZone) * scale
+	img := image.NewGray(image.Rect(0, 0, size, size))
+	for py := 0; py < size; py++ {
+		for px := 0; px < size; px++ {
+			v := uint8(0xFF)
+			if c.Dark(px/scale-QuietZone, py/scale-QuietZone) {
+				v = 0
+			}
+			img.SetGray(px, py, color.Gray{Y: v})
+		}
+	}
+	return img
+}
+
+// PNG encodes the symbol as a PNG image
+func (c *Code) PNG(scale int) ([]byte, error) {
+	var b bytes.Buffer
+	if err := png.Encode(&b, c.Image(scale)); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// SVG renders the symbol as a scalable SVG document, one unit per module
+func (c *Code) SVG() []byte {
+	size := c.Size + 2*QuietZone
+
+	var path strings.Builder
+	for y := 0; y < c.Size; y++ {
+		for x := 0; x < c.Size; x++ {
+			if c.Dark(x, y) {
+				fmt.Fprintf(&path, "M%d,%dh1v1h-1z", x+QuietZone, y+QuietZone)
+			}
+		}
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %d %d" shape-rendering="crispEdges">`, size, size)
+	b.WriteString(`<rect width="100%" height="100%" fill="#fff"/>`)
+	fmt.Fprintf(&b, `<path d="%s" fill="#000"/>`, path.String())
+	b.WriteString("</svg>\n")
+	return b.Bytes()
+}
+
+// ANSI renders the symbol for a terminal, two character cells per module.
+// Colors are set explicitly so the code scans on dark and light themes alike.
+func (c *Code) ANSI() string {
+	const (
+		dark  = "\x1b[40m  "
+		light = "\x1b[47m  "
+		reset = "\x1b[0m\n"
+	)
+
+	var b strings.Builder
+	for y := -QuietZone; y < c.Size+QuietZone; y++ {
+		for x := -QuietZone; x < c.Size+QuietZone; x++ {
+			if c.Dark(x, y) {
+				b.WriteString(dark)
+			} else {
+				b.WriteString(light)
+			}
+		}
+		b.WriteString(reset)
+	}
+	return b.String()
+}
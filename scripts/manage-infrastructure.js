@@ -8,7 +8,7 @@ class InfrastructureManager {
     this.token = token;
   }
 
-  async makeRequest(path, method = 'GET', data = null) {
+  async makeRequest(path, method = 'GET', data = null, contentType = 'application/json') {
     return new Promise((resolve, reject) => {
       const options = {
         hostname: new URL(this.baseURL).hostname,
@@ -17,7 +17,7 @@ class InfrastructureManager {
         method: method,
         headers: {
           'Authorization': `Bearer ${this.token}`,
-          'Content-Type': 'application/json'
+          'Content-Type': contentType
         }
       };
 
@@ -67,62 +67,64 @@ class InfrastructureManager {
     const response = await this.makeRequest('/infrastructure', 'POST', {
       infrastructure
     });
-    
+    return this.handleWrite(response, 'updated');
+  }
+
+  // patchInfrastructure sends a JSON Patch (an array of operations) or a JSON
+  // Merge Patch (an object). The server applies it to the stored document in
+  // one transaction, so concurrent patches do not overwrite each other.
+  async patchInfrastructure(patch) {
+    console.log('🩹 Patching infrastructure...');
+    const contentType = Array.isArray(patch)
+      ? 'application/json-patch+json'
+      : 'application/merge-patch+json';
+    const response = await this.makeRequest('/infrastructure', 'PATCH', patch, contentType);
+    return this.handleWrite(response, 'patched');
+  }
+
+  handleWrite(response, verb) {
     if (response.status === 200) {
-      console.log('✅ Infrastructure updated successfully');
+      console.log(`✅ Infrastructure ${verb} successfully (revision ${response.data.revision})`);
       return response.data;
+    } else if (response.status === 422 && response.data.fields) {
+      console.error('❌ Infrastructure failed validation:');
+      for (const field of response.data.fields) {
+        console.error(`  ${field.field}: ${field.message}`);
+      }
+      return null;
     } else {
-      console.error('❌ Failed to update infrastructure:', response.data);
+      console.error(`❌ Failed to ${verb === 'patched' ? 'patch' : 'update'} infrastructure:`, response.data);
       return null;
     }
   }
 
-  async addVPNInstance(instanceId) {
-    const current = await this.getInfrastructure();
-    if (!current) return;
-
-    const updatedInfrastructure = {
-      ...current.infrastructure,
-      vpn_instances: [...current.infrastructure.vpn_instances, instanceId]
-    };
+  // addResource appends a typed resource to one of the infrastructure lists.
+  // spec is optional; the server fills in defaults and validates it.
+  async addResource(list, kind, id, spec = undefined) {
+    const resource = { id, kind };
+    if (spec) {
+      resource.spec = spec;
+    }
 
-    return await this.updateInfrastructure(updatedInfrastructure);
+    return await this.patchInfrastructure([
+      { op: 'add', path: `/${list}/-`, value: resource }
+    ]);
   }
 
-  async addLoadBalancer(lbId) {
-    const current = await this.getInfrastructure();
-    if (!current) return;
-
-    const updatedInfrastructure = {
-      ...current.infrastructure,
-      load_balancers: [...current.infrastructure.load_balancers, lbId]
-    };
-
-    return await this.updateInfrastructure(updatedInfrastructure);
+  async addVPNInstance(instanceId, spec) {
+    return await this.addResource('vpn_instances', 'vpn_instance', instanceId, spec);
   }
 
-  async addDatabase(dbId) {
-    const current = await this.getInfrastructure();
-    if (!current) return;
-
-    const updatedInfrastructure = {
-      ...current.infrastructure,
-      databases: [...current.infrastructure.databases, dbId]
-    };
-
-    return await this.updateInfrastructure(updatedInfrastructure);
+  async addLoadBalancer(lbId, spec) {
+    return await this.addResource('load_balancers', 'load_balancer', lbId, spec);
   }
 
-  async addStorage(storageId) {
-    const current = await this.getInfrastructure();
-    if (!current) return;
-
-    const updatedInfrastructure = {
-      ...current.infrastructure,
-      storage: [...current.infrastructure.storage, storageId]
-    };
+  async addDatabase(dbId, spec) {
+    return await this.addResource('databases', 'database', dbId, spec);
+  }
 
-    return await this.updateInfrastructure(updatedInfrastructure);
+  async addStorage(storageId, spec) {
+    return await this.addResource('storage', 'storage', storageId, spec);
   }
 }
 
@@ -131,7 +133,7 @@ async function main() {
   const args = process.argv.slice(2);
   
   if (args.length < 2) {
-    console.log('Usage: node manage-infrastructure.js <base-url> <token> [command] [resource-id]');
+    console.log('Usage: node manage-infrastructure.js <base-url> <token> [command] [resource-id] [spec-json]');
     console.log('');
     console.log('Commands:');
     console.log('  get                    - Get current infrastructure');
@@ -139,17 +141,24 @@ async function main() {
     console.log('  add-lb <lb-id>         - Add load balancer');
     console.log('  add-db <db-id>         - Add database');
     console.log('  add-storage <storage-id> - Add storage');
+    console.log('  patch <patch-json>     - Apply a JSON Patch array or merge patch object');
+    console.log('');
+    console.log('The add commands take an optional JSON spec, e.g. \'{"engine":"postgres","size_gb":5}\'');
     console.log('');
     console.log('Examples:');
     console.log('  node manage-infrastructure.js https://your-worker.workers.dev your-jwt-token get');
     console.log('  node manage-infrastructure.js https://your-worker.workers.dev your-jwt-token add-vpn vpn-instance-1');
+    console.log('  node manage-infrastructure.js https://your-worker.workers.dev your-jwt-token add-db pg-main \'{"engine":"postgres"}\'');
+    console.log('  node manage-infrastructure.js https://your-worker.workers.dev your-jwt-token patch \'{"databases":null}\'');
     process.exit(1);
   }
 
-  const [baseURL, token, command, resourceId] = args;
+  const [baseURL, token, command, resourceId, specJSON] = args;
   const manager = new InfrastructureManager(baseURL, token);
 
   try {
+    const spec = specJSON ? JSON.parse(specJSON) : undefined;
+
     switch (command) {
       case 'get':
         await manager.getInfrastructure();
@@ -159,28 +168,35 @@ async function main() {
           console.error('❌ VPN instance ID required');
           process.exit(1);
         }
-        await manager.addVPNInstance(resourceId);
+        await manager.addVPNInstance(resourceId, spec);
         break;
       case 'add-lb':
         if (!resourceId) {
           console.error('❌ Load balancer ID required');
           process.exit(1);
         }
-        await manager.addLoadBalancer(resourceId);
+        await manager.addLoadBalancer(resourceId, spec);
         break;
       case 'add-db':
         if (!resourceId) {
           console.error('❌ Database ID required');
           process.exit(1);
         }
-        await manager.addDatabase(resourceId);
+        await manager.addDatabase(resourceId, spec);
         break;
       case 'add-storage':
         if (!resourceId) {
           console.error('❌ Storage ID required');
           process.exit(1);
         }
-        await manager.addStorage(resourceId);
+        await manager.addStorage(resourceId, spec);
+        break;
+      case 'patch':
+        if (!resourceId) {
+          console.error('❌ Patch JSON required');
+          process.exit(1);
+        }
+        await manager.patchInfrastructure(JSON.parse(resourceId));
         break;
       default:
         console.error('❌ Unknown command:', command);
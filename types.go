@@ -0,0 +1,459 @@
+// Package soltar holds the wire types of the Soltar VPN API and Client, a
+// typed SDK for it. The worker serves these types and the Linux client and
+// third-party tooling consume them, so they cannot drift apart.
+package soltar
+
+import (
+	"encoding/json"
+	"time"
+)
+
+type Environment struct {
+	ID        string    `json:"id"`
+	ClientID  string    `json:"client_id"`
+	VPNServer string    `json:"vpn_server"`
+	VPNPort   int       `json:"vpn_port"`
+	Created   time.Time `json:"created"`
+	// Status is one of the Environment* lifecycle states
+	Status        string             `json:"status"`
+	StatusReason  string             `json:"status_reason,omitempty"`
+	StatusChanged *time.Time         `json:"status_changed,omitempty"`
+	Transitions   []StatusTransition `json:"transitions,omitempty"`
+	Region        string             `json:"region"`
+	Subnets       []string           `json:"subnets,omitempty"`
+	// Instances, Databases and Storage are the environment's own resources
+	Instances []Resource `json:"instances"`
+	Databases []Resource `json:"databases"`
+	Storage   []Resource `json:"storage"`
+}
+
+// UnmarshalJSON also reads records from before typed resources, whose
+// resource lists held bare IDs
+func (e *Environment) UnmarshalJSON(data []byte) error {
+	type plain Environment
+	if err := json.Unmarshal(data, (*plain)(e)); err != nil {
+		return err
+	}
+	setResourceKind(e.Instances, ResourceInstance)
+	setResourceKind(e.Databases, ResourceDatabase)
+	setResourceKind(e.Storage, ResourceStorage)
+	return nil
+}
+
+// Environment lifecycle states. Only an active environment hands out
+// configs; deleted is final.
+const (
+	EnvironmentPending        = "pending"
+	EnvironmentProvisioning   = "provisioning"
+	EnvironmentActive         = "active"
+	EnvironmentSuspended      = "suspended"
+	EnvironmentDeprovisioning = "deprovisioning"
+	EnvironmentDeleted        = "deleted"
+	EnvironmentFailed         = "failed"
+)
+
+// StatusTransition records one change of Environment.Status. Actor is
+// "client", "system" or "admin:<name>".
+type StatusTransition struct {
+	From   string    `json:"from"`
+	To     string    `json:"to"`
+	Time   time.Time `json:"time"`
+	Reason string    `json:"reason,omitempty"`
+	Actor  string    `json:"actor,omitempty"`
+}
+
+// EnvironmentAction is the optional body of the suspend, resume and delete
+// endpoints
+type EnvironmentAction struct {
+	Reason string `json:"reason,omitempty"`
+}
+
+// EnvironmentResponse is returned by GET /environment and its actions
+type EnvironmentResponse struct {
+	ClientID    string      `json:"client_id"`
+	Environment Environment `json:"environment"`
+}
+
+// Infrastructure is the desired state of a client's infrastructure. Every
+// update bumps Generation, which is also its revision in the history and
+// what If-Match compares; a reconciler brings the provisioned resources in
+// line with it.
+type Infrastructure struct {
+	VPNInstances  []Resource `json:"vpn_instances"`
+	LoadBalancers []Resource `json:"load_balancers"`
+	Databases     []Resource `json:"databases"`
+	Storage       []Resource `json:"storage"`
+	Generation    int64      `json:"generation"`
+	Created       time.Time  `json:"created"`
+	LastUpdated   time.Time  `json:"last_updated"`
+}
+
+// UnmarshalJSON also reads documents from before typed resources, whose lists
+// held bare IDs. A resource without a kind takes the kind of its list.
+func (i *Infrastructure) UnmarshalJSON(data []byte) error {
+	type plain Infrastructure
+	if err := json.Unmarshal(data, (*plain)(i)); err != nil {
+		return err
+	}
+	setResourceKind(i.VPNInstances, ResourceVPNInstance)
+	setResourceKind(i.LoadBalancers, ResourceLoadBalancer)
+	setResourceKind(i.Databases, ResourceDatabase)
+	setResourceKind(i.Storage, ResourceStorage)
+	return nil
+}
+
+func setResourceKind(resources []Resource, kind string) {
+	for n := range resources {
+		if resources[n].Kind == "" {
+			resources[n].Kind = kind
+		}
+	}
+}
+
+// Kinds of infrastructure resources. Instances only occur in an
+// environment's own resources.
+const (
+	ResourceVPNInstance  = "vpn_instance"
+	ResourceLoadBalancer = "load_balancer"
+	ResourceDatabase     = "database"
+	ResourceStorage      = "storage"
+	ResourceInstance     = "instance"
+)
+
+// Resource is one piece of infrastructure. Spec holds the spec type of its
+// kind, e.g. a DatabaseSpec; omitted fields take their defaults. Status,
+// Created and Updated are maintained by the server, and Region defaults to
+// the environment's.
+type Resource struct {
+	ID      string          `json:"id"`
+	Kind    string          `json:"kind"`
+	Spec    json.RawMessage `json:"spec,omitempty"`
+	Status  string          `json:"status,omitempty"`
+	Region  string          `json:"region,omitempty"`
+	Created time.Time       `json:"created"`
+	Updated time.Time       `json:"updated"`
+}
+
+// UnmarshalJSON also accepts a bare ID, the form resources had before they
+// were typed
+func (r *Resource) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		*r = Resource{}
+		return json.Unmarshal(data, &r.ID)
+	}
+	type plain Resource
+	return json.Unmarshal(data, (*plain)(r))
+}
+
+// ResourceIDs lists the IDs of resources
+func ResourceIDs(resources []Resource) []string {
+	ids := make([]string, len(resources))
+	for n, r := range resources {
+		ids[n] = r.ID
+	}
+	return ids
+}
+
+// VPNInstanceSpec is the spec of a vpn_instance
+type VPNInstanceSpec struct {
+	// Protocol is wireguard (default) or openvpn
+	Protocol string `json:"protocol,omitempty"`
+	// Port defaults to 51820 for WireGuard and 1194 for OpenVPN
+	Port     int `json:"port,omitempty"`
+	MaxPeers int `json:"max_peers,omitempty"`
+}
+
+// LoadBalancerSpec is the spec of a load_balancer
+type LoadBalancerSpec struct {
+	// Protocol is tcp (default), udp, http or https
+	Protocol string `json:"protocol,omitempty"`
+	// Port defaults to 443
+	Port int `json:"port,omitempty"`
+	// Targets are IDs of VPN instances in the same infrastructure
+	Targets []string `json:"targets,omitempty"`
+}
+
+// DatabaseSpec is the spec of a database
+type DatabaseSpec struct {
+	// Engine is redis (default) or postgres
+	Engine  string `json:"engine,omitempty"`
+	Version string `json:"version,omitempty"`
+	// SizeGB defaults to 1
+	SizeGB int `json:"size_gb,omitempty"`
+}
+
+// StorageSpec is the spec of a storage volume. It cannot change once the
+// volume exists.
+type StorageSpec struct {
+	// SizeGB defaults to 10
+	SizeGB int `json:"size_gb,omitempty"`
+}
+
+// States of an infrastructure resource during reconciliation
+const (
+	ResourcePending  = "pending"
+	ResourceReady    = "ready"
+	ResourceDeleting = "deleting"
+	ResourceFailed   = "failed"
+)
+
+// ResourceStatus is the reconciliation state of one resource. A failed
+// resource is retried from NextAttempt on.
+type ResourceStatus struct {
+	Kind        string     `json:"kind"`
+	ID          string     `json:"id"`
+	State       string     `json:"state"`
+	LastError   string     `json:"last_error,omitempty"`
+	Attempts    int        `json:"attempts,omitempty"`
+	LastAttempt *time.Time `json:"last_attempt,omitempty"`
+	NextAttempt *time.Time `json:"next_attempt,omitempty"`
+}
+
+// InfrastructureStatus reports how far the provisioned resources have caught
+// up with the desired Infrastructure. Synced is true once
+// ObservedGeneration matches it and every resource is ready.
+type InfrastructureStatus struct {
+	ObservedGeneration int64            `json:"observed_generation"`
+	Synced             bool             `json:"synced"`
+	LastReconciled     *time.Time       `json:"last_reconciled,omitempty"`
+	LastError          string           `json:"last_error,omitempty"`
+	Resources          []ResourceStatus `json:"resources"`
+}
+
+type OTPRequest struct {
+	Email string `json:"email"`
+}
+
+type OTPVerify struct {
+	Email  string `json:"email"`
+	OTP    string `json:"otp"`
+	Device string `json:"device,omitempty"`
+}
+
+type AuthResponse struct {
+	ClientID     string      `json:"client_id"`
+	Token        string      `json:"token"`
+	RefreshToken string      `json:"refresh_token,omitempty"`
+	ExpiresIn    int         `json:"expires_in,omitempty"`
+	Environment  Environment `json:"environment"`
+}
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+type TokenResponse struct {
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int    `json:"expires_in"`
+}
+
+// ConnectResponse is returned by POST /connect
+type ConnectResponse struct {
+	Status      string      `json:"status"`
+	ClientID    string      `json:"client_id"`
+	Environment Environment `json:"environment"`
+}
+
+type VPNConfig struct {
+	Server        string           `json:"server"`
+	Port          int              `json:"port"`
+	Token         string           `json:"token"`
+	EnvironmentID string           `json:"environment_id"`
+	Peer          string           `json:"peer"`
+	WireGuard     *WireGuardConfig `json:"wireguard"`
+}
+
+// WireGuardConfig is the tunnel config of one peer (device) of a client
+type WireGuardConfig struct {
+	Interface WireGuardInterface `json:"interface"`
+	Peer      WireGuardPeer      `json:"peer"`
+}
+
+type WireGuardInterface struct {
+	// PrivateKey is empty when the client supplied its own key pair
+	PrivateKey string   `json:"private_key,omitempty"`
+	Address    []string `json:"address"`
+	DNS        []string `json:"dns"`
+}
+
+type WireGuardPeer struct {
+	PublicKey           string   `json:"public_key"`
+	PresharedKey        string   `json:"preshared_key"`
+	Endpoint            string   `json:"endpoint"`
+	AllowedIPs          []string `json:"allowed_ips"`
+	PersistentKeepalive int      `json:"persistent_keepalive"`
+}
+
+type InfrastructureUpdate struct {
+	Infrastructure Infrastructure `json:"infrastructure"`
+}
+
+// InfrastructureResponse is returned by GET /infrastructure
+type InfrastructureResponse struct {
+	ClientID       string               `json:"client_id"`
+	Infrastructure Infrastructure       `json:"infrastructure"`
+	Status         InfrastructureStatus `json:"status"`
+	Environment    Environment          `json:"environment"`
+}
+
+// Media types accepted by PATCH /infrastructure. A merge patch (RFC 7396) is
+// an object merged into the stored document; a JSON Patch (RFC 6902) is an
+// array of PatchOperation. Both apply to the Infrastructure object itself,
+// e.g. the path /vpn_instances/-.
+const (
+	MergePatchContentType = "application/merge-patch+json"
+	JSONPatchContentType  = "application/json-patch+json"
+)
+
+// PatchOperation is one operation of a JSON Patch: add, remove, replace,
+// move, copy or test. Value is the JSON of the value, where the op takes one.
+type PatchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// InfrastructureRevision is one entry of a client's infrastructure history.
+// Revision n holds the infrastructure of generation n; the log is
+// append-only, and a rollback is recorded as a new revision.
+type InfrastructureRevision struct {
+	Revision int64 `json:"revision"`
+	// Author is the subject of the token that made the change
+	Author string    `json:"author"`
+	Time   time.Time `json:"time"`
+	// RollbackOf is the revision a rollback restored
+	RollbackOf int64            `json:"rollback_of,omitempty"`
+	Diff       []ResourceChange `json:"diff"`
+	// Infrastructure is the full document; the history listing leaves it out
+	Infrastructure *Infrastructure `json:"infrastructure,omitempty"`
+}
+
+// ResourceChange is one resource a revision added, removed or changed
+type ResourceChange struct {
+	Op     string    `json:"op"`
+	Kind   string    `json:"kind"`
+	ID     string    `json:"id"`
+	Before *Resource `json:"before,omitempty"`
+	After  *Resource `json:"after,omitempty"`
+}
+
+// Operations of a ResourceChange
+const (
+	ResourceAdded   = "added"
+	ResourceRemoved = "removed"
+	ResourceChanged = "changed"
+)
+
+// InfrastructureHistoryResponse is returned by GET /infrastructure/history,
+// newest revision first
+type InfrastructureHistoryResponse struct {
+	ClientID  string                   `json:"client_id"`
+	Revision  int64                    `json:"revision"`
+	Revisions []InfrastructureRevision `json:"revisions"`
+}
+
+// HeartbeatRequest is posted by the client daemon every heartbeat interval.
+// Disconnect announces a clean shutdown so the device goes offline at once.
+type HeartbeatRequest struct {
+	Device        string     `json:"device,omitempty"`
+	TunnelUp      bool       `json:"tunnel_up"`
+	RxBytes       uint64     `json:"rx_bytes,omitempty"`
+	TxBytes       uint64     `json:"tx_bytes,omitempty"`
+	LastHandshake *time.Time `json:"last_handshake,omitempty"`
+	Disconnect    bool       `json:"disconnect,omitempty"`
+}
+
+// HeartbeatResponse tells the daemon how often to report. A device is
+// offline once Timeout seconds pass without a heartbeat.
+type HeartbeatResponse struct {
+	State    string `json:"state"`
+	Interval int    `json:"interval"`
+	Timeout  int    `json:"timeout"`
+}
+
+// Presence states derived from heartbeats
+const (
+	PresenceOnline  = "online"
+	PresenceOffline = "offline"
+)
+
+// DevicePresence is the state of one device, as of its last heartbeat
+type DevicePresence struct {
+	Device        string     `json:"device"`
+	State         string     `json:"state"`
+	LastHeartbeat time.Time  `json:"last_heartbeat"`
+	IP            string     `json:"ip,omitempty"`
+	TunnelUp      bool       `json:"tunnel_up"`
+	RxBytes       uint64     `json:"rx_bytes,omitempty"`
+	TxBytes       uint64     `json:"tx_bytes,omitempty"`
+	LastHandshake *time.Time `json:"last_handshake,omitempty"`
+}
+
+// ClientPresence is online while any of its devices is
+type ClientPresence struct {
+	ClientID      string           `json:"client_id"`
+	State         string           `json:"state"`
+	LastHeartbeat *time.Time       `json:"last_heartbeat,omitempty"`
+	Devices       []DevicePresence `json:"devices"`
+}
+
+// MessageResponse is the body of endpoints that only acknowledge a request
+type MessageResponse struct {
+	Message  string `json:"message"`
+	ClientID string `json:"client_id,omitempty"`
+	// Revision is set by infrastructure writes to the revision they created
+	Revision int64 `json:"revision,omitempty"`
+}
+
+// ErrorResponse carries a machine-readable error code alongside the message
+type ErrorResponse struct {
+	Error             string            `json:"error"`
+	Message           string            `json:"message"`
+	AttemptsRemaining *int              `json:"attempts_remaining,omitempty"`
+	RetryAfter        int               `json:"retry_after,omitempty"`
+	Fields            []ValidationError `json:"fields,omitempty"`
+}
+
+// ValidationError is one problem with a request body. Field is a path such as
+// "infrastructure.databases[0].spec.engine".
+type ValidationError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// Error codes returned by /register and /verify
+const (
+	ErrCodeInvalidRequest = "invalid_request"
+	ErrCodeRateLimited    = "rate_limited"
+	ErrCodeOTPNotFound    = "otp_not_found"
+	ErrCodeOTPExpired     = "otp_expired"
+	ErrCodeOTPLocked      = "otp_locked"
+	ErrCodeOTPMismatch    = "otp_mismatch"
+)
+
+// ErrCodeValidationFailed rejects an infrastructure document; Fields lists
+// each problem
+const ErrCodeValidationFailed = "validation_failed"
+
+// ErrCodeRevisionMismatch refuses an infrastructure write whose If-Match
+// names another revision than the current one
+const ErrCodeRevisionMismatch = "revision_mismatch"
+
+// ErrCodePatchConflict refuses a JSON Patch that cannot be applied to the
+// stored document, such as a failed test or a path that does not exist
+const ErrCodePatchConflict = "patch_conflict"
+
+// Error codes of the environment lifecycle
+const (
+	// ErrCodeEnvironmentNotActive refuses /connect and /config; the message
+	// names the state and its reason
+	ErrCodeEnvironmentNotActive = "environment_not_active"
+	// ErrCodeEnvironmentDeleted refuses /connect and /config for good once
+	// the environment is deleted
+	ErrCodeEnvironmentDeleted = "environment_deleted"
+	// ErrCodeInvalidTransition refuses a suspend, resume or delete the
+	// current state does not allow
+	ErrCodeInvalidTransition = "invalid_transition"
+)